@@ -0,0 +1,172 @@
+// Filename: client/client.go
+
+// Package client is the Go client for the quotes API.
+//
+//	c := client.New("https://quotes.example.com")
+//	_, err := c.Authenticate(ctx, "alice@example.com", "pa55word")
+//	quote, err := c.GetQuote(ctx, 1)
+//
+// Errors returned by the API are *Error values, which can be compared with
+// errors.Is() against ErrNotFound, ErrEditConflict and the other sentinels
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to a single deployment of the API. The exported fields may be
+// changed before the first request is made
+type Client struct {
+	BaseURL      string
+	Token        string
+	RefreshToken string
+	HTTPClient   *http.Client
+	UserAgent    string
+
+	// Requests that are rate limited with a 429 are retried up to
+	// MaxRetries times, waiting RetryBase, then twice that and so on, but
+	// never longer than RetryMax
+	MaxRetries int
+	RetryBase  time.Duration
+	RetryMax   time.Duration
+
+	// The X-Primary-Until value from the last write, which is sent back
+	// so that the client reads its own writes when the API has replicas
+	mu           sync.Mutex
+	primaryUntil string
+}
+
+// The New() function returns a client with the default retry settings
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		UserAgent:  "quotesapi-go-client",
+		MaxRetries: 4,
+		RetryBase:  500 * time.Millisecond,
+		RetryMax:   10 * time.Second,
+	}
+}
+
+// do() sends a request and decodes the JSON response into dst. A nil body
+// sends no request body and a nil dst discards the response
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, dst interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, u, payload)
+		if err != nil {
+			return err
+		}
+		if primaryUntil := resp.Header.Get("X-Primary-Until"); primaryUntil != "" {
+			c.mu.Lock()
+			c.primaryUntil = primaryUntil
+			c.mu.Unlock()
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < c.MaxRetries {
+			wait := c.backoff(attempt, resp.Header.Get("Retry-After"))
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return decodeError(resp)
+		}
+		if dst == nil {
+			return nil
+		}
+		err = json.NewDecoder(resp.Body).Decode(dst)
+		if err != nil {
+			return fmt.Errorf("client: decoding %s %s response: %w", method, path, err)
+		}
+		return nil
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	c.mu.Lock()
+	if c.primaryUntil != "" {
+		req.Header.Set("X-Primary-Until", c.primaryUntil)
+	}
+	c.mu.Unlock()
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// backoff() honours a Retry-After header in seconds if the server sent one,
+// otherwise the delay doubles with every attempt plus up to 10% jitter
+func (c *Client) backoff(attempt int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	delay := c.RetryBase
+	for i := 0; i < attempt && delay < c.RetryMax; i++ {
+		delay *= 2
+	}
+	if c.RetryMax > 0 && delay > c.RetryMax {
+		delay = c.RetryMax
+	}
+	if delay > 0 {
+		delay += time.Duration(rand.Int63n(int64(delay)/10 + 1))
+	}
+	return delay
+}
+
+// Metadata describes the page that a listing returned. It is empty when
+// there are no records
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+}
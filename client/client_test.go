@@ -0,0 +1,247 @@
+// Filename: client/client_test.go
+
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/client"
+)
+
+// recorder is an API stand-in that answers with the responses it is given,
+// in order, and keeps the requests that it was sent
+type recorder struct {
+	t         *testing.T
+	mu        sync.Mutex
+	responses []response
+	requests  []recorded
+}
+
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+type recorded struct {
+	method, path, authorization string
+	body                        map[string]string
+}
+
+func newTestClient(t *testing.T, responses ...response) (*client.Client, *recorder) {
+	rec := &recorder{t: t, responses: responses}
+	ts := httptest.NewServer(rec)
+	t.Cleanup(ts.Close)
+	c := client.New(ts.URL)
+	c.RetryBase = time.Millisecond
+	c.RetryMax = 5 * time.Millisecond
+	return c, rec
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	req := recorded{method: r.Method, path: r.URL.Path, authorization: r.Header.Get("Authorization")}
+	if raw, _ := io.ReadAll(r.Body); len(raw) > 0 {
+		json.Unmarshal(raw, &req.body)
+	}
+	rec.requests = append(rec.requests, req)
+	if len(rec.responses) == 0 {
+		rec.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := rec.responses[0]
+	rec.responses = rec.responses[1:]
+	for k, v := range resp.header {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	io.WriteString(w, resp.body)
+}
+
+func (rec *recorder) sent() []recorded {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]recorded(nil), rec.requests...)
+}
+
+var (
+	rateLimited = response{status: http.StatusTooManyRequests, body: `{"error": "rate limit exceeded"}`}
+	quoteFound  = response{status: http.StatusOK, body: `{"quote": {"id": 1, "author": "Seneca", "quote_string": "Luck is what happens when preparation meets opportunity", "category": ["luck"], "version": 1}}`}
+)
+
+func TestRetryAfterRateLimit(t *testing.T) {
+	c, rec := newTestClient(t, rateLimited, rateLimited, quoteFound)
+	quote, err := c.GetQuote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.Author != "Seneca" {
+		t.Errorf("got author %q; want %q", quote.Author, "Seneca")
+	}
+	if n := len(rec.sent()); n != 3 {
+		t.Errorf("got %d requests; want 3", n)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	c, rec := newTestClient(t, rateLimited, rateLimited, rateLimited)
+	c.MaxRetries = 2
+	_, err := c.GetQuote(context.Background(), 1)
+	if !errors.Is(err, client.ErrRateLimited) {
+		t.Fatalf("got %v; want ErrRateLimited", err)
+	}
+	if n := len(rec.sent()); n != 3 {
+		t.Errorf("got %d requests; want 3", n)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	limited := rateLimited
+	limited.header = map[string]string{"Retry-After": "1"}
+	c, _ := newTestClient(t, limited, quoteFound)
+	started := time.Now()
+	_, err := c.GetQuote(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without the header the wait would be a few milliseconds
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("retried after %v; want at least 1s", elapsed)
+	}
+
+	// The wait is cut short by the context
+	c, _ = newTestClient(t, limited)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = c.GetQuote(ctx, 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v; want context.DeadlineExceeded", err)
+	}
+}
+
+func TestNoRetryOnOtherErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response response
+		want     error
+	}{
+		{"not found", response{status: http.StatusNotFound, body: `{"error": "The requested resource could not be found"}`}, client.ErrNotFound},
+		{"unauthorized", response{status: http.StatusUnauthorized, body: `{"error": "invalid or missing authentication token"}`}, client.ErrUnauthorized},
+		{"forbidden", response{status: http.StatusForbidden, body: `{"error": "forbidden"}`}, client.ErrForbidden},
+		{"bad request", response{status: http.StatusBadRequest, body: `{"error": "body must not be empty"}`}, client.ErrBadRequest},
+		{"server error", response{status: http.StatusInternalServerError, body: `not json`}, client.ErrServer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestClient(t, tt.response)
+			_, err := c.GetQuote(context.Background(), 1)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v; want %v", err, tt.want)
+			}
+			if n := len(rec.sent()); n != 1 {
+				t.Errorf("got %d requests; want 1", n)
+			}
+			var apiErr *client.Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.response.status {
+				t.Errorf("got %#v; want an *Error with status %d", err, tt.response.status)
+			}
+		})
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	c, _ := newTestClient(t, response{
+		status: http.StatusUnprocessableEntity,
+		body:   `{"error": {"author": "must be provided", "category": "must not contain duplicate values"}}`,
+	})
+	_, err := c.CreateQuote(context.Background(), client.CreateQuoteInput{})
+	if !errors.Is(err, client.ErrFailedValidation) {
+		t.Fatalf("got %v; want ErrFailedValidation", err)
+	}
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %T; want *client.Error", err)
+	}
+	if apiErr.Fields["author"] != "must be provided" || apiErr.Fields["category"] != "must not contain duplicate values" {
+		t.Errorf("got fields %v", apiErr.Fields)
+	}
+	want := "quotes api: 422: author: must be provided, category: must not contain duplicate values"
+	if err.Error() != want {
+		t.Errorf("got %q; want %q", err.Error(), want)
+	}
+}
+
+func TestEditConflict(t *testing.T) {
+	conflict := quoteFound
+	conflict.status = http.StatusConflict
+	conflict.body = `{"error": "unable to update the record due to an edit conflict, please try again", "quote": {"id": 1, "author": "Seneca", "version": 3}}`
+	c, _ := newTestClient(t, conflict)
+	_, err := c.UpdateQuote(context.Background(), 1, client.UpdateQuoteInput{Author: client.String("Someone"), Version: client.Int32(2)})
+	if !errors.Is(err, client.ErrEditConflict) {
+		t.Fatalf("got %v; want ErrEditConflict", err)
+	}
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Current == nil || apiErr.Current.Version != 3 {
+		t.Errorf("got %#v; want the current quote at version 3", err)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	c, rec := newTestClient(t,
+		response{status: http.StatusCreated, body: `{"authentication token": {"token": "access1", "expiry": "2030-01-01T00:00:00Z"}, "refresh token": {"token": "refresh1", "expiry": "2030-01-02T00:00:00Z"}}`},
+		response{status: http.StatusCreated, body: `{"authentication token": {"token": "access2", "expiry": "2030-01-01T00:15:00Z"}, "refresh token": {"token": "refresh2", "expiry": "2030-01-02T00:00:00Z"}}`},
+		quoteFound,
+		response{status: http.StatusUnauthorized, body: `{"error": "Invalid authentication credentials"}`},
+	)
+	ctx := context.Background()
+	_, err := c.Authenticate(ctx, "alice@example.com", "pa55word1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "access1" || c.RefreshToken != "refresh1" {
+		t.Fatalf("got tokens %q and %q after signing in", c.Token, c.RefreshToken)
+	}
+
+	token, err := c.RefreshTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != "access2" || c.Token != "access2" || c.RefreshToken != "refresh2" {
+		t.Errorf("got tokens %q and %q after refreshing", c.Token, c.RefreshToken)
+	}
+	_, err = c.GetQuote(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refresh that fails leaves the tokens alone
+	_, err = c.RefreshTokens(ctx)
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("got %v; want ErrUnauthorized", err)
+	}
+	if c.Token != "access2" || c.RefreshToken != "refresh2" {
+		t.Errorf("got tokens %q and %q after a failed refresh", c.Token, c.RefreshToken)
+	}
+
+	sent := rec.sent()
+	if sent[1].path != "/v1/tokens/refresh" || sent[1].body["token"] != "refresh1" {
+		t.Errorf("got refresh request %+v; want the first refresh token sent to /v1/tokens/refresh", sent[1])
+	}
+	if sent[2].authorization != "Bearer access2" {
+		t.Errorf("got Authorization %q; want the refreshed token", sent[2].authorization)
+	}
+	if sent[3].body["token"] != "refresh2" {
+		t.Errorf("got refresh token %q; want %q", sent[3].body["token"], "refresh2")
+	}
+}
@@ -0,0 +1,90 @@
+// Filename: client/errors.go
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Compare these with errors.Is() to find out what went wrong
+var (
+	ErrBadRequest       = errors.New("bad request")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrForbidden        = errors.New("forbidden")
+	ErrNotFound         = errors.New("not found")
+	ErrEditConflict     = errors.New("edit conflict")
+	ErrFailedValidation = errors.New("failed validation")
+	ErrRateLimited      = errors.New("rate limit exceeded")
+	ErrServer           = errors.New("server error")
+)
+
+// Error is the "error" envelope of a failed response. Message holds the
+// error string, or Fields holds the message for each field when
+// validation failed. When an update is rejected because the version sent
+// is out of date, Current holds the quote as it is now
+type Error struct {
+	StatusCode int
+	Message    string
+	Fields     map[string]string
+	Current    *Quote
+}
+
+func (e *Error) Error() string {
+	if len(e.Fields) > 0 {
+		fields := make([]string, 0, len(e.Fields))
+		for field, message := range e.Fields {
+			fields = append(fields, field+": "+message)
+		}
+		sort.Strings(fields)
+		return fmt.Sprintf("quotes api: %d: %s", e.StatusCode, strings.Join(fields, ", "))
+	}
+	return fmt.Sprintf("quotes api: %d: %s", e.StatusCode, e.Message)
+}
+
+// Is() maps the status code onto the sentinel errors
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrEditConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrFailedValidation:
+		return e.StatusCode == http.StatusUnprocessableEntity
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error json.RawMessage `json:"error"`
+		Quote *Quote          `json:"quote"`
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil || json.Unmarshal(raw, &body) != nil || body.Error == nil {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+		return apiErr
+	}
+	// The error is either a string or an object of field errors
+	if json.Unmarshal(body.Error, &apiErr.Message) != nil {
+		json.Unmarshal(body.Error, &apiErr.Fields)
+	}
+	apiErr.Current = body.Quote
+	return apiErr
+}
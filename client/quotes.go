@@ -0,0 +1,178 @@
+// Filename: client/quotes.go
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type Quote struct {
+	ID          int64    `json:"id"`
+	Author      string   `json:"author"`
+	QuoteString string   `json:"quote_string"`
+	Category    []string `json:"category"`
+	Version     int32    `json:"version"`
+}
+
+// ListQuotesInput holds the filters for ListQuotes(). Zero values are left
+// out so that the server defaults apply
+type ListQuotesInput struct {
+	Author      string
+	QuoteString string
+	Category    []string
+	Page        int
+	PageSize    int
+	Sort        string
+}
+
+func (in ListQuotesInput) query() url.Values {
+	qs := url.Values{}
+	if in.Author != "" {
+		qs.Set("author", in.Author)
+	}
+	if in.QuoteString != "" {
+		qs.Set("quote_string", in.QuoteString)
+	}
+	if len(in.Category) > 0 {
+		qs.Set("category", strings.Join(in.Category, ","))
+	}
+	if in.Page > 0 {
+		qs.Set("page", strconv.Itoa(in.Page))
+	}
+	if in.PageSize > 0 {
+		qs.Set("page_size", strconv.Itoa(in.PageSize))
+	}
+	if in.Sort != "" {
+		qs.Set("sort", in.Sort)
+	}
+	return qs
+}
+
+// ListQuotes() returns a single page of quotes
+func (c *Client) ListQuotes(ctx context.Context, in ListQuotesInput) ([]*Quote, Metadata, error) {
+	var resp struct {
+		Quotes   []*Quote `json:"quotes"`
+		Metadata Metadata `json:"metadata"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/Quotes", in.query(), nil, &resp)
+	return resp.Quotes, resp.Metadata, err
+}
+
+// Quotes() returns an iterator over every page of quotes that match the
+// input, starting from in.Page
+//
+//	it := c.Quotes(client.ListQuotesInput{Category: []string{"life"}})
+//	for it.Next(ctx) {
+//		fmt.Println(it.Quote().QuoteString)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) Quotes(in ListQuotesInput) *QuoteIterator {
+	if in.Page < 1 {
+		in.Page = 1
+	}
+	return &QuoteIterator{client: c, input: in}
+}
+
+type QuoteIterator struct {
+	client   *Client
+	input    ListQuotesInput
+	page     []*Quote
+	current  *Quote
+	metadata Metadata
+	done     bool
+	err      error
+}
+
+// Next() moves to the next quote, fetching the next page when needed. It
+// returns false at the end of the listing or on an error
+func (it *QuoteIterator) Next(ctx context.Context) bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.page, it.metadata, it.err = it.client.ListQuotes(ctx, it.input)
+		if it.err != nil {
+			return false
+		}
+		// An empty Metadata means that nothing matched
+		if it.metadata.LastPage == 0 || it.metadata.CurrentPage >= it.metadata.LastPage {
+			it.done = true
+		}
+		it.input.Page++
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *QuoteIterator) Quote() *Quote {
+	return it.current
+}
+
+// Metadata() describes the page that the current quote came from
+func (it *QuoteIterator) Metadata() Metadata {
+	return it.metadata
+}
+
+func (it *QuoteIterator) Err() error {
+	return it.err
+}
+
+func (c *Client) GetQuote(ctx context.Context, id int64) (*Quote, error) {
+	var resp struct {
+		Quote *Quote `json:"quote"`
+	}
+	err := c.do(ctx, http.MethodGet, "/v1/Quotes/"+strconv.FormatInt(id, 10), nil, nil, &resp)
+	return resp.Quote, err
+}
+
+type CreateQuoteInput struct {
+	Author      string   `json:"author"`
+	QuoteString string   `json:"quote_string"`
+	Category    []string `json:"category"`
+}
+
+func (c *Client) CreateQuote(ctx context.Context, in CreateQuoteInput) (*Quote, error) {
+	var resp struct {
+		Quote *Quote `json:"quote"`
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/Quotes", nil, in, &resp)
+	return resp.Quote, err
+}
+
+// UpdateQuoteInput is a partial update, nil fields are left as they are.
+// Setting Version makes the update fail with ErrEditConflict if the quote
+// has changed since that version, and the error carries the current quote
+type UpdateQuoteInput struct {
+	Author      *string  `json:"author,omitempty"`
+	QuoteString *string  `json:"quote_string,omitempty"`
+	Category    []string `json:"category,omitempty"`
+	Version     *int32   `json:"version,omitempty"`
+}
+
+func (c *Client) UpdateQuote(ctx context.Context, id int64, in UpdateQuoteInput) (*Quote, error) {
+	var resp struct {
+		Quote *Quote `json:"quote"`
+	}
+	err := c.do(ctx, http.MethodPatch, "/v1/Quotes/"+strconv.FormatInt(id, 10), nil, in, &resp)
+	return resp.Quote, err
+}
+
+func (c *Client) DeleteQuote(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, "/v1/Quotes/"+strconv.FormatInt(id, 10), nil, nil, nil)
+}
+
+// String() returns a pointer to s, for filling in UpdateQuoteInput
+func String(s string) *string {
+	return &s
+}
+
+// Int32() returns a pointer to n, for filling in UpdateQuoteInput
+func Int32(n int32) *int32 {
+	return &n
+}
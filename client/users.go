@@ -0,0 +1,93 @@
+// Filename: client/users.go
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type User struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Activated bool      `json:"activated"`
+}
+
+type Token struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// RegisterUser() creates an account. The activation token is emailed to
+// the user
+func (c *Client) RegisterUser(ctx context.Context, name, email, password string) (*User, error) {
+	input := map[string]string{"name": name, "email": email, "password": password}
+	var resp struct {
+		User *User `json:"user"`
+	}
+	err := c.do(ctx, http.MethodPost, "/v1/users", nil, input, &resp)
+	return resp.User, err
+}
+
+// ActivateUser() activates the account that the token was sent to
+func (c *Client) ActivateUser(ctx context.Context, token string) (*User, error) {
+	input := map[string]string{"token": token}
+	var resp struct {
+		User *User `json:"user"`
+	}
+	err := c.do(ctx, http.MethodPut, "/v1/users/activated", nil, input, &resp)
+	return resp.User, err
+}
+
+// tokenPair is what the API returns for a sign in or a refresh
+type tokenPair struct {
+	Authentication *Token `json:"authentication token"`
+	Refresh        *Token `json:"refresh token"`
+}
+
+// CreateAuthenticationToken() exchanges an email and password for a
+// bearer token
+func (c *Client) CreateAuthenticationToken(ctx context.Context, email, password string) (*Token, error) {
+	pair, err := c.createTokens(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	return pair.Authentication, nil
+}
+
+func (c *Client) createTokens(ctx context.Context, email, password string) (*tokenPair, error) {
+	input := map[string]string{"email": email, "password": password}
+	var resp tokenPair
+	err := c.do(ctx, http.MethodPost, "/v1/tokens/authentication", nil, input, &resp)
+	return &resp, err
+}
+
+// Authenticate() creates a token and uses it for every request after this.
+// The refresh token is kept for RefreshTokens()
+func (c *Client) Authenticate(ctx context.Context, email, password string) (*Token, error) {
+	pair, err := c.createTokens(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	c.Token = pair.Authentication.Token
+	c.RefreshToken = pair.Refresh.Token
+	return pair.Authentication, nil
+}
+
+// RefreshTokens() exchanges the refresh token for a new bearer token before
+// the old one expires. Each refresh token works once, the new one replaces
+// it
+func (c *Client) RefreshTokens(ctx context.Context) (*Token, error) {
+	input := map[string]string{"token": c.RefreshToken}
+	var resp tokenPair
+	err := c.do(ctx, http.MethodPost, "/v1/tokens/refresh", nil, input, &resp)
+	if err != nil {
+		return nil, err
+	}
+	c.Token = resp.Authentication.Token
+	c.RefreshToken = resp.Refresh.Token
+	return resp.Authentication, nil
+}
@@ -0,0 +1,277 @@
+// Filename: cmd/api/account.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// showAccountHandler for the "GET /v1/users/me" endpoint
+func (app *application) showAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.contextLoadUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateAccountHandler for the "PATCH /v1/users/me" endpoint. Only the
+// name can be changed here, the email and password have their own
+// endpoints because they need more than a valid token
+func (app *application) updateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name *string `json:"name"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// The user in the context is shared with the rest of the request, so
+	// the changes are made on a copy
+	loaded, err := app.contextLoadUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user := *loaded
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	v := validator.New()
+	if data.ValidateUser(v, &user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(r.Context(), &user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": &user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updatePasswordHandler for the "PUT /v1/users/me/password" endpoint. Every
+// other authentication and refresh token of the user is revoked, so a
+// session that was opened with the old password doesn't outlive it
+func (app *application) updatePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	loaded, err := app.contextLoadUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user := *loaded
+	v := validator.New()
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlaintext(v, input.Password)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("current_password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.Users.Update(r.Context(), &user)
+		if err != nil {
+			return err
+		}
+		err = m.Tokens.DeleteAllForUserExcept(r.Context(), data.ScopeAuthentication, user.ID, app.contextGetToken(r))
+		if err != nil {
+			return err
+		}
+		return m.Tokens.DeleteAllForUserExcept(r.Context(), data.ScopeRefresh, user.ID, app.contextGetToken(r))
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokensRevoked(r.Context())
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "password successfully changed, other sessions have been signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler for the "POST /v1/users/me/email" endpoint. The
+// address isn't changed yet, a token is sent to the new address and the
+// change is made once it comes back through "PUT /v1/users/email"
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user, err := app.contextLoadUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.Password != "", "password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// A stolen token alone shouldn't be enough to take over the account
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	_, err = app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exist")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the latest request can be confirmed
+	var token *data.Token
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeEmailChange, user.ID)
+		if err != nil {
+			return err
+		}
+		token, err = m.Tokens.NewEmailChange(r.Context(), user.ID, input.Email, 1*24*time.Hour)
+		return err
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		data := map[string]interface{}{
+			"emailChangeToken": token.Plaintext,
+			"userID":           user.ID,
+		}
+		// The token goes to the new address, which proves that it is theirs
+		err := app.mailer.Send(input.Email, "email_change.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "a confirmation token has been sent to the new email address"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler for the "PUT /v1/users/email" endpoint. Like
+// activation it doesn't need an authentication token, the email change
+// token is proof enough
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var user *data.User
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		token, err := m.Tokens.Get(r.Context(), data.ScopeEmailChange, input.TokenPlaintext)
+		if err != nil {
+			return err
+		}
+		user, err = m.Users.Get(r.Context(), token.UserID)
+		if err != nil {
+			return err
+		}
+		user.Email = token.Email
+		err = m.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		return m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeEmailChange, user.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
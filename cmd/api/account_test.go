@@ -0,0 +1,126 @@
+// Filename: cmd/api/account_test.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// expectFieldError() fails the test unless body is a validation error for
+// field
+func expectFieldError(t *testing.T, code int, body map[string]interface{}, field string) {
+	t.Helper()
+	fields, _ := body["error"].(map[string]interface{})
+	if code != http.StatusUnprocessableEntity || fields[field] == nil {
+		t.Errorf("got status %d and %v; want %d with an error for %s", code, body, http.StatusUnprocessableEntity, field)
+	}
+}
+
+func TestUpdatePassword(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com", "quotes:read")
+	current, currentRefresh := ts.signIn(t, "alice@example.com")
+	other, otherRefresh := ts.signIn(t, "alice@example.com")
+
+	code, _, body := ts.do(t, http.MethodPut, "/v1/users/me/password", current, map[string]string{"current_password": "wr0ngpassword", "password": "newpa55word"})
+	expectFieldError(t, code, body, "current_password")
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", other, nil)
+	if code != http.StatusOK {
+		t.Errorf("other session after a wrong password: got status %d; want %d", code, http.StatusOK)
+	}
+
+	code, _, body = ts.do(t, http.MethodPut, "/v1/users/me/password", current, map[string]string{"current_password": "pa55word1", "password": "newpa55word"})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+
+	// The other session is signed out, this one and its refresh token stay
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", other, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("other session: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": otherRefresh})
+	if code != http.StatusUnauthorized {
+		t.Errorf("other refresh token: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", current, nil)
+	if code != http.StatusOK {
+		t.Errorf("current session: got status %d; want %d", code, http.StatusOK)
+	}
+	code, _, body = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": currentRefresh})
+	if code != http.StatusCreated {
+		t.Errorf("current refresh token: got status %d; want %d: %v", code, http.StatusCreated, body)
+	}
+
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "alice@example.com", "password": "pa55word1"})
+	if code != http.StatusUnauthorized {
+		t.Errorf("old password: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "alice@example.com", "password": "newpa55word"})
+	if code != http.StatusCreated {
+		t.Errorf("new password: got status %d; want %d", code, http.StatusCreated)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, token := insertTestUser(t, app, "alice@example.com")
+	insertTestUser(t, app, "bob@example.com")
+
+	code, _, body := ts.do(t, http.MethodPost, "/v1/users/me/email", token, map[string]string{"email": "new@example.com", "password": "wr0ngpassword"})
+	expectFieldError(t, code, body, "password")
+	code, _, body = ts.do(t, http.MethodPost, "/v1/users/me/email", token, map[string]string{"email": "bob@example.com", "password": "pa55word1"})
+	expectFieldError(t, code, body, "email")
+	if n := len(sentEmails(app)); n != 0 {
+		t.Fatalf("got %d emails for the refused requests; want none", n)
+	}
+
+	// The token goes to the new address, and the old one stays until it
+	// comes back
+	request := func(email string) string {
+		t.Helper()
+		code, _, body := ts.do(t, http.MethodPost, "/v1/users/me/email", token, map[string]string{"email": email, "password": "pa55word1"})
+		if code != http.StatusAccepted {
+			t.Fatalf("request: got status %d; want %d: %v", code, http.StatusAccepted, body)
+		}
+		emails := sentEmails(app)
+		last := emails[len(emails)-1]
+		if last.recipient != email || last.template != "email_change.tmpl" {
+			t.Fatalf("got a %s email to %s; want one to %s", last.template, last.recipient, email)
+		}
+		return last.data["emailChangeToken"].(string)
+	}
+	taken := request("carol@example.com")
+	code, _, body = ts.do(t, http.MethodGet, "/v1/users/me", token, nil)
+	if user, _ := body["user"].(map[string]interface{}); code != http.StatusOK || user["email"] != "alice@example.com" {
+		t.Errorf("before confirming: got status %d and %v", code, body)
+	}
+
+	// Someone else signed up with the address in the meantime
+	carol := &data.User{Name: "Carol", Email: "carol@example.com", Activated: true}
+	carol.Password.Set("pa55word1")
+	err := app.models.Users.Insert(context.Background(), carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, body = ts.do(t, http.MethodPut, "/v1/users/email", "", map[string]string{"token": taken})
+	expectFieldError(t, code, body, "email")
+
+	confirm := request("dave@example.com")
+	code, _, body = ts.do(t, http.MethodPut, "/v1/users/email", "", map[string]string{"token": confirm})
+	if user, _ := body["user"].(map[string]interface{}); code != http.StatusOK || user["email"] != "dave@example.com" {
+		t.Fatalf("confirm: got status %d and %v", code, body)
+	}
+	code, _, body = ts.do(t, http.MethodPut, "/v1/users/email", "", map[string]string{"token": confirm})
+	expectFieldError(t, code, body, "token")
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "dave@example.com", "password": "pa55word1"})
+	if code != http.StatusCreated {
+		t.Errorf("sign in with the new address: got status %d; want %d", code, http.StatusCreated)
+	}
+}
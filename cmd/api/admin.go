@@ -0,0 +1,329 @@
+// Filename: cmd/api/admin.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+var userSortList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+// adminUser is how the admin endpoints show a user. Unlike the public
+// view it has the version, which the changes can be made against, and
+// what the user is allowed to do
+type adminUser struct {
+	*data.User
+	Version     int              `json:"version"`
+	Roles       []string         `json:"roles"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+// errStaleUserVersion is returned by changeUser() when the client's
+// version is no longer the current one
+var errStaleUserVersion = errors.New("stale user version")
+
+func (app *application) adminUserView(r *http.Request, user *data.User) (*adminUser, error) {
+	roles, err := app.models.Permissions.GetRolesForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	return &adminUser{User: user, Version: user.Version, Roles: roles, Permissions: permissions}, nil
+}
+
+// listAdminUsersHandler for the "GET /v1/admin/users" endpoint
+func (app *application) listAdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string
+		Email     string
+		Activated *bool
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.Email = app.readString(qs, "email", "")
+	if activated := qs.Get("activated"); activated != "" {
+		value, err := strconv.ParseBool(activated)
+		if err != nil {
+			v.AddError("activated", "must be true or false")
+		}
+		input.Activated = &value
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = userSortList
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), input.Name, input.Email, input.Activated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showAdminUserHandler for the "GET /v1/admin/users/:id" endpoint
+func (app *application) showAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.writeAdminUser(w, r, http.StatusOK, user)
+}
+
+// grantUserPermissionsHandler for the "POST /v1/admin/users/:id/permissions"
+// endpoint
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Codes   []string `json:"codes"`
+		Version *int     `json:"version"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Codes) > 0, "codes", "must contain at least one permission")
+	v.Check(validator.Unique(input.Codes), "codes", "must not contain duplicate permissions")
+	if v.Valid() {
+		known, err := app.models.Permissions.GetAll(r.Context())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, code := range input.Codes {
+			v.Check(known.Contains(code), "codes", "unknown permission "+strconv.Quote(code))
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.changeUser(w, r, id, input.Version, func(m data.Models, user *data.User) error {
+		return m.Permissions.AddForUser(r.Context(), user.ID, input.Codes...)
+	}, map[string]string{"action": "grant_permissions", "codes": strings.Join(input.Codes, ",")})
+}
+
+// revokeUserPermissionHandler for the
+// "DELETE /v1/admin/users/:id/permissions/:code" endpoint. It only takes
+// away a direct grant, a role that grants the code has to be changed
+// separately
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	known, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !known.Contains(code) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	version, ok := app.readVersion(w, r)
+	if !ok {
+		return
+	}
+
+	app.changeUser(w, r, id, version, func(m data.Models, user *data.User) error {
+		err := m.Permissions.RemoveForUser(r.Context(), user.ID, code)
+		if err != nil {
+			return err
+		}
+		// A refresh token would keep handing out sessions, and a JWT
+		// carries the permissions it was issued with, so with JWTs the
+		// user is signed out everywhere. Opaque tokens have their
+		// permissions looked up on every request and can stay
+		if app.jwtKeys != nil {
+			return revokeUserTokens(r.Context(), m, user.ID)
+		}
+		return m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeRefresh, user.ID)
+	}, map[string]string{"action": "revoke_permission", "codes": code})
+}
+
+// deactivateUserHandler for the "POST /v1/admin/users/:id/deactivate"
+// endpoint. Every token of the user is removed, as a JWT would say that
+// they are activated until it expired. Once they sign in again, every
+// endpoint that needs an activated account turns them away
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserActivated(w, r, false)
+}
+
+// reactivateUserHandler for the "POST /v1/admin/users/:id/reactivate"
+// endpoint
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserActivated(w, r, true)
+}
+
+func (app *application) setUserActivated(w http.ResponseWriter, r *http.Request, activated bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Locking yourself out would leave nobody to undo it
+	if !activated && id == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you cannot deactivate your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	version, ok := app.readVersion(w, r)
+	if !ok {
+		return
+	}
+
+	action := "reactivate"
+	if !activated {
+		action = "deactivate"
+	}
+	app.changeUser(w, r, id, version, func(m data.Models, user *data.User) error {
+		user.Activated = activated
+		if !activated {
+			return revokeUserTokens(r.Context(), m, user.ID)
+		}
+		return nil
+	}, map[string]string{"action": action})
+}
+
+// revokeUserTokens() removes the authentication and refresh tokens of the
+// user. The removed authentication tokens go on the denylist, see
+// tokensRevoked()
+func revokeUserTokens(ctx context.Context, m data.Models, userID int64) error {
+	err := m.Tokens.DeleteAllForUsers(ctx, data.ScopeAuthentication, userID)
+	if err != nil {
+		return err
+	}
+	return m.Tokens.DeleteAllForUsers(ctx, data.ScopeRefresh, userID)
+}
+
+// readVersion() reads the optional "version" query parameter of the
+// endpoints that have no body. It writes the error response itself
+func (app *application) readVersion(w http.ResponseWriter, r *http.Request) (*int, bool) {
+	value := r.URL.Query().Get("version")
+	if value == "" {
+		return nil, true
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		v := validator.New()
+		v.AddError("version", "must be an integer value")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return &version, true
+}
+
+// changeUser() runs change on the user with the given id and saves the
+// user through UserModel.Update(), all in one transaction. The update
+// bumps the version even when change only touched the permissions, so
+// that two admins changing the same user can't both go through. When
+// the client sent the version that it saw, a newer one is rejected with
+// the current user. Successful changes are logged with props
+func (app *application) changeUser(w http.ResponseWriter, r *http.Request, id int64, version *int, change func(data.Models, *data.User) error, props map[string]string) {
+	var user *data.User
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		var err error
+		user, err = m.Users.Get(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if version != nil && *version != user.Version {
+			return errStaleUserVersion
+		}
+		err = change(m, user)
+		if err != nil {
+			return err
+		}
+		return m.Users.Update(r.Context(), user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, errStaleUserVersion):
+			current, err := app.adminUserView(r, user)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.staleVersionResponse(w, r, envelope{"user": current})
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.permissionCache != nil {
+		app.permissionCache.Invalidate(user.ID)
+	}
+	// The change may have removed tokens, this process turns their JWTs
+	// away at once
+	app.tokensRevoked(r.Context())
+
+	props["admin_id"] = strconv.FormatInt(app.contextGetUser(r).ID, 10)
+	props["user_id"] = strconv.FormatInt(user.ID, 10)
+	props["version"] = strconv.Itoa(user.Version)
+	app.logger.PrintInfo("admin changed user", props)
+
+	app.writeAdminUser(w, r, http.StatusOK, user)
+}
+
+func (app *application) writeAdminUser(w http.ResponseWriter, r *http.Request, status int, user *data.User) {
+	view, err := app.adminUserView(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, status, envelope{"user": view}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,251 @@
+// Filename: cmd/api/admin_test.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// adminUserOf() returns the "user" of an admin response
+func adminUserOf(t *testing.T, body map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	user, ok := body["user"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("got %v; want a user", body)
+	}
+	return user
+}
+
+func TestAdminUsersNeedUsersManage(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	target, _ := insertTestUser(t, app, "target@example.com", "quotes:read")
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read", "quotes:write")
+
+	paths := []struct{ method, path string }{
+		{http.MethodGet, "/v1/admin/users"},
+		{http.MethodGet, fmt.Sprintf("/v1/admin/users/%d", target.ID)},
+		{http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/permissions", target.ID)},
+		{http.MethodDelete, fmt.Sprintf("/v1/admin/users/%d/permissions/quotes:read", target.ID)},
+		{http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/deactivate", target.ID)},
+		{http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/reactivate", target.ID)},
+	}
+	for _, p := range paths {
+		code, _, _ := ts.do(t, p.method, p.path, "", nil)
+		if code != http.StatusUnauthorized {
+			t.Errorf("anonymous %s %s: got status %d; want %d", p.method, p.path, code, http.StatusUnauthorized)
+		}
+		code, _, _ = ts.do(t, p.method, p.path, reader, map[string]interface{}{"codes": []string{"quotes:write"}})
+		if code != http.StatusForbidden {
+			t.Errorf("%s %s without users:manage: got status %d; want %d", p.method, p.path, code, http.StatusForbidden)
+		}
+	}
+	// None of them went through
+	code, _, body := ts.do(t, http.MethodGet, "/v1/Quotes", reader, nil)
+	if code != http.StatusOK {
+		t.Errorf("reader: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+}
+
+func TestListAdminUsers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, admin := insertTestUser(t, app, "admin@example.com", "users:manage")
+	insertTestUser(t, app, "bob@example.com")
+	insertTestUser(t, app, "carol@example.com")
+	inactive := &data.User{Name: "Inactive User", Email: "dave@example.com"}
+	inactive.Password.Set("pa55word1")
+	err := app.models.Users.Insert(context.Background(), inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emails := func(body map[string]interface{}) string {
+		users, _ := body["users"].([]interface{})
+		var emails []string
+		for _, user := range users {
+			emails = append(emails, user.(map[string]interface{})["email"].(string))
+		}
+		return fmt.Sprint(emails)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[admin@example.com bob@example.com carol@example.com dave@example.com]"},
+		{"?sort=-email", "[dave@example.com carol@example.com bob@example.com admin@example.com]"},
+		{"?email=CAROL", "[carol@example.com]"},
+		{"?name=inactive", "[dave@example.com]"},
+		{"?activated=false", "[dave@example.com]"},
+		{"?activated=true&page_size=2&page=2", "[carol@example.com]"},
+	}
+	for _, tt := range tests {
+		code, _, body := ts.do(t, http.MethodGet, "/v1/admin/users"+tt.query, admin, nil)
+		if code != http.StatusOK {
+			t.Errorf("%q: got status %d; want %d: %v", tt.query, code, http.StatusOK, body)
+			continue
+		}
+		if got := emails(body); got != tt.want {
+			t.Errorf("%q: got %s; want %s", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"?sort=password_hash", "?sort=-version", "?activated=maybe", "?page=0", "?page_size=101"} {
+		code, _, body := ts.do(t, http.MethodGet, "/v1/admin/users"+query, admin, nil)
+		if code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: got status %d; want %d: %v", query, code, http.StatusUnprocessableEntity, body)
+		}
+	}
+}
+
+func TestAdminPermissions(t *testing.T) {
+	app := newTestApplication(t)
+	// The admin endpoints have to invalidate the cached permissions of
+	// the user, this process would otherwise go on using the old ones
+	app.permissionCache = data.NewCachedPermissions(app.models.Permissions, time.Hour)
+	app.models.Permissions = app.permissionCache
+	ts := newTestServer(t, app.routes())
+	_, admin := insertTestUser(t, app, "admin@example.com", "users:manage")
+	user, token := insertTestUser(t, app, "alice@example.com", "quotes:read")
+	base := fmt.Sprintf("/v1/admin/users/%d", user.ID)
+
+	code, _, _ := ts.do(t, http.MethodPost, "/v1/Quotes", token, map[string]interface{}{"author": "A", "quote_string": "B", "category": []string{"c"}})
+	if code != http.StatusForbidden {
+		t.Fatalf("before the grant: got status %d; want %d", code, http.StatusForbidden)
+	}
+
+	code, _, body := ts.do(t, http.MethodPost, base+"/permissions", admin, map[string]interface{}{"codes": []string{"quotes:write", "quotes:fly"}})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown code: got status %d; want %d: %v", code, http.StatusUnprocessableEntity, body)
+	}
+	code, _, body = ts.do(t, http.MethodPost, base+"/permissions", admin, map[string]interface{}{"codes": []string{"quotes:write"}, "version": 1})
+	if code != http.StatusOK {
+		t.Fatalf("grant: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	if got := adminUserOf(t, body); fmt.Sprint(got["permissions"]) != "[quotes:read quotes:write]" || got["version"] != float64(2) {
+		t.Errorf("grant: got %v", got)
+	}
+	code, _, body = ts.do(t, http.MethodPost, "/v1/Quotes", token, map[string]interface{}{"author": "A", "quote_string": "B", "category": []string{"c"}})
+	if code != http.StatusCreated {
+		t.Errorf("after the grant: got status %d; want %d: %v", code, http.StatusCreated, body)
+	}
+
+	// A version that someone else has moved on from gets the current user
+	code, _, body = ts.do(t, http.MethodDelete, base+"/permissions/quotes:write?version=1", admin, nil)
+	if code != http.StatusConflict {
+		t.Fatalf("stale version: got status %d; want %d: %v", code, http.StatusConflict, body)
+	}
+	if got := adminUserOf(t, body); got["version"] != float64(2) || fmt.Sprint(got["permissions"]) != "[quotes:read quotes:write]" {
+		t.Errorf("stale version: got %v; want the current user", got)
+	}
+
+	code, _, _ = ts.do(t, http.MethodDelete, base+"/permissions/quotes:fly", admin, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("unknown code: got status %d; want %d", code, http.StatusNotFound)
+	}
+	code, _, _ = ts.do(t, http.MethodDelete, "/v1/admin/users/999/permissions/quotes:write", admin, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("unknown user: got status %d; want %d", code, http.StatusNotFound)
+	}
+	code, _, body = ts.do(t, http.MethodDelete, base+"/permissions/quotes:write?version=2", admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("revoke: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/Quotes", token, map[string]interface{}{"author": "A", "quote_string": "B", "category": []string{"c"}})
+	if code != http.StatusForbidden {
+		t.Errorf("after the revoke: got status %d; want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestDeactivateUser(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	adminUser, admin := insertTestUser(t, app, "admin@example.com", "users:manage")
+	user, _ := insertTestUser(t, app, "alice@example.com", "quotes:read")
+	access, refresh := ts.signIn(t, "alice@example.com")
+
+	code, _, body := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/deactivate", adminUser.ID), admin, nil)
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("deactivating yourself: got status %d; want %d: %v", code, http.StatusUnprocessableEntity, body)
+	}
+
+	code, _, body = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/deactivate", user.ID), admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("deactivate: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	if got := adminUserOf(t, body); got["activated"] != false {
+		t.Errorf("deactivate: got %v", got)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", access, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("old token: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": refresh})
+	if code != http.StatusUnauthorized {
+		t.Errorf("old refresh token: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	// Signing in again gives a token that every activated endpoint refuses
+	access, _ = ts.signIn(t, "alice@example.com")
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", access, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("new token: got status %d; want %d", code, http.StatusForbidden)
+	}
+
+	code, _, body = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/reactivate", user.ID), admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("reactivate: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", access, nil)
+	if code != http.StatusOK {
+		t.Errorf("after reactivating: got status %d; want %d", code, http.StatusOK)
+	}
+}
+
+// A JWT carries the activation and permissions it was issued with, so the
+// admin changes have to revoke it rather than wait for it to expire
+func TestAdminChangesRevokeJWTs(t *testing.T) {
+	app := newTestApplication(t)
+	useJWT(t, app, testJWTKey("k1", "HS256"))
+	ts := newTestServer(t, app.routes())
+	_, admin := insertTestUser(t, app, "admin@example.com", "users:manage")
+	alice, _ := insertTestUser(t, app, "alice@example.com", "quotes:read", "quotes:write")
+	bob, _ := insertTestUser(t, app, "bob@example.com", "quotes:read")
+
+	aliceAccess, aliceRefresh := ts.signIn(t, "alice@example.com")
+	code, _, _ := ts.do(t, http.MethodGet, "/v1/Quotes", aliceAccess, nil)
+	if code != http.StatusOK {
+		t.Fatalf("before the revoke: got status %d; want %d", code, http.StatusOK)
+	}
+	code, _, body := ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/admin/users/%d/permissions/quotes:write", alice.ID), admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("revoke: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/Quotes", aliceAccess, map[string]interface{}{"author": "A", "quote_string": "B", "category": []string{"c"}})
+	if code != http.StatusUnauthorized {
+		t.Errorf("JWT after the revoke: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": aliceRefresh})
+	if code != http.StatusUnauthorized {
+		t.Errorf("refresh after the revoke: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+
+	bobAccess, bobRefresh := ts.signIn(t, "bob@example.com")
+	code, _, body = ts.do(t, http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/deactivate", bob.ID), admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("deactivate: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", bobAccess, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("JWT after deactivating: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": bobRefresh})
+	if code != http.StatusUnauthorized {
+		t.Errorf("refresh after deactivating: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+}
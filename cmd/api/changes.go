@@ -0,0 +1,69 @@
+// Filename: cmd/api/changes.go
+
+package main
+
+import (
+	"net/http"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// listChangesHandler for the "GET /v1/changes" endpoint, used by clients
+// that keep an offline copy of the quotes.
+//
+// Syncing: start without a token to receive every quote, then keep calling
+// with the sync_token from the previous response. While has_more is true
+// there is another page waiting. A change is either an "upsert" carrying
+// the whole quote or a "tombstone" for a quote that was deleted. Changes
+// must be applied in the order that they are returned, skipping any whose
+// version is older than the local copy of the quote.
+//
+// Conflicts: an offline edit is pushed back with "PATCH /v1/Quotes/:id",
+// sending the version that the edit was based on. If the quote has changed
+// on the server since then, the server wins: the PATCH is rejected with a
+// 409 that carries the current quote, the client syncs, reapplies its edit
+// to the current quote and retries with the new version. If the quote was
+// deleted the PATCH gets a 404 and the local edit should be dropped.
+func (app *application) listChangesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	since, err := data.ParseSyncToken(app.readString(qs, "since", ""))
+	if err != nil {
+		v.AddError("since", "must be a sync token returned by this endpoint")
+	}
+	pageSize := app.readInt(qs, "page_size", 100, v)
+	v.Check(pageSize > 0, "page_size", "must be greater than zero")
+	v.Check(pageSize <= 1000, "page_size", "must be a maximum of 1000")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	changes, next, more, err := app.models.Changes.GetFeed(r.Context(), since, pageSize)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	type feedEntry struct {
+		Type    string      `json:"type"`
+		ID      int64       `json:"id"`
+		Version int32       `json:"version"`
+		Quote   *data.Quote `json:"quote,omitempty"`
+	}
+	entries := make([]feedEntry, 0, len(changes))
+	for _, change := range changes {
+		entry := feedEntry{Type: "upsert", ID: change.QuoteID, Version: change.Version, Quote: change.Quote}
+		if change.EventType == data.EventQuoteDeleted {
+			entry.Type = "tombstone"
+			entry.Quote = nil
+		}
+		entries = append(entries, entry)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"changes": entries, "sync_token": next.String(), "has_more": more}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
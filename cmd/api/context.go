@@ -5,6 +5,7 @@ package main
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"quotesapi.desireamagwula.net/internals/data"
 )
@@ -15,10 +16,41 @@ type contextKey string
 // make user a key
 const userContextKey = contextKey("user")
 
-// Method to add user to the context
-func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
-	ctx := context.WithValue(r.Context(), userContextKey, user)
-	return r.WithContext(ctx)
+// The authentication token that the request was made with
+const tokenContextKey = contextKey("token")
+
+// The permissions of the user are kept next to it, and loaded the first
+// time that they are needed
+const permissionsContextKey = contextKey("permissions")
+
+// Set for a user that came from a JWT, which only has the fields that the
+// token carries
+const partialUserContextKey = contextKey("partial user")
+
+type requestPermissions struct {
+	mu          sync.Mutex
+	user        *data.User
+	permissions data.Permissions
+	loaded      bool
+}
+
+// Method to add user to the context. claims is nil unless the user was
+// authenticated by a JWT
+func (app *application) contextSetUser(r *http.Request, user *data.User, claims *accessClaims) *http.Request {
+	return r.WithContext(withUser(r.Context(), user, claims))
+}
+
+// withUser adds the user to ctx, along with the permissions that a JWT
+// carries so that they aren't read from the models
+func withUser(ctx context.Context, user *data.User, claims *accessClaims) context.Context {
+	ctx = context.WithValue(ctx, userContextKey, user)
+	held := &requestPermissions{user: user}
+	if claims != nil {
+		held.permissions = append(data.Permissions{}, claims.Permissions...)
+		held.loaded = true
+		ctx = context.WithValue(ctx, partialUserContextKey, true)
+	}
+	return context.WithValue(ctx, permissionsContextKey, held)
 }
 
 // Retrieve the User struct
@@ -28,4 +60,59 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 		panic("missing user value in request context")
 	}
 	return user
-}
\ No newline at end of file
+}
+
+// loadUser returns the whole record of the user in ctx. A user that came
+// from a JWT only has its id and activation, so the rest is read then
+func (app *application) loadUser(ctx context.Context) (*data.User, error) {
+	user, ok := ctx.Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in context")
+	}
+	if partial, _ := ctx.Value(partialUserContextKey).(bool); !partial {
+		return user, nil
+	}
+	return app.models.Users.Get(ctx, user.ID)
+}
+
+// contextLoadUser is loadUser() for the user of the request
+func (app *application) contextLoadUser(r *http.Request) (*data.User, error) {
+	return app.loadUser(r.Context())
+}
+
+// Method to add the authentication token to the context
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenContextKey, token))
+}
+
+// Retrieve the authentication token, which is empty for anonymous users
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// Retrieve the permissions of the user in the request context. They are
+// only read from the models once per request
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, error) {
+	return app.permissionsFor(r.Context(), app.contextGetUser(r))
+}
+
+// permissionsFor returns the permissions of user, from the request context
+// if it belongs to the same user
+func (app *application) permissionsFor(ctx context.Context, user *data.User) (data.Permissions, error) {
+	held, ok := ctx.Value(permissionsContextKey).(*requestPermissions)
+	if !ok || held.user != user {
+		return app.models.Permissions.GetAllForUser(ctx, user.ID)
+	}
+	held.mu.Lock()
+	defer held.mu.Unlock()
+	if !held.loaded {
+		permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		held.permissions = permissions
+		held.loaded = true
+	}
+	return held.permissions, nil
+}
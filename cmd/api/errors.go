@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
@@ -11,6 +13,15 @@ func (app *application) logError(r *http.Request, err error) {
 		"request_url":    r.URL.String(),
 	})
 }
+// logCancelled records a request that was abandoned by the client
+func (app *application) logCancelled(r *http.Request, err error) {
+	app.logger.PrintInfo("request cancelled", map[string]string{
+		"request_method": r.Method,
+		"request_url":    r.URL.String(),
+		"error":          err.Error(),
+	})
+}
+
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	// CReate a variable
 	env := envelope{"error": message}
@@ -23,6 +34,12 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 
 // Server error response
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// A client that goes away cancels its queries. That isn't a problem
+	// with the server, and there is nobody left to respond to
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		app.logCancelled(r, err)
+		return
+	}
 	app.logError(r, err)
 	// Prepare a message with the
 	message := "the server encountered a problem and could not proceed"
@@ -61,6 +78,16 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// Stale version error, the current record is sent back alongside the message
+func (app *application) staleVersionResponse(w http.ResponseWriter, r *http.Request, current envelope) {
+	current["error"] = "the record has been changed since the version you sent, please merge your changes and try again"
+	err := app.writeJSON(w, http.StatusConflict, current, nil)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 // Rate limit error
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
@@ -0,0 +1,475 @@
+// Filename: cmd/api/graphql.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// graphQLError is an error with extensions. graphql-go copies the
+// extensions into the "errors" entry of the response
+type graphQLError struct {
+	message    string
+	extensions map[string]interface{}
+}
+
+func (e *graphQLError) Error() string {
+	return e.message
+}
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	return e.extensions
+}
+
+// graphQLExtensions puts back the extensions that graphql-go loses. It only
+// copies them for errors that a resolver returns, the ones from thunks are
+// wrapped twice, so this follows their original errors to the graphQLError
+func graphQLExtensions(errs []gqlerrors.FormattedError) {
+	for i := range errs {
+		if errs[i].Extensions != nil {
+			continue
+		}
+		var err error = errs[i]
+		for err != nil {
+			switch e := err.(type) {
+			case *graphQLError:
+				errs[i].Extensions = e.Extensions()
+				err = nil
+			case gqlerrors.FormattedError:
+				err = e.OriginalError()
+			case *gqlerrors.Error:
+				err = e.OriginalError
+			default:
+				err = nil
+			}
+		}
+	}
+}
+
+// graphQLFailedValidation turns validator errors into a GraphQL error
+func graphQLFailedValidation(errors map[string]string) error {
+	return &graphQLError{
+		message:    "failed validation",
+		extensions: map[string]interface{}{"code": "VALIDATION_FAILED", "errors": errors},
+	}
+}
+
+// graphQLErrorFor maps the errors used by the REST handlers onto GraphQL
+// errors, using the same messages as errors.go
+func (app *application) graphQLErrorFor(err error) error {
+	newError := func(code, message string) error {
+		return &graphQLError{message: message, extensions: map[string]interface{}{"code": code}}
+	}
+	switch {
+	case errors.Is(err, errAuthenticationRequired):
+		return newError("UNAUTHENTICATED", "you must be authenticated to access this resource")
+	case errors.Is(err, errInactiveAccount):
+		return newError("FORBIDDEN", "your user account must be activated to access this resource")
+	case errors.Is(err, errNotPermitted):
+		return newError("FORBIDDEN", "your user account does not have the necessary permissions to access this resource")
+	case errors.Is(err, data.ErrRecordNotFound):
+		return newError("NOT_FOUND", "The requested resource could not be found")
+	case errors.Is(err, data.ErrEditConflict):
+		return newError("CONFLICT", "unable to update the record due to an edit conflict, please try again")
+	case errors.Is(err, context.Canceled):
+		app.logger.PrintInfo("request cancelled", map[string]string{"request_url": "/v1/graphql", "error": err.Error()})
+		return newError("CANCELLED", "the request was cancelled")
+	default:
+		app.logger.PrintError(err, map[string]string{"request_url": "/v1/graphql"})
+		return newError("INTERNAL_SERVER_ERROR", "the server encountered a problem and could not proceed")
+	}
+}
+
+// batchLoader collects the keys that are asked for while a level of the
+// query is being resolved and fetches them all with one call the first
+// time that any of the values is needed
+type batchLoader[V any] struct {
+	ctx     context.Context
+	fetch   func(context.Context, []int64) (map[int64]V, error)
+	mu      sync.Mutex
+	pending []int64
+	results map[int64]V
+	err     error
+}
+
+func newBatchLoader[V any](ctx context.Context, fetch func(context.Context, []int64) (map[int64]V, error)) *batchLoader[V] {
+	return &batchLoader[V]{ctx: ctx, fetch: fetch, results: make(map[int64]V)}
+}
+
+// load() queues the key and returns a thunk, which graphql-go calls once
+// the rest of the fields on the same level have been queued
+func (l *batchLoader[V]) load(key int64) func() (V, bool, error) {
+	l.mu.Lock()
+	if _, ok := l.results[key]; !ok {
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (V, bool, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if len(l.pending) > 0 {
+			keys := l.pending
+			l.pending = nil
+			results, err := l.fetch(l.ctx, keys)
+			if err != nil {
+				l.err = err
+			}
+			for k, v := range results {
+				l.results[k] = v
+			}
+		}
+		value, ok := l.results[key]
+		return value, ok, l.err
+	}
+}
+
+// The per-request state that the resolvers share
+type graphQLState struct {
+	user        *data.User
+	quotes      *batchLoader[*data.Quote]
+	permissions *batchLoader[data.Permissions]
+}
+
+const graphQLStateContextKey = contextKey("graphql")
+
+func graphQLStateFrom(ctx context.Context) *graphQLState {
+	state, ok := ctx.Value(graphQLStateContextKey).(*graphQLState)
+	if !ok {
+		panic("missing graphql state in context")
+	}
+	return state
+}
+
+// graphQLRequire wraps a resolver with the checks from requirePermission().
+// An empty code only requires an activated user
+func (app *application) graphQLRequire(code string, resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		state := graphQLStateFrom(p.Context)
+		err := app.checkPermission(p.Context, state.user, code)
+		if err != nil {
+			return nil, app.graphQLErrorFor(err)
+		}
+		return resolve(p)
+	}
+}
+
+// readGraphQLID converts an ID argument into a record id
+func readGraphQLID(p graphql.ResolveParams, name string) (int64, error) {
+	raw, _ := p.Args[name].(string)
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 1 {
+		return 0, graphQLFailedValidation(map[string]string{name: "must be a valid id"})
+	}
+	return id, nil
+}
+
+// readGraphQLStrings converts a list argument into a string slice
+func readGraphQLStrings(p graphql.ResolveParams, name string) []string {
+	raw, ok := p.Args[name].([]interface{})
+	if !ok {
+		return nil
+	}
+	values := make([]string, 0, len(raw))
+	for _, value := range raw {
+		s, _ := value.(string)
+		values = append(values, s)
+	}
+	return values
+}
+
+// newGraphQLSchema builds the schema that is served by graphqlHandler
+func (app *application) newGraphQLSchema() (graphql.Schema, error) {
+	quoteType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Quote",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"author":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"quote_string": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"category":     &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"version":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metadata",
+		Fields: graphql.Fields{
+			"current_page":  &graphql.Field{Type: graphql.Int},
+			"page_size":     &graphql.Field{Type: graphql.Int},
+			"first_page":    &graphql.Field{Type: graphql.Int},
+			"last_page":     &graphql.Field{Type: graphql.Int},
+			"total_records": &graphql.Field{Type: graphql.Int},
+		},
+	})
+
+	quoteListType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "QuoteList",
+		Fields: graphql.Fields{
+			"quotes":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(quoteType)))},
+			"metadata": &graphql.Field{Type: graphql.NewNonNull(metadataType)},
+		},
+	})
+
+	// permissions are resolved through the loader, so listing several
+	// users never costs more than one permissions query
+	resolvePermissions := func(p graphql.ResolveParams) (interface{}, error) {
+		user, _ := p.Source.(*data.User)
+		if user == nil {
+			return nil, nil
+		}
+		thunk := graphQLStateFrom(p.Context).permissions.load(user.ID)
+		return func() (interface{}, error) {
+			permissions, _, err := thunk()
+			if err != nil {
+				return nil, app.graphQLErrorFor(err)
+			}
+			if permissions == nil {
+				permissions = data.Permissions{}
+			}
+			return []string(permissions), nil
+		}, nil
+	}
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"created_at":  &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"activated":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"permissions": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))), Resolve: resolvePermissions},
+		},
+	})
+
+	// The root fields of both operations are nullable, so that one of them
+	// failing only nulls itself and the others are still returned
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"quote": &graphql.Field{
+				Type: quoteType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.graphQLRequire("quotes:read", func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := readGraphQLID(p, "id")
+					if err != nil {
+						return nil, err
+					}
+					// Every quote(id:) on the same level shares one query
+					thunk := graphQLStateFrom(p.Context).quotes.load(id)
+					return func() (interface{}, error) {
+						quote, ok, err := thunk()
+						if err != nil {
+							return nil, app.graphQLErrorFor(err)
+						}
+						if !ok {
+							return nil, app.graphQLErrorFor(data.ErrRecordNotFound)
+						}
+						return quote, nil
+					}, nil
+				}),
+			},
+			"quotes": &graphql.Field{
+				Type: quoteListType,
+				Args: graphql.FieldConfigArgument{
+					"author":       &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"quote_string": &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"category":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"page":         &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"page_size":    &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+					"sort":         &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "id"},
+				},
+				Resolve: app.graphQLRequire("quotes:read", func(p graphql.ResolveParams) (interface{}, error) {
+					author, _ := p.Args["author"].(string)
+					quoteString, _ := p.Args["quote_string"].(string)
+					category := readGraphQLStrings(p, "category")
+					if category == nil {
+						category = []string{}
+					}
+					filters := data.Filters{SortList: quoteSortList}
+					filters.Page, _ = p.Args["page"].(int)
+					filters.PageSize, _ = p.Args["page_size"].(int)
+					filters.Sort, _ = p.Args["sort"].(string)
+
+					v := validator.New()
+					if data.ValidateFilters(v, filters); !v.Valid() {
+						return nil, graphQLFailedValidation(v.Errors)
+					}
+					quotes, metadata, err := app.models.Quote.GetAll(p.Context, author, quoteString, category, filters)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					return map[string]interface{}{"quotes": quotes, "metadata": metadata}, nil
+				}),
+			},
+			// Users can only ever see themselves
+			"me": &graphql.Field{
+				Type: userType,
+				Resolve: app.graphQLRequire("", func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := app.loadUser(p.Context)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					return user, nil
+				}),
+			},
+			"permissions": &graphql.Field{
+				Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+				Resolve: app.graphQLRequire("", func(p graphql.ResolveParams) (interface{}, error) {
+					p.Source = graphQLStateFrom(p.Context).user
+					return resolvePermissions(p)
+				}),
+			},
+		},
+	})
+
+	mutationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createQuote": &graphql.Field{
+				Type: quoteType,
+				Args: graphql.FieldConfigArgument{
+					"author":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"quote_string": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"category":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+				},
+				Resolve: app.graphQLRequire("quotes:write", func(p graphql.ResolveParams) (interface{}, error) {
+					quote := &data.Quote{Category: readGraphQLStrings(p, "category")}
+					quote.Author, _ = p.Args["author"].(string)
+					quote.Quote_string, _ = p.Args["quote_string"].(string)
+
+					v := validator.New()
+					if data.ValidateQuote(v, quote); !v.Valid() {
+						return nil, graphQLFailedValidation(v.Errors)
+					}
+					err := app.models.Quote.Insert(p.Context, quote)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					return quote, nil
+				}),
+			},
+			"updateQuote": &graphql.Field{
+				Type: quoteType,
+				Args: graphql.FieldConfigArgument{
+					"id":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"author":       &graphql.ArgumentConfig{Type: graphql.String},
+					"quote_string": &graphql.ArgumentConfig{Type: graphql.String},
+					"category":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"version":      &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: app.graphQLRequire("quotes:write", func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := readGraphQLID(p, "id")
+					if err != nil {
+						return nil, err
+					}
+					quote, err := app.models.Quote.Get(p.Context, id)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					// Same conflict rule as "PATCH /v1/Quotes/:id"
+					if version, ok := p.Args["version"].(int); ok && int32(version) != quote.Version {
+						return nil, app.graphQLErrorFor(data.ErrEditConflict)
+					}
+					if author, ok := p.Args["author"].(string); ok {
+						quote.Author = author
+					}
+					if quoteString, ok := p.Args["quote_string"].(string); ok {
+						quote.Quote_string = quoteString
+					}
+					if category := readGraphQLStrings(p, "category"); category != nil {
+						quote.Category = category
+					}
+
+					v := validator.New()
+					if data.ValidateQuote(v, quote); !v.Valid() {
+						return nil, graphQLFailedValidation(v.Errors)
+					}
+					err = app.models.Quote.Update(p.Context, quote)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					return quote, nil
+				}),
+			},
+			"deleteQuote": &graphql.Field{
+				Type: graphql.ID,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.graphQLRequire("quotes:write", func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := readGraphQLID(p, "id")
+					if err != nil {
+						return nil, err
+					}
+					err = app.models.Quote.Delete(p.Context, id)
+					if err != nil {
+						return nil, app.graphQLErrorFor(err)
+					}
+					return id, nil
+				}),
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    queryType,
+		Mutation: mutationType,
+	})
+}
+
+// graphqlHandler for the "POST /v1/graphql" endpoint. Authentication has
+// already been done by the authenticate() middleware, the permission checks
+// happen in the resolvers
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Query != "", "query", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	state := &graphQLState{
+		user:        app.contextGetUser(r),
+		quotes:      newBatchLoader(r.Context(), app.models.Quote.GetMany),
+		permissions: newBatchLoader(r.Context(), app.models.Permissions.GetAllForUsers),
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         app.graphqlSchema,
+		RequestString:  input.Query,
+		OperationName:  input.OperationName,
+		VariableValues: input.Variables,
+		Context:        context.WithValue(r.Context(), graphQLStateContextKey, state),
+	})
+
+	env := envelope{"data": result.Data}
+	if len(result.Errors) > 0 {
+		graphQLExtensions(result.Errors)
+		env["errors"] = result.Errors
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Filename: cmd/api/graphql_test.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// graphQL() runs a query and returns its data and errors
+func (ts *testServer) graphQL(t *testing.T, token, query string) (map[string]interface{}, []interface{}) {
+	t.Helper()
+	code, _, body := ts.do(t, http.MethodPost, "/v1/graphql", token, map[string]string{"query": query})
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	data, _ := body["data"].(map[string]interface{})
+	if data == nil {
+		t.Fatalf("got no data: %v", body)
+	}
+	errs, _ := body["errors"].([]interface{})
+	return data, errs
+}
+
+// expectErrorAt() fails the test unless errs is a single error for the
+// root field, with the code if it isn't empty
+func expectErrorAt(t *testing.T, errs []interface{}, field, code string) {
+	t.Helper()
+	if len(errs) != 1 {
+		t.Fatalf("got errors %v; want one for %s", errs, field)
+	}
+	err, _ := errs[0].(map[string]interface{})
+	path, _ := err["path"].([]interface{})
+	extensions, _ := err["extensions"].(map[string]interface{})
+	if len(path) != 1 || path[0] != field || (code != "" && extensions["code"] != code) {
+		t.Errorf("got error %v; want %s at %s", err, code, field)
+	}
+}
+
+func TestGraphQLPartialResults(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	insertTestQuote(t, app)
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read")
+	_, writer := insertTestUser(t, app, "writer@example.com", "quotes:read", "quotes:write")
+
+	// A quote that doesn't exist only nulls its own field
+	data, errs := ts.graphQL(t, reader, `{
+		quote(id: "999") { id }
+		quotes { metadata { total_records } }
+		me { email }
+		permissions
+	}`)
+	expectErrorAt(t, errs, "quote", "NOT_FOUND")
+	if quote, ok := data["quote"]; !ok || quote != nil {
+		t.Errorf("got quote %v; want null", quote)
+	}
+	quotes, _ := data["quotes"].(map[string]interface{})
+	metadata, _ := quotes["metadata"].(map[string]interface{})
+	if metadata["total_records"] != float64(1) {
+		t.Errorf("got quotes %v; want one record", data["quotes"])
+	}
+	if me, _ := data["me"].(map[string]interface{}); me["email"] != "reader@example.com" {
+		t.Errorf("got me %v", data["me"])
+	}
+	if permissions, _ := data["permissions"].([]interface{}); len(permissions) != 1 {
+		t.Errorf("got permissions %v; want quotes:read", data["permissions"])
+	}
+
+	// So does a field that the user isn't allowed to see
+	data, errs = ts.graphQL(t, "", `{ quotes { metadata { total_records } } permissions }`)
+	if len(errs) != 2 {
+		t.Errorf("got errors %v; want one for each field", errs)
+	}
+	if data["quotes"] != nil || data["permissions"] != nil {
+		t.Errorf("got %v; want both fields null", data)
+	}
+
+	// A mutation that fails doesn't hide the ones that worked
+	data, errs = ts.graphQL(t, writer, `mutation {
+		created: createQuote(author: "Grace Hopper", quote_string: "Ships are safe in harbour", category: ["computing"]) { author }
+		deleted: deleteQuote(id: "999")
+	}`)
+	expectErrorAt(t, errs, "deleted", "NOT_FOUND")
+	if created, _ := data["created"].(map[string]interface{}); created["author"] != "Grace Hopper" {
+		t.Errorf("got created %v", data["created"])
+	}
+	if deleted, ok := data["deleted"]; !ok || deleted != nil {
+		t.Errorf("got deleted %v; want null", deleted)
+	}
+
+	data, errs = ts.graphQL(t, reader, `mutation { createQuote(author: "A", quote_string: "B", category: ["c"]) { id } }`)
+	expectErrorAt(t, errs, "createQuote", "FORBIDDEN")
+	if data["createQuote"] != nil {
+		t.Errorf("got createQuote %v; want null", data["createQuote"])
+	}
+}
+
+// countingQuotes counts the calls to GetMany()
+type countingQuotes struct {
+	data.QuoteStore
+	calls atomic.Int64
+}
+
+func (q *countingQuotes) GetMany(ctx context.Context, ids []int64) (map[int64]*data.Quote, error) {
+	q.calls.Add(1)
+	return q.QuoteStore.GetMany(ctx, ids)
+}
+
+func TestGraphQLBatchesQuotes(t *testing.T) {
+	app := newTestApplication(t)
+	quotes := &countingQuotes{QuoteStore: app.models.Quote}
+	app.models.Quote = quotes
+	ts := newTestServer(t, app.routes())
+	for i := 0; i < 3; i++ {
+		insertTestQuote(t, app)
+	}
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read")
+
+	data, errs := ts.graphQL(t, reader, `{
+		a: quote(id: "1") { id }
+		b: quote(id: "2") { id }
+		c: quote(id: "3") { id }
+		d: quote(id: "999") { id }
+	}`)
+	if n := quotes.calls.Load(); n != 1 {
+		t.Errorf("got %d calls to GetMany; want 1", n)
+	}
+	expectErrorAt(t, errs, "d", "NOT_FOUND")
+	for field, id := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if quote, _ := data[field].(map[string]interface{}); quote["id"] != id {
+			t.Errorf("got %s %v; want quote %s", field, data[field], id)
+		}
+	}
+}
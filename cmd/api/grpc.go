@@ -0,0 +1,423 @@
+// Filename: cmd/api/grpc.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/rpc/quotesv1"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// The permission that each gRPC method requires. Methods that aren't
+// listed here don't need an authenticated user
+var grpcPermissions = map[string]string{
+	quotesv1.QuoteService_Get_FullMethodName:    "quotes:read",
+	quotesv1.QuoteService_List_FullMethodName:   "quotes:read",
+	quotesv1.QuoteService_Watch_FullMethodName:  "quotes:read",
+	quotesv1.QuoteService_Create_FullMethodName: "quotes:write",
+	quotesv1.QuoteService_Update_FullMethodName: "quotes:write",
+	quotesv1.QuoteService_Delete_FullMethodName: "quotes:write",
+}
+
+// newGRPCServer creates the gRPC server with both services registered
+func (app *application) newGRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(app.grpcRecoverUnary, app.grpcRateLimitUnary, app.grpcAuthenticateUnary),
+		grpc.ChainStreamInterceptor(app.grpcRecoverStream, app.grpcRateLimitStream, app.grpcAuthenticateStream),
+	)
+	quotesv1.RegisterQuoteServiceServer(srv, &quoteServer{app: app})
+	quotesv1.RegisterAuthServiceServer(srv, &authServer{app: app})
+	return srv
+}
+
+// grpcRateLimit is the gRPC version of rateLimit(), with the same limiter
+// so that the calls count towards the same rate as the JSON API
+func (app *application) grpcRateLimit(ctx context.Context) error {
+	if app.config.limiter.enabled && !app.limiter.allow(grpcClient(ctx).ip) {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+	return nil
+}
+
+func (app *application) grpcRateLimitUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := app.grpcRateLimit(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (app *application) grpcRateLimitStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := app.grpcRateLimit(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcAuthenticate is the gRPC version of the authenticate() and
+// requirePermission() middleware. The bearer token is read from the
+// "authorization" metadata entry and the user is added to the context
+func (app *application) grpcAuthenticate(ctx context.Context, method string) (context.Context, error) {
+	user := data.AnonymousUser
+	var claims *accessClaims
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 {
+		headerParts := strings.Split(values[0], " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			return nil, status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+		}
+		var err error
+		user, claims, err = app.userForToken(ctx, headerParts[1], grpcClient(ctx))
+		if err != nil {
+			return nil, app.grpcError(err)
+		}
+	}
+	ctx = withUser(ctx, user, claims)
+	if code, ok := grpcPermissions[method]; ok {
+		err := app.checkPermission(ctx, user, code)
+		if err != nil {
+			return nil, app.grpcError(err)
+		}
+	}
+	return ctx, nil
+}
+
+func (app *application) grpcAuthenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := app.grpcAuthenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(app.grpcReadYourWrites(ctx, info.FullMethod), req)
+}
+
+// grpcReadYourWrites is the gRPC version of readYourWrites(). The deadline
+// is sent and read back in the x-primary-until metadata entry
+func (app *application) grpcReadYourWrites(ctx context.Context, method string) context.Context {
+	if app.replicas == nil {
+		return ctx
+	}
+	if grpcPermissions[method] == "quotes:write" {
+		until := time.Now().Add(app.config.db.replicas.readYourWrites)
+		grpc.SetHeader(ctx, metadata.Pairs(primaryUntilHeader, strconv.FormatInt(until.UnixMilli(), 10)))
+		return data.WithPrimary(ctx)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(primaryUntilHeader); len(values) > 0 {
+		if time.Now().Before(parsePrimaryUntil(values[0], app.config.db.replicas.readYourWrites)) {
+			return data.WithPrimary(ctx)
+		}
+	}
+	return ctx
+}
+
+// authenticatedStream swaps the context of a stream for one with the user
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (app *application) grpcAuthenticateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := app.grpcAuthenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// The gRPC versions of recoverPanic()
+func (app *application) grpcRecoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = app.grpcPanic(info.FullMethod, p)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func (app *application) grpcRecoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = app.grpcPanic(info.FullMethod, p)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+func (app *application) grpcPanic(method string, p interface{}) error {
+	app.logger.PrintError(fmt.Errorf("%s", p), map[string]string{"grpc_method": method})
+	return status.Error(codes.Internal, "the server encountered a problem and could not proceed")
+}
+
+// grpcError maps the errors used by the JSON API onto gRPC status codes,
+// using the same messages as errors.go
+func (app *application) grpcError(err error) error {
+	switch {
+	case errors.Is(err, errInvalidAuthenticationToken):
+		return status.Error(codes.Unauthenticated, "invalid or missing authentication token")
+	case errors.Is(err, errInvalidCredentials):
+		return status.Error(codes.Unauthenticated, "Invalid authentication credentials")
+	case errors.Is(err, errAuthenticationRequired):
+		return status.Error(codes.Unauthenticated, "you must be authenticated to access this resource")
+	case errors.Is(err, errInactiveAccount):
+		return status.Error(codes.PermissionDenied, "your user account must be activated to access this resource")
+	case errors.Is(err, errNotPermitted):
+		return status.Error(codes.PermissionDenied, "your user account does not have the necessary permissions to access this resource")
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Error(codes.NotFound, "The requested resource could not be found")
+	case errors.Is(err, data.ErrEditConflict):
+		return status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+	case errors.Is(err, context.Canceled):
+		app.logger.PrintInfo("request cancelled", map[string]string{"error": err.Error()})
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, "the server encountered a problem and could not proceed")
+	}
+}
+
+// grpcFailedValidation reports validator errors as INVALID_ARGUMENT with a
+// BadRequest detail per field
+func grpcFailedValidation(errors map[string]string) error {
+	violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(errors))
+	for field, description := range errors {
+		violations = append(violations, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+	}
+	st, err := status.New(codes.InvalidArgument, "failed validation").WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "failed validation")
+	}
+	return st.Err()
+}
+
+func quoteToProto(quote *data.Quote) *quotesv1.Quote {
+	return &quotesv1.Quote{
+		Id:          quote.ID,
+		Author:      quote.Author,
+		QuoteString: quote.Quote_string,
+		Category:    quote.Category,
+		Version:     quote.Version,
+	}
+}
+
+type quoteServer struct {
+	quotesv1.UnimplementedQuoteServiceServer
+	app *application
+}
+
+func (s *quoteServer) Get(ctx context.Context, req *quotesv1.GetQuoteRequest) (*quotesv1.Quote, error) {
+	quote, err := s.app.models.Quote.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return quoteToProto(quote), nil
+}
+
+func (s *quoteServer) List(ctx context.Context, req *quotesv1.ListQuotesRequest) (*quotesv1.ListQuotesResponse, error) {
+	filters := data.Filters{
+		Page:     int(req.GetPage()),
+		PageSize: int(req.GetPageSize()),
+		Sort:     req.GetSort(),
+		SortList: quoteSortList,
+	}
+	// Unset fields get the same defaults as the JSON API
+	if filters.Page == 0 {
+		filters.Page = 1
+	}
+	if filters.PageSize == 0 {
+		filters.PageSize = 20
+	}
+	if filters.Sort == "" {
+		filters.Sort = "id"
+	}
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, grpcFailedValidation(v.Errors)
+	}
+	category := req.GetCategory()
+	if category == nil {
+		category = []string{}
+	}
+
+	quotes, metadata, err := s.app.models.Quote.GetAll(ctx, req.GetAuthor(), req.GetQuoteString(), category, filters)
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	resp := &quotesv1.ListQuotesResponse{
+		Quotes: make([]*quotesv1.Quote, 0, len(quotes)),
+		Metadata: &quotesv1.Metadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+	}
+	for _, quote := range quotes {
+		resp.Quotes = append(resp.Quotes, quoteToProto(quote))
+	}
+	return resp, nil
+}
+
+func (s *quoteServer) Create(ctx context.Context, req *quotesv1.CreateQuoteRequest) (*quotesv1.Quote, error) {
+	quote := &data.Quote{
+		Author:       req.GetAuthor(),
+		Quote_string: req.GetQuoteString(),
+		Category:     req.GetCategory(),
+	}
+	v := validator.New()
+	if data.ValidateQuote(v, quote); !v.Valid() {
+		return nil, grpcFailedValidation(v.Errors)
+	}
+	err := s.app.models.Quote.Insert(ctx, quote)
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return quoteToProto(quote), nil
+}
+
+func (s *quoteServer) Update(ctx context.Context, req *quotesv1.UpdateQuoteRequest) (*quotesv1.Quote, error) {
+	quote, err := s.app.models.Quote.Get(ctx, req.GetId())
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	// Same conflict rule as "PATCH /v1/Quotes/:id"
+	if req.Version != nil && req.GetVersion() != quote.Version {
+		return nil, s.app.grpcError(data.ErrEditConflict)
+	}
+	if req.Author != nil {
+		quote.Author = req.GetAuthor()
+	}
+	if req.QuoteString != nil {
+		quote.Quote_string = req.GetQuoteString()
+	}
+	if req.Category != nil {
+		quote.Category = req.GetCategory().GetValues()
+	}
+
+	v := validator.New()
+	if data.ValidateQuote(v, quote); !v.Valid() {
+		return nil, grpcFailedValidation(v.Errors)
+	}
+	err = s.app.models.Quote.Update(ctx, quote)
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return quoteToProto(quote), nil
+}
+
+func (s *quoteServer) Delete(ctx context.Context, req *quotesv1.DeleteQuoteRequest) (*quotesv1.DeleteQuoteResponse, error) {
+	err := s.app.models.Quote.Delete(ctx, req.GetId())
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return &quotesv1.DeleteQuoteResponse{}, nil
+}
+
+// Watch streams changes the same way as "GET /v1/Quotes/stream"
+func (s *quoteServer) Watch(req *quotesv1.WatchQuotesRequest, stream quotesv1.QuoteService_WatchServer) error {
+	filter := data.QuoteFilter{
+		Author:       req.GetAuthor(),
+		Quote_string: req.GetQuoteString(),
+		Category:     req.GetCategory(),
+	}
+	var last data.SyncToken
+	if req.LastEventId != nil {
+		var err error
+		last, err = s.app.changeToken(stream.Context(), req.GetLastEventId())
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvalidSyncToken):
+				return grpcFailedValidation(map[string]string{"last_event_id": "must be the id of an event"})
+			default:
+				return s.app.grpcError(err)
+			}
+		}
+	}
+
+	err := s.app.watchQuoteChanges(stream.Context(), filter, last, req.LastEventId != nil,
+		// ready
+		func() error {
+			return stream.SendHeader(metadata.MD{})
+		},
+		// send
+		func(change *data.QuoteChange) error {
+			return stream.Send(&quotesv1.QuoteEvent{
+				Id:        change.ID,
+				Type:      change.EventType,
+				Quote:     quoteToProto(change.Quote),
+				Version:   change.Version,
+				CreatedAt: timestamppb.New(change.CreatedAt),
+			})
+		},
+		// idle, gRPC has its own keepalives
+		func() error {
+			return nil
+		},
+	)
+	if err != nil {
+		return s.app.grpcError(err)
+	}
+	return nil
+}
+
+type authServer struct {
+	quotesv1.UnimplementedAuthServiceServer
+	app *application
+}
+
+// CreateToken is the gRPC version of "POST /v1/tokens/authentication"
+func (s *authServer) CreateToken(ctx context.Context, req *quotesv1.CreateTokenRequest) (*quotesv1.AuthenticationToken, error) {
+	v := validator.New()
+	data.ValidateEmail(v, req.GetEmail())
+	data.ValidatePasswordPlaintext(v, req.GetPassword())
+	if !v.Valid() {
+		return nil, grpcFailedValidation(v.Errors)
+	}
+	user, err := s.app.checkCredentials(ctx, req.GetEmail(), req.GetPassword())
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	access, refresh, err := s.app.signIn(ctx, user.ID, grpcClient(ctx))
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return tokensToProto(access, refresh), nil
+}
+
+// RefreshToken is the gRPC version of "POST /v1/tokens/refresh"
+func (s *authServer) RefreshToken(ctx context.Context, req *quotesv1.RefreshTokenRequest) (*quotesv1.AuthenticationToken, error) {
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, req.GetRefreshToken()); !v.Valid() {
+		return nil, grpcFailedValidation(v.Errors)
+	}
+	access, refresh, err := s.app.refreshTokens(ctx, req.GetRefreshToken(), grpcClient(ctx))
+	if err != nil {
+		return nil, s.app.grpcError(err)
+	}
+	return tokensToProto(access, refresh), nil
+}
+
+func tokensToProto(access, refresh *data.Token) *quotesv1.AuthenticationToken {
+	return &quotesv1.AuthenticationToken{
+		Token:         access.Plaintext,
+		Expiry:        timestamppb.New(access.Expiry),
+		RefreshToken:  refresh.Plaintext,
+		RefreshExpiry: timestamppb.New(refresh.Expiry),
+	}
+}
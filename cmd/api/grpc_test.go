@@ -0,0 +1,138 @@
+// Filename: cmd/api/grpc_test.go
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"quotesapi.desireamagwula.net/internals/rpc/quotesv1"
+)
+
+// newTestGRPCClient serves app over gRPC on a loopback port, so that the
+// client address is the same as the one of the httptest servers
+func newTestGRPCClient(t *testing.T, app *application) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := app.newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func withBearer(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func TestGRPCTokens(t *testing.T) {
+	app := newTestApplication(t)
+	conn := newTestGRPCClient(t, app)
+	auth := quotesv1.NewAuthServiceClient(conn)
+	quotes := quotesv1.NewQuoteServiceClient(conn)
+	ctx := context.Background()
+	insertTestUser(t, app, "reader@example.com", "quotes:read")
+
+	_, err := auth.CreateToken(ctx, &quotesv1.CreateTokenRequest{Email: "reader@example.com", Password: "wrongpa55word"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("wrong password: got %v; want Unauthenticated", err)
+	}
+
+	first, err := auth.CreateToken(ctx, &quotesv1.CreateTokenRequest{Email: "reader@example.com", Password: "pa55word1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetToken() == "" || first.GetRefreshToken() == "" || first.GetRefreshExpiry() == nil {
+		t.Fatalf("got %v; want an authentication and a refresh token", first)
+	}
+	_, err = quotes.List(withBearer(ctx, first.GetToken()), &quotesv1.ListQuotesRequest{})
+	if err != nil {
+		t.Fatalf("list with the new token: %v", err)
+	}
+
+	second, err := auth.RefreshToken(ctx, &quotesv1.RefreshTokenRequest{RefreshToken: first.GetRefreshToken()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.GetRefreshToken() == first.GetRefreshToken() {
+		t.Error("the refresh token wasn't replaced")
+	}
+	// The new refresh token expires with the sign in, give or take the
+	// rounding of the lifetime
+	if d := first.GetRefreshExpiry().AsTime().Sub(second.GetRefreshExpiry().AsTime()); d < -time.Second || d > time.Second {
+		t.Errorf("got refresh expiry %v; want %v", second.GetRefreshExpiry().AsTime(), first.GetRefreshExpiry().AsTime())
+	}
+	_, err = quotes.List(withBearer(ctx, first.GetToken()), &quotesv1.ListQuotesRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("list with the replaced token: got %v; want Unauthenticated", err)
+	}
+	_, err = quotes.List(withBearer(ctx, second.GetToken()), &quotesv1.ListQuotesRequest{})
+	if err != nil {
+		t.Errorf("list with the refreshed token: %v", err)
+	}
+
+	// Using the first refresh token again revokes the whole family
+	_, err = auth.RefreshToken(ctx, &quotesv1.RefreshTokenRequest{RefreshToken: first.GetRefreshToken()})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("reused refresh token: got %v; want Unauthenticated", err)
+	}
+	_, err = auth.RefreshToken(ctx, &quotesv1.RefreshTokenRequest{RefreshToken: second.GetRefreshToken()})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("refresh after reuse: got %v; want Unauthenticated", err)
+	}
+	_, err = quotes.List(withBearer(ctx, second.GetToken()), &quotesv1.ListQuotesRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("list after reuse: got %v; want Unauthenticated", err)
+	}
+
+	_, err = auth.RefreshToken(ctx, &quotesv1.RefreshTokenRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("empty refresh token: got %v; want InvalidArgument", err)
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.limiter = newIPLimiter(0.001, 3)
+	conn := newTestGRPCClient(t, app)
+	auth := quotesv1.NewAuthServiceClient(conn)
+	ts := newTestServer(t, app.routes())
+	ctx := context.Background()
+
+	// The JSON API and gRPC draw from the same bucket of the client address
+	code, _, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusOK {
+		t.Fatalf("healthcheck: got status %d; want %d", code, http.StatusOK)
+	}
+	req := &quotesv1.CreateTokenRequest{Email: "nobody@example.com", Password: "pa55word1"}
+	for i := 0; i < 2; i++ {
+		_, err := auth.CreateToken(ctx, req)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("call %d: got %v; want Unauthenticated", i+1, err)
+		}
+	}
+	_, err := auth.CreateToken(ctx, req)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v; want ResourceExhausted", err)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil)
+	if code != http.StatusTooManyRequests {
+		t.Errorf("healthcheck: got status %d; want %d", code, http.StatusTooManyRequests)
+	}
+}
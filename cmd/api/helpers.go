@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 	"quotesapi.desireamagwula.net/internals/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -163,3 +164,22 @@ func (app *application) background (fn func()) {
 	}()
 }
 
+
+// humanDuration() writes d the way an email would, as "45 minutes" or
+// "2 hours", falling back on time.Duration's own format
+func humanDuration(d time.Duration) string {
+	unit := func(n int64, name string) string {
+		if n == 1 {
+			return "1 " + name
+		}
+		return strconv.FormatInt(n, 10) + " " + name + "s"
+	}
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return unit(int64(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return unit(int64(d/time.Minute), "minute")
+	default:
+		return d.String()
+	}
+}
@@ -0,0 +1,141 @@
+// Filename: cmd/api/jwt.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/jwt"
+)
+
+// accessClaims is what a JWT authentication token carries, enough to
+// authenticate the request and check its permissions without the database.
+// They are as old as the token, so deactivating a user or taking one of
+// their permissions away also revokes their tokens, see admin.go
+type accessClaims struct {
+	jwt.Claims
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+}
+
+// user returns the user that the claims describe. Only the id and the
+// activation are filled in, see loadUser()
+func (c *accessClaims) user() (*data.User, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, errInvalidAuthenticationToken
+	}
+	return &data.User{ID: id, Activated: c.Activated}, nil
+}
+
+// isJWT tells a JWT apart from the opaque tokens, which have no dots
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// newJWT signs an authentication token for the user. It is stored like an
+// opaque token, so that it shows up as a session and can be revoked, but
+// authenticate() never reads it back
+func (app *application) newJWT(ctx context.Context, m data.Models, userID int64, family string, client clientInfo) (*data.Token, error) {
+	user, err := m.Users.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	permissions, err := m.Permissions.GetAllForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	// The id makes every token unique, even two issued in the same second
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.users.accessTokenTTL).Truncate(time.Second)
+	claims := accessClaims{
+		Claims: jwt.Claims{
+			Subject:   strconv.FormatInt(user.ID, 10),
+			ID:        hex.EncodeToString(randomBytes),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiry.Unix(),
+		},
+		Activated:   user.Activated,
+		Permissions: append([]string{}, permissions...),
+	}
+	signed, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	token := &data.Token{
+		Plaintext: signed,
+		Hash:      data.HashToken(signed),
+		UserID:    user.ID,
+		Expiry:    expiry,
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+		IP:        client.ip,
+		UserAgent: client.userAgent,
+	}
+	err = m.Tokens.Insert(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// verifyJWT checks the signature, expiry and denylist of a JWT and returns
+// its claims
+func (app *application) verifyJWT(token string) (*accessClaims, error) {
+	var claims accessClaims
+	err := app.jwtKeys.Verify(token, &claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrInvalid), errors.Is(err, jwt.ErrExpired):
+			return nil, errInvalidAuthenticationToken
+		default:
+			return nil, err
+		}
+	}
+	if app.denylist.Contains(data.HashToken(token)) {
+		return nil, errInvalidAuthenticationToken
+	}
+	return &claims, nil
+}
+
+// tokensRevoked reloads the denylist after authentication tokens were
+// removed, so that this process refuses their JWTs at once. Other
+// processes hear about it from the database
+func (app *application) tokensRevoked(ctx context.Context) {
+	if app.denylist == nil {
+		return
+	}
+	err := app.denylist.Refresh(ctx)
+	if err != nil {
+		// The next reload picks them up
+		app.logger.PrintError(err, map[string]string{"worker": "denylist"})
+	}
+}
+
+// jwksHandler for the "GET /.well-known/jwks.json" endpoint. It publishes
+// the EdDSA keys that JWTs are signed with, the list is empty when tokens
+// are opaque or only HS256 keys are used
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []jwt.JWK{}
+	if app.jwtKeys != nil {
+		keys = app.jwtKeys.JWKS()
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,159 @@
+// Filename: cmd/api/jwt_test.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/jwt"
+)
+
+func TestJWTSignIn(t *testing.T) {
+	app := newTestApplication(t)
+	useJWT(t, app, testJWTKey("k1", jwt.EdDSA))
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com", "quotes:read")
+
+	access, _ := ts.signIn(t, "alice@example.com")
+	if !isJWT(access) {
+		t.Fatalf("got token %q; want a JWT", access)
+	}
+	var claims accessClaims
+	err := app.jwtKeys.Verify(access, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.Activated || fmt.Sprint(claims.Permissions) != "[quotes:read]" {
+		t.Errorf("got claims %+v", claims)
+	}
+	code, _, _ := ts.do(t, http.MethodGet, "/v1/Quotes", access, nil)
+	if code != http.StatusOK {
+		t.Errorf("got status %d; want %d", code, http.StatusOK)
+	}
+
+	// A JWT is refused once it has expired, or when it is tampered with
+	app.config.users.accessTokenTTL = -time.Minute
+	expired, _ := ts.signIn(t, "alice@example.com")
+	parts := strings.Split(access, ".")
+	parts[2] = strings.Repeat("A", len(parts[2]))
+	for name, token := range map[string]string{"expired": expired, "tampered": strings.Join(parts, ".")} {
+		code, _, _ := ts.do(t, http.MethodGet, "/v1/Quotes", token, nil)
+		if code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d; want %d", name, code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	app := newTestApplication(t)
+	useJWT(t, app, testJWTKey("k1", jwt.HS256))
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com", "quotes:read")
+	old, _ := ts.signIn(t, "alice@example.com")
+
+	// Like restarting with -jwt-key for k2 ahead of the one for k1
+	useJWT(t, app, testJWTKey("k2", jwt.EdDSA), testJWTKey("k1", jwt.HS256))
+	code, _, _ := ts.do(t, http.MethodGet, "/v1/Quotes", old, nil)
+	if code != http.StatusOK {
+		t.Errorf("token of the old key: got status %d; want %d", code, http.StatusOK)
+	}
+	access, _ := ts.signIn(t, "alice@example.com")
+	var claims accessClaims
+	err := newJWTKeySet(t, testJWTKey("k2", jwt.EdDSA)).Verify(access, &claims)
+	if err != nil {
+		t.Errorf("the new token isn't signed with the new key: %v", err)
+	}
+
+	useJWT(t, app, testJWTKey("k2", jwt.EdDSA))
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", old, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("token of a removed key: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func newJWTKeySet(t *testing.T, s string) *jwt.KeySet {
+	t.Helper()
+	key, err := jwt.ParseKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := jwt.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+// JWTs are checked without reading the tokens table, a revoked one is only
+// refused because its hash is on the denylist
+func TestJWTDenylist(t *testing.T) {
+	app := newTestApplication(t)
+	useJWT(t, app, testJWTKey("k1", jwt.EdDSA))
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com")
+	laptop, _ := ts.signIn(t, "alice@example.com")
+	phone, _ := ts.signIn(t, "alice@example.com")
+
+	// Another process, which has loaded the denylist before the revoke
+	other, err := data.NewTokenDenylist(context.Background(), app.models.Tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, body := ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/users/me/sessions/%d", ts.currentSession(t, phone)), laptop, nil)
+	if code != http.StatusOK {
+		t.Fatalf("revoke: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", phone, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("revoked JWT: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", laptop, nil)
+	if code != http.StatusOK {
+		t.Errorf("other JWT: got status %d; want %d", code, http.StatusOK)
+	}
+
+	hash := data.HashToken(phone)
+	if other.Contains(hash) {
+		t.Fatal("the other process knew about the revoke before it reloaded")
+	}
+	err = other.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.Contains(hash) {
+		t.Error("the other process doesn't refuse the revoked JWT after a reload")
+	}
+	if other.Contains(data.HashToken(laptop)) {
+		t.Error("the other process refuses a JWT that wasn't revoked")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	code, _, body := ts.do(t, http.MethodGet, "/.well-known/jwks.json", "", nil)
+	if keys, ok := body["keys"].([]interface{}); code != http.StatusOK || !ok || len(keys) != 0 {
+		t.Errorf("opaque tokens: got status %d and %v; want no keys", code, body)
+	}
+
+	useJWT(t, app, testJWTKey("hs", jwt.HS256), testJWTKey("ed", jwt.EdDSA))
+	code, _, body = ts.do(t, http.MethodGet, "/.well-known/jwks.json", "", nil)
+	keys, _ := body["keys"].([]interface{})
+	if code != http.StatusOK || len(keys) != 1 {
+		t.Fatalf("got status %d and %v; want the EdDSA key", code, body)
+	}
+	key := keys[0].(map[string]interface{})
+	if key["kid"] != "ed" || key["kty"] != "OKP" || key["alg"] != jwt.EdDSA || key["x"] == "" {
+		t.Errorf("got key %v", key)
+	}
+	if _, ok := key["d"]; ok {
+		t.Errorf("got the private key in %v", key)
+	}
+}
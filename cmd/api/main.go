@@ -5,16 +5,22 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/graphql-go/graphql"
 	_ "github.com/lib/pq"
+	"quotesapi.desireamagwula.net/internals/cache"
 	"quotesapi.desireamagwula.net/internals/data"
 	"quotesapi.desireamagwula.net/internals/jsonlog"
+	"quotesapi.desireamagwula.net/internals/jwt"
 	"quotesapi.desireamagwula.net/internals/mailer"
+	"quotesapi.desireamagwula.net/internals/webhook"
 )
 
 const version = "1.0.0"
@@ -23,12 +29,31 @@ const version = "1.0.0"
 
 type config struct {
 	port int
-	env  string // development, staging, production, etc.
-	db   struct {
+	grpc struct {
+		port int // 0 turns the gRPC server off
+	}
+	env string // development, staging, production, etc.
+	db  struct {
 		dsn          string
+		driver       string // worked out from the scheme of the dsn
+		source       string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		migrate      string
+		timeout      time.Duration
+		timeouts     map[string]time.Duration // per operation, see data.Options
+		replicas     struct {
+			dsns           []string
+			maxLag         time.Duration
+			readYourWrites time.Duration // how long a client that wrote reads from the primary
+		}
+	}
+	cache struct {
+		store          string // none, lru or a redis:// URL
+		size           int
+		ttl            time.Duration
+		permissionsTTL time.Duration // 0 turns the permission cache off
 	}
 	limiter struct {
 		rps     float64 // requests/second
@@ -45,26 +70,94 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	users struct {
+		defaultRole        string        // given to users at registration, none if empty
+		activationResend   time.Duration // how often an activation or password reset email can be sent to one address
+		passwordResetTTL   time.Duration // how long a password reset token lasts
+		activationWindow   time.Duration // how long until an account that isn't activated is removed, 0 to keep them
+		sessionFlush       time.Duration // how often the last use of each session is saved
+		accessTokenTTL     time.Duration // how long an authentication token lasts
+		refreshTokenTTL    time.Duration // how long a sign in can be kept up with refresh tokens
+		tokenFormat        string        // opaque or jwt
+		jwtKeys            []string      // kid:alg:base64, the first one signs
+		jwtDenylistRefresh time.Duration // how often the denylist of revoked JWTs is reloaded
+	}
+	webhooks struct {
+		enabled      bool
+		pollInterval time.Duration
+		batchSize    int
+		maxAttempts  int
+		backoffBase  time.Duration
+		backoffMax   time.Duration
+		timeout      time.Duration
+		retention    time.Duration // 0 keeps every event
+	}
+}
+
+// mailSender is the part of mailer.Mailer that the handlers use, so that
+// the tests can keep the emails instead of sending them
+type mailSender interface {
+	Send(recipient, templateFile string, data interface{}) error
 }
 
 // DEpendency injection
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailSender
+	sender  webhook.Sender
+	changes *data.ChangeListener
+	// nil unless -db-replica-dsn was given
+	replicas *data.ReplicaSet
+	// nil unless -cache was given
+	quoteCache *data.CachedQuotes
+	// nil if -permissions-cache-ttl is 0
+	permissionCache *data.CachedPermissions
+	// Rate limits both the JSON API and gRPC per client IP address
+	limiter *ipLimiter
+	// Throttle POST /v1/tokens/activation and /v1/tokens/password-reset
+	// per email address
+	activationThrottle    *throttle
+	passwordResetThrottle *throttle
+	// Uses of authentication tokens that haven't been saved yet
+	sessions *sessionTracker
+	// nil unless -token-format is jwt
+	jwtKeys  *jwt.KeySet
+	denylist *data.TokenDenylist
+	// The schema served by POST /v1/graphql
+	graphqlSchema graphql.Schema
+	wg            sync.WaitGroup
 }
 
 func main() {
 	var cfg config
 	// read in the flags that are needed to populate our config
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
+	flag.IntVar(&cfg.grpc.port, "grpc-port", 4001, "gRPC server port (0 to disable)")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development | staging | production)")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("QUOTES_DB_DSN"), "Postgresql DSN")
+	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("QUOTES_DB_DSN"), "Postgresql DSN, or sqlite:PATH for SQLite")
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "Postgresql max open CONNECTIONS")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "Postgresql idle open CONNECTIONS")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgresQL max connection idle time")
+	flag.StringVar(&cfg.db.migrate, "migrate", "", "Migrate the database and exit (up | down | status | to=N)")
+	flag.DurationVar(&cfg.db.timeout, "db-timeout", data.DefaultTimeout, "Timeout for a single database operation")
+	flag.Func("db-replica-dsn", "Postgresql DSN of a read replica (repeatable)", func(val string) error {
+		cfg.db.replicas.dsns = append(cfg.db.replicas.dsns, val)
+		return nil
+	})
+	flag.DurationVar(&cfg.db.replicas.maxLag, "db-replica-max-lag", 10*time.Second, "Replication lag at which a replica stops taking reads")
+	flag.DurationVar(&cfg.db.replicas.readYourWrites, "db-read-your-writes", 5*time.Second, "How long a client that wrote reads from the primary")
+	flag.Func("db-timeouts", "Timeouts for single database operations, such as \"quotes.GetAll=10s\" (space separated)", func(val string) error {
+		var err error
+		cfg.db.timeouts, err = data.ParseTimeouts(val)
+		return err
+	})
+	// These are flags for the quote cache
+	flag.StringVar(&cfg.cache.store, "cache", "none", "Cache for quote reads (none | lru | redis://[:password@]host[:port][/db])")
+	flag.IntVar(&cfg.cache.size, "cache-size", 10000, "Entries kept by the lru cache")
+	flag.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "How long a cached quote read is kept")
+	flag.DurationVar(&cfg.cache.permissionsTTL, "permissions-cache-ttl", 10*time.Second, "How long a user's permissions are cached (0 to disable)")
 	// These are flags for the rate limiter
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
@@ -76,6 +169,30 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "30af5426f69429", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "AppleTree <no-reply@Appletree.desireamagwula.net>", "SMTP sender")
 
+	// These are our flags for the webhook delivery worker
+	flag.BoolVar(&cfg.webhooks.enabled, "webhooks-enabled", true, "Run the webhook delivery worker")
+	flag.DurationVar(&cfg.webhooks.pollInterval, "webhooks-poll-interval", 2*time.Second, "How often the webhook worker checks for new events")
+	flag.IntVar(&cfg.webhooks.batchSize, "webhooks-batch-size", 50, "Webhook deliveries sent per poll")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Attempts before a delivery is dead-lettered")
+	flag.DurationVar(&cfg.webhooks.backoffBase, "webhooks-backoff-base", 10*time.Second, "Delay before the first webhook retry")
+	flag.DurationVar(&cfg.webhooks.backoffMax, "webhooks-backoff-max", time.Hour, "Maximum delay between webhook retries")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhooks-timeout", 10*time.Second, "Timeout for a single webhook request")
+	flag.DurationVar(&cfg.webhooks.retention, "webhooks-retention", 30*24*time.Hour, "How long finished webhook events and their deliveries are kept (0 to keep them)")
+
+	flag.StringVar(&cfg.users.defaultRole, "default-role", "viewer", "Role given to new users at registration (empty for none)")
+	flag.DurationVar(&cfg.users.activationResend, "activation-resend-interval", 5*time.Minute, "How often an activation or a password reset email can be requested for one address")
+	flag.DurationVar(&cfg.users.passwordResetTTL, "password-reset-ttl", 45*time.Minute, "Lifetime of a password reset token")
+	flag.DurationVar(&cfg.users.activationWindow, "activation-window", 7*24*time.Hour, "How long a new account has to be activated before it is removed (0 to keep them)")
+	flag.DurationVar(&cfg.users.sessionFlush, "session-flush-interval", time.Minute, "How often the last use of each session is saved")
+	flag.DurationVar(&cfg.users.accessTokenTTL, "access-token-ttl", 15*time.Minute, "Lifetime of an authentication token")
+	flag.DurationVar(&cfg.users.refreshTokenTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of a refresh token, and so of a sign in")
+	flag.StringVar(&cfg.users.tokenFormat, "token-format", "opaque", "Format of authentication tokens (opaque | jwt)")
+	flag.Func("jwt-key", "Key to sign JWTs with, as kid:alg:base64 with alg EdDSA or HS256 (repeat to keep old keys, the first one signs)", func(val string) error {
+		cfg.users.jwtKeys = append(cfg.users.jwtKeys, val)
+		return nil
+	})
+	flag.DurationVar(&cfg.users.jwtDenylistRefresh, "jwt-denylist-refresh", 30*time.Second, "How often the denylist of revoked JWTs is reloaded")
+
 	//Use the flag.Func funtion to parse our trusted origin flag from a string to a string slice
 	flag.Func("cors-trusted-origins", "Trusted CORS origin (space seperated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
@@ -86,6 +203,7 @@ func main() {
 
 	// create a logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	cfg.db.driver, cfg.db.source = data.ParseDSN(cfg.db.dsn)
 	// CReate the connection pool
 	db, err := openDB(cfg)
 	if err != nil {
@@ -94,14 +212,93 @@ func main() {
 
 	defer db.Close()
 	// LOg the succesful
-	logger.PrintInfo("database connection pool established", nil)
+	logger.PrintInfo("database connection pool established", map[string]string{
+		"driver": cfg.db.driver,
+	})
+
+	if cfg.db.migrate != "" {
+		err = runMigrations(db, cfg.db.driver, cfg.db.migrate, logger)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+	err = checkSchemaVersion(db, cfg.db.driver)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	replicas, err := openReplicas(cfg, db, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	models := data.NewModelsFor(cfg.db.driver, db, data.Options{
+		Timeout:  cfg.db.timeout,
+		Timeouts: cfg.db.timeouts,
+		Observe:  observeDBOperation,
+		Replicas: replicas,
+	})
+
+	err = checkDefaultRole(cfg, models)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	quoteCache, err := openQuoteCache(cfg, &models)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	permissionCache, err := openPermissionCache(cfg, &models, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	jwtKeys, denylist, err := openJWT(cfg, models, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Follow the change log. The trigger on the quotes table sends a
+	// notification for every change, SQLite can't, so its log is polled
+	onListenerError := func(err error) {
+		logger.PrintError(err, map[string]string{"listener": data.QuoteChangesChannel})
+	}
+	var changes *data.ChangeListener
+	if cfg.db.driver == data.DriverSQLite {
+		changes, err = data.NewPollingChangeListener(context.Background(), models.Changes, time.Second, onListenerError)
+	} else {
+		changes, err = data.NewChangeListener(context.Background(), cfg.db.dsn, models.Changes, time.Second, onListenerError)
+	}
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 
 	//create an instancr of application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:                cfg,
+		logger:                logger,
+		models:                models,
+		mailer:                mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		sender:                webhook.New(nil, cfg.webhooks.timeout, "quotesapi-webhooks/"+version),
+		changes:               changes,
+		replicas:              replicas,
+		quoteCache:            quoteCache,
+		permissionCache:       permissionCache,
+		limiter:               newIPLimiter(cfg.limiter.rps, cfg.limiter.burst),
+		activationThrottle:    newThrottle(cfg.users.activationResend),
+		passwordResetThrottle: newThrottle(cfg.users.activationResend),
+		sessions:              newSessionTracker(),
+		jwtKeys:               jwtKeys,
+		denylist:              denylist,
+	}
+
+	if quoteCache != nil {
+		app.publishCacheStats()
+	}
+
+	app.graphqlSchema, err = app.newGraphQLSchema()
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
 
 	// Call app.serve to start the server
@@ -111,20 +308,18 @@ func main() {
 	}
 }
 
-// The openDB funtion returns a *sql.DB connection pool
+// The openDB funtion returns a *sql.DB connection pool for the driver that
+// was picked by the DSN
 
 func openDB(cfg config) (*sql.DB, error) {
-	db, err := sql.Open("postgres", cfg.db.dsn)
+	db, err := sql.Open(cfg.db.driver, cfg.db.source)
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(cfg.db.maxOpenConns)
-	db.SetMaxIdleConns(cfg.db.maxIdleConns)
-	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	err = setPoolLimits(db, cfg)
 	if err != nil {
 		return nil, err
 	}
-	db.SetConnMaxIdleTime(duration)
 	// Create a context with a 5-second timeout timeline
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -135,3 +330,166 @@ func openDB(cfg config) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+// setPoolLimits applies the -db-max-* settings to a pool
+func setPoolLimits(db *sql.DB, cfg config) error {
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	if err != nil {
+		return err
+	}
+	db.SetConnMaxIdleTime(duration)
+	return nil
+}
+
+// openReplicas opens a pool for every -db-replica-dsn. It returns nil if
+// there are none. A replica that can't be reached yet isn't fatal, it
+// stays out of rotation until a health check passes
+func openReplicas(cfg config, primary *sql.DB, logger *jsonlog.Logger) (*data.ReplicaSet, error) {
+	if len(cfg.db.replicas.dsns) == 0 {
+		return nil, nil
+	}
+	if cfg.db.driver != data.DriverPostgres {
+		return nil, errors.New("read replicas are only supported with Postgresql")
+	}
+	dbs := make(map[string]*sql.DB)
+	for i, dsn := range cfg.db.replicas.dsns {
+		driver, source := data.ParseDSN(dsn)
+		if driver != cfg.db.driver {
+			return nil, fmt.Errorf("replica %d is not a Postgresql DSN", i+1)
+		}
+		db, err := sql.Open(driver, source)
+		if err != nil {
+			return nil, err
+		}
+		err = setPoolLimits(db, cfg)
+		if err != nil {
+			return nil, err
+		}
+		dbs[fmt.Sprintf("replica-%d", i+1)] = db
+	}
+	replicas := data.NewReplicaSet(primary, dbs)
+	replicas.MaxLag = cfg.db.replicas.maxLag
+	replicas.OnChange = func(name string, healthy bool, err error) {
+		if healthy {
+			logger.PrintInfo("replica is taking reads", map[string]string{"replica": name})
+			return
+		}
+		logger.PrintError(err, map[string]string{"replica": name})
+	}
+	return replicas, nil
+}
+
+// openQuoteCache puts the -cache store in front of the quote reads of
+// models. It returns nil if caching is off
+func openQuoteCache(cfg config, models *data.Models) (*data.CachedQuotes, error) {
+	var store cache.Store
+	switch {
+	case cfg.cache.store == "none" || cfg.cache.store == "":
+		return nil, nil
+	case cfg.cache.store == "lru":
+		if cfg.cache.size <= 0 {
+			return nil, errors.New("-cache-size must be greater than zero")
+		}
+		store = cache.NewLRU(cfg.cache.size)
+	case strings.HasPrefix(cfg.cache.store, "redis://"):
+		redis, err := cache.NewRedis(cfg.cache.store)
+		if err != nil {
+			return nil, err
+		}
+		store = redis
+	default:
+		return nil, fmt.Errorf("unknown cache %q", cfg.cache.store)
+	}
+	quotes, err := data.NewCachedQuotes(models.Quote, store, cfg.cache.ttl)
+	if err != nil {
+		return nil, err
+	}
+	models.Quote = quotes
+	return quotes, nil
+}
+
+// openPermissionCache caches the permissions of users for
+// -permissions-cache-ttl. With Postgres the cache also hears about the
+// changes made by other processes, such as quotesctl
+func openPermissionCache(cfg config, models *data.Models, logger *jsonlog.Logger) (*data.CachedPermissions, error) {
+	if cfg.cache.permissionsTTL <= 0 {
+		return nil, nil
+	}
+	permissions := data.NewCachedPermissions(models.Permissions, cfg.cache.permissionsTTL)
+	if cfg.db.driver == data.DriverPostgres {
+		err := permissions.Listen(cfg.db.dsn, func(err error) {
+			logger.PrintError(err, map[string]string{"listener": data.PermissionChangesChannel})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	models.Permissions = permissions
+	return permissions, nil
+}
+
+// openJWT reads the -jwt-key flags and loads the denylist when tokens are
+// issued as JWTs. With Postgres the denylist also hears about the tokens
+// revoked by other processes at once, with SQLite it waits for a reload
+func openJWT(cfg config, models data.Models, logger *jsonlog.Logger) (*jwt.KeySet, *data.TokenDenylist, error) {
+	switch cfg.users.tokenFormat {
+	case "opaque":
+		return nil, nil, nil
+	case "jwt":
+	default:
+		return nil, nil, fmt.Errorf("-token-format: unknown format %q", cfg.users.tokenFormat)
+	}
+	if len(cfg.users.jwtKeys) == 0 {
+		return nil, nil, errors.New("-token-format=jwt needs at least one -jwt-key")
+	}
+	var keys []*jwt.Key
+	for _, s := range cfg.users.jwtKeys {
+		key, err := jwt.ParseKey(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-jwt-key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	keySet, err := jwt.NewKeySet(keys...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	denylist, err := data.NewTokenDenylist(ctx, models.Tokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.db.driver == data.DriverPostgres {
+		err := denylist.Listen(cfg.db.dsn, func(err error) {
+			logger.PrintError(err, map[string]string{"listener": data.TokenDenylistChannel})
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return keySet, denylist, nil
+}
+
+// checkDefaultRole makes sure that -default-role exists, registration
+// would otherwise leave new users without any permissions
+func checkDefaultRole(cfg config, models data.Models) error {
+	if cfg.users.defaultRole == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	roles, err := models.Permissions.GetRoles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if role.Name == cfg.users.defaultRole {
+			return nil
+		}
+	}
+	return fmt.Errorf("-default-role: unknown role %q", cfg.users.defaultRole)
+}
@@ -0,0 +1,77 @@
+// Filename: cmd/api/metrics.go
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The database metrics are published by expvar and served on
+// "GET /debug/vars". database_operations counts every operation by its
+// outcome, database_operations_by_name does the same for each operation
+// and database_operation_time_us adds up how long they took
+var (
+	dbOperations       = expvar.NewMap("database_operations")
+	dbOperationsByName = expvar.NewMap("database_operations_by_name")
+	dbOperationTime    = expvar.NewMap("database_operation_time_us")
+	dbOperationsMu     sync.Mutex
+)
+
+// metricNames are the expvar variables that "GET /debug/vars" serves. The
+// handler of the expvar package isn't used, it serves every variable and
+// those include cmdline, which has the passwords and keys of the flags
+var metricNames = []string{
+	"database_operations",
+	"database_operations_by_name",
+	"database_operation_time_us",
+	"quote_cache",
+}
+
+// metricsHandler for the "GET /debug/vars" endpoint
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	first := true
+	for _, name := range metricNames {
+		v := expvar.Get(name)
+		if v == nil {
+			continue
+		}
+		if !first {
+			buf.WriteString(",")
+		}
+		first = false
+		fmt.Fprintf(&buf, "\n%q: %s", name, v.String())
+	}
+	buf.WriteString("\n}\n")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// publishCacheStats serves the hit, miss and error counts of the quote
+// cache as "quote_cache"
+func (app *application) publishCacheStats() {
+	expvar.Publish("quote_cache", expvar.Func(func() interface{} {
+		return app.quoteCache.Stats()
+	}))
+}
+
+// observeDBOperation is handed to the models as data.Options.Observe
+func observeDBOperation(op, outcome string, duration time.Duration) {
+	dbOperations.Add(outcome, 1)
+	dbOperationTime.Add(op, duration.Microseconds())
+
+	dbOperationsMu.Lock()
+	outcomes, ok := dbOperationsByName.Get(op).(*expvar.Map)
+	if !ok {
+		outcomes = new(expvar.Map)
+		dbOperationsByName.Set(op, outcomes)
+	}
+	dbOperationsMu.Unlock()
+	outcomes.Add(outcome, 1)
+}
@@ -0,0 +1,47 @@
+// Filename: cmd/api/metrics_test.go
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read")
+	_, admin := insertTestUser(t, app, "admin@example.com", "users:manage")
+
+	code, _, _ := ts.do(t, http.MethodGet, "/debug/vars", "", nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("anonymous: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, "/debug/vars", reader, nil)
+	if code != http.StatusForbidden {
+		t.Errorf("reader: got status %d; want %d", code, http.StatusForbidden)
+	}
+
+	code, _, body := ts.do(t, http.MethodGet, "/debug/vars", admin, nil)
+	if code != http.StatusOK {
+		t.Fatalf("admin: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	// cmdline has the flags, and with them the passwords and keys
+	for _, name := range []string{"cmdline", "memstats"} {
+		if _, ok := body[name]; ok {
+			t.Errorf("got %s in the metrics", name)
+		}
+	}
+	for name := range body {
+		known := false
+		for _, metric := range metricNames {
+			known = known || name == metric
+		}
+		if !known {
+			t.Errorf("got %s; want only the metrics of the API", name)
+		}
+	}
+	if _, ok := body["database_operations"]; !ok {
+		t.Errorf("got %v; want database_operations", body)
+	}
+}
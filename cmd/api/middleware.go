@@ -3,15 +3,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
 	"quotesapi.desireamagwula.net/internals/data"
 	"quotesapi.desireamagwula.net/internals/validator"
 )
@@ -28,32 +28,9 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// rateLimit() checks the client IP address against app.limiter, which the
+// gRPC server uses as well
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Create a client type
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-	// Launch a backaground Goroutine that removes old entries
-	// from the clients map once every minute
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			// Lock before starting to cleanup
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.config.limiter.enabled {
 			// Get the IP address of the request
@@ -62,30 +39,53 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 				app.serverErrorResponse(w, r, err)
 				return
 			}
-			// Lock()
-			mu.Lock()
-			// Check if the IP address is in the map
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(
-					rate.Limit(app.config.limiter.rps),
-					app.config.limiter.burst,
-				)}
-			}
-			// Update the last seen time of the client
-			clients[ip].lastSeen = time.Now()
-			// Check if request allowed
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			if !app.limiter.allow(ip) {
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			mu.Unlock()
 		} // end of enabled conditional
 		next.ServeHTTP(w, r)
 	})
 }
 
+var errInvalidAuthenticationToken = errors.New("invalid authentication token")
+
+// userForToken looks up the user that a bearer token belongs to and
+// records the use for the session list. It is shared by authenticate()
+// and the gRPC interceptors. A JWT is checked without the database and
+// comes back with its claims, opaque tokens are still accepted so that the
+// sessions from before -token-format=jwt keep working
+func (app *application) userForToken(ctx context.Context, token string, client clientInfo) (*data.User, *accessClaims, error) {
+	if app.jwtKeys != nil && isJWT(token) {
+		claims, err := app.verifyJWT(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		user, err := claims.user()
+		if err != nil {
+			return nil, nil, err
+		}
+		app.sessions.record(token, client)
+		return user, claims, nil
+	}
+	// Validate the token
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, nil, errInvalidAuthenticationToken
+	}
+	user, err := app.models.Users.GetForToken(ctx, data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil, errInvalidAuthenticationToken
+		default:
+			return nil, nil, err
+		}
+	}
+	app.sessions.record(token, client)
+	return user, nil, nil
+}
+
 // Authentication
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -96,7 +96,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		authorizationHeader := r.Header.Get("Authorization")
 		// If no authorization found, then we will create an anonymous user
 		if authorizationHeader == "" {
-			r = app.contextSetUser(r, data.AnonymousUser)
+			r = app.contextSetUser(r, data.AnonymousUser, nil)
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -108,17 +108,11 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the token
 		token := headerParts[1]
-		// Validate the token
-		v := validator.New()
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
 		// Retrieve detials about the user
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, claims, err := app.userForToken(r.Context(), token, requestClient(r))
 		if err != nil {
 			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
+			case errors.Is(err, errInvalidAuthenticationToken):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
 				app.serverErrorResponse(w, r, err)
@@ -127,7 +121,8 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		// Add the user information to the request context
-		r = app.contextSetUser(r, user)
+		r = app.contextSetUser(r, user, claims)
+		r = app.contextSetToken(r, token)
 		// Call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
@@ -161,12 +156,40 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// The reasons that checkPermission() can refuse a user
+var (
+	errAuthenticationRequired = errors.New("authentication required")
+	errInactiveAccount        = errors.New("inactive account")
+	errNotPermitted           = errors.New("not permitted")
+)
+
+// checkPermission performs the same checks as requirePermission for code
+// that isn't an HTTP handler, such as the GraphQL resolvers
+func (app *application) checkPermission(ctx context.Context, user *data.User, code string) error {
+	if user.IsAnonymous() {
+		return errAuthenticationRequired
+	}
+	if !user.Activated {
+		return errInactiveAccount
+	}
+	if code == "" {
+		return nil
+	}
+	permissions, err := app.permissionsFor(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !permissions.Include(code) {
+		return errNotPermitted
+	}
+	return nil
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// get the user
-		user := app.contextGetUser(r)
-		// get the permission slice for the user
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		// get the permission slice for the user, which is cached in the
+		// request context for any further checks
+		permissions, err := app.contextGetPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -183,6 +206,80 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// The read-your-writes deadline is handed to clients as unix milliseconds,
+// in a header for API clients and a cookie for browsers
+const (
+	primaryUntilHeader = "X-Primary-Until"
+	primaryUntilCookie = "primary_until"
+)
+
+// readYourWrites sends every request that writes, and every read from a
+// client that wrote in the last -db-read-your-writes, to the primary. A
+// client that just created a quote can then always read it back, however
+// far behind the replicas are
+func (app *application) readYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.replicas == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if time.Now().Before(primaryUntil(r, app.config.db.replicas.readYourWrites)) {
+				r = r.WithContext(data.WithPrimary(r.Context()))
+			}
+		default:
+			// Set before the handler runs, the headers can't change once
+			// it has written the response
+			until := time.Now().Add(app.config.db.replicas.readYourWrites)
+			value := strconv.FormatInt(until.UnixMilli(), 10)
+			w.Header().Set(primaryUntilHeader, value)
+			http.SetCookie(w, &http.Cookie{
+				Name:     primaryUntilCookie,
+				Value:    value,
+				Path:     "/",
+				Expires:  until,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			r = r.WithContext(data.WithPrimary(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// primaryUntil returns the read-your-writes deadline that the client sent
+// back, or the zero time
+func primaryUntil(r *http.Request, window time.Duration) time.Time {
+	value := r.Header.Get(primaryUntilHeader)
+	if value == "" {
+		if cookie, err := r.Cookie(primaryUntilCookie); err == nil {
+			value = cookie.Value
+		}
+	}
+	return parsePrimaryUntil(value, window)
+}
+
+// parsePrimaryUntil() reads a deadline in unix milliseconds. The client can
+// send anything, so a deadline in the past is ignored and one that is
+// further away than window is cut back to it, or a client could keep every
+// read it makes off the replicas
+func parsePrimaryUntil(value string, window time.Duration) time.Time {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	now := time.Now()
+	until := time.UnixMilli(ms)
+	switch {
+	case !until.After(now):
+		return time.Time{}
+	case until.After(now.Add(window)):
+		return now.Add(window)
+	}
+	return until
+}
+
 // Enable CORS
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
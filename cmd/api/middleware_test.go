@@ -0,0 +1,42 @@
+// Filename: cmd/api/middleware_test.go
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePrimaryUntil(t *testing.T) {
+	const window = 5 * time.Second
+	ms := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)
+	}
+	tests := []struct {
+		name  string
+		value string
+		// The deadline has to be about this far away, or zero if it is 0
+		want time.Duration
+	}{
+		{"inside the window", ms(2 * time.Second), 2 * time.Second},
+		{"far in the future", ms(365 * 24 * time.Hour), window},
+		{"in the past", ms(-time.Second), 0},
+		{"not a number", "soon", 0},
+		{"missing", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until := parsePrimaryUntil(tt.value, window)
+			if tt.want == 0 {
+				if !until.IsZero() {
+					t.Errorf("got %v; want the zero time", until)
+				}
+				return
+			}
+			if d := time.Until(until); d > tt.want || d < tt.want-time.Second {
+				t.Errorf("got a deadline %v away; want %v", d, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Filename: cmd/api/migrate.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"quotesapi.desireamagwula.net/internals/jsonlog"
+	"quotesapi.desireamagwula.net/internals/migrate"
+	"quotesapi.desireamagwula.net/migrations"
+)
+
+// runMigrations handles the -migrate=up|down|status|to=N flag. The server
+// doesn't start in this mode
+func runMigrations(db *sql.DB, driver, mode string, logger *jsonlog.Logger) error {
+	migrator, err := migrate.New(db, driver, migrations.For(driver))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch {
+	case mode == "up":
+		err = migrator.Up(ctx)
+	case mode == "down":
+		err = migrator.Down(ctx)
+	case strings.HasPrefix(mode, "to="):
+		var target uint64
+		target, err = strconv.ParseUint(strings.TrimPrefix(mode, "to="), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid -migrate value %q", mode)
+		}
+		err = migrator.To(ctx, uint(target))
+	case mode == "status":
+	default:
+		return fmt.Errorf("invalid -migrate value %q, expected up, down, status or to=N", mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	current, dirty, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if mode == "status" {
+		for _, m := range migrator.Migrations() {
+			state := "pending"
+			if m.Version <= current {
+				state = "applied"
+			}
+			logger.PrintInfo("migration", map[string]string{
+				"version": strconv.FormatUint(uint64(m.Version), 10),
+				"name":    m.Name,
+				"state":   state,
+			})
+		}
+	}
+	logger.PrintInfo("schema version", map[string]string{
+		"version":  strconv.FormatUint(uint64(current), 10),
+		"expected": strconv.FormatUint(uint64(migrator.Latest()), 10),
+		"dirty":    strconv.FormatBool(dirty),
+	})
+	return nil
+}
+
+// checkSchemaVersion stops the server from running against a database that
+// hasn't been migrated to the version that this binary was built for
+func checkSchemaVersion(db *sql.DB, driver string) error {
+	migrator, err := migrate.New(db, driver, migrations.For(driver))
+	if err != nil {
+		return err
+	}
+	current, dirty, err := migrator.Version(context.Background())
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("schema version %d is dirty: %w", current, migrate.ErrDirty)
+	}
+	if current != migrator.Latest() {
+		return fmt.Errorf("schema version is %d but this binary expects %d, migrate with -migrate=to=%d", current, migrator.Latest(), migrator.Latest())
+	}
+	return nil
+}
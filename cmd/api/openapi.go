@@ -0,0 +1,90 @@
+// Filename: cmd/api/openapi.go
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The OpenAPI 3.1 description of every route in routes.go. Keep it in step
+// with the handlers, TestOpenAPI fails if a route is missing
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler for the "GET /v1/openapi.json" endpoint
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// routeTable records every route registered on the router so that they can
+// be compared with the OpenAPI document
+type routeTable struct {
+	*httprouter.Router
+	routes []string
+}
+
+func (t *routeTable) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	t.routes = append(t.routes, method+" "+path)
+	t.Router.HandlerFunc(method, path, handler)
+}
+
+// checkOpenAPI() returns an error listing the routes that are missing from
+// the OpenAPI document, and the documented operations that no route serves
+func (t *routeTable) checkOpenAPI(spec []byte) error {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(spec, &doc)
+	if err != nil {
+		return fmt.Errorf("openapi.json: %w", err)
+	}
+
+	documented := make(map[string]bool)
+	var problems []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			method = strings.ToUpper(method)
+			if method == "PARAMETERS" {
+				continue
+			}
+			documented[method+" "+path] = true
+			// Paths such as /v1/Quotes/stream are served by a wildcard
+			// route, so ask the router rather than comparing strings
+			handle, _, _ := t.Lookup(method, strings.NewReplacer("{", "", "}", "").Replace(path))
+			if handle == nil {
+				problems = append(problems, method+" "+path+" is documented but not routed")
+			}
+		}
+	}
+	for _, route := range t.routes {
+		method, path, _ := strings.Cut(route, " ")
+		if !documented[method+" "+openAPIPath(path)] {
+			problems = append(problems, route+" is routed but not documented")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("openapi.json is out of date: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// openAPIPath() turns httprouter's /v1/Quotes/:id into /v1/Quotes/{id}
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,55 @@
+// Filename: cmd/api/openapi_test.go
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestOpenAPI(t *testing.T) {
+	app := newTestApplication(t)
+	err := app.router().checkOpenAPI(openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOpenAPI(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	router := &routeTable{Router: httprouter.New()}
+	router.HandlerFunc(http.MethodGet, "/v1/Quotes/:id", noop)
+	router.HandlerFunc(http.MethodDelete, "/v1/Quotes/:id", noop)
+
+	spec, err := json.Marshal(map[string]interface{}{
+		"paths": map[string]interface{}{
+			"/v1/Quotes/{id}": map[string]interface{}{
+				"parameters": []interface{}{},
+				"get":        map[string]interface{}{},
+				"patch":      map[string]interface{}{},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = router.checkOpenAPI(spec)
+	if err == nil {
+		t.Fatal("checkOpenAPI() = nil, want an error")
+	}
+	for _, want := range []string{
+		"DELETE /v1/Quotes/:id is routed but not documented",
+		"PATCH /v1/Quotes/{id} is documented but not routed",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("checkOpenAPI() = %q, want it to mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "GET") {
+		t.Errorf("checkOpenAPI() = %q, want GET to match", err)
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"quotesapi.desireamagwula.net/internals/validator"
 )
 
-// CreatequoteHandler for the POST /v1/quotes" endpoint
+// CreatequoteHandler for the "POST /v1/Quotes" endpoint
 
 func (app *application) createQuoteHandler(w http.ResponseWriter, r *http.Request) {
 	// Our target decode destination fmt.Fprintln(w, "create a new quote..")
@@ -43,7 +43,7 @@ func (app *application) createQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// CReate a quote
-	err = app.models.Quote.Insert(quote)
+	err = app.models.Quote.Insert(r.Context(), quote)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -70,7 +70,7 @@ func (app *application) showQuoteHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Fetch the specific quote
-	quote, err := app.models.Quote.Get(id)
+	quote, err := app.models.Quote.Get(r.Context(), id)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -99,7 +99,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// Fetch the orginal record from the database
-	quote, err := app.models.Quote.Get(id)
+	quote, err := app.models.Quote.Get(r.Context(), id)
 	// Handle errors
 	if err != nil {
 		switch {
@@ -119,6 +119,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		Author    *string  `json:"author"`
 		Quote_string   *string  `json:"quote_string"`
 		Category    []string `json:"category"`
+		Version   *int32   `json:"version"`
 	}
 
 	// Initialize a new json.Decoder instance
@@ -127,6 +128,13 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		app.badRequestResponse(w, r, err)
 		return
 	}
+	// If the client says which version its edit is based on, and that is no
+	// longer the current version, the server wins and the client gets the
+	// current quote back so that it can resolve the conflict
+	if input.Version != nil && *input.Version != quote.Version {
+		app.staleVersionResponse(w, r, envelope{"quote": quote})
+		return
+	}
 	// Check for updates
 	if input.Author != nil {
 		quote.Author = *input.Author
@@ -149,7 +157,7 @@ func (app *application) updateQuoteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	// Let's pass the updated quote record to the Update() method
-	err = app.models.Quote.Update(quote)
+	err = app.models.Quote.Update(r.Context(), quote)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -177,7 +185,7 @@ func (app *application) deleteQuoteHandler(w http.ResponseWriter, r *http.Reques
 	// Delete the quote from the Database. Send a 404 not found status cide to the client
 	// if not found
 
-	err = app.models.Quote.Delete(id)
+	err = app.models.Quote.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -196,6 +204,9 @@ func (app *application) deleteQuoteHandler(w http.ResponseWriter, r *http.Reques
 
 }
 
+// The sort values that are allowed when listing quotes
+var quoteSortList = []string{"id", "author", "quote_string", "-id", "-author", "-quote_string"}
+
 // Allows the client to see a listing of quotes based on a set of criterias
 
 func (app *application) listQuotesHandler(w http.ResponseWriter, r *http.Request) {
@@ -219,20 +230,22 @@ func (app *application) listQuotesHandler(w http.ResponseWriter, r *http.Request
 	// Get the sort info
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// Specify the allowed sort values
-	input.Filters.SortList = []string{"id", "author", "quote_string", "-id", "-author", "-quote_string"}
+	input.Filters.SortList = quoteSortList
 	// CHeck for validation error
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	// Get a listing of all quotes
-	quotes, metadata, err := app.models.Quote.GetAll(input.Author, input.Quote_string, input.Category, input.Filters)
+	quotes, metadata, err := app.models.Quote.GetAll(r.Context(), input.Author, input.Quote_string, input.Category, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Send a JSON response containing all the quotes
-	err = app.writeJSON(w, http.StatusOK, envelope{"quotes": quotes, "metadata ": metadata}, nil)
+	// Send a JSON response containing all the quotes. The key used to be
+	// "metadata " with a trailing space, it is sent as well until the
+	// clients that read it have moved to "metadata"
+	err = app.writeJSON(w, http.StatusOK, envelope{"quotes": quotes, "metadata": metadata, "metadata ": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,88 @@
+// Filename: cmd/api/quotes_test.go
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestQuoteHandlers(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read")
+	_, writer := insertTestUser(t, app, "writer@example.com", "quotes:read", "quotes:write")
+
+	quote := map[string]interface{}{
+		"author":       "Ada Lovelace",
+		"quote_string": "That brain of mine is something more than merely mortal",
+		"category":     []string{"science"},
+	}
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		body     interface{}
+		wantCode int
+	}{
+		{"anonymous", http.MethodPost, "", quote, http.StatusUnauthorized},
+		{"without quotes:write", http.MethodPost, reader, quote, http.StatusForbidden},
+		{"invalid quote", http.MethodPost, writer, map[string]interface{}{"author": ""}, http.StatusUnprocessableEntity},
+		{"valid quote", http.MethodPost, writer, quote, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := ts.do(t, tt.method, "/v1/Quotes", tt.token, tt.body)
+			if code != tt.wantCode {
+				t.Errorf("got status %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+
+	code, headers, body := ts.do(t, http.MethodPost, "/v1/Quotes", writer, quote)
+	if code != http.StatusCreated {
+		t.Fatalf("create: got status %d, want %d", code, http.StatusCreated)
+	}
+	id := int64(body["quote"].(map[string]interface{})["id"].(float64))
+	path := fmt.Sprintf("/v1/Quotes/%d", id)
+	if location, want := headers.Get("Location"), fmt.Sprintf("/v1/quotes/%d", id); location != want {
+		t.Errorf("Location = %q, want %q", location, want)
+	}
+
+	code, _, body = ts.do(t, http.MethodGet, path, reader, nil)
+	if code != http.StatusOK {
+		t.Fatalf("show: got status %d, want %d", code, http.StatusOK)
+	}
+	if author := body["quote"].(map[string]interface{})["author"]; author != "Ada Lovelace" {
+		t.Errorf("show: author = %v, want %q", author, "Ada Lovelace")
+	}
+
+	code, _, body = ts.do(t, http.MethodGet, "/v1/Quotes", reader, nil)
+	if code != http.StatusOK {
+		t.Fatalf("list: got status %d, want %d", code, http.StatusOK)
+	}
+	// The old key with a trailing space is still sent
+	for _, key := range []string{"metadata", "metadata "} {
+		if _, ok := body[key]; !ok {
+			t.Errorf("list: no %q key in %v", key, body)
+		}
+	}
+
+	code, _, body = ts.do(t, http.MethodPatch, path, writer, map[string]interface{}{"author": "A. Lovelace"})
+	if code != http.StatusOK {
+		t.Fatalf("update: got status %d, want %d", code, http.StatusOK)
+	}
+	if author := body["quote"].(map[string]interface{})["author"]; author != "A. Lovelace" {
+		t.Errorf("update: author = %v, want %q", author, "A. Lovelace")
+	}
+
+	code, _, _ = ts.do(t, http.MethodDelete, path, writer, nil)
+	if code != http.StatusOK {
+		t.Fatalf("delete: got status %d, want %d", code, http.StatusOK)
+	}
+	code, _, _ = ts.do(t, http.MethodGet, path, reader, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("show after delete: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -9,19 +9,57 @@ import (
 
 
 func (app *application) routes() http.Handler {
+	router := app.router()
+	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.readYourWrites(router)))))
+}
+
+// router registers every route. Each of them has to be described in
+// openapi.json, which TestOpenAPI checks
+func (app *application) router() *routeTable {
 	// Create
-	router := httprouter.New()
+	router := &routeTable{Router: httprouter.New()}
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openAPIHandler)
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("users:manage", app.metricsHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/Quotes", app.requirePermission("quotes:read",app.listQuotesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/Quotes", app.requirePermission("quotes:write", app.createQuoteHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/Quotes/:id", app.requirePermission("quotes:read", app.showQuoteHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/Quotes/:id", app.requirePermission("quotes:read", app.showQuoteOrStreamHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/Quotes/:id", app.requirePermission("quotes:write", app.updateQuoteHandler))
     router.HandlerFunc(http.MethodDelete, "/v1/Quotes/:id", app.requirePermission("quotes:write", app.deleteQuoteHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/changes", app.requirePermission("quotes:read", app.listChangesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/graphql", app.graphqlHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showAccountHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireActivatedUser(app.updateAccountHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireActivatedUser(app.updatePasswordHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireActivatedUser(app.requestEmailChangeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireAuthenticatedUser(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireAuthenticatedUser(app.revokeSessionHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.resetPasswordHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.createRefreshedTokensHandler)
+	router.HandlerFunc(http.MethodGet, "/.well-known/jwks.json", app.jwksHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePermission("webhooks:manage", app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePermission("webhooks:manage", app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission("webhooks:manage", app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission("webhooks:manage", app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", app.requirePermission("webhooks:manage", app.redeliverWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:manage", app.listAdminUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:manage", app.showAdminUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:manage", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:manage", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/deactivate", app.requirePermission("users:manage", app.deactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", app.requirePermission("users:manage", app.reactivateUserHandler))
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	return router
 }
\ No newline at end of file
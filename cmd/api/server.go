@@ -7,26 +7,99 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
 func (app *application) serve() error {
 	// Create our HTTP server
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.routes(),
-		ErrorLog:     log.New(app.logger, "", 0),
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
+		Addr:        fmt.Sprintf(":%d", app.config.port),
+		Handler:     app.routes(),
+		ErrorLog:    log.New(app.logger, "", 0),
+		IdleTimeout: time.Minute,
+		ReadTimeout: 10 * time.Second,
+		// The quote stream lifts this deadline for its own responses
 		WriteTimeout: 30 * time.Second,
 	}
 	// The Shutdown() function should return its error to this channel
 	shutdownError := make(chan error)
 
+	// Background workers run until this context is cancelled on shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	// Stopping the workers also closes the open quote streams, which
+	// would otherwise keep Shutdown() waiting until its deadline
+	srv.RegisterOnShutdown(stopWorkers)
+	app.background(func() {
+		app.changes.Run(workerCtx)
+	})
+	if app.quoteCache != nil {
+		app.background(func() {
+			app.quoteCache.Run(workerCtx, app.changes)
+		})
+	}
+	if app.permissionCache != nil {
+		app.background(func() {
+			app.permissionCache.Run(workerCtx)
+		})
+	}
+	if app.replicas != nil {
+		app.background(func() {
+			app.replicas.Run(workerCtx, 5*time.Second)
+		})
+	}
+	app.background(func() {
+		app.runSessionTracker(workerCtx, app.config.users.sessionFlush)
+	})
+	if app.denylist != nil {
+		app.background(func() {
+			app.denylist.Run(workerCtx, app.config.users.jwtDenylistRefresh, func(err error) {
+				app.logger.PrintError(err, map[string]string{"worker": "denylist"})
+			})
+		})
+	}
+	if app.config.users.activationWindow > 0 {
+		app.background(func() {
+			app.runUnactivatedUserCleanup(workerCtx, time.Hour)
+		})
+	}
+	if app.config.webhooks.enabled {
+		app.background(func() {
+			app.runWebhookWorker(workerCtx)
+		})
+		if app.config.webhooks.retention > 0 {
+			app.background(func() {
+				app.runOutboxCleanup(workerCtx, time.Hour)
+			})
+		}
+	}
+
+	// The gRPC server runs on its own port and shares the shutdown below
+	var grpcServer *grpc.Server
+	if app.config.grpc.port != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.grpc.port))
+		if err != nil {
+			return err
+		}
+		grpcServer = app.newGRPCServer()
+		go func() {
+			app.logger.PrintInfo("starting grpc server", map[string]string{
+				"addr": listener.Addr().String(),
+			})
+			err := grpcServer.Serve(listener)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}()
+	}
+
 	// Start a background Goroutine
 	go func() {
 		// Create a quit/exit channel which carries os.Signal values
@@ -47,6 +120,9 @@ func (app *application) serve() error {
 		if err != nil {
 			shutdownError <- err
 		}
+		if grpcServer != nil {
+			app.stopGRPCServer(ctx, grpcServer)
+		}
 		// log a message about the go routines
 		app.logger.PrintInfo("Completing background tasks", map[string]string{
 			"addr": srv.Addr,
@@ -77,3 +153,18 @@ func (app *application) serve() error {
 	})
 	return nil
 }
+
+// stopGRPCServer lets in-flight calls finish, but only until the context
+// runs out
+func (app *application) stopGRPCServer(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
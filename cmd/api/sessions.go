@@ -0,0 +1,234 @@
+// Filename: cmd/api/sessions.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// clientInfo is what a session shows about the client that uses it
+type clientInfo struct {
+	ip        string
+	userAgent string
+}
+
+// User agents are cut short, a client can send anything in the header
+const maxUserAgent = 256
+
+func newClientInfo(addr, userAgent string) clientInfo {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	return clientInfo{ip: ip, userAgent: userAgent}
+}
+
+func requestClient(r *http.Request) clientInfo {
+	return newClientInfo(r.RemoteAddr, r.UserAgent())
+}
+
+func grpcClient(ctx context.Context) clientInfo {
+	var addr, userAgent string
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("user-agent"); len(values) > 0 {
+		userAgent = values[0]
+	}
+	return newClientInfo(addr, userAgent)
+}
+
+// sessionTracker collects the uses of authentication tokens, so that
+// authenticate() doesn't write to the database on every request. The
+// latest use of each token is saved every -session-flush-interval
+type sessionTracker struct {
+	mu   sync.Mutex
+	uses map[string]data.TokenUse
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{uses: make(map[string]data.TokenUse)}
+}
+
+func (t *sessionTracker) record(token string, client clientInfo) {
+	hash := data.HashToken(token)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uses[string(hash)] = data.TokenUse{Hash: hash, At: time.Now(), IP: client.ip, UserAgent: client.userAgent}
+}
+
+// pending() returns the use of a token that hasn't been saved yet
+func (t *sessionTracker) pending(hash []byte) (data.TokenUse, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	use, ok := t.uses[string(hash)]
+	return use, ok
+}
+
+// take() returns the uses that haven't been saved and forgets them
+func (t *sessionTracker) take() []data.TokenUse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	uses := make([]data.TokenUse, 0, len(t.uses))
+	for _, use := range t.uses {
+		uses = append(uses, use)
+	}
+	t.uses = make(map[string]data.TokenUse)
+	return uses
+}
+
+// runSessionTracker saves the token uses every interval, and once more
+// when ctx is cancelled so that a shutdown doesn't lose them
+func (app *application) runSessionTracker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			app.flushSessions(ctx)
+			return
+		case <-ticker.C:
+			app.flushSessions(ctx)
+		}
+	}
+}
+
+func (app *application) flushSessions(ctx context.Context) {
+	uses := app.sessions.take()
+	if len(uses) == 0 {
+		return
+	}
+	err := app.models.Tokens.RecordUses(ctx, uses)
+	if err != nil {
+		// The uses are lost, which only makes last_used_at a little stale
+		app.logger.PrintError(err, map[string]string{"worker": "sessions"})
+	}
+}
+
+// deleteAuthenticationTokenHandler for the "DELETE /v1/tokens/authentication"
+// endpoint. It signs out the client that makes the request, along with the
+// refresh tokens of its sign in
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		token, err := m.Tokens.Get(r.Context(), data.ScopeAuthentication, app.contextGetToken(r))
+		if err != nil {
+			// It expired or was revoked since the request was authenticated
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		err = m.Tokens.DeleteAllForFamily(r.Context(), data.ScopeRefresh, token.Family)
+		if err != nil {
+			return err
+		}
+		return m.Tokens.Delete(r.Context(), data.ScopeAuthentication, app.contextGetToken(r))
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokensRevoked(r.Context())
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler for the
+// "DELETE /v1/tokens/authentication/all" endpoint. It signs the user out
+// everywhere, including the client that makes the request
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	userID := app.contextGetUser(r).ID
+	err := app.models.WithTx(r.Context(), func(m data.Models) error {
+		err := m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeAuthentication, userID)
+		if err != nil {
+			return err
+		}
+		return m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeRefresh, userID)
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.tokensRevoked(r.Context())
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been signed out of every session"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listSessionsHandler for the "GET /v1/users/me/sessions" endpoint
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.models.Tokens.GetSessions(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Uses that this instance hasn't saved yet are newer than the stored
+	// ones. Other instances' are only seen once they have saved them
+	current := string(data.HashToken(app.contextGetToken(r)))
+	for _, session := range sessions {
+		if use, ok := app.sessions.pending(session.Hash); ok {
+			at := use.At
+			session.LastUsedAt = &at
+			session.IP = use.IP
+			session.UserAgent = use.UserAgent
+		}
+		session.Current = string(session.Hash) == current
+	}
+	lastSeen := func(s *data.Session) time.Time {
+		if s.LastUsedAt != nil {
+			return *s.LastUsedAt
+		}
+		return s.CreatedAt
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return lastSeen(sessions[i]).After(lastSeen(sessions[j]))
+	})
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// revokeSessionHandler for the "DELETE /v1/users/me/sessions/:id" endpoint
+func (app *application) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Tokens.DeleteSession(r.Context(), app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokensRevoked(r.Context())
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
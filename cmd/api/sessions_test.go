@@ -0,0 +1,176 @@
+// Filename: cmd/api/sessions_test.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// sessionsOf() lists the sessions that token sees, by id
+func (ts *testServer) sessionsOf(t *testing.T, token string) map[int64]map[string]interface{} {
+	t.Helper()
+	code, _, body := ts.do(t, http.MethodGet, "/v1/users/me/sessions", token, nil)
+	if code != http.StatusOK {
+		t.Fatalf("got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	sessions := make(map[int64]map[string]interface{})
+	list, _ := body["sessions"].([]interface{})
+	for _, s := range list {
+		session := s.(map[string]interface{})
+		sessions[int64(session["id"].(float64))] = session
+	}
+	return sessions
+}
+
+// currentSession() returns the id of the session of token
+func (ts *testServer) currentSession(t *testing.T, token string) int64 {
+	t.Helper()
+	for id, session := range ts.sessionsOf(t, token) {
+		if session["current"] == true {
+			return id
+		}
+	}
+	t.Fatal("no session is the current one")
+	return 0
+}
+
+// expectSignedIn() checks whether the access and refresh tokens still work
+func (ts *testServer) expectSignedIn(t *testing.T, name, access, refresh string, want bool) {
+	t.Helper()
+	wantCode := http.StatusUnauthorized
+	if want {
+		wantCode = http.StatusOK
+	}
+	code, _, _ := ts.do(t, http.MethodGet, "/v1/users/me", access, nil)
+	if code != wantCode {
+		t.Errorf("%s: got status %d; want %d", name, code, wantCode)
+	}
+	if want {
+		wantCode = http.StatusCreated
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": refresh})
+	if code != wantCode {
+		t.Errorf("%s refresh token: got status %d; want %d", name, code, wantCode)
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com")
+	laptop, laptopRefresh := ts.signIn(t, "alice@example.com")
+	phone, phoneRefresh := ts.signIn(t, "alice@example.com")
+
+	// Signing out only ends the sign in that the token is from
+	code, _, body := ts.do(t, http.MethodDelete, "/v1/tokens/authentication", laptop, nil)
+	if code != http.StatusOK {
+		t.Fatalf("sign out: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	ts.expectSignedIn(t, "laptop", laptop, laptopRefresh, false)
+	ts.expectSignedIn(t, "phone", phone, phoneRefresh, true)
+
+	// The refresh above replaced the phone's tokens
+	phone, phoneRefresh = ts.signIn(t, "alice@example.com")
+	tablet, tabletRefresh := ts.signIn(t, "alice@example.com")
+	code, _, body = ts.do(t, http.MethodDelete, "/v1/tokens/authentication/all", phone, nil)
+	if code != http.StatusOK {
+		t.Fatalf("sign out everywhere: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	ts.expectSignedIn(t, "phone", phone, phoneRefresh, false)
+	ts.expectSignedIn(t, "tablet", tablet, tabletRefresh, false)
+}
+
+func TestSessions(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "alice@example.com")
+	_, bob := insertTestUser(t, app, "bob@example.com")
+	laptop, laptopRefresh := ts.signIn(t, "alice@example.com")
+	phone, phoneRefresh := ts.signIn(t, "alice@example.com")
+
+	sessions := ts.sessionsOf(t, laptop)
+	// insertTestUser() made one as well
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions; want 3", len(sessions))
+	}
+	phoneSession := ts.currentSession(t, phone)
+	if sessions[phoneSession]["current"] != false {
+		t.Errorf("the phone's session is the current one of the laptop")
+	}
+
+	// Nobody else can revoke it, or find out that it exists
+	path := fmt.Sprintf("/v1/users/me/sessions/%d", phoneSession)
+	code, _, _ := ts.do(t, http.MethodDelete, path, bob, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("another user's session: got status %d; want %d", code, http.StatusNotFound)
+	}
+	ts.expectSignedIn(t, "phone", phone, phoneRefresh, true)
+	// The refresh replaced the phone's tokens and with them its session
+	phone, phoneRefresh = ts.signIn(t, "alice@example.com")
+	phoneSession = ts.currentSession(t, phone)
+	path = fmt.Sprintf("/v1/users/me/sessions/%d", phoneSession)
+
+	code, _, body := ts.do(t, http.MethodDelete, path, laptop, nil)
+	if code != http.StatusOK {
+		t.Fatalf("revoke: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+	ts.expectSignedIn(t, "phone", phone, phoneRefresh, false)
+	ts.expectSignedIn(t, "laptop", laptop, laptopRefresh, true)
+	code, _, _ = ts.do(t, http.MethodDelete, path, bob, nil)
+	if code != http.StatusNotFound {
+		t.Errorf("revoked session: got status %d; want %d", code, http.StatusNotFound)
+	}
+}
+
+// The uses of tokens that haven't been saved yet are saved when the tracker
+// is stopped
+func TestSessionTrackerFlushesOnShutdown(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	user, token := insertTestUser(t, app, "alice@example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Long enough that only the shutdown saves anything
+		app.runSessionTracker(ctx, time.Hour)
+		close(done)
+	}()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/users/me", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("User-Agent", "sessions-test/1.0")
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	sessions, err := app.models.Tokens.GetSessions(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].LastUsedAt != nil {
+		t.Fatalf("got sessions %+v; want one that hasn't been saved as used", sessions)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tracker didn't stop")
+	}
+	sessions, err = app.models.Tokens.GetSessions(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].LastUsedAt == nil || sessions[0].UserAgent != "sessions-test/1.0" || sessions[0].IP != "127.0.0.1" {
+		t.Errorf("got sessions %+v; want the use to be saved", sessions)
+	}
+}
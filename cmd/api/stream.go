@@ -0,0 +1,221 @@
+// Filename: cmd/api/stream.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// httprouter doesn't allow a static segment next to the :id wildcard, so
+// "GET /v1/Quotes/stream" is dispatched from here
+func (app *application) showQuoteOrStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if httprouter.ParamsFromContext(r.Context()).ByName("id") == "stream" {
+		app.streamQuotesHandler(w, r)
+		return
+	}
+	app.showQuoteHandler(w, r)
+}
+
+// streamQuotesHandler for the "GET /v1/Quotes/stream" endpoint. It pushes
+// quote changes to the client as Server-Sent Events. The event id is the
+// position of the change in the log, so a client that reconnects with
+// Last-Event-ID gets every change that it missed
+func (app *application) streamQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	filter := data.QuoteFilter{
+		Author:       app.readString(qs, "author", ""),
+		Quote_string: app.readString(qs, "quote_string", ""),
+		Category:     app.readCSV(qs, "category", []string{}),
+	}
+
+	// EventSource sends the header when it reconnects. The query string
+	// parameter is there for the first connection
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = qs.Get("last_event_id")
+	}
+	var last data.SyncToken
+	if lastEventID != "" {
+		var err error
+		last, err = app.parseEventID(r.Context(), lastEventID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrInvalidSyncToken):
+				app.badRequestResponse(w, r, errors.New("invalid Last-Event-ID"))
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	// The stream is long lived, so the server's WriteTimeout is lifted for
+	// this response only
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	started := false
+	err = app.watchQuoteChanges(r.Context(), filter, last, lastEventID != "",
+		// ready
+		func() error {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "retry: 3000\n\n")
+			return rc.Flush()
+		},
+		// send
+		func(change *data.QuoteChange) error {
+			js, err := json.Marshal(envelope{"quote": change.Quote, "version": change.Version})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", change.Token(), change.EventType, js)
+			if err != nil {
+				return err
+			}
+			return rc.Flush()
+		},
+		// idle
+		func() error {
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return err
+			}
+			return rc.Flush()
+		},
+	)
+	if err != nil {
+		if !started {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.logError(r, err)
+	}
+}
+
+// parseEventID() turns a Last-Event-ID into a position in the change log.
+// Event ids are sync tokens, but the id of a change is accepted as well, as
+// the gRPC Watch call uses those
+func (app *application) parseEventID(ctx context.Context, s string) (data.SyncToken, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return data.ParseSyncToken(s)
+	}
+	return app.changeToken(ctx, id)
+}
+
+// changeToken() returns the position of the change with the given id. Zero
+// is the start of the log
+func (app *application) changeToken(ctx context.Context, id int64) (data.SyncToken, error) {
+	if id < 0 {
+		return data.SyncToken{}, data.ErrInvalidSyncToken
+	}
+	if id == 0 {
+		return data.SyncToken{}, nil
+	}
+	token, err := app.models.Changes.TokenFor(ctx, id)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return token, data.ErrInvalidSyncToken
+	}
+	return token, err
+}
+
+// watchQuoteChanges passes every change that matches the filter to send,
+// until the context is done or the server shuts down. When resume is true
+// it starts with the changes that come after last, otherwise only new
+// changes are sent. ready is called once the watch is set up and idle is
+// called every 15 seconds. It is shared by the SSE stream and the gRPC
+// Watch call
+func (app *application) watchQuoteChanges(ctx context.Context, filter data.QuoteFilter, last data.SyncToken, resume bool,
+	ready func() error, send func(*data.QuoteChange) error, idle func() error) error {
+	// Subscribe before reading the backlog so that nothing falls in between
+	sub := app.changes.Subscribe()
+	defer sub.Close()
+
+	if !resume {
+		var err error
+		last, err = app.models.Changes.Latest(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	deliver := func(change *data.QuoteChange) error {
+		last = change.Token()
+		if !filter.Matches(change.Quote) {
+			return nil
+		}
+		return send(change)
+	}
+	// catchUp replays the changes that come after last
+	catchUp := func() error {
+		for {
+			changes, err := app.models.Changes.GetSince(ctx, last, 500)
+			if err != nil {
+				return err
+			}
+			for _, change := range changes {
+				if err := deliver(change); err != nil {
+					return err
+				}
+			}
+			if len(changes) < 500 {
+				return nil
+			}
+		}
+	}
+
+	err := ready()
+	if err == nil && resume {
+		err = catchUp()
+	}
+	if err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change, ok := <-sub.C:
+			// The channel is closed when the server shuts down
+			if !ok {
+				return nil
+			}
+			if sub.Lagged() {
+				err = catchUp()
+			} else if last.Before(change.Token()) {
+				err = deliver(change)
+			}
+		case <-heartbeat.C:
+			if sub.Lagged() {
+				err = catchUp()
+			}
+			if err == nil {
+				err = idle()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Filename: cmd/api/stream_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// followChanges() runs a change listener over store until the test ends
+func followChanges(t *testing.T, app *application, store data.ChangeStore) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := data.NewPollingChangeListener(ctx, store, 5*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.changes = listener
+	done := make(chan struct{})
+	go func() {
+		listener.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// stream() opens the change stream and passes on its events. The first one
+// is the retry line, which is sent once the stream is set up
+func (ts *testServer) stream(t *testing.T, token, lastEventID string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/v1/Quotes/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		t.Fatalf("got status %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer res.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				event.data = value
+			case "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	next(t, events)
+	return events
+}
+
+func next(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("the stream ended")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+func TestStreamQuotes(t *testing.T) {
+	app := newTestApplication(t)
+	followChanges(t, app, app.models.Changes)
+	ts := newTestServer(t, app.routes())
+	_, reader := insertTestUser(t, app, "reader@example.com", "quotes:read")
+
+	events := ts.stream(t, reader, "")
+	insertTestQuote(t, app)
+	first := next(t, events)
+	insertTestQuote(t, app)
+	second := next(t, events)
+	if first.event != "quote.created" || !strings.Contains(first.data, "Ada Lovelace") {
+		t.Errorf("got event %+v", first)
+	}
+
+	// The event ids are positions in the change log
+	for _, event := range []sseEvent{first, second} {
+		token, err := data.ParseSyncToken(event.id)
+		if err != nil || token.ID == 0 {
+			t.Errorf("got event id %q; want a sync token", event.id)
+		}
+	}
+	if first.id == second.id {
+		t.Errorf("both events have the id %q", first.id)
+	}
+
+	// Resuming replays what came after the event, and so does the id of
+	// the change that it was for
+	for _, lastEventID := range []string{first.id, "1"} {
+		resumed := next(t, ts.stream(t, reader, lastEventID))
+		if resumed != second {
+			t.Errorf("resumed after %q: got %+v; want %+v", lastEventID, resumed, second)
+		}
+	}
+
+	for _, lastEventID := range []string{"not a token", "-1", "999"} {
+		code, _, _ := ts.do(t, http.MethodGet, "/v1/Quotes/stream?last_event_id="+url.QueryEscape(lastEventID), reader, nil)
+		if code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d; want %d", lastEventID, code, http.StatusBadRequest)
+		}
+	}
+}
+
+// commitLog is a change log that the test commits changes to in any order
+// of their ids, as concurrent transactions do
+type commitLog struct {
+	data.ChangeStore
+	mu      sync.Mutex
+	changes []*data.QuoteChange
+}
+
+func (l *commitLog) commit(id int64, xid uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, &data.QuoteChange{
+		ID:        id,
+		XID:       xid,
+		QuoteID:   id,
+		EventType: "quote.created",
+		Version:   1,
+		Quote:     &data.Quote{ID: id, Author: "Ada Lovelace", Version: 1},
+	})
+}
+
+func (l *commitLog) GetSince(ctx context.Context, after data.SyncToken, limit int) ([]*data.QuoteChange, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changes := []*data.QuoteChange{}
+	for _, change := range l.changes {
+		if after.Before(change.Token()) && len(changes) < limit {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (l *commitLog) Latest(ctx context.Context) (data.SyncToken, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.changes) == 0 {
+		return data.SyncToken{}, nil
+	}
+	return l.changes[len(l.changes)-1].Token(), nil
+}
+
+// A change whose id was handed out first but that was committed last is
+// still sent
+func TestStreamFollowsCommitOrder(t *testing.T) {
+	app := newTestApplication(t)
+	log := &commitLog{}
+	app.models.Changes = log
+	followChanges(t, app, log)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	sent := make(chan int64, 16)
+	go app.watchQuoteChanges(ctx, data.QuoteFilter{}, data.SyncToken{}, false,
+		func() error {
+			close(ready)
+			return nil
+		},
+		func(change *data.QuoteChange) error {
+			sent <- change.ID
+			return nil
+		},
+		func() error { return nil },
+	)
+	<-ready
+
+	log.commit(2, 10)
+	log.commit(1, 11)
+	log.commit(3, 12)
+	for _, want := range []int64{2, 1, 3} {
+		select {
+		case id := <-sent:
+			if id != want {
+				t.Errorf("got change %d; want %d", id, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %d", want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Filename: cmd/api/testutils_test.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/jsonlog"
+	"quotesapi.desireamagwula.net/internals/jwt"
+	"quotesapi.desireamagwula.net/internals/webhook"
+)
+
+// newTestApplication returns an application on the in-memory models. The
+// rate limiter is off and none of the background workers are started
+func newTestApplication(t *testing.T) *application {
+	t.Helper()
+	var cfg config
+	cfg.env = "testing"
+	cfg.users.accessTokenTTL = 15 * time.Minute
+	cfg.users.refreshTokenTTL = 24 * time.Hour
+	cfg.users.tokenFormat = "opaque"
+	cfg.users.activationResend = time.Minute
+	cfg.users.passwordResetTTL = 45 * time.Minute
+	cfg.webhooks.batchSize = 50
+	cfg.webhooks.maxAttempts = 3
+	cfg.webhooks.backoffBase = time.Millisecond
+	cfg.webhooks.backoffMax = time.Millisecond
+	cfg.webhooks.timeout = 5 * time.Second
+	app := &application{
+		config:                cfg,
+		logger:                jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models:                data.NewMemoryModels(),
+		mailer:                &testMailer{},
+		sender:                webhook.New(nil, cfg.webhooks.timeout, "quotesapi-webhooks/test"),
+		limiter:               newIPLimiter(cfg.limiter.rps, cfg.limiter.burst),
+		activationThrottle:    newThrottle(cfg.users.activationResend),
+		passwordResetThrottle: newThrottle(cfg.users.activationResend),
+		sessions:              newSessionTracker(),
+	}
+	var err error
+	app.graphqlSchema, err = app.newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// testMailer keeps the emails that would have been sent
+type testMailer struct {
+	mu     sync.Mutex
+	emails []testEmail
+}
+
+type testEmail struct {
+	recipient string
+	template  string
+	data      map[string]interface{}
+}
+
+func (m *testMailer) Send(recipient, templateFile string, data interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values, _ := data.(map[string]interface{})
+	m.emails = append(m.emails, testEmail{recipient: recipient, template: templateFile, data: values})
+	return nil
+}
+
+// sentEmails() waits for the background goroutines of app, and returns the
+// emails that were sent
+func sentEmails(app *application) []testEmail {
+	app.wg.Wait()
+	m := app.mailer.(*testMailer)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]testEmail(nil), m.emails...)
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &testServer{ts}
+}
+
+// do() sends a request with an optional bearer token and JSON body, and
+// decodes the JSON response
+func (ts *testServer) do(t *testing.T, method, path, token string, body interface{}) (int, http.Header, map[string]interface{}) {
+	t.Helper()
+	var reqBody io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqBody = bytes.NewReader(js)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var decoded map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&decoded)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return res.StatusCode, res.Header, decoded
+}
+
+// insertTestUser creates an activated user with the given permissions and
+// returns it with an authentication token
+func insertTestUser(t *testing.T, app *application, email string, codes ...string) (*data.User, string) {
+	t.Helper()
+	ctx := context.Background()
+	user := &data.User{Name: "Test User", Email: email, Activated: true}
+	err := user.Password.Set("pa55word1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) > 0 {
+		err = app.models.Permissions.AddForUser(ctx, user.ID, codes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := app.models.Tokens.NewAuthentication(ctx, user.ID, time.Hour, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.Plaintext
+}
+
+// signIn() signs in with the password that insertTestUser() gives every
+// user, and returns the authentication and refresh tokens
+func (ts *testServer) signIn(t *testing.T, email string) (string, string) {
+	t.Helper()
+	code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": email, "password": "pa55word1"})
+	if code != http.StatusCreated {
+		t.Fatalf("sign in as %s: got status %d; want %d: %v", email, code, http.StatusCreated, body)
+	}
+	access, _ := body["authentication token"].(map[string]interface{})
+	refresh, _ := body["refresh token"].(map[string]interface{})
+	return access["token"].(string), refresh["token"].(string)
+}
+
+// testJWTKey() returns a -jwt-key value, the same for the same id
+func testJWTKey(id, alg string) string {
+	return id + ":" + alg + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id), 32)[:32])
+}
+
+// useJWT() makes app issue JWTs, like -token-format=jwt with the keys
+func useJWT(t *testing.T, app *application, keys ...string) {
+	t.Helper()
+	var parsed []*jwt.Key
+	for _, s := range keys {
+		key, err := jwt.ParseKey(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, key)
+	}
+	var err error
+	app.jwtKeys, err = jwt.NewKeySet(parsed...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.denylist, err = data.NewTokenDenylist(context.Background(), app.models.Tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.config.users.tokenFormat = "jwt"
+}
@@ -0,0 +1,90 @@
+// Filename: cmd/api/throttle.go
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttle lets something happen once per interval for each key, such as
+// sending an email to an address. Like the rate limiter it only knows about
+// the requests that this instance has seen
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{interval: interval, last: make(map[string]time.Time)}
+}
+
+// allow() reports whether key may go ahead now, and if it may, starts a
+// new interval for it. Callers normalise key, such as lowercasing emails
+func (t *throttle) allow(key string) bool {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.last[key]; ok && now.Sub(last) < t.interval {
+		return false
+	}
+	// Forget the keys whose interval is over, there is no need for a
+	// goroutine to do it when every call can
+	for k, last := range t.last {
+		if now.Sub(last) >= t.interval {
+			delete(t.last, k)
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+// ipLimiter is the rate limiter of -limiter-rps and -limiter-burst, with a
+// token bucket for each client IP address. The JSON API and the gRPC
+// server share one, so a client can't get twice the rate by using both
+type ipLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   int
+	clients map[string]*limitedClient
+}
+
+type limitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiter(rps float64, burst int) *ipLimiter {
+	l := &ipLimiter{rps: rps, burst: burst, clients: make(map[string]*limitedClient)}
+	// Launch a background goroutine that removes old entries from the
+	// clients map once every minute
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			l.mu.Lock()
+			for ip, client := range l.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(l.clients, ip)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// allow() reports whether a request from ip may go ahead now
+func (l *ipLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	client, found := l.clients[ip]
+	if !found {
+		client = &limitedClient{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = time.Now()
+	return client.limiter.Allow()
+}
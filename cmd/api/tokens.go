@@ -3,8 +3,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"quotesapi.desireamagwula.net/internals/data"
@@ -30,39 +33,301 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	// Get user details based on the provided email 
-	user, err := app.models.Users.GetByEmail(input.Email)
+	// Check the credentials
+	user, err := app.checkCredentials(r.Context(), input.Email, input.Password)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
+		case errors.Is(err, errInvalidCredentials):
 			app.invalidCredentialResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// Check if the passwrd matches
-	match, err := user.Password.Matches(input.Password)
+	access, refresh, err := app.signIn(r.Context(), user.ID, requestClient(r))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// If passwords don't match, then return an invalid credentials response 
+	// Return 
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication token": access, "refresh token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// checkCredentials returns the user with the email if the password is
+// theirs. It is shared by the JSON and gRPC APIs
+func (app *application) checkCredentials(ctx context.Context, email, password string) (*data.User, error) {
+	// Get user details based on the provided email
+	user, err := app.models.Users.GetByEmail(ctx, email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errInvalidCredentials
+		default:
+			return nil, err
+		}
+	}
+	// Check if the passwrd matches
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		return nil, err
+	}
+	// If passwords don't match, then the credentials are invalid
 	if !match {
-		app.invalidCredentialResponse(w, r)
+		return nil, errInvalidCredentials
+	}
+	return user, nil
+}
+
+// newAuthenticationToken creates an authentication token for client in the
+// format that -token-format picks
+func (app *application) newAuthenticationToken(ctx context.Context, m data.Models, userID int64, family string, client clientInfo) (*data.Token, error) {
+	if app.jwtKeys != nil {
+		return app.newJWT(ctx, m, userID, family, client)
+	}
+	return m.Tokens.NewAuthentication(ctx, userID, app.config.users.accessTokenTTL, family, client.ip, client.userAgent)
+}
+
+// signIn creates a short lived authentication token and a refresh token
+// that starts a new family. It is shared by the JSON and gRPC APIs
+func (app *application) signIn(ctx context.Context, userID int64, client clientInfo) (access, refresh *data.Token, err error) {
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = app.models.WithTx(ctx, func(m data.Models) error {
+		access, refresh, err = app.issueTokens(ctx, m, userID, family, app.config.users.refreshTokenTTL, client)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// issueTokens creates an authentication token for client and a refresh
+// token that lasts refreshTTL, both of the family
+func (app *application) issueTokens(ctx context.Context, m data.Models, userID int64, family string, refreshTTL time.Duration, client clientInfo) (access, refresh *data.Token, err error) {
+	access, err = app.newAuthenticationToken(ctx, m, userID, family, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err = m.Tokens.NewRefresh(ctx, userID, refreshTTL, family)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// createRefreshedTokensHandler for the "POST /v1/tokens/refresh" endpoint.
+// The refresh token is exchanged for a new authentication token and a new
+// refresh token, which expires when the first one of the sign in did. A
+// refresh token that comes back after it was exchanged has been copied, so
+// the whole family is revoked and whoever holds it has to sign in again
+func (app *application) createRefreshedTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	// Password is correct so we will generate an authentication token
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	access, refresh, err := app.refreshTokens(r.Context(), input.TokenPlaintext, requestClient(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidCredentials):
+			app.invalidCredentialResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication token": access, "refresh token": refresh}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokens exchanges a refresh token for new tokens, see
+// createRefreshedTokensHandler(). A token that is unknown, expired or
+// reused is reported as errInvalidCredentials. It is shared by the JSON and
+// gRPC APIs
+func (app *application) refreshTokens(ctx context.Context, plaintext string, client clientInfo) (access, refresh *data.Token, err error) {
+	var reused *data.Token
+	err = app.models.WithTx(ctx, func(m data.Models) error {
+		used, err := m.Tokens.UseRefresh(ctx, plaintext)
+		if err != nil {
+			if errors.Is(err, data.ErrTokenReused) {
+				reused = used
+			}
+			return err
+		}
+		// The authentication token that was issued with it is replaced too
+		err = m.Tokens.DeleteAllForFamily(ctx, data.ScopeAuthentication, used.Family)
+		if err != nil {
+			return err
+		}
+		access, refresh, err = app.issueTokens(ctx, m, used.UserID, used.Family, time.Until(used.Expiry), client)
+		return err
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			err = app.revokeTokenFamily(ctx, reused.Family)
+			if err != nil {
+				return nil, nil, err
+			}
+			app.tokensRevoked(ctx)
+			app.logger.PrintInfo("refresh token reused, token family revoked", map[string]string{
+				"user_id": strconv.FormatInt(reused.UserID, 10),
+			})
+			return nil, nil, errInvalidCredentials
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil, errInvalidCredentials
+		default:
+			return nil, nil, err
+		}
+	}
+	app.tokensRevoked(ctx)
+	return access, refresh, nil
+}
+
+// revokeTokenFamily removes every authentication and refresh token of the
+// family
+func (app *application) revokeTokenFamily(ctx context.Context, family string) error {
+	return app.models.WithTx(ctx, func(m data.Models) error {
+		err := m.Tokens.DeleteAllForFamily(ctx, data.ScopeAuthentication, family)
+		if err != nil {
+			return err
+		}
+		return m.Tokens.DeleteAllForFamily(ctx, data.ScopeRefresh, family)
+	})
+}
+
+// createPasswordResetTokenHandler for the "POST /v1/tokens/password-reset"
+// endpoint. The answer is the same whether or not there is an activated
+// account with the email, so that it can't be used to find out who has one.
+// Like activation emails, an address can only be sent one reset email per
+// -activation-resend-interval
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
-	// Return 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication token": token}, nil)
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Emails are citext, so the throttle has to see every spelling of an
+	// address as the same one
+	if !app.passwordResetThrottle.allow(strings.ToLower(strings.TrimSpace(input.Email))) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil && user.Activated:
+		token, err := app.models.Tokens.New(r.Context(), user.ID, app.config.users.passwordResetTTL, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+				"passwordResetTTL":   humanDuration(app.config.users.passwordResetTTL),
+			}
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "if an activated account uses this email address, you will receive an email with password reset instructions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
+}
+
+// createActivationTokenHandler for the "POST /v1/tokens/activation"
+// endpoint. It replaces the activation tokens of an account that isn't
+// activated yet and emails the new one. Like the password reset it gives
+// the same answer for every address, and an address can only be sent one
+// email per -activation-resend-interval
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if !app.activationThrottle.allow(strings.ToLower(strings.TrimSpace(input.Email))) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
 
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil && !user.Activated:
+		var token *data.Token
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			err := m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeActivation, user.ID)
+			if err != nil {
+				return err
+			}
+			token, err = m.Tokens.New(r.Context(), user.ID, 1*24*time.Hour, data.ScopeActivation)
+			return err
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	case err != nil && !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-}
\ No newline at end of file
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "if an account that isn't activated yet uses this email address, you will receive an email with activation instructions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
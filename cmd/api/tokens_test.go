@@ -0,0 +1,209 @@
+// Filename: cmd/api/tokens_test.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	_, session := insertTestUser(t, app, "alice@example.com", "quotes:read")
+	inactive := &data.User{Name: "Inactive User", Email: "inactive@example.com"}
+	inactive.Password.Set("pa55word1")
+	err := app.models.Users.Insert(context.Background(), inactive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every address gets the same answer, but only an activated account
+	// is sent an email
+	for _, email := range []string{"alice@example.com", "nobody@example.com", "inactive@example.com"} {
+		code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/password-reset", "", map[string]string{"email": email})
+		if code != http.StatusAccepted {
+			t.Fatalf("%s: got status %d; want %d: %v", email, code, http.StatusAccepted, body)
+		}
+	}
+	emails := sentEmails(app)
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails; want 1", len(emails))
+	}
+	email := emails[0]
+	if email.recipient != "alice@example.com" || email.template != "token_password_reset.tmpl" {
+		t.Errorf("got a %s email to %s", email.template, email.recipient)
+	}
+	if ttl := email.data["passwordResetTTL"]; ttl != "45 minutes" {
+		t.Errorf("got passwordResetTTL %q; want %q", ttl, "45 minutes")
+	}
+	token, _ := email.data["passwordResetToken"].(string)
+
+	// Another email to the same address has to wait
+	for _, address := range []string{"alice@example.com", "ALICE@example.com"} {
+		code, _, _ := ts.do(t, http.MethodPost, "/v1/tokens/password-reset", "", map[string]string{"email": address})
+		if code != http.StatusTooManyRequests {
+			t.Errorf("%s: got status %d; want %d", address, code, http.StatusTooManyRequests)
+		}
+	}
+	if n := len(sentEmails(app)); n != 1 {
+		t.Errorf("got %d emails after the throttled requests; want 1", n)
+	}
+
+	code, _, body := ts.do(t, http.MethodPut, "/v1/users/password", "", map[string]string{"password": "newpa55word", "token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("unknown token: got status %d; want %d: %v", code, http.StatusUnprocessableEntity, body)
+	}
+	code, _, body = ts.do(t, http.MethodPut, "/v1/users/password", "", map[string]string{"password": "newpa55word", "token": token})
+	if code != http.StatusOK {
+		t.Fatalf("reset: got status %d; want %d: %v", code, http.StatusOK, body)
+	}
+
+	// The reset signed alice out and used the token up
+	code, _, _ = ts.do(t, http.MethodGet, "/v1/Quotes", session, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("old session: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPut, "/v1/users/password", "", map[string]string{"password": "otherpa55word", "token": token})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("used token: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "alice@example.com", "password": "pa55word1"})
+	if code != http.StatusUnauthorized {
+		t.Errorf("old password: got status %d; want %d", code, http.StatusUnauthorized)
+	}
+	code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/authentication", "", map[string]string{"email": "alice@example.com", "password": "newpa55word"})
+	if code != http.StatusCreated {
+		t.Errorf("new password: got status %d; want %d", code, http.StatusCreated)
+	}
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.users.passwordResetTTL = time.Second
+	ts := newTestServer(t, app.routes())
+	insertTestUser(t, app, "bob@example.com")
+
+	code, _, _ := ts.do(t, http.MethodPost, "/v1/tokens/password-reset", "", map[string]string{"email": "bob@example.com"})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d", code, http.StatusAccepted)
+	}
+	emails := sentEmails(app)
+	if len(emails) != 1 {
+		t.Fatalf("got %d emails; want 1", len(emails))
+	}
+	if ttl := emails[0].data["passwordResetTTL"]; ttl != "1s" {
+		t.Errorf("got passwordResetTTL %q; want %q", ttl, "1s")
+	}
+	token, _ := emails[0].data["passwordResetToken"].(string)
+
+	// Expiry times are kept to the second, so this can be half a second late
+	time.Sleep(1600 * time.Millisecond)
+	code, _, _ = ts.do(t, http.MethodPut, "/v1/users/password", "", map[string]string{"password": "newpa55word", "token": token})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("expired token: got status %d; want %d", code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	tests := map[time.Duration]string{
+		45 * time.Minute: "45 minutes",
+		time.Minute:      "1 minute",
+		time.Hour:        "1 hour",
+		24 * time.Hour:   "24 hours",
+		90 * time.Minute: "90 minutes",
+		90 * time.Second: "1m30s",
+	}
+	for d, want := range tests {
+		if got := humanDuration(d); got != want {
+			t.Errorf("humanDuration(%v) = %q; want %q", d, got, want)
+		}
+	}
+}
+
+func TestActivationResendThrottle(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	user := &data.User{Name: "Inactive User", Email: "carol@example.com"}
+	user.Password.Set("pa55word1")
+	err := app.models.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/activation", "", map[string]string{"email": "carol@example.com"})
+	if code != http.StatusAccepted {
+		t.Fatalf("got status %d; want %d: %v", code, http.StatusAccepted, body)
+	}
+	// Emails are citext, so no spelling of the address gets another one
+	for _, address := range []string{"carol@example.com", "CAROL@example.com", "Carol@Example.com"} {
+		code, _, _ := ts.do(t, http.MethodPost, "/v1/tokens/activation", "", map[string]string{"email": address})
+		if code != http.StatusTooManyRequests {
+			t.Errorf("%s: got status %d; want %d", address, code, http.StatusTooManyRequests)
+		}
+	}
+	emails := sentEmails(app)
+	if len(emails) != 1 || emails[0].template != "token_activation.tmpl" {
+		t.Errorf("got emails %v; want one activation email", emails)
+	}
+}
+
+// A refresh token that is used twice was stolen, by whoever used it first
+// or second. Every token of its sign in is revoked, so that neither the
+// thief nor the user goes on with it
+func TestRefreshTokenReuse(t *testing.T) {
+	for _, format := range []string{"opaque", "jwt"} {
+		t.Run(format, func(t *testing.T) {
+			app := newTestApplication(t)
+			if format == "jwt" {
+				useJWT(t, app, testJWTKey("k1", "EdDSA"))
+			}
+			ts := newTestServer(t, app.routes())
+			insertTestUser(t, app, "alice@example.com")
+			first, stolen := ts.signIn(t, "alice@example.com")
+			other, otherRefresh := ts.signIn(t, "alice@example.com")
+
+			code, _, body := ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": stolen})
+			if code != http.StatusCreated {
+				t.Fatalf("refresh: got status %d; want %d: %v", code, http.StatusCreated, body)
+			}
+			access, _ := body["authentication token"].(map[string]interface{})
+			refresh, _ := body["refresh token"].(map[string]interface{})
+			second, secondRefresh := access["token"].(string), refresh["token"].(string)
+			code, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", second, nil)
+			if code != http.StatusOK {
+				t.Fatalf("refreshed token: got status %d; want %d", code, http.StatusOK)
+			}
+
+			code, _, body = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": stolen})
+			if code != http.StatusUnauthorized {
+				t.Fatalf("reuse: got status %d; want %d: %v", code, http.StatusUnauthorized, body)
+			}
+			for name, token := range map[string]string{"first": first, "second": second} {
+				code, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", token, nil)
+				if code != http.StatusUnauthorized {
+					t.Errorf("%s authentication token: got status %d; want %d", name, code, http.StatusUnauthorized)
+				}
+			}
+			code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": secondRefresh})
+			if code != http.StatusUnauthorized {
+				t.Errorf("latest refresh token: got status %d; want %d", code, http.StatusUnauthorized)
+			}
+
+			// The other sign in is left alone
+			code, _, _ = ts.do(t, http.MethodGet, "/v1/users/me", other, nil)
+			if code != http.StatusOK {
+				t.Errorf("other sign in: got status %d; want %d", code, http.StatusOK)
+			}
+			code, _, _ = ts.do(t, http.MethodPost, "/v1/tokens/refresh", "", map[string]string{"token": otherRefresh})
+			if code != http.StatusCreated {
+				t.Errorf("other refresh token: got status %d; want %d", code, http.StatusCreated)
+			}
+		})
+	}
+}
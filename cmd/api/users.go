@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"quotesapi.desireamagwula.net/internals/data"
@@ -45,8 +47,26 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	//Insert the datain the database
-	err = app.models.Users.Insert(user)
+	// The user, their role and their activation token are created
+	// in one transaction, so a failure part way leaves nothing behind
+	var token *data.Token
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		//Insert the datain the database
+		err := m.Users.Insert(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		// Put the newly inserted user in the -default-role
+		if role := app.config.users.defaultRole; role != "" {
+			err = m.Permissions.AddRolesForUser(r.Context(), user.ID, role)
+			if err != nil {
+				return err
+			}
+		}
+		// Generate a token for the newly created user
+		token, err = m.Tokens.New(r.Context(), user.ID, 1*24*time.Hour, data.ScopeActivation)
+		return err
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -57,20 +77,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	
-	// Add permissions for the newly inserted user
-	err = app.models.Permissions.AddForUser(user.ID, "quotes:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Generate a token for the newly created user 
-	token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
 	app.background(func() {
 		data := map[string]interface{} {
 			"activationToken" : token.Plaintext, 
@@ -107,23 +113,26 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+		// Activating the user and using up their tokens happen together
+		var user *data.User
+		err = app.models.WithTx(r.Context(), func(m data.Models) error {
+			var err error
+			user, err = m.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
+			if err != nil {
+				return err
+			}
+			user.Activated = true
+			err = m.Users.Update(r.Context(), user)
+			if err != nil {
+				return err
+			}
+			return m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeActivation, user.ID)
+		})
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
 				v.AddError("token", "invalid or expired activation token")
 				app.failedValidationResponse(w, r, v.Errors)
-			default:
-				app.serverErrorResponse(w, r, err)
-			}
-			return
-		}
-
-		user.Activated = true
-
-		err = app.models.Users.Update(user)
-		if err != nil {
-			switch {
 			case errors.Is(err, data.ErrEditConflict):
 				app.editConflictResponse(w, r)
 			default:
@@ -131,12 +140,6 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 			}
 			return
 		}
-
-		err = app.models.Tokens.DeleteAllForUsers(data.ScopeActivation, user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
 		// Send a json response with the updated details 
 		err = app.writeJSON(w, http.StatusOK, envelope{"user":user}, nil)
 		if err != nil {
@@ -146,4 +149,90 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	}
 
-	
+// resetPasswordHandler for the "PUT /v1/users/password" endpoint. Resetting
+// the password signs the user out everywhere and uses up every reset token
+func (app *application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.WithTx(r.Context(), func(m data.Models) error {
+		user, err := m.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
+		if err != nil {
+			return err
+		}
+		err = user.Password.Set(input.Password)
+		if err != nil {
+			return err
+		}
+		err = m.Users.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+		err = m.Tokens.DeleteAllForUsers(r.Context(), data.ScopePasswordReset, user.ID)
+		if err != nil {
+			return err
+		}
+		err = m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeAuthentication, user.ID)
+		if err != nil {
+			return err
+		}
+		return m.Tokens.DeleteAllForUsers(r.Context(), data.ScopeRefresh, user.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.tokensRevoked(r.Context())
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runUnactivatedUserCleanup removes the accounts that weren't activated
+// within -activation-window, once at startup and then every interval. The
+// accounts created before activation was recorded are never removed, see
+// migration 000014
+func (app *application) runUnactivatedUserCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := app.models.Users.DeleteUnactivated(ctx, time.Now().Add(-app.config.users.activationWindow))
+		if err != nil && ctx.Err() == nil {
+			app.logger.PrintError(err, map[string]string{"worker": "unactivated users"})
+		}
+		if n > 0 {
+			app.logger.PrintInfo("removed unactivated users", map[string]string{
+				"count":  strconv.FormatInt(n, 10),
+				"window": app.config.users.activationWindow.String(),
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
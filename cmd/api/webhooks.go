@@ -0,0 +1,363 @@
+// Filename: cmd/api/webhooks.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+	"quotesapi.desireamagwula.net/internals/webhook"
+)
+
+// createWebhookHandler for the "POST /v1/webhooks" endpoint. The signing
+// secret is only ever returned here
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	hook := &data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+		Active: true,
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, hook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(r.Context(), hook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", "/v1/webhooks/"+strconv.FormatInt(hook.ID, 10))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": hook, "secret": hook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	hook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": hook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	hook, err := app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.URL != nil {
+		hook.URL = *input.URL
+	}
+	if input.Events != nil {
+		hook.Events = input.Events
+	}
+	if input.Active != nil {
+		hook.Active = *input.Active
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, hook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Update(r.Context(), hook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": hook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Webhooks.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler returns the delivery log of a subscription
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Webhooks.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Status string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Status = app.readString(qs, "status", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = "-id"
+	input.Filters.SortList = []string{"-id"}
+	v.Check(input.Status == "" || validator.In(input.Status, data.DeliveryPending, data.DeliverySucceeded, data.DeliveryDead), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(r.Context(), id, input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// redeliverWebhookHandler requeues a delivery, including dead-lettered ones
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	params := httprouter.ParamsFromContext(r.Context())
+	deliveryID, err := strconv.ParseInt(params.ByName("delivery_id"), 10, 64)
+	if err != nil || deliveryID < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Webhooks.Redeliver(r.Context(), id, deliveryID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "delivery has been queued"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runWebhookWorker moves events out of the outbox and delivers them until
+// the context is cancelled by the shutdown in serve()
+func (app *application) runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(app.config.webhooks.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.processWebhooks(ctx)
+		}
+	}
+}
+
+// processWebhooks performs a single pass of the worker
+func (app *application) processWebhooks(ctx context.Context) {
+	_, err := app.models.Webhooks.FanOut(ctx, app.config.webhooks.batchSize)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"worker": "webhooks"})
+		return
+	}
+	// The lease must outlive the request timeout so that a delivery
+	// isn't picked up twice while it is still in flight. The whole batch
+	// is sent at once, so every request is over within one timeout and
+	// no lease runs out while its delivery waits behind a slow receiver
+	lease := 2 * app.config.webhooks.timeout
+	deliveries, err := app.models.Webhooks.ClaimDeliveries(ctx, app.config.webhooks.batchSize, lease)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"worker": "webhooks"})
+		return
+	}
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *data.PendingDelivery) {
+			defer wg.Done()
+			app.deliverWebhook(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// runOutboxCleanup removes the webhook events that are older than
+// -webhooks-retention and have nothing left to deliver, once at startup
+// and then every interval
+func (app *application) runOutboxCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := app.models.Webhooks.DeleteFinishedEvents(ctx, time.Now().Add(-app.config.webhooks.retention))
+		if err != nil && ctx.Err() == nil {
+			app.logger.PrintError(err, map[string]string{"worker": "webhook outbox"})
+		}
+		if n > 0 {
+			app.logger.PrintInfo("removed finished webhook events", map[string]string{
+				"count":     strconv.FormatInt(n, 10),
+				"retention": app.config.webhooks.retention.String(),
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (app *application) deliverWebhook(ctx context.Context, delivery *data.PendingDelivery) {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":         delivery.EventID,
+		"type":       delivery.EventType,
+		"created_at": delivery.EventCreatedAt,
+		"data":       delivery.Payload,
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	status, err := app.sender.Send(ctx, delivery.URL, delivery.Secret, delivery.EventType, delivery.ID, body)
+	// The outcome is recorded even when the worker is being stopped, so
+	// that a delivery which went out isn't sent again
+	done := context.Background()
+	if err == nil {
+		err = app.models.Webhooks.MarkDelivered(done, delivery.ID, status)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+
+	// A send that was cut short because the worker is stopping says
+	// nothing about the receiver. The attempt is handed back and the
+	// lease left to run out, so another worker sends it again
+	if ctx.Err() != nil {
+		err = app.models.Webhooks.ReleaseDelivery(done, delivery.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+
+	dead := delivery.Attempts >= app.config.webhooks.maxAttempts
+	next := time.Now().Add(webhook.Backoff(delivery.Attempts, app.config.webhooks.backoffBase, app.config.webhooks.backoffMax))
+	app.logger.PrintInfo("webhook delivery failed", map[string]string{
+		"delivery_id": strconv.FormatInt(delivery.ID, 10),
+		"webhook_id":  strconv.FormatInt(delivery.WebhookID, 10),
+		"attempt":     strconv.Itoa(delivery.Attempts),
+		"dead":        strconv.FormatBool(dead),
+		"error":       err.Error(),
+	})
+	err = app.models.Webhooks.MarkFailed(done, delivery.ID, status, err.Error(), next, dead)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
@@ -0,0 +1,198 @@
+// Filename: cmd/api/webhooks_test.go
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/webhook"
+)
+
+// subscribe() points a new subscription to quote.created at url and queues
+// one event for it
+func subscribe(t *testing.T, app *application, url string) *data.Webhook {
+	t.Helper()
+	ctx := context.Background()
+	hook := &data.Webhook{URL: url, Events: []string{data.EventQuoteCreated}, Active: true}
+	err := app.models.Webhooks.Insert(ctx, hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func insertTestQuote(t *testing.T, app *application) {
+	t.Helper()
+	quote := &data.Quote{Author: "Ada Lovelace", Quote_string: "The engine might compose music", Category: []string{"science"}}
+	err := app.models.Quote.Insert(context.Background(), quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deliveriesOf(t *testing.T, app *application, hook *data.Webhook) []*data.WebhookDelivery {
+	t.Helper()
+	filters := data.Filters{Page: 1, PageSize: 20, Sort: "id", SortList: []string{"id"}}
+	deliveries, _, err := app.models.Webhooks.GetDeliveries(context.Background(), hook.ID, "", filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	app := newTestApplication(t)
+	var secret atomic.Value
+	verified := make(chan bool, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+		verified <- webhook.Verify(secret.Load().(string), timestamp, body, r.Header.Get(webhook.HeaderSignature))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	hook := subscribe(t, app, receiver.URL)
+	secret.Store(hook.Secret)
+	insertTestQuote(t, app)
+	app.processWebhooks(context.Background())
+
+	select {
+	case ok := <-verified:
+		if !ok {
+			t.Error("the receiver couldn't verify the signature")
+		}
+	default:
+		t.Fatal("nothing was delivered")
+	}
+	deliveries := deliveriesOf(t, app, hook)
+	if len(deliveries) != 1 || deliveries[0].Status != data.DeliverySucceeded || deliveries[0].ResponseStatus != http.StatusNoContent {
+		t.Errorf("deliveries = %+v, want one that succeeded with %d", deliveries, http.StatusNoContent)
+	}
+}
+
+func TestWebhookRetriesAndDeadLetter(t *testing.T) {
+	app := newTestApplication(t)
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	hook := subscribe(t, app, receiver.URL)
+	insertTestQuote(t, app)
+	for attempt := 1; attempt <= app.config.webhooks.maxAttempts; attempt++ {
+		app.processWebhooks(context.Background())
+		deliveries := deliveriesOf(t, app, hook)
+		if len(deliveries) != 1 {
+			t.Fatalf("attempt %d: %d deliveries, want 1", attempt, len(deliveries))
+		}
+		delivery := deliveries[0]
+		wantStatus := data.DeliveryPending
+		if attempt == app.config.webhooks.maxAttempts {
+			wantStatus = data.DeliveryDead
+		}
+		if delivery.Attempts != attempt || delivery.Status != wantStatus || delivery.ResponseStatus != http.StatusInternalServerError {
+			t.Fatalf("attempt %d: delivery = %+v, want %d attempts and status %q", attempt, delivery, attempt, wantStatus)
+		}
+		if wantStatus == data.DeliveryPending && delivery.NextAttemptAt.After(time.Now().Add(time.Second)) {
+			t.Errorf("attempt %d: next attempt at %s, further away than the backoff", attempt, delivery.NextAttemptAt)
+		}
+		// Wait out the backoff
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A dead letter isn't tried again
+	app.processWebhooks(context.Background())
+	if n := atomic.LoadInt32(&attempts); int(n) != app.config.webhooks.maxAttempts {
+		t.Errorf("the receiver got %d requests, want %d", n, app.config.webhooks.maxAttempts)
+	}
+}
+
+// The deliveries of a batch are sent at once, so that a slow receiver
+// doesn't hold the rest of the batch past its lease
+func TestWebhookBatchIsSentConcurrently(t *testing.T) {
+	app := newTestApplication(t)
+	const batch = 3
+	var mu sync.Mutex
+	arrived := 0
+	all := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrived++
+		if arrived == batch {
+			close(all)
+		}
+		mu.Unlock()
+		// Every request waits for the others, which only works if they
+		// are in flight together
+		select {
+		case <-all:
+			w.WriteHeader(http.StatusNoContent)
+		case <-time.After(2 * time.Second):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	var hooks []*data.Webhook
+	for i := 0; i < batch; i++ {
+		hooks = append(hooks, subscribe(t, app, receiver.URL))
+	}
+	insertTestQuote(t, app)
+	app.processWebhooks(context.Background())
+	for _, hook := range hooks {
+		deliveries := deliveriesOf(t, app, hook)
+		if len(deliveries) != 1 || deliveries[0].Status != data.DeliverySucceeded {
+			t.Errorf("webhook %d: deliveries = %+v, want one that succeeded", hook.ID, deliveries)
+		}
+	}
+}
+
+// A send that shutdown cuts short isn't counted, even on the last attempt
+func TestWebhookShutdownDoesNotUseAnAttempt(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.webhooks.maxAttempts = 1
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	hook := subscribe(t, app, receiver.URL)
+	insertTestQuote(t, app)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		app.processWebhooks(ctx)
+		close(done)
+	}()
+	<-arrived
+	cancel()
+	<-done
+
+	deliveries := deliveriesOf(t, app, hook)
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(deliveries))
+	}
+	delivery := deliveries[0]
+	if delivery.Status != data.DeliveryPending || delivery.Attempts != 0 || delivery.LastError != "" {
+		t.Errorf("delivery = %+v, want a pending one with no attempts", delivery)
+	}
+	if !delivery.NextAttemptAt.After(time.Now()) {
+		t.Errorf("next attempt at %s, want the lease to be kept", delivery.NextAttemptAt)
+	}
+}
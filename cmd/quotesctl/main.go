@@ -0,0 +1,239 @@
+// Filename: cmd/quotesctl/main.go
+
+// quotesctl is the admin tool for the quotes API. It works on the database
+// directly, so it needs the same DSN as cmd/api
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/lib/pq"
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+const usage = `Usage: quotesctl [-db-dsn DSN] [-db-timeout D] [-db-timeouts OPS] [-json] <command> <subcommand> [flags]
+
+Commands:
+  users create -name NAME -email EMAIL -password PASSWORD [-activated] [-permissions CODES] [-roles ROLES]
+  users list [-page N] [-page-size N]
+  users activate -email EMAIL
+  permissions list [-email EMAIL]
+  permissions grant -email EMAIL -code CODES
+  permissions revoke -email EMAIL -code CODES
+  roles list [-email EMAIL]
+  roles assign -email EMAIL -role ROLES
+  roles unassign -email EMAIL -role ROLES
+  tokens purge
+  tokens revoke -email EMAIL [-scope authentication|activation|all]
+  quotes export [-file PATH]
+  quotes import [-file PATH]
+  seed load
+  seed generate [-quotes N] [-users N] [-seed N] [-password PASSWORD]
+
+CODES is a comma separated list such as quotes:read,quotes:write, where
+quotes:* stands for every quotes code and * for every code. ROLES is a
+comma separated list of role names such as viewer,contributor. The
+export and import files default to stdout and stdin. A DSN of
+sqlite:PATH opens a SQLite database, which has to be migrated by the api
+binary first, and "memory:" uses an in-memory store that is thrown away on exit.
+
+-db-timeout bounds every query, 3s by default. -db-timeouts overrides it
+for single operations, as in -db-timeouts "quotes.GetAll=1m" for a slow
+export. Interrupting quotesctl cancels the query that is running.
+`
+
+// errUsage is returned for a bad command line, after which the usage is
+// printed
+var errUsage = errors.New("invalid usage")
+
+type cli struct {
+	// ctx is cancelled when quotesctl is interrupted
+	ctx    context.Context
+	models data.Models
+	json   bool
+	in     io.Reader
+	out    io.Writer
+}
+
+// A command runs one subcommand with the arguments that follow it
+type command func(c *cli, args []string) error
+
+var commands = map[string]map[string]command{
+	"users": {
+		"create":   (*cli).createUser,
+		"list":     (*cli).listUsers,
+		"activate": (*cli).activateUser,
+	},
+	"permissions": {
+		"list":   (*cli).listPermissions,
+		"grant":  (*cli).grantPermissions,
+		"revoke": (*cli).revokePermissions,
+	},
+	"roles": {
+		"list":     (*cli).listRoles,
+		"assign":   (*cli).assignRoles,
+		"unassign": (*cli).unassignRoles,
+	},
+	"tokens": {
+		"purge":  (*cli).purgeTokens,
+		"revoke": (*cli).revokeTokens,
+	},
+	"quotes": {
+		"export": (*cli).exportQuotes,
+		"import": (*cli).importQuotes,
+	},
+	"seed": {
+		"load":     (*cli).loadSeed,
+		"generate": (*cli).generateSeed,
+	},
+}
+
+func main() {
+	var (
+		dsn      string
+		asJSON   bool
+		timeout  time.Duration
+		opts     data.Options
+		timeouts string
+	)
+	flag.StringVar(&dsn, "db-dsn", os.Getenv("QUOTES_DB_DSN"), "Postgresql DSN, sqlite:PATH or memory:")
+	flag.BoolVar(&asJSON, "json", false, "Print JSON instead of tables")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "Timeout for connecting to the database")
+	flag.DurationVar(&opts.Timeout, "db-timeout", data.DefaultTimeout, "Timeout for a single query")
+	flag.StringVar(&timeouts, "db-timeouts", "", "Timeouts for single operations (space separated op=duration)")
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || commands[args[0]] == nil || commands[args[0]][args[1]] == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+	run := commands[args[0]][args[1]]
+	var err error
+	opts.Timeouts, err = data.ParseTimeouts(timeouts)
+	if err != nil {
+		fatal(err)
+	}
+
+	models, closeModels, err := openModels(dsn, timeout, opts)
+	if err != nil {
+		fatal(err)
+	}
+	defer closeModels()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	c := &cli{ctx: ctx, models: models, json: asJSON, in: os.Stdin, out: os.Stdout}
+	err = run(c, args[2:])
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// openModels() returns the models for dsn and a func that releases them
+func openModels(dsn string, timeout time.Duration, opts data.Options) (data.Models, func() error, error) {
+	if dsn == "memory:" {
+		return data.NewMemoryModels(), func() error { return nil }, nil
+	}
+	db, driver, err := openDB(dsn, timeout)
+	if err != nil {
+		return data.Models{}, nil, err
+	}
+	return data.NewModelsFor(driver, db, opts), db.Close, nil
+}
+
+// openDB() opens the database that the DSN scheme points at and returns it
+// together with the driver name
+func openDB(dsn string, timeout time.Duration) (*sql.DB, string, error) {
+	if dsn == "" {
+		return nil, "", errors.New("no DSN, set QUOTES_DB_DSN or pass -db-dsn")
+	}
+	driver, source := data.ParseDSN(dsn)
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, "", err
+	}
+	return db, driver, nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "quotesctl:", err)
+	os.Exit(1)
+}
+
+// newFlags() returns a flag set for a subcommand whose errors are reported
+// as errUsage
+func newFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() > 0 {
+		return fmt.Errorf("%s: %w", fs.Name(), errUsage)
+	}
+	return nil
+}
+
+// splitCodes() turns "a, b,,c" into [a b c]
+func splitCodes(s string) []string {
+	var codes []string
+	for _, code := range strings.Split(s, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// print() writes v as JSON when -json is set, otherwise as a table with
+// the given header and rows
+func (c *cli) print(v interface{}, header []string, rows [][]string) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "\t")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// message() prints the outcome of a command that has no other output
+func (c *cli) message(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if c.json {
+		return c.print(map[string]string{"message": msg}, nil, nil)
+	}
+	_, err := fmt.Fprintln(c.out, msg)
+	return err
+}
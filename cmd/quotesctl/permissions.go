@@ -0,0 +1,105 @@
+// Filename: cmd/quotesctl/permissions.go
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// listPermissions prints the codes held by a user, or every code that
+// exists when no email is given
+func (c *cli) listPermissions(args []string) error {
+	fs := newFlags("permissions list")
+	email := fs.String("email", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var permissions data.Permissions
+	var err error
+	if *email == "" {
+		permissions, err = c.models.Permissions.GetAll(c.ctx)
+	} else {
+		var user *data.User
+		user, err = c.userByEmail(*email)
+		if err != nil {
+			return err
+		}
+		permissions, err = c.models.Permissions.GetAllForUser(c.ctx, user.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	rows := make([][]string, 0, len(permissions))
+	for _, code := range permissions {
+		rows = append(rows, []string{code})
+	}
+	return c.print(permissions, []string{"CODE"}, rows)
+}
+
+func (c *cli) grantPermissions(args []string) error {
+	user, codes, err := c.permissionArgs("permissions grant", args)
+	if err != nil {
+		return err
+	}
+	err = c.models.Permissions.AddForUser(c.ctx, user.ID, codes...)
+	if err != nil {
+		return err
+	}
+	return c.message("granted %s to %s", strings.Join(codes, ", "), user.Email)
+}
+
+func (c *cli) revokePermissions(args []string) error {
+	user, codes, err := c.permissionArgs("permissions revoke", args)
+	if err != nil {
+		return err
+	}
+	err = c.models.Permissions.RemoveForUser(c.ctx, user.ID, codes...)
+	if err != nil {
+		return err
+	}
+	return c.message("revoked %s from %s", strings.Join(codes, ", "), user.Email)
+}
+
+func (c *cli) permissionArgs(name string, args []string) (*data.User, []string, error) {
+	fs := newFlags(name)
+	email := fs.String("email", "", "")
+	code := fs.String("code", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return nil, nil, err
+	}
+	codes := splitCodes(*code)
+	if len(codes) == 0 {
+		return nil, nil, fmt.Errorf("-code: %w", errUsage)
+	}
+	err := c.checkCodes(codes)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, codes, nil
+}
+
+// checkCodes() makes sure that every code exists, AddForUser() would
+// otherwise skip unknown codes without saying so
+func (c *cli) checkCodes(codes []string) error {
+	known, err := c.models.Permissions.GetAll(c.ctx)
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if !known.Contains(code) {
+			return fmt.Errorf("unknown permission %q, the known permissions are %s", code, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Filename: cmd/quotesctl/quotes.go
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// exportQuotes writes every quote as a JSON array, which importQuotes reads
+// back in
+func (c *cli) exportQuotes(args []string) error {
+	fs := newFlags("quotes export")
+	file := fs.String("file", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	quotes := []*data.Quote{}
+	filters := data.Filters{Page: 1, PageSize: 100, Sort: "id", SortList: []string{"id"}}
+	for {
+		page, metadata, err := c.models.Quote.GetAll(c.ctx, "", "", []string{}, filters)
+		if err != nil {
+			return err
+		}
+		quotes = append(quotes, page...)
+		if filters.Page >= metadata.LastPage {
+			break
+		}
+		filters.Page++
+	}
+
+	out := c.out
+	if *file != "" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "\t")
+	err := enc.Encode(quotes)
+	if err != nil {
+		return err
+	}
+	if *file != "" {
+		return c.message("exported %d quotes to %s", len(quotes), *file)
+	}
+	return nil
+}
+
+// importQuotes creates a quote for each entry of a JSON array. The ids and
+// versions in the file are ignored. Nothing is imported unless every entry
+// is valid
+func (c *cli) importQuotes(args []string) error {
+	fs := newFlags("quotes import")
+	file := fs.String("file", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	var in io.Reader = c.in
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var quotes []*data.Quote
+	err := json.NewDecoder(in).Decode(&quotes)
+	if err != nil {
+		return fmt.Errorf("reading quotes: %w", err)
+	}
+	for i, quote := range quotes {
+		v := validator.New()
+		if data.ValidateQuote(v, quote); !v.Valid() {
+			return fmt.Errorf("quote %d: %w", i+1, validationError(v))
+		}
+	}
+
+	for i, quote := range quotes {
+		err = c.models.Quote.Insert(c.ctx, quote)
+		if err != nil {
+			return fmt.Errorf("quote %d: %w (%d imported before it)", i+1, err, i)
+		}
+	}
+	return c.message("imported %d quotes", len(quotes))
+}
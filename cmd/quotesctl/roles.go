@@ -0,0 +1,113 @@
+// Filename: cmd/quotesctl/roles.go
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// listRoles prints every role with the codes that it grants, or the roles
+// of a user when an email is given
+func (c *cli) listRoles(args []string) error {
+	fs := newFlags("roles list")
+	email := fs.String("email", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if *email != "" {
+		user, err := c.userByEmail(*email)
+		if err != nil {
+			return err
+		}
+		names, err := c.models.Permissions.GetRolesForUser(c.ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(names))
+		for _, name := range names {
+			rows = append(rows, []string{name})
+		}
+		return c.print(names, []string{"ROLE"}, rows)
+	}
+
+	roles, err := c.models.Permissions.GetRoles(c.ctx)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(roles))
+	for _, role := range roles {
+		rows = append(rows, []string{role.Name, strings.Join(role.Permissions, ",")})
+	}
+	return c.print(roles, []string{"ROLE", "PERMISSIONS"}, rows)
+}
+
+func (c *cli) assignRoles(args []string) error {
+	user, names, err := c.roleArgs("roles assign", args)
+	if err != nil {
+		return err
+	}
+	err = c.models.Permissions.AddRolesForUser(c.ctx, user.ID, names...)
+	if err != nil {
+		return err
+	}
+	return c.message("added %s to %s", user.Email, strings.Join(names, ", "))
+}
+
+func (c *cli) unassignRoles(args []string) error {
+	user, names, err := c.roleArgs("roles unassign", args)
+	if err != nil {
+		return err
+	}
+	err = c.models.Permissions.RemoveRolesForUser(c.ctx, user.ID, names...)
+	if err != nil {
+		return err
+	}
+	return c.message("removed %s from %s", user.Email, strings.Join(names, ", "))
+}
+
+func (c *cli) roleArgs(name string, args []string) (*data.User, []string, error) {
+	fs := newFlags(name)
+	email := fs.String("email", "", "")
+	role := fs.String("role", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return nil, nil, err
+	}
+	names := splitCodes(*role)
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("-role: %w", errUsage)
+	}
+	err := c.checkRoles(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, names, nil
+}
+
+// checkRoles() makes sure that every role exists, AddRolesForUser() would
+// otherwise skip unknown roles without saying so
+func (c *cli) checkRoles(names []string) error {
+	roles, err := c.models.Permissions.GetRoles(c.ctx)
+	if err != nil {
+		return err
+	}
+	known := make([]string, 0, len(roles))
+	exists := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		known = append(known, role.Name)
+		exists[role.Name] = true
+	}
+	for _, name := range names {
+		if !exists[name] {
+			return fmt.Errorf("unknown role %q, the known roles are %s", name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Filename: cmd/quotesctl/tokens.go
+
+package main
+
+import (
+	"fmt"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+func (c *cli) purgeTokens(args []string) error {
+	fs := newFlags("tokens purge")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	n, err := c.models.Tokens.DeleteExpired(c.ctx)
+	if err != nil {
+		return err
+	}
+	return c.message("purged %d expired tokens", n)
+}
+
+// revokeTokens signs a user out everywhere, or cancels their pending
+// activation
+func (c *cli) revokeTokens(args []string) error {
+	fs := newFlags("tokens revoke")
+	email := fs.String("email", "", "")
+	scope := fs.String("scope", data.ScopeAuthentication, "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var scopes []string
+	switch *scope {
+	case data.ScopeAuthentication:
+		// Signing out has to take the refresh tokens too
+		scopes = []string{data.ScopeAuthentication, data.ScopeRefresh}
+	case data.ScopeActivation:
+		scopes = []string{*scope}
+	case "all":
+		scopes = []string{data.ScopeAuthentication, data.ScopeRefresh, data.ScopeActivation}
+	default:
+		return fmt.Errorf("-scope %q: %w", *scope, errUsage)
+	}
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		err = c.models.Tokens.DeleteAllForUsers(c.ctx, scope, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return c.message("revoked the %s tokens of %s", *scope, user.Email)
+}
@@ -0,0 +1,154 @@
+// Filename: cmd/quotesctl/users.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// validationError() reports the validator errors on a single line
+func validationError(v *validator.Validator) error {
+	problems := make([]string, 0, len(v.Errors))
+	for field, message := range v.Errors {
+		problems = append(problems, field+" "+message)
+	}
+	return errors.New("invalid input: " + strings.Join(problems, ", "))
+}
+
+func (c *cli) createUser(args []string) error {
+	fs := newFlags("users create")
+	name := fs.String("name", "", "")
+	email := fs.String("email", "", "")
+	password := fs.String("password", "", "")
+	activated := fs.Bool("activated", false, "")
+	permissions := fs.String("permissions", "quotes:read", "")
+	roles := fs.String("roles", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	user := &data.User{
+		Name:      *name,
+		Email:     *email,
+		Activated: *activated,
+	}
+	err := user.Password.Set(*password)
+	if err != nil {
+		return err
+	}
+	v := validator.New()
+	if data.ValidateUser(v, user); !v.Valid() {
+		return validationError(v)
+	}
+	codes := splitCodes(*permissions)
+	err = c.checkCodes(codes)
+	if err != nil {
+		return err
+	}
+	names := splitCodes(*roles)
+	err = c.checkRoles(names)
+	if err != nil {
+		return err
+	}
+
+	err = c.models.WithTx(c.ctx, func(m data.Models) error {
+		err := m.Users.Insert(c.ctx, user)
+		if err != nil {
+			return err
+		}
+		if len(codes) > 0 {
+			err = m.Permissions.AddForUser(c.ctx, user.ID, codes...)
+			if err != nil {
+				return err
+			}
+		}
+		if len(names) > 0 {
+			err = m.Permissions.AddRolesForUser(c.ctx, user.ID, names...)
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			return fmt.Errorf("a user with the email %s already exists", user.Email)
+		}
+		return err
+	}
+	return c.printUsers([]*data.User{user})
+}
+
+func (c *cli) listUsers(args []string) error {
+	fs := newFlags("users list")
+	page := fs.Int("page", 1, "")
+	pageSize := fs.Int("page-size", 50, "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	filters := data.Filters{Page: *page, PageSize: *pageSize, Sort: "id", SortList: []string{"id"}}
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return validationError(v)
+	}
+	users, _, err := c.models.Users.GetAll(c.ctx, "", "", nil, filters)
+	if err != nil {
+		return err
+	}
+	return c.printUsers(users)
+}
+
+func (c *cli) activateUser(args []string) error {
+	fs := newFlags("users activate")
+	email := fs.String("email", "", "")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(*email)
+	if err != nil {
+		return err
+	}
+	if user.Activated {
+		return c.message("%s is already activated", user.Email)
+	}
+	user.Activated = true
+	err = c.models.Users.Update(c.ctx, user)
+	if err != nil {
+		return err
+	}
+	// Any outstanding activation tokens are no use now
+	err = c.models.Tokens.DeleteAllForUsers(c.ctx, data.ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+	return c.message("%s has been activated", user.Email)
+}
+
+func (c *cli) printUsers(users []*data.User) error {
+	rows := make([][]string, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, []string{
+			strconv.FormatInt(user.ID, 10),
+			user.Name,
+			user.Email,
+			strconv.FormatBool(user.Activated),
+			user.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return c.print(users, []string{"ID", "NAME", "EMAIL", "ACTIVATED", "CREATED"}, rows)
+}
+
+func (c *cli) userByEmail(email string) (*data.User, error) {
+	if email == "" {
+		return nil, fmt.Errorf("-email: %w", errUsage)
+	}
+	user, err := c.models.Users.GetByEmail(c.ctx, email)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, fmt.Errorf("no user with the email %s", email)
+	}
+	return user, err
+}
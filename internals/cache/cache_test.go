@@ -0,0 +1,106 @@
+// Filename: internals/cache/cache_test.go
+
+package cache_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/cache"
+	"quotesapi.desireamagwula.net/internals/cache/cachetest"
+)
+
+// expectEntry() fails the test unless store holds want under key, or holds
+// nothing if want is empty
+func expectEntry(t *testing.T, store cache.Store, key, want string) {
+	t.Helper()
+	value, ok, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get %q: %v", key, err)
+	}
+	switch {
+	case want == "" && ok:
+		t.Errorf("get %q: got %q; want a miss", key, value)
+	case want != "" && !ok:
+		t.Errorf("get %q: got a miss; want %q", key, want)
+	case want != "" && string(value) != want:
+		t.Errorf("get %q: got %q; want %q", key, value, want)
+	}
+}
+
+func set(t *testing.T, store cache.Store, key, value string, ttl time.Duration) {
+	t.Helper()
+	err := store.Set(context.Background(), key, []byte(value), ttl)
+	if err != nil {
+		t.Fatalf("set %q: %v", key, err)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := cache.NewLRU(2)
+	set(t, c, "a", "1", time.Minute)
+	set(t, c, "b", "2", time.Minute)
+	// Reading a makes b the least recently used
+	expectEntry(t, c, "a", "1")
+	set(t, c, "c", "3", time.Minute)
+	expectEntry(t, c, "b", "")
+	expectEntry(t, c, "a", "1")
+	expectEntry(t, c, "c", "3")
+
+	// Setting a key again replaces its value without evicting anything
+	set(t, c, "a", "4", time.Minute)
+	expectEntry(t, c, "a", "4")
+	expectEntry(t, c, "c", "3")
+
+	set(t, c, "short", "5", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	expectEntry(t, c, "short", "")
+}
+
+func TestRedis(t *testing.T) {
+	server := cachetest.NewRedis(t, "s3cret")
+	c, err := cache.NewRedis(server.URL + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEntry(t, c, "a", "")
+	set(t, c, "a", "binary\r\n\x00value", time.Minute)
+	expectEntry(t, c, "a", "binary\r\n\x00value")
+	set(t, c, "short", "1", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	expectEntry(t, c, "short", "")
+	// The connection is reused, so the password is only sent once
+	if n := server.Commands("AUTH"); n != 1 {
+		t.Errorf("got %d AUTH commands; want 1", n)
+	}
+	if n := server.Commands("SELECT"); n != 1 {
+		t.Errorf("got %d SELECT commands; want 1", n)
+	}
+
+	// Another database doesn't see the entry
+	other, err := cache.NewRedis(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEntry(t, other, "a", "")
+
+	wrong, err := cache.NewRedis(strings.Replace(server.URL, "s3cret", "wrong", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = wrong.Get(context.Background(), "a")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("got %v; want a WRONGPASS error", err)
+	}
+}
+
+func TestNewRedis(t *testing.T) {
+	for _, rawURL := range []string{"http://localhost", "redis://localhost/db"} {
+		_, err := cache.NewRedis(rawURL)
+		if err == nil {
+			t.Errorf("%s: got no error", rawURL)
+		}
+	}
+}
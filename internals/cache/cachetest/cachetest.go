@@ -0,0 +1,210 @@
+// Filename: internals/cache/cachetest/cachetest.go
+
+// Package cachetest runs a small in-process stand-in for a Redis server,
+// so that the Redis store can be tested without one. It only knows the
+// commands that cache.Redis sends: AUTH, SELECT, GET and SET with PX
+package cachetest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Redis is a running fake server
+type Redis struct {
+	// URL is the redis:// URL to give to cache.NewRedis()
+	URL string
+
+	password string
+	mu       sync.Mutex
+	dbs      map[int]map[string]redisEntry
+	commands map[string]int
+}
+
+type redisEntry struct {
+	value   string
+	expires time.Time
+}
+
+// NewRedis() starts a fake server that wants password, if it isn't empty,
+// and stops it when the test ends
+func NewRedis(t *testing.T, password string) *Redis {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Redis{
+		URL:      "redis://" + lis.Addr().String(),
+		password: password,
+		dbs:      make(map[int]map[string]redisEntry),
+		commands: make(map[string]int),
+	}
+	if password != "" {
+		s.URL = "redis://:" + password + "@" + lis.Addr().String()
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		lis.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+// Commands() returns how many times the command has been received
+func (s *Redis) Commands(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[name]
+}
+
+func (s *Redis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	db := 0
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		s.mu.Lock()
+		s.commands[name]++
+		s.mu.Unlock()
+
+		var reply string
+		switch {
+		case name == "AUTH":
+			if len(args) == 2 && args[1] == s.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "SELECT" && len(args) == 2:
+			db, err = strconv.Atoi(args[1])
+			if err != nil {
+				reply = "-ERR invalid DB index\r\n"
+			} else {
+				reply = "+OK\r\n"
+			}
+		case name == "GET" && len(args) == 2:
+			value, ok := s.get(db, args[1])
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case name == "SET" && len(args) == 5 && strings.ToUpper(args[3]) == "PX":
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil || ms <= 0 {
+				reply = "-ERR invalid expire time in 'set' command\r\n"
+				break
+			}
+			s.set(db, args[1], args[2], time.Duration(ms)*time.Millisecond)
+			reply = "+OK\r\n"
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Redis) get(db int, key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.dbs[db][key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.value, true
+}
+
+func (s *Redis) set(db int, key, value string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dbs[db] == nil {
+		s.dbs[db] = make(map[string]redisEntry)
+	}
+	s.dbs[db][key] = redisEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// readCommand() reads one command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, fmt.Errorf("cachetest: expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("cachetest: bad array length %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, fmt.Errorf("cachetest: expected a bulk string, got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("cachetest: bad bulk string length %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
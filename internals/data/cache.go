@@ -0,0 +1,425 @@
+// Filename: internals/data/cache.go
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
+	"quotesapi.desireamagwula.net/internals/cache"
+)
+
+// CachedQuotes puts a cache in front of QuoteStore.Get() and GetAll().
+// Every key holds a generation, which goes up with every write made here
+// and every change that arrives through the change listener, so a write
+// anywhere moves the readers on to new keys and the old entries are left
+// to expire. Change ids can't be used instead, as a transaction can commit
+// after one that was handed a higher id. The generation is only known to
+// this process, so the keys also start with an id picked when it starts,
+// and a restarted process or another replica never reads entries cached
+// for a different generation. Reads served by a lagging read replica can
+// be cached under a generation that is newer than they are, which the TTL
+// puts a bound on
+type CachedQuotes struct {
+	// Writes and GetMany() go straight to the store
+	QuoteStore
+
+	cache cache.Store
+	ttl   time.Duration
+
+	// Both are part of every key
+	instance   string
+	generation atomic.Int64
+	// Only one of the callers that miss on the same key reads the store,
+	// the rest wait for its answer
+	group singleflight.Group
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+}
+
+// CacheStats are the counters reported by CachedQuotes.Stats(). Errors
+// counts cache operations that failed, and were treated as misses
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	Errors int64 `json:"errors"`
+}
+
+// NewCachedQuotes() wraps store with a cache whose entries live for ttl
+func NewCachedQuotes(store QuoteStore, c cache.Store, ttl time.Duration) (*CachedQuotes, error) {
+	randomBytes := make([]byte, 8)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedQuotes{QuoteStore: store, cache: c, ttl: ttl, instance: hex.EncodeToString(randomBytes)}, nil
+}
+
+func (q *CachedQuotes) Stats() CacheStats {
+	return CacheStats{Hits: q.hits.Load(), Misses: q.misses.Load(), Errors: q.errors.Load()}
+}
+
+// Run() follows the changes made by every replica until the context is
+// cancelled or the listener stops
+func (q *CachedQuotes) Run(ctx context.Context, listener *ChangeListener) {
+	sub := listener.Subscribe()
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			q.generation.Add(1)
+		}
+		// A change that was dropped has to move it on as well
+		if sub.Lagged() {
+			q.generation.Add(1)
+		}
+	}
+}
+
+func (q *CachedQuotes) Insert(ctx context.Context, quote *Quote) error {
+	err := q.QuoteStore.Insert(ctx, quote)
+	if err != nil {
+		return err
+	}
+	q.generation.Add(1)
+	return nil
+}
+
+func (q *CachedQuotes) Update(ctx context.Context, quote *Quote) error {
+	err := q.QuoteStore.Update(ctx, quote)
+	if err != nil {
+		return err
+	}
+	q.generation.Add(1)
+	return nil
+}
+
+func (q *CachedQuotes) Delete(ctx context.Context, id int64) error {
+	err := q.QuoteStore.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	q.generation.Add(1)
+	return nil
+}
+
+// The cached form of a listing
+type cachedQuotePage struct {
+	Quotes   []*Quote
+	Metadata Metadata
+}
+
+func (q *CachedQuotes) Get(ctx context.Context, id int64) (*Quote, error) {
+	var quote Quote
+	err := q.cached(ctx, q.key("get", strconv.FormatInt(id, 10)), &quote, func(ctx context.Context) (interface{}, error) {
+		return q.QuoteStore.Get(ctx, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &quote, nil
+}
+
+func (q *CachedQuotes) GetAll(ctx context.Context, author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error) {
+	var page cachedQuotePage
+	key := q.key("list", listingKey(author, quote_string, category, filters))
+	err := q.cached(ctx, key, &page, func(ctx context.Context) (interface{}, error) {
+		quotes, metadata, err := q.QuoteStore.GetAll(ctx, author, quote_string, category, filters)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedQuotePage{Quotes: quotes, Metadata: metadata}, nil
+	})
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	// gob doesn't tell an empty slice from a nil one
+	if page.Quotes == nil {
+		page.Quotes = []*Quote{}
+	}
+	return page.Quotes, page.Metadata, nil
+}
+
+func (q *CachedQuotes) key(kind, rest string) string {
+	return fmt.Sprintf("quotes:%s:%d:%s:%s", q.instance, q.generation.Load(), kind, rest)
+}
+
+// listingKey() normalises the filters, so that searches which can only
+// return the same rows share an entry. The searches are reduced to their
+// sorted words, which is all that the queries look at
+func listingKey(author, quoteString string, category []string, filters Filters) string {
+	words := func(s string) string {
+		terms := searchTerms(s)
+		sort.Strings(terms)
+		return strings.Join(terms, " ")
+	}
+	categories := append([]string(nil), category...)
+	sort.Strings(categories)
+	v := url.Values{}
+	v.Set("author", words(author))
+	v.Set("quote_string", words(quoteString))
+	v["category"] = categories
+	v.Set("page", strconv.Itoa(filters.Page))
+	v.Set("page_size", strconv.Itoa(filters.PageSize))
+	v.Set("sort", filters.Sort)
+	return v.Encode()
+}
+
+// cacheFetchTimeout bounds a fetch made on a miss. The fetch doesn't stop
+// when the caller that started it goes away, as the other callers waiting
+// on the same key would get its error
+const cacheFetchTimeout = 30 * time.Second
+
+// cached() decodes the entry for key into dst. On a miss it calls fetch,
+// once for all of the callers waiting on the same key, and caches what it
+// returns. A cache that fails is counted and treated as a miss
+func (q *CachedQuotes) cached(ctx context.Context, key string, dst interface{}, fetch func(ctx context.Context) (interface{}, error)) error {
+	value, ok, err := q.cache.Get(ctx, key)
+	if err != nil {
+		q.errors.Add(1)
+	}
+	if ok {
+		if gob.NewDecoder(bytes.NewReader(value)).Decode(dst) == nil {
+			q.hits.Add(1)
+			return nil
+		}
+		q.errors.Add(1)
+	}
+	q.misses.Add(1)
+
+	result, err, _ := q.group.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheFetchTimeout)
+		defer cancel()
+		v, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := q.cache.Set(ctx, key, buf.Bytes(), q.ttl); err != nil {
+			q.errors.Add(1)
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(result.([]byte))).Decode(dst)
+}
+
+// The channel that the users_permissions_notify_change() trigger publishes
+// the ids of users whose permissions changed to
+const PermissionChangesChannel = "permission_changes"
+
+// CachedPermissions keeps the permissions of each user for a short while,
+// so that checking them doesn't cost a query on every request. Changes made
+// through it drop the user's entry at once. Changes made elsewhere, such as
+// by quotesctl, do the same when Listen() has been called, otherwise they
+// are seen when the entry expires
+type CachedPermissions struct {
+	// Writes, GetAll() and the role lookups go straight to the store
+	PermissionStore
+
+	ttl      time.Duration
+	listener *pq.Listener
+
+	mu      sync.Mutex
+	entries map[int64]cachedPermissions
+	// Bumped by every invalidation. A read that was in flight when it
+	// happened may have seen the old permissions, so isn't cached
+	generation uint64
+}
+
+type cachedPermissions struct {
+	permissions Permissions
+	expires     time.Time
+}
+
+// NewCachedPermissions() wraps store with a cache whose entries live for ttl
+func NewCachedPermissions(store PermissionStore, ttl time.Duration) *CachedPermissions {
+	return &CachedPermissions{
+		PermissionStore: store,
+		ttl:             ttl,
+		entries:         make(map[int64]cachedPermissions),
+	}
+}
+
+// Listen() connects to the Postgres database at dsn to hear about the
+// permission changes made by every process. Run() then applies them
+func (p *CachedPermissions) Listen(dsn string, onError func(error)) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+	err := listener.Listen(PermissionChangesChannel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	p.listener = listener
+	return nil
+}
+
+// Run() drops the entries of the users named in notifications, or every
+// entry for a notification without a user, until the context is cancelled. It returns at once if Listen() wasn't called
+func (p *CachedPermissions) Run(ctx context.Context) {
+	if p.listener == nil {
+		return
+	}
+	defer p.listener.Close()
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			go p.listener.Ping()
+		case n := <-p.listener.Notify:
+			// Notifications may have been missed while reconnecting
+			if n == nil {
+				p.invalidate()
+				continue
+			}
+			// A change to what a role grants comes without a user
+			if n.Extra == "" {
+				p.invalidate()
+				continue
+			}
+			userID, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				continue
+			}
+			p.invalidate(userID)
+		}
+	}
+}
+
+// Invalidate() drops the cached permissions of a user. It is for changes
+// made inside Models.WithTx(), whose models aren't cached, and which only
+// count once the transaction has committed
+func (p *CachedPermissions) Invalidate(userID int64) {
+	p.invalidate(userID)
+}
+
+// invalidate() drops the entries of the given users, or every entry if
+// there are none
+func (p *CachedPermissions) invalidate(userIDs ...int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.generation++
+	if len(userIDs) == 0 {
+		p.entries = make(map[int64]cachedPermissions)
+		return
+	}
+	for _, userID := range userIDs {
+		delete(p.entries, userID)
+	}
+}
+
+// lookup() returns the cached permissions of the users that have them, and
+// the generation to store the rest under
+func (p *CachedPermissions) lookup(userIDs []int64) (map[int64]Permissions, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	found := make(map[int64]Permissions)
+	for _, userID := range userIDs {
+		entry, ok := p.entries[userID]
+		if ok && now.Before(entry.expires) {
+			found[userID] = entry.permissions
+		}
+	}
+	return found, p.generation
+}
+
+func (p *CachedPermissions) store(generation uint64, loaded map[int64]Permissions) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if generation != p.generation {
+		return
+	}
+	expires := time.Now().Add(p.ttl)
+	for userID, permissions := range loaded {
+		p.entries[userID] = cachedPermissions{permissions: permissions, expires: expires}
+	}
+}
+
+func (p *CachedPermissions) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	byUser, err := p.GetAllForUsers(ctx, []int64{userID})
+	if err != nil {
+		return nil, err
+	}
+	return byUser[userID], nil
+}
+
+// GetAllForUsers() loads the users that aren't cached in a single query
+func (p *CachedPermissions) GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error) {
+	byUser, generation := p.lookup(userIDs)
+	var missing []int64
+	for _, userID := range userIDs {
+		if _, ok := byUser[userID]; !ok {
+			missing = append(missing, userID)
+		}
+	}
+	if len(missing) == 0 {
+		return byUser, nil
+	}
+	loaded, err := p.PermissionStore.GetAllForUsers(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	// Users without permissions are cached too
+	for _, userID := range missing {
+		if _, ok := loaded[userID]; !ok {
+			loaded[userID] = Permissions{}
+		}
+		byUser[userID] = loaded[userID]
+	}
+	p.store(generation, loaded)
+	return byUser, nil
+}
+
+func (p *CachedPermissions) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer p.invalidate(userID)
+	return p.PermissionStore.AddForUser(ctx, userID, codes...)
+}
+
+func (p *CachedPermissions) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer p.invalidate(userID)
+	return p.PermissionStore.RemoveForUser(ctx, userID, codes...)
+}
+
+func (p *CachedPermissions) AddRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	defer p.invalidate(userID)
+	return p.PermissionStore.AddRolesForUser(ctx, userID, roles...)
+}
+
+func (p *CachedPermissions) RemoveRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	defer p.invalidate(userID)
+	return p.PermissionStore.RemoveRolesForUser(ctx, userID, roles...)
+}
@@ -0,0 +1,346 @@
+// Filename: internals/data/cache_test.go
+
+package data_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/cache"
+	"quotesapi.desireamagwula.net/internals/cache/cachetest"
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+// slowQuotes counts the reads that reach the store, and holds them until
+// release is closed or their context is done
+type slowQuotes struct {
+	data.QuoteStore
+	reads   atomic.Int64
+	release chan struct{}
+}
+
+func (s *slowQuotes) Get(ctx context.Context, id int64) (*data.Quote, error) {
+	s.reads.Add(1)
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.QuoteStore.Get(ctx, id)
+}
+
+// The stores that CachedQuotes is tested on
+var cacheStores = []struct {
+	name string
+	new  func(t *testing.T) cache.Store
+}{
+	{"lru", func(t *testing.T) cache.Store {
+		return cache.NewLRU(100)
+	}},
+	{"redis", func(t *testing.T) cache.Store {
+		c, err := cache.NewRedis(cachetest.NewRedis(t, "").URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}},
+}
+
+func insertQuote(t *testing.T, store data.QuoteStore, author string) *data.Quote {
+	t.Helper()
+	quote := &data.Quote{Author: author, Quote_string: "Cache me if you can", Category: []string{"test"}}
+	err := store.Insert(context.Background(), quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return quote
+}
+
+// waitFor() polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachedQuotes(t *testing.T) {
+	for _, store := range cacheStores {
+		t.Run(store.name, func(t *testing.T) {
+			t.Run("stampede", func(t *testing.T) {
+				testCacheStampede(t, store.new(t))
+			})
+			t.Run("cancelled caller", func(t *testing.T) {
+				testCacheCancelledCaller(t, store.new(t))
+			})
+			t.Run("invalidation", func(t *testing.T) {
+				testCacheInvalidation(t, store.new(t))
+			})
+			t.Run("out of order commits", func(t *testing.T) {
+				testCacheOutOfOrderCommits(t, store.new(t))
+			})
+		})
+	}
+}
+
+// Callers that miss on the same key at once share a single read
+func testCacheStampede(t *testing.T, c cache.Store) {
+	ctx := context.Background()
+	m := data.NewMemoryModels()
+	quote := insertQuote(t, m.Quote, "Stampede")
+	slow := &slowQuotes{QuoteStore: m.Quote, release: make(chan struct{})}
+	q, err := data.NewCachedQuotes(slow, c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := q.Get(ctx, quote.ID)
+			if err == nil && got.Author != quote.Author {
+				t.Errorf("got author %q; want %q", got.Author, quote.Author)
+			}
+			errs <- err
+		}()
+	}
+	waitFor(t, "the first read", func() bool { return slow.reads.Load() > 0 })
+	// Give the other callers time to miss and queue up behind it
+	time.Sleep(50 * time.Millisecond)
+	close(slow.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := slow.reads.Load(); n != 1 {
+		t.Errorf("got %d reads of the store; want 1", n)
+	}
+	if stats := q.Stats(); stats.Misses != callers {
+		t.Errorf("got %d misses; want %d", stats.Misses, callers)
+	}
+
+	_, err = q.Get(ctx, quote.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := slow.reads.Load(); n != 1 {
+		t.Errorf("got %d reads of the store after a hit; want 1", n)
+	}
+}
+
+// The caller that starts a read going away doesn't fail the others that
+// wait on it
+func testCacheCancelledCaller(t *testing.T, c cache.Store) {
+	m := data.NewMemoryModels()
+	quote := insertQuote(t, m.Quote, "Cancelled")
+	slow := &slowQuotes{QuoteStore: m.Quote, release: make(chan struct{})}
+	q, err := data.NewCachedQuotes(slow, c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := q.Get(ctx, quote.ID)
+		first <- err
+	}()
+	waitFor(t, "the first read", func() bool { return slow.reads.Load() > 0 })
+	second := make(chan error, 1)
+	go func() {
+		_, err := q.Get(context.Background(), quote.ID)
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	close(slow.release)
+
+	if err := <-second; err != nil {
+		t.Errorf("the waiting caller got %v; want no error", err)
+	}
+	<-first
+	if n := slow.reads.Load(); n != 1 {
+		t.Errorf("got %d reads of the store; want 1", n)
+	}
+}
+
+// Writes move the readers on to new keys, straight away for those made
+// through the cache and through the change listener for the rest
+func testCacheInvalidation(t *testing.T, c cache.Store) {
+	ctx := context.Background()
+	m := data.NewMemoryModels()
+	quote := insertQuote(t, m.Quote, "Before")
+	q, err := data.NewCachedQuotes(m.Quote, c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := func() string {
+		t.Helper()
+		got, err := q.Get(ctx, quote.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Author
+	}
+	listing := func() int {
+		t.Helper()
+		quotes, _, err := q.GetAll(ctx, "", "", []string{}, data.Filters{Page: 1, PageSize: 20, Sort: "id", SortList: []string{"id"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(quotes)
+	}
+	if got := author(); got != "Before" {
+		t.Fatalf("got author %q; want %q", got, "Before")
+	}
+	if got := listing(); got != 1 {
+		t.Fatalf("got %d quotes; want 1", got)
+	}
+
+	// A write through the cache
+	quote.Author = "Through the cache"
+	err = q.Update(ctx, quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := author(); got != "Through the cache" {
+		t.Errorf("got author %q; want %q", got, "Through the cache")
+	}
+	insertQuote(t, q, "Another")
+	if got := listing(); got != 2 {
+		t.Errorf("got %d quotes; want 2", got)
+	}
+
+	// A write by another replica is served from the cache until its
+	// change arrives
+	author()
+	listener, err := data.NewPollingChangeListener(ctx, m.Changes, 5*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote.Author = "Elsewhere"
+	err = m.Quote.Update(ctx, quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := author(); got != "Through the cache" {
+		t.Errorf("got author %q before the change arrived; want %q", got, "Through the cache")
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go listener.Run(runCtx)
+	go q.Run(runCtx, listener)
+	waitFor(t, "the change to arrive", func() bool { return author() == "Elsewhere" })
+}
+
+// commitLog is a change log that the test commits to in any order of the
+// change ids, as concurrent transactions do
+type commitLog struct {
+	data.ChangeStore
+	mu      sync.Mutex
+	changes []*data.QuoteChange
+}
+
+func (l *commitLog) commit(id int64, xid uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, &data.QuoteChange{ID: id, XID: xid, EventType: "quote.updated"})
+}
+
+func (l *commitLog) GetSince(ctx context.Context, after data.SyncToken, limit int) ([]*data.QuoteChange, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changes := []*data.QuoteChange{}
+	for _, change := range l.changes {
+		if after.Before(change.Token()) && len(changes) < limit {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (l *commitLog) Latest(ctx context.Context) (data.SyncToken, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.changes) == 0 {
+		return data.SyncToken{}, nil
+	}
+	return l.changes[len(l.changes)-1].Token(), nil
+}
+
+// A change that was handed a lower id than one before it, but committed
+// after it, still moves the readers on
+func testCacheOutOfOrderCommits(t *testing.T, c cache.Store) {
+	ctx := context.Background()
+	m := data.NewMemoryModels()
+	quote := insertQuote(t, m.Quote, "Before")
+	q, err := data.NewCachedQuotes(m.Quote, c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := func(q *data.CachedQuotes) string {
+		t.Helper()
+		got, err := q.Get(ctx, quote.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Author
+	}
+	log := &commitLog{}
+	listener, err := data.NewPollingChangeListener(ctx, log, 5*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go listener.Run(runCtx)
+	go q.Run(runCtx, listener)
+
+	// Writes by another replica, whose changes arrive through the log
+	update := func(name string, id int64, xid uint64) {
+		t.Helper()
+		quote.Author = name
+		err := m.Quote.Update(ctx, quote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.commit(id, xid)
+	}
+	if got := author(q); got != "Before" {
+		t.Fatalf("got author %q; want %q", got, "Before")
+	}
+	update("First", 5, 10)
+	waitFor(t, "the first change to arrive", func() bool { return author(q) == "First" })
+	update("Second", 4, 11)
+	waitFor(t, "the second change to arrive", func() bool { return author(q) == "Second" })
+
+	// A restarted process starts counting again, and must not be handed
+	// what was cached before
+	restarted, err := data.NewCachedQuotes(m.Quote, c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quote.Author = "After the restart"
+	err = m.Quote.Update(ctx, quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := author(restarted); got != "After the restart" {
+		t.Errorf("got author %q after a restart; want %q", got, "After the restart")
+	}
+}
@@ -0,0 +1,464 @@
+// Filename: internals/data/changes.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// The channel that the quotes_notify_change() trigger publishes to
+const QuoteChangesChannel = "quote_changes"
+
+var ErrInvalidSyncToken = errors.New("invalid sync token")
+
+// A QuoteChange is a single row of the quote_changes table. For deletes
+// Quote holds the row as it was before it was removed
+type QuoteChange struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	QuoteID   int64     `json:"quote_id"`
+	EventType string    `json:"event_type"`
+	Version   int32     `json:"version"`
+	Quote     *Quote    `json:"quote"`
+	// The transaction that made the change, which orders it in the log
+	XID uint64 `json:"-"`
+}
+
+// Token() returns the position of the change in the log
+func (c *QuoteChange) Token() SyncToken {
+	return SyncToken{XID: c.XID, ID: c.ID}
+}
+
+// QuoteFilter holds the listing filters so that they can be applied to a
+// single quote outside of the database
+type QuoteFilter struct {
+	Author       string
+	Quote_string string
+	Category     []string
+}
+
+// Matches() mirrors the WHERE clause of QuoteModel.GetAll()
+func (f QuoteFilter) Matches(quote *Quote) bool {
+	if quote == nil {
+		return false
+	}
+	if !matchesSearch(quote.Author, f.Author) || !matchesSearch(quote.Quote_string, f.Quote_string) {
+		return false
+	}
+	for _, category := range f.Category {
+		found := false
+		for _, c := range quote.Category {
+			if c == category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesSearch() behaves like to_tsvector('simple', text) @@
+// plainto_tsquery('simple', query). Every word in the query has to appear
+// in the text, ignoring case and punctuation
+func matchesSearch(text, query string) bool {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return true
+	}
+	words := make(map[string]bool)
+	for _, word := range searchTerms(text) {
+		words[word] = true
+	}
+	for _, term := range terms {
+		if !words[term] {
+			return false
+		}
+	}
+	return true
+}
+
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type ChangeModel struct {
+	DB   Querier
+	opts *Options
+}
+
+// GetSince() returns up to limit changes that come after the token, in the
+// order of the log. Only changes from transactions older than every
+// transaction still in flight are read, so nothing can later appear behind
+// the last change that is returned
+func (m ChangeModel) GetSince(ctx context.Context, after SyncToken, limit int) ([]*QuoteChange, error) {
+	query := `
+		SELECT xid::text, id, created_at, quote_id, event_type, version, payload
+		FROM quote_changes
+		WHERE (xid, id) > ($1::text::xid8, $2)
+		AND xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY xid, id
+		LIMIT $3
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.GetSince")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, strconv.FormatUint(after.XID, 10), after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*QuoteChange{}
+	for rows.Next() {
+		var change QuoteChange
+		var xid string
+		var payload []byte
+		err := rows.Scan(
+			&xid,
+			&change.ID,
+			&change.CreatedAt,
+			&change.QuoteID,
+			&change.EventType,
+			&change.Version,
+			&payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+		change.XID, err = strconv.ParseUint(xid, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(payload, &change.Quote)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Latest() returns the token of the last change that GetSince() can see,
+// or the zero token when there is none
+func (m ChangeModel) Latest(ctx context.Context) (SyncToken, error) {
+	query := `
+		SELECT xid::text, id
+		FROM quote_changes
+		WHERE xid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY xid DESC, id DESC
+		LIMIT 1
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.Latest")
+	defer cancel()
+	var token SyncToken
+	var xid string
+	err := m.DB.QueryRowContext(ctx, query).Scan(&xid, &token.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return SyncToken{}, nil
+		default:
+			return SyncToken{}, err
+		}
+	}
+	token.XID, err = strconv.ParseUint(xid, 10, 64)
+	return token, err
+}
+
+// TokenFor() returns the token of the change with the given id
+func (m ChangeModel) TokenFor(ctx context.Context, id int64) (SyncToken, error) {
+	query := `
+		SELECT xid::text
+		FROM quote_changes
+		WHERE id = $1
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.TokenFor")
+	defer cancel()
+	var xid string
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&xid)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return SyncToken{}, ErrRecordNotFound
+		default:
+			return SyncToken{}, err
+		}
+	}
+	token := SyncToken{ID: id}
+	token.XID, err = strconv.ParseUint(xid, 10, 64)
+	return token, err
+}
+
+// A SyncToken marks a position in the change feed. Changes are ordered by
+// the transaction that made them and then by id
+type SyncToken struct {
+	XID uint64
+	ID  int64
+}
+
+// Before() reports whether the token comes before u in the log
+func (t SyncToken) Before(u SyncToken) bool {
+	return t.XID < u.XID || (t.XID == u.XID && t.ID < u.ID)
+}
+
+// String() returns the opaque form of the token that is handed to clients
+func (t SyncToken) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", t.XID, t.ID)))
+}
+
+// The ParseSyncToken() function reverses String(). An empty string is the
+// start of the feed
+func ParseSyncToken(s string) (SyncToken, error) {
+	var token SyncToken
+	if s == "" {
+		return token, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, ErrInvalidSyncToken
+	}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 2 {
+		return token, ErrInvalidSyncToken
+	}
+	token.XID, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return token, ErrInvalidSyncToken
+	}
+	token.ID, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || token.ID < 0 {
+		return token, ErrInvalidSyncToken
+	}
+	return token, nil
+}
+
+// GetFeed() returns the next page of changes after the token along with the
+// token for the page after it. It reads the same changes as GetSince(), but
+// within a page only the latest change to each quote is kept
+func (m ChangeModel) GetFeed(ctx context.Context, since SyncToken, limit int) ([]*QuoteChange, SyncToken, bool, error) {
+	// Read one extra row to find out whether there is another page
+	changes, err := m.GetSince(ctx, since, limit+1)
+	if err != nil {
+		return nil, since, false, err
+	}
+	changes, next, more := feedPage(changes, since, limit)
+	return changes, next, more, nil
+}
+
+// feedPage() turns up to limit+1 changes read after since into a page of
+// the feed. An empty page hands back the token that it was asked for
+func feedPage(changes []*QuoteChange, since SyncToken, limit int) ([]*QuoteChange, SyncToken, bool) {
+	more := len(changes) > limit
+	if more {
+		changes = changes[:limit]
+	}
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Token()
+	}
+	return compactChanges(changes), next, more
+}
+
+// compactChanges() drops every change that is followed by a later change
+// to the same quote, keeping the order of what is left
+func compactChanges(changes []*QuoteChange) []*QuoteChange {
+	last := make(map[int64]int)
+	for i, change := range changes {
+		last[change.QuoteID] = i
+	}
+	compacted := make([]*QuoteChange, 0, len(last))
+	for i, change := range changes {
+		if last[change.QuoteID] == i {
+			compacted = append(compacted, change)
+		}
+	}
+	return compacted
+}
+
+// A ChangeListener reads the change log and fans the changes out to
+// subscribers in the order of the log. Every API replica runs its own
+// listener, so every replica sees every change. The notifications sent by
+// the trigger on the quotes table only carry the id of the change, they
+// wake the listener up to read the log. The log is also read every
+// interval, which picks up the changes that were held back behind an older
+// transaction, and is all that databases without LISTEN/NOTIFY get
+type ChangeListener struct {
+	listener    *pq.Listener
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+
+	store    ChangeStore
+	interval time.Duration
+	last     SyncToken
+	onError  func(error)
+}
+
+// A Subscription receives changes on C. If the subscriber falls behind,
+// changes are dropped and Lagged() reports true. The subscriber should then
+// catch up with ChangeStore.GetSince()
+type Subscription struct {
+	C        chan *QuoteChange
+	lagged   int32
+	listener *ChangeListener
+}
+
+func (s *Subscription) Lagged() bool {
+	return atomic.SwapInt32(&s.lagged, 0) == 1
+}
+
+// Close() stops delivery to the subscription
+func (s *Subscription) Close() {
+	s.listener.mu.Lock()
+	defer s.listener.mu.Unlock()
+	if _, ok := s.listener.subscribers[s]; ok {
+		delete(s.listener.subscribers, s)
+		close(s.C)
+	}
+}
+
+// The NewChangeListener() function connects to the database and starts
+// listening. Changes made before it was created are not delivered.
+// Connection problems and failed reads are passed to onError
+func NewChangeListener(ctx context.Context, dsn string, store ChangeStore, interval time.Duration, onError func(error)) (*ChangeListener, error) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+	err := listener.Listen(QuoteChangesChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	l, err := NewPollingChangeListener(ctx, store, interval, onError)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	l.listener = listener
+	return l, nil
+}
+
+// NewPollingChangeListener() returns a listener that only reads the log
+// every interval
+func NewPollingChangeListener(ctx context.Context, store ChangeStore, interval time.Duration, onError func(error)) (*ChangeListener, error) {
+	last, err := store.Latest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangeListener{
+		subscribers: make(map[*Subscription]struct{}),
+		store:       store,
+		interval:    interval,
+		last:        last,
+		onError:     onError,
+	}, nil
+}
+
+func (l *ChangeListener) Subscribe() *Subscription {
+	sub := &Subscription{
+		C:        make(chan *QuoteChange, 64),
+		listener: l,
+	}
+	l.mu.Lock()
+	l.subscribers[sub] = struct{}{}
+	l.mu.Unlock()
+	return sub
+}
+
+// Run() delivers changes until the context is cancelled, at which point
+// every subscription channel is closed
+func (l *ChangeListener) Run(ctx context.Context) {
+	defer func() {
+		l.mu.Lock()
+		for sub := range l.subscribers {
+			delete(l.subscribers, sub)
+			close(sub.C)
+		}
+		l.mu.Unlock()
+		if l.listener != nil {
+			l.listener.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	var notify <-chan *pq.Notification
+	var ping <-chan time.Time
+	if l.listener != nil {
+		notify = l.listener.Notify
+		pingTicker := time.NewTicker(90 * time.Second)
+		defer pingTicker.Stop()
+		ping = pingTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping:
+			go l.listener.Ping()
+			continue
+		case <-notify:
+			// A nil notification means that the connection was
+			// re-established. Reading the log covers anything that was
+			// missed, and every notification that is already waiting
+			for len(notify) > 0 {
+				<-notify
+			}
+		case <-ticker.C:
+		}
+		l.read(ctx)
+	}
+}
+
+// read() hands out the changes made since the last one that was delivered
+func (l *ChangeListener) read(ctx context.Context) {
+	for {
+		changes, err := l.store.GetSince(ctx, l.last, 500)
+		if err != nil {
+			if l.onError != nil && ctx.Err() == nil {
+				l.onError(err)
+			}
+			return
+		}
+		for _, change := range changes {
+			l.broadcast(change)
+			l.last = change.Token()
+		}
+		if len(changes) < 500 {
+			return
+		}
+	}
+}
+
+func (l *ChangeListener) broadcast(change *QuoteChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for sub := range l.subscribers {
+		select {
+		case sub.C <- change:
+		default:
+			atomic.StoreInt32(&sub.lagged, 1)
+		}
+	}
+}
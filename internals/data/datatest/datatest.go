@@ -0,0 +1,1235 @@
+// Filename: internals/data/datatest/datatest.go
+
+// Package datatest is the conformance suite for implementations of the
+// data.Models interfaces. Every implementation has to pass it, so that the
+// handlers behave the same whichever one they are given. It is run from
+// the _test.go files of the data package, and writes rows, so a database
+// that it is pointed at has to be a throwaway one
+package datatest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+)
+
+var checks = []struct {
+	name string
+	fn   func(*checker) error
+}{
+	{"quotes", (*checker).quotes},
+	{"quote listing", (*checker).quoteListing},
+	{"users", (*checker).users},
+	{"tokens", (*checker).tokens},
+	{"sessions", (*checker).sessions},
+	{"refresh tokens", (*checker).refreshTokens},
+	{"token denylist", (*checker).denylist},
+	{"permissions", (*checker).permissions},
+	{"roles", (*checker).roles},
+	{"transactions", (*checker).transactions},
+	{"webhooks", (*checker).webhooks},
+	{"changes", (*checker).changes},
+	{"change feed paging", (*checker).changeFeedPaging},
+}
+
+// Run() runs every check as a subtest of t. newModels is called once per
+// check, so it can hand out a fresh store every time or keep returning the
+// same database. Rows are tagged with a random word so that the checks
+// aren't thrown by data that is already there
+func Run(t *testing.T, newModels func(t *testing.T) data.Models) {
+	for _, check := range checks {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			c := &checker{t: t, ctx: context.Background(), m: newModels(t), tag: "t" + randomHex(6)}
+			err := check.fn(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+type checker struct {
+	t   *testing.T
+	ctx context.Context
+	m   data.Models
+	tag string
+}
+
+// errorf() records a failure and carries on, returning an error from a
+// check stops it
+func (c *checker) errorf(format string, args ...interface{}) {
+	c.t.Helper()
+	c.t.Errorf(format, args...)
+}
+
+func (c *checker) expect(err, target error, what string) {
+	c.t.Helper()
+	if !errors.Is(err, target) {
+		c.errorf("%s: got error %v, want %v", what, err, target)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *checker) newQuote(author, text string, category ...string) (*data.Quote, error) {
+	quote := &data.Quote{Author: author, Quote_string: text, Category: category}
+	err := c.m.Quote.Insert(c.ctx, quote)
+	if err != nil {
+		return nil, fmt.Errorf("Insert(): %w", err)
+	}
+	return quote, nil
+}
+
+func (c *checker) quotes() error {
+	quote, err := c.newQuote(c.tag+" author", "a quote", "conformance")
+	if err != nil {
+		return err
+	}
+	if quote.ID < 1 || quote.Version != 1 || quote.CreatedAt.IsZero() {
+		c.errorf("Insert() set id %d, version %d, created_at %v", quote.ID, quote.Version, quote.CreatedAt)
+	}
+
+	got, err := c.m.Quote.Get(c.ctx, quote.ID)
+	if err != nil {
+		return fmt.Errorf("Get(): %w", err)
+	}
+	if got.Author != quote.Author || got.Quote_string != quote.Quote_string || strings.Join(got.Category, ",") != "conformance" || got.Version != 1 {
+		c.errorf("Get() = %+v, want %+v", got, quote)
+	}
+	_, err = c.m.Quote.Get(c.ctx, 0)
+	c.expect(err, data.ErrRecordNotFound, "Get(0)")
+
+	// Changing what Get() returned must not change the stored quote
+	got.Category[0] = "changed"
+	again, err := c.m.Quote.Get(c.ctx, quote.ID)
+	if err == nil && again.Category[0] != "conformance" {
+		c.errorf("Get() returned a quote that shares memory with the store")
+	}
+
+	stale := *got
+	got.Quote_string = "an edited quote"
+	err = c.m.Quote.Update(c.ctx, got)
+	if err != nil {
+		return fmt.Errorf("Update(): %w", err)
+	}
+	if got.Version != 2 {
+		c.errorf("Update() set version %d, want 2", got.Version)
+	}
+	err = c.m.Quote.Update(c.ctx, &stale)
+	c.expect(err, data.ErrEditConflict, "Update() with a stale version")
+
+	many, err := c.m.Quote.GetMany(c.ctx, []int64{quote.ID, -1})
+	if err != nil {
+		return fmt.Errorf("GetMany(): %w", err)
+	}
+	if len(many) != 1 || many[quote.ID] == nil || many[quote.ID].Quote_string != "an edited quote" {
+		c.errorf("GetMany() = %v, want only quote %d with the edit", many, quote.ID)
+	}
+
+	err = c.m.Quote.Delete(c.ctx, quote.ID)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+	_, err = c.m.Quote.Get(c.ctx, quote.ID)
+	c.expect(err, data.ErrRecordNotFound, "Get() after Delete()")
+	err = c.m.Quote.Delete(c.ctx, quote.ID)
+	c.expect(err, data.ErrRecordNotFound, "Delete() twice")
+	err = c.m.Quote.Update(c.ctx, got)
+	c.expect(err, data.ErrEditConflict, "Update() after Delete()")
+	return nil
+}
+
+func (c *checker) quoteListing() error {
+	// The categories are unique to this run, so they pick out its quotes
+	mine := c.tag + "-mine"
+	other := c.tag + "-other"
+	inputs := []struct {
+		author, text string
+		category     []string
+	}{
+		{"Bravo " + c.tag, "the early bird", []string{mine, other}},
+		{"Alpha " + c.tag, "catches the worm", []string{mine}},
+		{"Charlie " + c.tag, "the second mouse gets the cheese", []string{mine, other}},
+	}
+	for _, in := range inputs {
+		_, err := c.newQuote(in.author, in.text, in.category...)
+		if err != nil {
+			return err
+		}
+	}
+
+	list := func(author, text string, category []string, sort string, page, pageSize int) ([]string, data.Metadata, error) {
+		filters := data.Filters{Page: page, PageSize: pageSize, Sort: sort, SortList: []string{"id", "author", "-author", "quote_string", "-quote_string"}}
+		quotes, metadata, err := c.m.Quote.GetAll(c.ctx, author, text, category, filters)
+		if err != nil {
+			return nil, metadata, fmt.Errorf("GetAll(): %w", err)
+		}
+		authors := make([]string, len(quotes))
+		for i, quote := range quotes {
+			authors[i] = strings.Fields(quote.Author)[0]
+		}
+		return authors, metadata, nil
+	}
+
+	cases := []struct {
+		name     string
+		author   string
+		text     string
+		category []string
+		sort     string
+		want     string
+	}{
+		{"by id", "", "", []string{mine}, "id", "Bravo Alpha Charlie"},
+		{"by author", "", "", []string{mine}, "author", "Alpha Bravo Charlie"},
+		{"by author descending", "", "", []string{mine}, "-author", "Charlie Bravo Alpha"},
+		{"by quote", "", "", []string{mine}, "quote_string", "Alpha Bravo Charlie"},
+		{"every category has to match", "", "", []string{mine, other}, "id", "Bravo Charlie"},
+		{"author search", "alpha " + c.tag, "", []string{}, "id", "Alpha"},
+		{"quote search ignores case and order", "", "MOUSE second", []string{mine}, "id", "Charlie"},
+		{"every search word has to match", "", "early worm", []string{mine}, "id", ""},
+	}
+	for _, tc := range cases {
+		got, _, err := list(tc.author, tc.text, tc.category, tc.sort, 1, 20)
+		if err != nil {
+			return err
+		}
+		if strings.Join(got, " ") != tc.want {
+			c.errorf("GetAll() %s = %q, want %q", tc.name, strings.Join(got, " "), tc.want)
+		}
+	}
+
+	got, metadata, err := list("", "", []string{mine}, "id", 2, 2)
+	if err != nil {
+		return err
+	}
+	want := data.Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3}
+	if strings.Join(got, " ") != "Charlie" || metadata != want {
+		c.errorf("GetAll() page 2 = %v %+v, want [Charlie] %+v", got, metadata, want)
+	}
+	got, metadata, err = list("", "", []string{mine}, "id", 3, 2)
+	if err != nil {
+		return err
+	}
+	if len(got) != 0 || metadata != (data.Metadata{}) {
+		c.errorf("GetAll() past the last page = %v %+v, want nothing", got, metadata)
+	}
+	return nil
+}
+
+func (c *checker) newUser(name string) (*data.User, error) {
+	user := &data.User{Name: name, Email: name + "." + c.tag + "@example.com", Activated: true}
+	err := user.Password.Set("pa55word")
+	if err != nil {
+		return nil, err
+	}
+	err = c.m.Users.Insert(c.ctx, user)
+	if err != nil {
+		return nil, fmt.Errorf("Insert(): %w", err)
+	}
+	return user, nil
+}
+
+func (c *checker) users() error {
+	user, err := c.newUser("alice")
+	if err != nil {
+		return err
+	}
+	if user.ID < 1 || user.CreatedAt.IsZero() {
+		c.errorf("Insert() set id %d, created_at %v", user.ID, user.CreatedAt)
+	}
+
+	duplicate := &data.User{Name: "Alice", Email: strings.ToUpper(user.Email)}
+	duplicate.Password.Set("pa55word")
+	err = c.m.Users.Insert(c.ctx, duplicate)
+	c.expect(err, data.ErrDuplicateEmail, "Insert() with the same email in upper case")
+
+	got, err := c.m.Users.GetByEmail(c.ctx, strings.ToUpper(user.Email))
+	if err != nil {
+		return fmt.Errorf("GetByEmail(): %w", err)
+	}
+	if got.ID != user.ID || got.Name != "alice" || !got.Activated {
+		c.errorf("GetByEmail() = %+v, want %+v", got, user)
+	}
+	match, err := got.Password.Matches("pa55word")
+	if err != nil || !match {
+		c.errorf("the stored password doesn't match: %v", err)
+	}
+	_, err = c.m.Users.GetByEmail(c.ctx, "nobody."+c.tag+"@example.com")
+	c.expect(err, data.ErrRecordNotFound, "GetByEmail() for an unknown email")
+
+	stale := *got
+	got.Name = "Alice"
+	err = c.m.Users.Update(c.ctx, got)
+	if err != nil {
+		return fmt.Errorf("Update(): %w", err)
+	}
+	err = c.m.Users.Update(c.ctx, &stale)
+	c.expect(err, data.ErrEditConflict, "Update() with a stale version")
+
+	bob, err := c.newUser("bob")
+	if err != nil {
+		return err
+	}
+	bob.Email = user.Email
+	err = c.m.Users.Update(c.ctx, bob)
+	c.expect(err, data.ErrDuplicateEmail, "Update() to an email that is taken")
+
+	filters := data.Filters{Page: 1, PageSize: 100, Sort: "-id", SortList: []string{"-id"}}
+	users, metadata, err := c.m.Users.GetAll(c.ctx, "", "", nil, filters)
+	if err != nil {
+		return fmt.Errorf("GetAll(): %w", err)
+	}
+	if len(users) < 2 || users[0].ID != bob.ID || users[1].ID != user.ID || metadata.TotalRecords < 2 {
+		c.errorf("GetAll() newest first didn't start with the two new users")
+	}
+
+	// The searches match part of the name or email in any case
+	bob.Email = "bob." + c.tag + "@example.com"
+	bob.Activated = false
+	err = c.m.Users.Update(c.ctx, bob)
+	if err != nil {
+		return fmt.Errorf("Update(): %w", err)
+	}
+	inactive := false
+	users, metadata, err = c.m.Users.GetAll(c.ctx, "BO", strings.ToUpper(c.tag), &inactive, filters)
+	if err != nil {
+		return fmt.Errorf("GetAll() with filters: %w", err)
+	}
+	if len(users) != 1 || users[0].ID != bob.ID || metadata.TotalRecords != 1 {
+		c.errorf("GetAll() for inactive users named bo = %d users, want only %d", len(users), bob.ID)
+	}
+
+	got, err = c.m.Users.Get(c.ctx, bob.ID)
+	if err != nil {
+		return fmt.Errorf("Get(): %w", err)
+	}
+	if got.Email != bob.Email || got.Activated || got.Version != bob.Version {
+		c.errorf("Get() = %+v, want %+v", got, bob)
+	}
+	_, err = c.m.Users.Get(c.ctx, 0)
+	c.expect(err, data.ErrRecordNotFound, "Get() for id 0")
+
+	// DeleteUnactivated() would also remove accounts that were there
+	// before, so it runs in a transaction that is rolled back
+	errRollback := errors.New("rollback")
+	err = c.m.WithTx(c.ctx, func(m data.Models) error {
+		carol := &data.User{Name: "carol", Email: "carol." + c.tag + "@example.com"}
+		carol.Password.Set("pa55word")
+		err := m.Users.Insert(c.ctx, carol)
+		if err != nil {
+			return fmt.Errorf("Insert(): %w", err)
+		}
+		n, err := m.Users.DeleteUnactivated(c.ctx, time.Now().Add(time.Minute))
+		if err != nil {
+			return fmt.Errorf("DeleteUnactivated(): %w", err)
+		}
+		if n < 1 {
+			c.errorf("DeleteUnactivated() removed %d users, want at least 1", n)
+		}
+		_, err = m.Users.Get(c.ctx, carol.ID)
+		c.expect(err, data.ErrRecordNotFound, "Get() for a user that was never activated")
+		// bob was deactivated, which isn't the same as never activated
+		_, err = m.Users.Get(c.ctx, bob.ID)
+		if err != nil {
+			c.errorf("DeleteUnactivated() removed a deactivated user: %v", err)
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		return err
+	}
+	return nil
+}
+
+func (c *checker) tokens() error {
+	user, err := c.newUser("tokens")
+	if err != nil {
+		return err
+	}
+	token, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	got, err := c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, token.Plaintext)
+	if err != nil {
+		return fmt.Errorf("GetForToken(): %w", err)
+	}
+	if got.ID != user.ID {
+		c.errorf("GetForToken() returned user %d, want %d", got.ID, user.ID)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeActivation, token.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() with the wrong scope")
+
+	expired, err := c.m.Tokens.New(c.ctx, user.ID, -time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, expired.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() with an expired token")
+
+	n, err := c.m.Tokens.DeleteExpired(c.ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteExpired(): %w", err)
+	}
+	if n < 1 {
+		c.errorf("DeleteExpired() removed %d tokens, want at least 1", n)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, token.Plaintext)
+	if err != nil {
+		c.errorf("DeleteExpired() removed a token that is still valid: %v", err)
+	}
+
+	err = c.m.Tokens.DeleteAllForUsers(c.ctx, data.ScopeAuthentication, user.ID)
+	if err != nil {
+		return fmt.Errorf("DeleteAllForUsers(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, token.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() after DeleteAllForUsers()")
+
+	change, err := c.m.Tokens.NewEmailChange(c.ctx, user.ID, "tokens-new@example.com", time.Hour)
+	if err != nil {
+		return fmt.Errorf("NewEmailChange(): %w", err)
+	}
+	stored, err := c.m.Tokens.Get(c.ctx, data.ScopeEmailChange, change.Plaintext)
+	if err != nil {
+		return fmt.Errorf("Get(): %w", err)
+	}
+	if stored.UserID != user.ID || stored.Email != "tokens-new@example.com" {
+		c.errorf("Get() = user %d, email %q, want user %d, email %q", stored.UserID, stored.Email, user.ID, "tokens-new@example.com")
+	}
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeAuthentication, change.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "Get() with the wrong scope")
+
+	kept, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	other, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	err = c.m.Tokens.DeleteAllForUserExcept(c.ctx, data.ScopeAuthentication, user.ID, kept.Plaintext)
+	if err != nil {
+		return fmt.Errorf("DeleteAllForUserExcept(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, kept.Plaintext)
+	if err != nil {
+		c.errorf("DeleteAllForUserExcept() removed the token it was told to keep: %v", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, other.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() after DeleteAllForUserExcept()")
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeEmailChange, change.Plaintext)
+	if err != nil {
+		c.errorf("DeleteAllForUserExcept() removed a token of another scope: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) sessions() error {
+	user, err := c.newUser("sessions")
+	if err != nil {
+		return err
+	}
+	first, err := c.m.Tokens.NewAuthentication(c.ctx, user.ID, time.Hour, "", "192.0.2.1", "first agent")
+	if err != nil {
+		return fmt.Errorf("NewAuthentication(): %w", err)
+	}
+	second, err := c.m.Tokens.NewAuthentication(c.ctx, user.ID, time.Hour, "", "192.0.2.2", "second agent")
+	if err != nil {
+		return fmt.Errorf("NewAuthentication(): %w", err)
+	}
+	_, err = c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeActivation)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+
+	// first is used later than second was created, so it comes first
+	used := time.Now().Add(time.Minute)
+	err = c.m.Tokens.RecordUses(c.ctx, []data.TokenUse{
+		{Hash: data.HashToken(first.Plaintext), At: used, IP: "198.51.100.1", UserAgent: "used agent"},
+		// An older use that was saved late doesn't win
+		{Hash: data.HashToken(first.Plaintext), At: used.Add(-time.Second * 30), IP: "198.51.100.2", UserAgent: "older agent"},
+	})
+	if err != nil {
+		return fmt.Errorf("RecordUses(): %w", err)
+	}
+	sessions, err := c.m.Tokens.GetSessions(c.ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetSessions(): %w", err)
+	}
+	if len(sessions) != 2 {
+		return fmt.Errorf("GetSessions() returned %d sessions, want the 2 authentication tokens", len(sessions))
+	}
+	got := sessions[0]
+	if string(got.Hash) != string(data.HashToken(first.Plaintext)) || got.IP != "198.51.100.1" || got.UserAgent != "used agent" || got.LastUsedAt == nil || got.CreatedAt.IsZero() {
+		c.errorf("GetSessions() first = %+v, want the used token from 198.51.100.1", got)
+	}
+	if got := sessions[1]; got.IP != "192.0.2.2" || got.UserAgent != "second agent" || got.LastUsedAt != nil {
+		c.errorf("GetSessions() second = %+v, want the unused token from 192.0.2.2", got)
+	}
+
+	other, err := c.newUser("sessions-other")
+	if err != nil {
+		return err
+	}
+	err = c.m.Tokens.DeleteSession(c.ctx, other.ID, sessions[1].ID)
+	c.expect(err, data.ErrRecordNotFound, "DeleteSession() for another user's session")
+	err = c.m.Tokens.DeleteSession(c.ctx, user.ID, sessions[1].ID)
+	if err != nil {
+		return fmt.Errorf("DeleteSession(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, second.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() after DeleteSession()")
+
+	err = c.m.Tokens.Delete(c.ctx, data.ScopeActivation, first.Plaintext)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, first.Plaintext)
+	if err != nil {
+		c.errorf("Delete() with the wrong scope removed the token: %v", err)
+	}
+	err = c.m.Tokens.Delete(c.ctx, data.ScopeAuthentication, first.Plaintext)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, first.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() after Delete()")
+	return nil
+}
+
+// signIn creates the authentication and refresh tokens of a new family
+func (c *checker) signIn(userID int64) (access, refresh *data.Token, err error) {
+	family, err := data.NewTokenFamily()
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err = c.m.Tokens.NewAuthentication(c.ctx, userID, time.Hour, family, "192.0.2.1", "agent")
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewAuthentication(): %w", err)
+	}
+	refresh, err = c.m.Tokens.NewRefresh(c.ctx, userID, time.Hour, family)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewRefresh(): %w", err)
+	}
+	return access, refresh, nil
+}
+
+func (c *checker) refreshTokens() error {
+	user, err := c.newUser("refresh")
+	if err != nil {
+		return err
+	}
+	access, refresh, err := c.signIn(user.ID)
+	if err != nil {
+		return err
+	}
+	revoked, revokedRefresh, err := c.signIn(user.ID)
+	if err != nil {
+		return err
+	}
+	_, otherRefresh, err := c.signIn(user.ID)
+	if err != nil {
+		return err
+	}
+	plain, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+
+	used, err := c.m.Tokens.UseRefresh(c.ctx, refresh.Plaintext)
+	if err != nil {
+		return fmt.Errorf("UseRefresh(): %w", err)
+	}
+	if used.UserID != user.ID || used.Family != refresh.Family || !used.Used {
+		c.errorf("UseRefresh() = user %d, family %q, used %t, want user %d, family %q, used", used.UserID, used.Family, used.Used, user.ID, refresh.Family)
+	}
+	reused, err := c.m.Tokens.UseRefresh(c.ctx, refresh.Plaintext)
+	c.expect(err, data.ErrTokenReused, "UseRefresh() a second time")
+	if reused == nil || reused.Family != refresh.Family {
+		c.errorf("UseRefresh() a second time returned %+v, want the token with its family", reused)
+	}
+	_, err = c.m.Tokens.UseRefresh(c.ctx, access.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "UseRefresh() with an authentication token")
+
+	// Revoking a session takes the refresh tokens of its family with it
+	sessions, err := c.m.Tokens.GetSessions(c.ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetSessions(): %w", err)
+	}
+	for _, session := range sessions {
+		if string(session.Hash) != string(data.HashToken(revoked.Plaintext)) {
+			continue
+		}
+		err = c.m.Tokens.DeleteSession(c.ctx, user.ID, session.ID)
+		if err != nil {
+			return fmt.Errorf("DeleteSession(): %w", err)
+		}
+	}
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeRefresh, revokedRefresh.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "Get() of a refresh token after DeleteSession()")
+
+	err = c.m.Tokens.DeleteAllForUserExcept(c.ctx, data.ScopeRefresh, user.ID, access.Plaintext)
+	if err != nil {
+		return fmt.Errorf("DeleteAllForUserExcept(): %w", err)
+	}
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeRefresh, refresh.Plaintext)
+	if err != nil {
+		c.errorf("DeleteAllForUserExcept() removed a refresh token of the kept family: %v", err)
+	}
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeRefresh, otherRefresh.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "Get() of another family's refresh token after DeleteAllForUserExcept()")
+
+	err = c.m.Tokens.DeleteAllForFamily(c.ctx, data.ScopeAuthentication, access.Family)
+	if err != nil {
+		return fmt.Errorf("DeleteAllForFamily(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, access.Plaintext)
+	c.expect(err, data.ErrRecordNotFound, "GetForToken() after DeleteAllForFamily()")
+	_, err = c.m.Tokens.Get(c.ctx, data.ScopeRefresh, refresh.Plaintext)
+	if err != nil {
+		c.errorf("DeleteAllForFamily() removed a token of another scope: %v", err)
+	}
+	err = c.m.Tokens.DeleteAllForFamily(c.ctx, data.ScopeAuthentication, "")
+	if err != nil {
+		return fmt.Errorf("DeleteAllForFamily(): %w", err)
+	}
+	_, err = c.m.Users.GetForToken(c.ctx, data.ScopeAuthentication, plain.Plaintext)
+	if err != nil {
+		c.errorf("DeleteAllForFamily() with no family removed a token: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) denylist() error {
+	user, err := c.newUser("denylist")
+	if err != nil {
+		return err
+	}
+	revoked, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	expired, err := c.m.Tokens.New(c.ctx, user.ID, -time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	activation, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeActivation)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	kept, err := c.m.Tokens.New(c.ctx, user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		return fmt.Errorf("New(): %w", err)
+	}
+	err = c.m.Tokens.Delete(c.ctx, data.ScopeAuthentication, revoked.Plaintext)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+	err = c.m.Tokens.DeleteAllForUsers(c.ctx, data.ScopeActivation, user.ID)
+	if err != nil {
+		return fmt.Errorf("DeleteAllForUsers(): %w", err)
+	}
+	_, err = c.m.Tokens.DeleteExpired(c.ctx)
+	if err != nil {
+		return fmt.Errorf("DeleteExpired(): %w", err)
+	}
+
+	hashes, err := c.m.Tokens.GetDenylist(c.ctx)
+	if err != nil {
+		return fmt.Errorf("GetDenylist(): %w", err)
+	}
+	denied := make(map[string]bool)
+	for _, hash := range hashes {
+		denied[string(hash)] = true
+	}
+	if !denied[string(data.HashToken(revoked.Plaintext))] {
+		c.errorf("GetDenylist() is missing a revoked authentication token")
+	}
+	for name, token := range map[string]*data.Token{"an expired": expired, "an activation": activation, "a live": kept} {
+		if denied[string(data.HashToken(token.Plaintext))] {
+			c.errorf("GetDenylist() includes %s token", name)
+		}
+	}
+	return nil
+}
+
+func sorted(p data.Permissions) string {
+	codes := append([]string(nil), p...)
+	sort.Strings(codes)
+	return strings.Join(codes, ",")
+}
+
+func (c *checker) permissions() error {
+	user, err := c.newUser("permissions")
+	if err != nil {
+		return err
+	}
+	none, err := c.newUser("nopermissions")
+	if err != nil {
+		return err
+	}
+
+	all, err := c.m.Permissions.GetAll(c.ctx)
+	if err != nil {
+		return fmt.Errorf("GetAll(): %w", err)
+	}
+	if !all.Contains("quotes:read") || !all.Contains("quotes:write") {
+		c.errorf("GetAll() = %v, want quotes:read and quotes:write in it", all)
+	}
+
+	err = c.m.Permissions.AddForUser(c.ctx, user.ID, "quotes:read", "quotes:write", "no:such-code")
+	if err != nil {
+		return fmt.Errorf("AddForUser(): %w", err)
+	}
+	err = c.m.Permissions.AddForUser(c.ctx, user.ID, "quotes:read")
+	if err != nil {
+		c.errorf("AddForUser() for a permission the user has: %v", err)
+	}
+	got, err := c.m.Permissions.GetAllForUser(c.ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetAllForUser(): %w", err)
+	}
+	if sorted(got) != "quotes:read,quotes:write" {
+		c.errorf("GetAllForUser() = %v, want quotes:read and quotes:write", got)
+	}
+	got, err = c.m.Permissions.GetAllForUser(c.ctx, none.ID)
+	if err != nil || len(got) != 0 {
+		c.errorf("GetAllForUser() for a user without permissions = %v, %v", got, err)
+	}
+
+	err = c.m.Permissions.RemoveForUser(c.ctx, user.ID, "quotes:write")
+	if err != nil {
+		return fmt.Errorf("RemoveForUser(): %w", err)
+	}
+	byUser, err := c.m.Permissions.GetAllForUsers(c.ctx, []int64{user.ID, none.ID})
+	if err != nil {
+		return fmt.Errorf("GetAllForUsers(): %w", err)
+	}
+	if sorted(byUser[user.ID]) != "quotes:read" || len(byUser[none.ID]) != 0 {
+		c.errorf("GetAllForUsers() = %v, want only quotes:read for user %d", byUser, user.ID)
+	}
+	return nil
+}
+
+func (c *checker) roles() error {
+	user, err := c.newUser("roles")
+	if err != nil {
+		return err
+	}
+
+	roles, err := c.m.Permissions.GetRoles(c.ctx)
+	if err != nil {
+		return fmt.Errorf("GetRoles(): %w", err)
+	}
+	grants := make(map[string]string)
+	for _, role := range roles {
+		grants[role.Name] = sorted(role.Permissions)
+	}
+	want := map[string]string{
+		"viewer":      "quotes:read",
+		"contributor": "quotes:read,quotes:write",
+		"moderator":   "quotes:*",
+		"admin":       "*",
+	}
+	for name, codes := range want {
+		if grants[name] != codes {
+			c.errorf("GetRoles() gives %s %q, want %q", name, grants[name], codes)
+		}
+	}
+
+	// Role grants add to the direct ones
+	err = c.m.Permissions.AddForUser(c.ctx, user.ID, "webhooks:manage")
+	if err != nil {
+		return fmt.Errorf("AddForUser(): %w", err)
+	}
+	err = c.m.Permissions.AddRolesForUser(c.ctx, user.ID, "viewer", "contributor", "no-such-role")
+	if err != nil {
+		return fmt.Errorf("AddRolesForUser(): %w", err)
+	}
+	names, err := c.m.Permissions.GetRolesForUser(c.ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetRolesForUser(): %w", err)
+	}
+	if strings.Join(names, ",") != "viewer,contributor" {
+		c.errorf("GetRolesForUser() = %v, want viewer and contributor", names)
+	}
+	got, err := c.m.Permissions.GetAllForUser(c.ctx, user.ID)
+	if err != nil {
+		return fmt.Errorf("GetAllForUser(): %w", err)
+	}
+	if sorted(got) != "quotes:read,quotes:write,webhooks:manage" {
+		c.errorf("GetAllForUser() = %v, want the role and direct grants once each", got)
+	}
+
+	// Wildcards grant every code under them
+	err = c.m.Permissions.RemoveRolesForUser(c.ctx, user.ID, "viewer", "contributor")
+	if err != nil {
+		return fmt.Errorf("RemoveRolesForUser(): %w", err)
+	}
+	err = c.m.Permissions.AddRolesForUser(c.ctx, user.ID, "moderator")
+	if err != nil {
+		return fmt.Errorf("AddRolesForUser(): %w", err)
+	}
+	byUser, err := c.m.Permissions.GetAllForUsers(c.ctx, []int64{user.ID})
+	if err != nil {
+		return fmt.Errorf("GetAllForUsers(): %w", err)
+	}
+	got = byUser[user.ID]
+	if sorted(got) != "quotes:*,webhooks:manage" {
+		c.errorf("GetAllForUsers() = %v, want quotes:* and webhooks:manage", got)
+	}
+	if !got.Include("quotes:write") || got.Include("users:read") {
+		c.errorf("%v should include quotes:write and not users:read", got)
+	}
+	return nil
+}
+
+// drainOutbox() fans out every event that is waiting in the outbox
+func (c *checker) drainOutbox() error {
+	for {
+		n, err := c.m.Webhooks.FanOut(c.ctx, 1000)
+		if err != nil {
+			return fmt.Errorf("FanOut(): %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+func (c *checker) transactions() error {
+	ctx := c.ctx
+	errRollback := errors.New("roll back")
+
+	// A failed transaction leaves nothing behind, not even the writes made
+	// before the one that failed
+	rolledBack := &data.User{Name: "rollback", Email: "rollback." + c.tag + "@example.com"}
+	err := rolledBack.Password.Set("pa55word")
+	if err != nil {
+		return err
+	}
+	err = c.m.WithTx(ctx, func(m data.Models) error {
+		err := m.Users.Insert(c.ctx, rolledBack)
+		if err != nil {
+			return err
+		}
+		err = m.Permissions.AddForUser(c.ctx, rolledBack.ID, "quotes:read")
+		if err != nil {
+			return err
+		}
+		// Reads inside the transaction see its own writes
+		_, err = m.Users.GetByEmail(c.ctx, rolledBack.Email)
+		if err != nil {
+			c.errorf("GetByEmail() inside the transaction: %v", err)
+		}
+		return errRollback
+	})
+	c.expect(err, errRollback, "WithTx() returning an error")
+	_, err = c.m.Users.GetByEmail(c.ctx, rolledBack.Email)
+	c.expect(err, data.ErrRecordNotFound, "GetByEmail() after a rollback")
+
+	// A successful one keeps every write, including those made by a
+	// nested WithTx() and by models that open their own transaction
+	committed := &data.User{Name: "commit", Email: "commit." + c.tag + "@example.com", Activated: true}
+	err = committed.Password.Set("pa55word")
+	if err != nil {
+		return err
+	}
+	var quote *data.Quote
+	var token *data.Token
+	err = c.m.WithTx(ctx, func(m data.Models) error {
+		err := m.Users.Insert(c.ctx, committed)
+		if err != nil {
+			return err
+		}
+		quote = &data.Quote{Author: c.tag, Quote_string: "written in a transaction", Category: []string{"conformance"}}
+		err = m.Quote.Insert(c.ctx, quote)
+		if err != nil {
+			return err
+		}
+		return m.WithTx(ctx, func(m data.Models) error {
+			token, err = m.Tokens.New(c.ctx, committed.ID, time.Hour, data.ScopeActivation)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("WithTx(): %w", err)
+	}
+	got, err := c.m.Users.GetForToken(c.ctx, data.ScopeActivation, token.Plaintext)
+	if err != nil || got.ID != committed.ID {
+		c.errorf("GetForToken() after a commit = %v, %v, want user %d", got, err, committed.ID)
+	}
+	_, err = c.m.Quote.Get(c.ctx, quote.ID)
+	if err != nil {
+		c.errorf("Get() for a quote inserted in a transaction: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) webhooks() error {
+	// Events left by the other checks mustn't reach the new subscription
+	err := c.drainOutbox()
+	if err != nil {
+		return err
+	}
+	hook := &data.Webhook{URL: "https://example.com/" + c.tag, Events: []string{data.EventQuoteCreated}, Active: true}
+	err = c.m.Webhooks.Insert(c.ctx, hook)
+	if err != nil {
+		return fmt.Errorf("Insert(): %w", err)
+	}
+	if !strings.HasPrefix(hook.Secret, "whsec_") || hook.Version != 1 {
+		c.errorf("Insert() set secret %q and version %d", hook.Secret, hook.Version)
+	}
+	got, err := c.m.Webhooks.Get(c.ctx, hook.ID)
+	if err != nil {
+		return fmt.Errorf("Get(): %w", err)
+	}
+	if got.URL != hook.URL || got.Secret != hook.Secret {
+		c.errorf("Get() = %+v, want %+v", got, hook)
+	}
+	stale := *got
+	got.Events = append(got.Events, data.EventQuoteDeleted)
+	err = c.m.Webhooks.Update(c.ctx, got)
+	if err != nil {
+		return fmt.Errorf("Update(): %w", err)
+	}
+	err = c.m.Webhooks.Update(c.ctx, &stale)
+	c.expect(err, data.ErrEditConflict, "Update() with a stale version")
+
+	// A created quote has to end up as one pending delivery
+	_, err = c.newQuote("Webhook "+c.tag, "delivered", c.tag)
+	if err != nil {
+		return err
+	}
+	err = c.drainOutbox()
+	if err != nil {
+		return err
+	}
+	filters := data.Filters{Page: 1, PageSize: 20, Sort: "-id", SortList: []string{"-id"}}
+	deliveries, _, err := c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliveryPending, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].EventType != data.EventQuoteCreated || deliveries[0].Attempts != 0 {
+		return fmt.Errorf("GetDeliveries() = %+v, want one pending quote.created delivery", deliveries)
+	}
+	delivery := deliveries[0]
+
+	var claimed *data.PendingDelivery
+	for claimed == nil {
+		batch, err := c.m.Webhooks.ClaimDeliveries(c.ctx, 1000, time.Minute)
+		if err != nil {
+			return fmt.Errorf("ClaimDeliveries(): %w", err)
+		}
+		if len(batch) == 0 {
+			return errors.New("ClaimDeliveries() never returned the new delivery")
+		}
+		for _, d := range batch {
+			if d.ID == delivery.ID {
+				claimed = d
+			}
+		}
+	}
+	if claimed.Attempts != 1 || claimed.URL != hook.URL || claimed.Secret != hook.Secret || len(claimed.Payload) == 0 {
+		c.errorf("ClaimDeliveries() = %+v", claimed)
+	}
+
+	// A send cut short by shutdown doesn't count as an attempt, and the
+	// delivery stays leased until the lease runs out
+	err = c.m.Webhooks.ReleaseDelivery(c.ctx, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("ReleaseDelivery(): %w", err)
+	}
+	released, _, err := c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliveryPending, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(released) != 1 || released[0].Attempts != 0 || !released[0].NextAttemptAt.After(time.Now()) {
+		c.errorf("GetDeliveries() after ReleaseDelivery() = %+v, want no attempts and the lease kept", released)
+	}
+
+	err = c.m.Webhooks.MarkFailed(c.ctx, delivery.ID, 500, "boom", time.Now(), true)
+	if err != nil {
+		return fmt.Errorf("MarkFailed(): %w", err)
+	}
+	dead, _, err := c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliveryDead, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(dead) != 1 || dead[0].LastError != "boom" || dead[0].ResponseStatus != 500 || dead[0].LastAttemptAt == nil {
+		c.errorf("GetDeliveries() for dead deliveries = %+v", dead)
+	}
+
+	err = c.m.Webhooks.Redeliver(c.ctx, hook.ID+1, delivery.ID)
+	c.expect(err, data.ErrRecordNotFound, "Redeliver() with the wrong webhook")
+	err = c.m.Webhooks.Redeliver(c.ctx, hook.ID, delivery.ID)
+	if err != nil {
+		return fmt.Errorf("Redeliver(): %w", err)
+	}
+	err = c.m.Webhooks.MarkDelivered(c.ctx, delivery.ID, 204)
+	if err != nil {
+		return fmt.Errorf("MarkDelivered(): %w", err)
+	}
+	done, _, err := c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliverySucceeded, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(done) != 1 || done[0].Attempts != 0 || done[0].LastError != "" {
+		c.errorf("GetDeliveries() for succeeded deliveries = %+v", done)
+	}
+
+	// Pruning the outbox takes the finished events and their deliveries,
+	// and leaves the ones that are still being delivered
+	_, err = c.newQuote("Webhook "+c.tag, "still pending", c.tag)
+	if err != nil {
+		return err
+	}
+	err = c.drainOutbox()
+	if err != nil {
+		return err
+	}
+	_, err = c.m.Webhooks.DeleteFinishedEvents(c.ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		return fmt.Errorf("DeleteFinishedEvents(): %w", err)
+	}
+	done, _, err = c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliverySucceeded, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(done) != 1 {
+		c.errorf("DeleteFinishedEvents() took an event newer than the cutoff, %d deliveries are left", len(done))
+	}
+	n, err := c.m.Webhooks.DeleteFinishedEvents(c.ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		return fmt.Errorf("DeleteFinishedEvents(): %w", err)
+	}
+	if n < 1 {
+		c.errorf("DeleteFinishedEvents() = %d, want at least 1", n)
+	}
+	done, _, err = c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliverySucceeded, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(done) != 0 {
+		c.errorf("GetDeliveries() after DeleteFinishedEvents() = %+v, want none", done)
+	}
+	pending, _, err := c.m.Webhooks.GetDeliveries(c.ctx, hook.ID, data.DeliveryPending, filters)
+	if err != nil {
+		return fmt.Errorf("GetDeliveries(): %w", err)
+	}
+	if len(pending) != 1 {
+		c.errorf("DeleteFinishedEvents() took a pending delivery, %d are left", len(pending))
+	}
+	_, err = c.m.Webhooks.ClaimDeliveries(c.ctx, 1000, time.Minute)
+	if err != nil {
+		return fmt.Errorf("ClaimDeliveries() after DeleteFinishedEvents(): %w", err)
+	}
+
+	err = c.m.Webhooks.Delete(c.ctx, hook.ID)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+	err = c.m.Webhooks.Delete(c.ctx, hook.ID)
+	c.expect(err, data.ErrRecordNotFound, "Delete() twice")
+	return nil
+}
+
+func (c *checker) changes() error {
+	latest, err := c.m.Changes.Latest(c.ctx)
+	if err != nil {
+		return fmt.Errorf("Latest(): %w", err)
+	}
+
+	quote, err := c.newQuote("Changes "+c.tag, "first", c.tag)
+	if err != nil {
+		return err
+	}
+	quote.Quote_string = "second"
+	err = c.m.Quote.Update(c.ctx, quote)
+	if err != nil {
+		return fmt.Errorf("Update(): %w", err)
+	}
+	err = c.m.Quote.Delete(c.ctx, quote.ID)
+	if err != nil {
+		return fmt.Errorf("Delete(): %w", err)
+	}
+
+	changes, err := c.m.Changes.GetSince(c.ctx, latest, 1000)
+	if err != nil {
+		return fmt.Errorf("GetSince(): %w", err)
+	}
+	var events []string
+	last := latest
+	for _, change := range changes {
+		if !last.Before(change.Token()) {
+			c.errorf("GetSince() returned change %d out of order", change.ID)
+		}
+		last = change.Token()
+		if change.QuoteID == quote.ID {
+			events = append(events, fmt.Sprintf("%s@%d", change.EventType, change.Version))
+			if change.Quote == nil || change.Quote.ID != quote.ID {
+				c.errorf("change %d doesn't carry the quote", change.ID)
+			}
+		}
+	}
+	want := "quote.created@1 quote.updated@2 quote.deleted@2"
+	if strings.Join(events, " ") != want {
+		c.errorf("GetSince() = %q, want %q", strings.Join(events, " "), want)
+	}
+	if now, err := c.m.Changes.Latest(c.ctx); err != nil || now != last {
+		c.errorf("Latest() = %v, %v, want %v", now, err, last)
+	}
+	if len(changes) > 0 {
+		token, err := c.m.Changes.TokenFor(c.ctx, changes[0].ID)
+		if err != nil || token != changes[0].Token() {
+			c.errorf("TokenFor(%d) = %v, %v, want %v", changes[0].ID, token, err, changes[0].Token())
+		}
+	}
+	_, err = c.m.Changes.TokenFor(c.ctx, 1<<62)
+	c.expect(err, data.ErrRecordNotFound, "TokenFor() of a missing change")
+
+	// Read the whole feed. Compaction may leave earlier changes to the
+	// quote on earlier pages, but the tombstone has to come last
+	var token data.SyncToken
+	var seen []string
+	for {
+		page, next, more, err := c.m.Changes.GetFeed(c.ctx, token, 1000)
+		if err != nil {
+			return fmt.Errorf("GetFeed(): %w", err)
+		}
+		for _, change := range page {
+			if change.QuoteID == quote.ID {
+				seen = append(seen, change.EventType)
+			}
+		}
+		if !more {
+			break
+		}
+		token = next
+	}
+	if len(seen) == 0 || seen[len(seen)-1] != data.EventQuoteDeleted {
+		c.errorf("GetFeed() for the quote = %v, want it to end with %s", seen, data.EventQuoteDeleted)
+	}
+	return nil
+}
+
+// feedEnd() pages through the whole feed and returns the token at its end
+func (c *checker) feedEnd() (data.SyncToken, error) {
+	var token data.SyncToken
+	for {
+		_, next, more, err := c.m.Changes.GetFeed(c.ctx, token, 1000)
+		if err != nil {
+			return token, fmt.Errorf("GetFeed(): %w", err)
+		}
+		token = next
+		if !more {
+			return token, nil
+		}
+	}
+}
+
+// changeFeedPaging() pins down how the feed is paged, which every store
+// does its own way: changes come in the order that they were written, a
+// transaction's changes come together, a page that is cut short says so,
+// and the token of an empty page is the one that it was asked for
+func (c *checker) changeFeedPaging() error {
+	start, err := c.feedEnd()
+	if err != nil {
+		return err
+	}
+	var a, b, q *data.Quote
+	for _, quote := range []**data.Quote{&a, &b, &q} {
+		*quote, err = c.newQuote("Paging "+c.tag, "first", c.tag)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.m.WithTx(c.ctx, func(m data.Models) error {
+		for _, quote := range []*data.Quote{a, b} {
+			quote.Quote_string = "second"
+			err := m.Quote.Update(c.ctx, quote)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("WithTx(): %w", err)
+	}
+	name := map[int64]string{a.ID: "a", b.ID: "b", q.ID: "c"}
+	describe := func(changes []*data.QuoteChange) []string {
+		var events []string
+		for _, change := range changes {
+			events = append(events, fmt.Sprintf("%s.%s", name[change.QuoteID], strings.TrimPrefix(change.EventType, "quote.")))
+		}
+		return events
+	}
+
+	// Two changes per page, no page then has two changes to one quote and
+	// nothing is compacted away. The token goes through its string form
+	// like a client's would
+	var seen []string
+	token := start
+	for i := 0; ; i++ {
+		if i > 10 {
+			return errors.New("GetFeed() never reported the last page")
+		}
+		page, next, more, err := c.m.Changes.GetFeed(c.ctx, token, 2)
+		if err != nil {
+			return fmt.Errorf("GetFeed(): %w", err)
+		}
+		if len(page) > 2 {
+			c.errorf("GetFeed() with a limit of 2 returned %d changes", len(page))
+		}
+		seen = append(seen, describe(page)...)
+		if !more {
+			if len(page) != 1 || next == token {
+				c.errorf("the last page = %v, %v, want one change and a new token", describe(page), next)
+			}
+			token = next
+			break
+		}
+		token, err = data.ParseSyncToken(next.String())
+		if err != nil {
+			return fmt.Errorf("ParseSyncToken(): %w", err)
+		}
+	}
+	want := "a.created b.created c.created a.updated b.updated"
+	if strings.Join(seen, " ") != want {
+		c.errorf("paging through the feed = %q, want %q", strings.Join(seen, " "), want)
+	}
+
+	page, next, more, err := c.m.Changes.GetFeed(c.ctx, token, 1)
+	if err != nil {
+		return fmt.Errorf("GetFeed(): %w", err)
+	}
+	if len(page) != 0 || more || next != token {
+		c.errorf("GetFeed() at the end = %v, %v, %v, want no changes and the same token", describe(page), next, more)
+	}
+
+	// One page of everything keeps the last change to each quote
+	page, _, more, err = c.m.Changes.GetFeed(c.ctx, start, 1000)
+	if err != nil {
+		return fmt.Errorf("GetFeed(): %w", err)
+	}
+	want = "c.created a.updated b.updated"
+	if strings.Join(describe(page), " ") != want || more {
+		c.errorf("GetFeed() in one page = %q, %v, want %q, false", strings.Join(describe(page), " "), more, want)
+	}
+	return nil
+}
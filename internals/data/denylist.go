@@ -0,0 +1,107 @@
+// Filename: internals/data/denylist.go
+
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The channel that the tokens_deny_deleted() trigger announces additions
+// to the denylist on
+const TokenDenylistChannel = "token_denylist"
+
+// TokenDenylist keeps the denylist of authentication tokens in memory, so
+// that a signed token can be checked against it without a query. Run()
+// reloads it every interval, and as soon as another process adds to it
+// when Listen() has been called. Revocations made by this process should
+// call Refresh() once they have committed
+type TokenDenylist struct {
+	store    TokenStore
+	listener *pq.Listener
+
+	// Reloads run one at a time, so that one that started before a
+	// revocation can't replace the list loaded after it
+	refreshing sync.Mutex
+	mu         sync.RWMutex
+	hashes     map[string]bool
+}
+
+// NewTokenDenylist() loads the denylist from store
+func NewTokenDenylist(ctx context.Context, store TokenStore) (*TokenDenylist, error) {
+	d := &TokenDenylist{store: store, hashes: make(map[string]bool)}
+	err := d.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Listen() connects to the Postgres database at dsn to hear about the
+// tokens denied by every process
+func (d *TokenDenylist) Listen(dsn string, onError func(error)) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	})
+	err := listener.Listen(TokenDenylistChannel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	d.listener = listener
+	return nil
+}
+
+// Run() reloads the denylist every interval and on every notification
+// until the context is cancelled. Entries that expire drop out on reload
+func (d *TokenDenylist) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	var notify <-chan *pq.Notification
+	if d.listener != nil {
+		defer d.listener.Close()
+		notify = d.listener.Notify
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-notify:
+		}
+		err := d.Refresh(ctx)
+		if err != nil && ctx.Err() == nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// Refresh() reloads the denylist from the store
+func (d *TokenDenylist) Refresh(ctx context.Context) error {
+	d.refreshing.Lock()
+	defer d.refreshing.Unlock()
+	denied, err := d.store.GetDenylist(ctx)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]bool, len(denied))
+	for _, hash := range denied {
+		hashes[string(hash)] = true
+	}
+	d.mu.Lock()
+	d.hashes = hashes
+	d.mu.Unlock()
+	return nil
+}
+
+// Contains() reports whether the token with the given hash was revoked
+func (d *TokenDenylist) Contains(hash []byte) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.hashes[string(hash)]
+}
@@ -0,0 +1,1233 @@
+// Filename: internals/data/memory.go
+
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// memoryStore holds every table for the in-memory models behind one lock.
+// It mirrors the Postgres schema, including the quote_changes trigger and
+// the webhook outbox, so that the two implementations can be swapped
+type memoryStore struct {
+	mu sync.Mutex
+	memoryTables
+}
+
+type memoryTables struct {
+	quotes      map[int64]*Quote
+	lastQuoteID int64
+
+	users      map[int64]*User
+	lastUserID int64
+	// the users that have been activated at some point, which stands in
+	// for users.activated_at
+	everActivated map[int64]bool
+
+	// tokens are keyed by the string form of their hash
+	tokens      map[string]*memoryToken
+	lastTokenID int64
+	// the expiry of each denied hash, see deleteToken()
+	denylist map[string]time.Time
+
+	permissions     []string
+	userPermissions map[int64]map[string]bool
+	roles           []*Role
+	userRoles       map[int64]map[string]bool
+
+	webhooks        map[int64]*Webhook
+	lastWebhookID   int64
+	outbox          []*memoryOutboxEvent
+	lastEventID     int64
+	deliveries      map[int64]*memoryDelivery
+	lastDeliveryID  int64
+	changes         []*QuoteChange
+	lastChangeID    int64
+	lastTransaction uint64
+}
+
+type memoryOutboxEvent struct {
+	id         int64
+	createdAt  time.Time
+	eventType  string
+	payload    []byte
+	dispatched bool
+}
+
+type memoryDelivery struct {
+	WebhookDelivery
+	lastAttemptAt *time.Time
+}
+
+type memoryToken struct {
+	Token
+	id         int64
+	createdAt  time.Time
+	lastUsedAt *time.Time
+}
+
+// NewMemoryModels() returns models that keep everything in memory. They are
+// meant for tests and local development, nothing survives a restart. They
+// never wait on anything, so apart from WithTx() they ignore their contexts
+func NewMemoryModels() Models {
+	s := &memoryStore{memoryTables: memoryTables{
+		quotes:          make(map[int64]*Quote),
+		users:           make(map[int64]*User),
+		everActivated:   make(map[int64]bool),
+		tokens:          make(map[string]*memoryToken),
+		denylist:        make(map[string]time.Time),
+		permissions:     []string{"quotes:read", "quotes:write", "webhooks:manage", "*", "quotes:*", "webhooks:*", "users:manage"},
+		userPermissions: make(map[int64]map[string]bool),
+		roles: []*Role{
+			{Name: "viewer", Permissions: Permissions{"quotes:read"}},
+			{Name: "contributor", Permissions: Permissions{"quotes:read", "quotes:write"}},
+			{Name: "moderator", Permissions: Permissions{"quotes:*"}},
+			{Name: "admin", Permissions: Permissions{"*"}},
+		},
+		userRoles:  make(map[int64]map[string]bool),
+		webhooks:   make(map[int64]*Webhook),
+		deliveries: make(map[int64]*memoryDelivery),
+	}}
+	models := memoryModels(s)
+	models.withTx = s.withTx
+	return models
+}
+
+// withTx() holds the lock for the whole transaction, so transactions run
+// one at a time and nothing sees one half done. fn works on a copy of the
+// tables, which replaces the originals if it succeeds
+func (s *memoryStore) withTx(ctx context.Context, fn func(Models) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memoryStore{memoryTables: s.memoryTables.clone()}
+	models := memoryModels(tx)
+	models.withTx = func(_ context.Context, fn func(Models) error) error {
+		return fn(models)
+	}
+	err := fn(models)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	s.memoryTables = tx.memoryTables
+	return nil
+}
+
+// clone() makes a deep copy of the tables
+func (t *memoryTables) clone() memoryTables {
+	c := *t
+	c.quotes = make(map[int64]*Quote, len(t.quotes))
+	for id, quote := range t.quotes {
+		c.quotes[id] = copyQuote(quote)
+	}
+	c.users = make(map[int64]*User, len(t.users))
+	for id, user := range t.users {
+		c.users[id] = copyUser(user)
+	}
+	c.everActivated = make(map[int64]bool, len(t.everActivated))
+	for id, ok := range t.everActivated {
+		c.everActivated[id] = ok
+	}
+	c.tokens = make(map[string]*memoryToken, len(t.tokens))
+	for hash, token := range t.tokens {
+		copied := *token
+		if token.lastUsedAt != nil {
+			lastUsedAt := *token.lastUsedAt
+			copied.lastUsedAt = &lastUsedAt
+		}
+		c.tokens[hash] = &copied
+	}
+	c.denylist = make(map[string]time.Time, len(t.denylist))
+	for hash, expiry := range t.denylist {
+		c.denylist[hash] = expiry
+	}
+	c.permissions = append([]string(nil), t.permissions...)
+	c.userPermissions = make(map[int64]map[string]bool, len(t.userPermissions))
+	for id, codes := range t.userPermissions {
+		c.userPermissions[id] = make(map[string]bool, len(codes))
+		for code, ok := range codes {
+			c.userPermissions[id][code] = ok
+		}
+	}
+	// Roles are never changed, only the users in them
+	c.userRoles = make(map[int64]map[string]bool, len(t.userRoles))
+	for id, roles := range t.userRoles {
+		c.userRoles[id] = make(map[string]bool, len(roles))
+		for role, ok := range roles {
+			c.userRoles[id][role] = ok
+		}
+	}
+	c.webhooks = make(map[int64]*Webhook, len(t.webhooks))
+	for id, webhook := range t.webhooks {
+		c.webhooks[id] = copyWebhook(webhook)
+	}
+	c.outbox = make([]*memoryOutboxEvent, len(t.outbox))
+	for i, event := range t.outbox {
+		copied := *event
+		c.outbox[i] = &copied
+	}
+	c.deliveries = make(map[int64]*memoryDelivery, len(t.deliveries))
+	for id, delivery := range t.deliveries {
+		copied := *delivery
+		c.deliveries[id] = &copied
+	}
+	// Changes are never modified once they are recorded
+	c.changes = append([]*QuoteChange(nil), t.changes...)
+	return c
+}
+
+func memoryModels(s *memoryStore) Models {
+	return Models{
+		Changes:     memoryChangeModel{s},
+		Permissions: memoryPermissionModel{s},
+		Quote:       memoryQuoteModel{s},
+		Tokens:      memoryTokenModel{s},
+		Users:       memoryUserModel{s},
+		Webhooks:    memoryWebhookModel{s},
+	}
+}
+
+// now() matches the timestamp(0) columns, which drop the fractional second
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func copyQuote(quote *Quote) *Quote {
+	c := *quote
+	c.Category = append([]string(nil), quote.Category...)
+	return &c
+}
+
+// recordQuoteChange() does the job of the quotes_notify_change() trigger
+// and of insertOutboxEvent(). The caller holds the lock
+func (s *memoryStore) recordQuoteChange(eventType string, quote *Quote) error {
+	s.lastTransaction++
+	payload, err := json.Marshal(map[string]interface{}{"quote": quote})
+	if err != nil {
+		return err
+	}
+	s.lastEventID++
+	s.outbox = append(s.outbox, &memoryOutboxEvent{
+		id:        s.lastEventID,
+		createdAt: time.Now(),
+		eventType: eventType,
+		payload:   payload,
+	})
+	// The trigger payload doesn't carry created_at
+	changed := copyQuote(quote)
+	changed.CreatedAt = time.Time{}
+	s.lastChangeID++
+	s.changes = append(s.changes, &QuoteChange{
+		ID:        s.lastChangeID,
+		CreatedAt: time.Now(),
+		QuoteID:   quote.ID,
+		EventType: eventType,
+		Version:   quote.Version,
+		Quote:     changed,
+		XID:       s.lastTransaction,
+	})
+	return nil
+}
+
+// paginate() returns the page of items selected by the filters along with
+// the metadata, like LIMIT/OFFSET and COUNT(*) OVER() do
+func paginate[T any](items []T, filters Filters) ([]T, Metadata) {
+	total := len(items)
+	start := filters.offSet()
+	if start > total {
+		start = total
+	}
+	end := start + filters.limit()
+	if end > total {
+		end = total
+	}
+	if start == end {
+		// COUNT(*) OVER() has no row to be read from when the page is empty
+		return items[start:end], Metadata{}
+	}
+	return items[start:end], calculateMetadata(total, filters.Page, filters.PageSize)
+}
+
+type memoryQuoteModel struct {
+	s *memoryStore
+}
+
+func (m memoryQuoteModel) Insert(ctx context.Context, quote *Quote) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.lastQuoteID++
+	quote.ID = m.s.lastQuoteID
+	quote.CreatedAt = now()
+	quote.Version = 1
+	m.s.quotes[quote.ID] = copyQuote(quote)
+	return m.s.recordQuoteChange(EventQuoteCreated, quote)
+}
+
+func (m memoryQuoteModel) Get(ctx context.Context, id int64) (*Quote, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	quote, ok := m.s.quotes[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyQuote(quote), nil
+}
+
+func (m memoryQuoteModel) Update(ctx context.Context, quote *Quote) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	current, ok := m.s.quotes[quote.ID]
+	if !ok || current.Version != quote.Version {
+		return ErrEditConflict
+	}
+	quote.Version++
+	updated := copyQuote(quote)
+	updated.CreatedAt = current.CreatedAt
+	m.s.quotes[quote.ID] = updated
+	return m.s.recordQuoteChange(EventQuoteUpdated, updated)
+}
+
+func (m memoryQuoteModel) Delete(ctx context.Context, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	quote, ok := m.s.quotes[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.quotes, id)
+	return m.s.recordQuoteChange(EventQuoteDeleted, quote)
+}
+
+func (m memoryQuoteModel) GetAll(ctx context.Context, author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error) {
+	column, order := filters.sortColumn(), filters.sortOrder()
+	filter := QuoteFilter{Author: author, Quote_string: quote_string, Category: category}
+
+	m.s.mu.Lock()
+	quotes := []*Quote{}
+	for _, quote := range m.s.quotes {
+		if filter.Matches(quote) {
+			quotes = append(quotes, copyQuote(quote))
+		}
+	}
+	m.s.mu.Unlock()
+
+	sort.Slice(quotes, func(i, j int) bool {
+		a, b := quotes[i], quotes[j]
+		var c int
+		switch column {
+		case "author":
+			c = strings.Compare(a.Author, b.Author)
+		case "quote_string":
+			c = strings.Compare(a.Quote_string, b.Quote_string)
+		default:
+			c = compareInt64(a.ID, b.ID)
+		}
+		if order == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			return a.ID < b.ID
+		}
+		return c < 0
+	})
+	page, metadata := paginate(quotes, filters)
+	return page, metadata, nil
+}
+
+func (m memoryQuoteModel) GetMany(ctx context.Context, ids []int64) (map[int64]*Quote, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	quotes := make(map[int64]*Quote, len(ids))
+	for _, id := range ids {
+		if quote, ok := m.s.quotes[id]; ok {
+			quotes[id] = copyQuote(quote)
+		}
+	}
+	return quotes, nil
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type memoryUserModel struct {
+	s *memoryStore
+}
+
+func copyUser(user *User) *User {
+	c := *user
+	c.Password.hash = append([]byte(nil), user.Password.hash...)
+	c.Password.plaintext = nil
+	return &c
+}
+
+// emailTaken() compares emails without regard to case, like citext. The
+// caller holds the lock
+func (s *memoryStore) emailTaken(email string, exceptID int64) bool {
+	for id, user := range s.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if m.s.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+	m.s.lastUserID++
+	user.ID = m.s.lastUserID
+	user.CreatedAt = now()
+	user.Version = 1
+	m.s.users[user.ID] = copyUser(user)
+	if user.Activated {
+		m.s.everActivated[user.ID] = true
+	}
+	return nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, user := range m.s.users {
+		if strings.EqualFold(user.Email, email) {
+			return copyUser(user), nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	user, ok := m.s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) GetAll(ctx context.Context, name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	column, order := filters.sortColumn(), filters.sortOrder()
+	name, email = strings.ToLower(name), strings.ToLower(email)
+
+	m.s.mu.Lock()
+	users := make([]*User, 0, len(m.s.users))
+	for _, user := range m.s.users {
+		if !strings.Contains(strings.ToLower(user.Name), name) || !strings.Contains(strings.ToLower(user.Email), email) {
+			continue
+		}
+		if activated != nil && user.Activated != *activated {
+			continue
+		}
+		users = append(users, copyUser(user))
+	}
+	m.s.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		var c int
+		switch column {
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "email":
+			c = strings.Compare(strings.ToLower(a.Email), strings.ToLower(b.Email))
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		default:
+			c = compareInt64(a.ID, b.ID)
+		}
+		if order == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			return a.ID < b.ID
+		}
+		return c < 0
+	})
+	page, metadata := paginate(users, filters)
+	return page, metadata, nil
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if m.s.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+	current, ok := m.s.users[user.ID]
+	if !ok || current.Version != user.Version {
+		return ErrEditConflict
+	}
+	user.Version++
+	updated := copyUser(user)
+	updated.CreatedAt = current.CreatedAt
+	m.s.users[user.ID] = updated
+	if user.Activated {
+		m.s.everActivated[user.ID] = true
+	}
+	return nil
+}
+
+func (m memoryUserModel) DeleteUnactivated(ctx context.Context, createdBefore time.Time) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var n int64
+	for id, user := range m.s.users {
+		if user.Activated || m.s.everActivated[id] || !user.CreatedAt.Before(createdBefore) {
+			continue
+		}
+		// The foreign keys cascade to these in Postgres and SQLite
+		delete(m.s.users, id)
+		delete(m.s.userPermissions, id)
+		delete(m.s.userRoles, id)
+		for hash, token := range m.s.tokens {
+			if token.UserID == id {
+				m.s.deleteToken(hash)
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	token, ok := m.s.tokens[string(hash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	user, ok := m.s.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyUser(user), nil
+}
+
+// deleteToken() removes a token and, like the tokens_deny_deleted trigger,
+// denies an authentication token that hasn't expired yet
+func (t *memoryTables) deleteToken(hash string) {
+	token, ok := t.tokens[hash]
+	if !ok {
+		return
+	}
+	if token.Scope == ScopeAuthentication && token.Expiry.After(time.Now()) {
+		if _, denied := t.denylist[hash]; !denied {
+			t.denylist[hash] = token.Expiry
+		}
+	}
+	delete(t.tokens, hash)
+}
+
+type memoryTokenModel struct {
+	s *memoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewAuthentication(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewEmailChange(ctx context.Context, userID int64, email string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.Email = email
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	m.s.lastTokenID++
+	stored := &memoryToken{Token: *token, id: m.s.lastTokenID, createdAt: now()}
+	stored.Plaintext = ""
+	// The expiry column is timestamp(0)
+	stored.Expiry = token.Expiry.Round(time.Second)
+	m.s.tokens[string(token.Hash)] = stored
+	return nil
+}
+
+func (m memoryTokenModel) Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	token, ok := m.s.tokens[string(hash[:])]
+	if !ok || token.Scope != scope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	copied := token.Token
+	return &copied, nil
+}
+
+func (m memoryTokenModel) UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	hash := string(HashToken(tokenPlaintext))
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	token, ok := m.s.tokens[hash]
+	if !ok || token.Scope != ScopeRefresh || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	copied := token.Token
+	if token.Used {
+		return &copied, ErrTokenReused
+	}
+	token.Used = true
+	copied.Used = true
+	return &copied, nil
+}
+
+func (m memoryTokenModel) DeleteAllForFamily(ctx context.Context, scope, family string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for hash, token := range m.s.tokens {
+		if token.Scope == scope && token.Family == family && family != "" {
+			m.s.deleteToken(hash)
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	hash := string(HashToken(tokenPlaintext))
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if token, ok := m.s.tokens[hash]; ok && token.Scope == scope {
+		m.s.deleteToken(hash)
+	}
+	return nil
+}
+
+func (m memoryTokenModel) GetSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	m.s.mu.Lock()
+	sessions := []*Session{}
+	now := time.Now()
+	for _, token := range m.s.tokens {
+		if token.UserID != userID || token.Scope != ScopeAuthentication || !token.Expiry.After(now) {
+			continue
+		}
+		session := &Session{
+			ID:        token.id,
+			CreatedAt: token.createdAt,
+			Expiry:    token.Expiry,
+			IP:        token.IP,
+			UserAgent: token.UserAgent,
+			Hash:      append([]byte(nil), token.Hash...),
+		}
+		if token.lastUsedAt != nil {
+			lastUsedAt := *token.lastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+	m.s.mu.Unlock()
+
+	lastSeen := func(s *Session) time.Time {
+		if s.LastUsedAt != nil {
+			return *s.LastUsedAt
+		}
+		return s.CreatedAt
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, b := lastSeen(sessions[i]), lastSeen(sessions[j])
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return sessions[i].ID > sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteSession(ctx context.Context, userID, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var session *memoryToken
+	for _, token := range m.s.tokens {
+		if token.id == id && token.UserID == userID && token.Scope == ScopeAuthentication {
+			session = token
+			break
+		}
+	}
+	if session == nil {
+		return ErrRecordNotFound
+	}
+	for hash, token := range m.s.tokens {
+		if token == session || (session.Family != "" && token.Family == session.Family && token.UserID == userID) {
+			m.s.deleteToken(hash)
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) RecordUses(ctx context.Context, uses []TokenUse) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, use := range uses {
+		token, ok := m.s.tokens[string(use.Hash)]
+		// The last_used_at column is timestamp(0)
+		at := use.At.Round(time.Second)
+		if !ok || (token.lastUsedAt != nil && token.lastUsedAt.After(at)) {
+			continue
+		}
+		token.lastUsedAt = &at
+		token.IP = use.IP
+		token.UserAgent = use.UserAgent
+	}
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUsers(ctx context.Context, scope string, userID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for hash, token := range m.s.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			m.s.deleteToken(hash)
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	keep := sha256.Sum256([]byte(tokenPlaintext))
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var family string
+	if kept, ok := m.s.tokens[string(keep[:])]; ok {
+		family = kept.Family
+	}
+	for hash, token := range m.s.tokens {
+		if token.Scope != scope || token.UserID != userID || hash == string(keep[:]) {
+			continue
+		}
+		if token.Family == "" || token.Family != family {
+			m.s.deleteToken(hash)
+		}
+	}
+	return nil
+}
+
+func (m memoryTokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	var n int64
+	now := time.Now()
+	for hash, token := range m.s.tokens {
+		if token.Expiry.Before(now) {
+			m.s.deleteToken(hash)
+			n++
+		}
+	}
+	for hash, expiry := range m.s.denylist {
+		if expiry.Before(now) {
+			delete(m.s.denylist, hash)
+		}
+	}
+	return n, nil
+}
+
+func (m memoryTokenModel) GetDenylist(ctx context.Context) ([][]byte, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	hashes := [][]byte{}
+	now := time.Now()
+	for hash, expiry := range m.s.denylist {
+		if expiry.After(now) {
+			hashes = append(hashes, []byte(hash))
+		}
+	}
+	return hashes, nil
+}
+
+type memoryPermissionModel struct {
+	s *memoryStore
+}
+
+// forUser() returns nil when the user has no permissions, like the scan
+// loop in PermissionModel. The caller holds the lock
+func (s *memoryStore) forUser(userID int64) Permissions {
+	granted := make(map[string]bool)
+	for code, ok := range s.userPermissions[userID] {
+		granted[code] = ok
+	}
+	for _, role := range s.roles {
+		if s.userRoles[userID][role.Name] {
+			for _, code := range role.Permissions {
+				granted[code] = true
+			}
+		}
+	}
+	var permissions Permissions
+	for _, code := range s.permissions {
+		if granted[code] {
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	return m.s.forUser(userID), nil
+}
+
+func (m memoryPermissionModel) GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	permissions := make(map[int64]Permissions, len(userIDs))
+	for _, id := range userIDs {
+		if p := m.s.forUser(id); p != nil {
+			permissions[id] = p
+		}
+	}
+	return permissions, nil
+}
+
+// AddForUser() skips codes that don't exist and ones the user already has
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, code := range codes {
+		if !Permissions(m.s.permissions).Contains(code) {
+			continue
+		}
+		if m.s.userPermissions[userID] == nil {
+			m.s.userPermissions[userID] = make(map[string]bool)
+		}
+		m.s.userPermissions[userID][code] = true
+	}
+	return nil
+}
+
+func (m memoryPermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, code := range codes {
+		delete(m.s.userPermissions[userID], code)
+	}
+	return nil
+}
+
+func (m memoryPermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	permissions := append(Permissions(nil), m.s.permissions...)
+	sort.Strings(permissions)
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) GetRoles(ctx context.Context) ([]*Role, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	roles := make([]*Role, 0, len(m.s.roles))
+	for _, role := range m.s.roles {
+		permissions := append(Permissions{}, role.Permissions...)
+		sort.Strings(permissions)
+		roles = append(roles, &Role{Name: role.Name, Permissions: permissions})
+	}
+	return roles, nil
+}
+
+func (m memoryPermissionModel) GetRolesForUser(ctx context.Context, userID int64) ([]string, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	roles := []string{}
+	for _, role := range m.s.roles {
+		if m.s.userRoles[userID][role.Name] {
+			roles = append(roles, role.Name)
+		}
+	}
+	return roles, nil
+}
+
+// AddRolesForUser() skips roles that don't exist
+func (m memoryPermissionModel) AddRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, name := range roles {
+		for _, role := range m.s.roles {
+			if role.Name != name {
+				continue
+			}
+			if m.s.userRoles[userID] == nil {
+				m.s.userRoles[userID] = make(map[string]bool)
+			}
+			m.s.userRoles[userID][name] = true
+		}
+	}
+	return nil
+}
+
+func (m memoryPermissionModel) RemoveRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, role := range roles {
+		delete(m.s.userRoles[userID], role)
+	}
+	return nil
+}
+
+type memoryWebhookModel struct {
+	s *memoryStore
+}
+
+func copyWebhook(webhook *Webhook) *Webhook {
+	c := *webhook
+	c.Events = append([]string(nil), webhook.Events...)
+	return &c
+}
+
+func (m memoryWebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return err
+	}
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	webhook.Secret = secret
+	m.s.lastWebhookID++
+	webhook.ID = m.s.lastWebhookID
+	webhook.CreatedAt = now()
+	webhook.Version = 1
+	m.s.webhooks[webhook.ID] = copyWebhook(webhook)
+	return nil
+}
+
+func (m memoryWebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	webhook, ok := m.s.webhooks[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyWebhook(webhook), nil
+}
+
+func (m memoryWebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	webhooks := make([]*Webhook, 0, len(m.s.webhooks))
+	for _, webhook := range m.s.webhooks {
+		webhooks = append(webhooks, copyWebhook(webhook))
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+func (m memoryWebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	current, ok := m.s.webhooks[webhook.ID]
+	if !ok || current.Version != webhook.Version {
+		return ErrEditConflict
+	}
+	webhook.Version++
+	updated := copyWebhook(webhook)
+	updated.CreatedAt = current.CreatedAt
+	updated.Secret = current.Secret
+	m.s.webhooks[webhook.ID] = updated
+	return nil
+}
+
+func (m memoryWebhookModel) Delete(ctx context.Context, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if _, ok := m.s.webhooks[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.webhooks, id)
+	// ON DELETE CASCADE
+	for deliveryID, delivery := range m.s.deliveries {
+		if delivery.WebhookID == id {
+			delete(m.s.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (m memoryWebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	m.s.mu.Lock()
+	deliveries := []*WebhookDelivery{}
+	for _, delivery := range m.s.deliveries {
+		if delivery.WebhookID != webhookID || (status != "" && delivery.Status != status) {
+			continue
+		}
+		c := delivery.WebhookDelivery
+		c.EventType = m.s.event(delivery.EventID).eventType
+		if delivery.lastAttemptAt != nil {
+			t := *delivery.lastAttemptAt
+			c.LastAttemptAt = &t
+		}
+		deliveries = append(deliveries, &c)
+	}
+	m.s.mu.Unlock()
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID > deliveries[j].ID })
+	page, metadata := paginate(deliveries, filters)
+	return page, metadata, nil
+}
+
+func (m memoryWebhookModel) FanOut(ctx context.Context, limit int) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	webhooks := make([]*Webhook, 0, len(m.s.webhooks))
+	for _, webhook := range m.s.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+
+	var n int64
+	for _, event := range m.s.outbox {
+		if n == int64(limit) {
+			break
+		}
+		if event.dispatched {
+			continue
+		}
+		for _, webhook := range webhooks {
+			if !webhook.Active || !validator.In(event.eventType, webhook.Events...) {
+				continue
+			}
+			m.s.lastDeliveryID++
+			m.s.deliveries[m.s.lastDeliveryID] = &memoryDelivery{WebhookDelivery: WebhookDelivery{
+				ID:            m.s.lastDeliveryID,
+				CreatedAt:     now(),
+				WebhookID:     webhook.ID,
+				EventID:       event.id,
+				Status:        DeliveryPending,
+				NextAttemptAt: time.Now(),
+			}}
+		}
+		event.dispatched = true
+		n++
+	}
+	return n, nil
+}
+
+func (m memoryWebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*PendingDelivery, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	t := time.Now()
+	due := []*memoryDelivery{}
+	for _, delivery := range m.s.deliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(t) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := []*PendingDelivery{}
+	for _, delivery := range due {
+		delivery.Attempts++
+		attemptedAt := t
+		delivery.lastAttemptAt = &attemptedAt
+		delivery.NextAttemptAt = t.Add(lease)
+		webhook := m.s.webhooks[delivery.WebhookID]
+		event := m.s.event(delivery.EventID)
+		claimed = append(claimed, &PendingDelivery{
+			ID:             delivery.ID,
+			WebhookID:      delivery.WebhookID,
+			EventID:        delivery.EventID,
+			EventType:      event.eventType,
+			EventCreatedAt: event.createdAt,
+			Attempts:       delivery.Attempts,
+			URL:            webhook.URL,
+			Secret:         webhook.Secret,
+			Payload:        append(json.RawMessage(nil), event.payload...),
+		})
+	}
+	return claimed, nil
+}
+
+func (m memoryWebhookModel) MarkDelivered(ctx context.Context, id int64, responseStatus int) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if delivery, ok := m.s.deliveries[id]; ok {
+		delivery.Status = DeliverySucceeded
+		delivery.ResponseStatus = responseStatus
+		delivery.LastError = ""
+	}
+	return nil
+}
+
+func (m memoryWebhookModel) MarkFailed(ctx context.Context, id int64, responseStatus int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if delivery, ok := m.s.deliveries[id]; ok {
+		delivery.Status = DeliveryPending
+		if dead {
+			delivery.Status = DeliveryDead
+		}
+		delivery.ResponseStatus = responseStatus
+		delivery.LastError = lastError
+		delivery.NextAttemptAt = nextAttemptAt
+	}
+	return nil
+}
+
+func (m memoryWebhookModel) ReleaseDelivery(ctx context.Context, id int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if delivery, ok := m.s.deliveries[id]; ok && delivery.Status == DeliveryPending && delivery.Attempts > 0 {
+		delivery.Attempts--
+	}
+	return nil
+}
+
+// event() finds an outbox event by id, the outbox is kept in id order
+func (t *memoryTables) event(id int64) *memoryOutboxEvent {
+	i := sort.Search(len(t.outbox), func(i int) bool { return t.outbox[i].id >= id })
+	if i == len(t.outbox) || t.outbox[i].id != id {
+		return nil
+	}
+	return t.outbox[i]
+}
+
+func (m memoryWebhookModel) DeleteFinishedEvents(ctx context.Context, before time.Time) (int64, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	pending := make(map[int64]bool)
+	for _, delivery := range m.s.deliveries {
+		if delivery.Status == DeliveryPending {
+			pending[delivery.EventID] = true
+		}
+	}
+	kept := m.s.outbox[:0]
+	deleted := make(map[int64]bool)
+	for _, event := range m.s.outbox {
+		if event.dispatched && event.createdAt.Before(before) && !pending[event.id] {
+			deleted[event.id] = true
+			continue
+		}
+		kept = append(kept, event)
+	}
+	m.s.outbox = kept
+	// ON DELETE CASCADE
+	for id, delivery := range m.s.deliveries {
+		if deleted[delivery.EventID] {
+			delete(m.s.deliveries, id)
+		}
+	}
+	return int64(len(deleted)), nil
+}
+
+func (m memoryWebhookModel) Redeliver(ctx context.Context, webhookID, deliveryID int64) error {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	delivery, ok := m.s.deliveries[deliveryID]
+	if !ok || delivery.WebhookID != webhookID {
+		return ErrRecordNotFound
+	}
+	delivery.Status = DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	return nil
+}
+
+type memoryChangeModel struct {
+	s *memoryStore
+}
+
+func copyChange(change *QuoteChange) *QuoteChange {
+	c := *change
+	c.Quote = copyQuote(change.Quote)
+	return &c
+}
+
+func (m memoryChangeModel) GetSince(ctx context.Context, after SyncToken, limit int) ([]*QuoteChange, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	changes := []*QuoteChange{}
+	for _, change := range m.s.changes {
+		if len(changes) == limit {
+			break
+		}
+		if after.Before(change.Token()) {
+			changes = append(changes, copyChange(change))
+		}
+	}
+	return changes, nil
+}
+
+func (m memoryChangeModel) Latest(ctx context.Context) (SyncToken, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	if len(m.s.changes) == 0 {
+		return SyncToken{}, nil
+	}
+	return m.s.changes[len(m.s.changes)-1].Token(), nil
+}
+
+func (m memoryChangeModel) TokenFor(ctx context.Context, id int64) (SyncToken, error) {
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+	for _, change := range m.s.changes {
+		if change.ID == id {
+			return change.Token(), nil
+		}
+	}
+	return SyncToken{}, ErrRecordNotFound
+}
+
+// GetFeed() has nothing to wait for, every write is committed as soon as
+// it is made
+func (m memoryChangeModel) GetFeed(ctx context.Context, since SyncToken, limit int) ([]*QuoteChange, SyncToken, bool, error) {
+	changes, err := m.GetSince(ctx, since, limit+1)
+	if err != nil {
+		return nil, since, false, err
+	}
+	changes, next, more := feedPage(changes, since, limit)
+	return changes, next, more, nil
+}
@@ -0,0 +1,16 @@
+// Filename: internals/data/memory_test.go
+
+package data_test
+
+import (
+	"testing"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/data/datatest"
+)
+
+func TestMemoryModels(t *testing.T) {
+	datatest.Run(t, func(t *testing.T) data.Models {
+		return data.NewMemoryModels()
+	})
+}
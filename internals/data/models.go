@@ -3,8 +3,12 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"net/url"
+	"strings"
+	"time"
 )
 
 var (
@@ -12,20 +16,166 @@ var (
 	ErrEditConflict = errors.New("edit conflict")
 )
 
+// The interfaces below are what the handlers depend on. The Postgres models
+// (QuoteModel and friends) are the default, NewSQLiteModels() and
+// NewMemoryModels() return implementations that behave the same way. Every
+// method takes the context of whatever it is done for, usually the request,
+// so that the query is abandoned when the caller gives up
+type QuoteStore interface {
+	Insert(ctx context.Context, quote *Quote) error
+	Get(ctx context.Context, id int64) (*Quote, error)
+	Update(ctx context.Context, quote *Quote) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error)
+	GetMany(ctx context.Context, ids []int64) (map[int64]*Quote, error)
+}
+
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetAll(ctx context.Context, name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+	DeleteUnactivated(ctx context.Context, createdBefore time.Time) (int64, error)
+}
+
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	NewAuthentication(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error)
+	NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error)
+	NewEmailChange(ctx context.Context, userID int64, email string, ttl time.Duration) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error)
+	UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error)
+	Delete(ctx context.Context, scope, tokenPlaintext string) error
+	GetSessions(ctx context.Context, userID int64) ([]*Session, error)
+	DeleteSession(ctx context.Context, userID, id int64) error
+	RecordUses(ctx context.Context, uses []TokenUse) error
+	DeleteAllForUsers(ctx context.Context, scope string, userID int64) error
+	DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, tokenPlaintext string) error
+	DeleteAllForFamily(ctx context.Context, scope, family string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+	GetDenylist(ctx context.Context) ([][]byte, error)
+}
+
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	RemoveForUser(ctx context.Context, userID int64, codes ...string) error
+	GetAll(ctx context.Context) (Permissions, error)
+	GetRoles(ctx context.Context) ([]*Role, error)
+	GetRolesForUser(ctx context.Context, userID int64) ([]string, error)
+	AddRolesForUser(ctx context.Context, userID int64, roles ...string) error
+	RemoveRolesForUser(ctx context.Context, userID int64, roles ...string) error
+}
+
+type WebhookStore interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	Get(ctx context.Context, id int64) (*Webhook, error)
+	GetAll(ctx context.Context) ([]*Webhook, error)
+	Update(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, id int64) error
+	GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error)
+	FanOut(ctx context.Context, limit int) (int64, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*PendingDelivery, error)
+	MarkDelivered(ctx context.Context, id int64, responseStatus int) error
+	MarkFailed(ctx context.Context, id int64, responseStatus int, lastError string, nextAttemptAt time.Time, dead bool) error
+	ReleaseDelivery(ctx context.Context, id int64) error
+	Redeliver(ctx context.Context, webhookID, deliveryID int64) error
+	DeleteFinishedEvents(ctx context.Context, before time.Time) (int64, error)
+}
+
+type ChangeStore interface {
+	GetSince(ctx context.Context, after SyncToken, limit int) ([]*QuoteChange, error)
+	Latest(ctx context.Context) (SyncToken, error)
+	TokenFor(ctx context.Context, id int64) (SyncToken, error)
+	GetFeed(ctx context.Context, since SyncToken, limit int) ([]*QuoteChange, SyncToken, bool, error)
+}
+
 type Models struct {
-	Permissions PermissionModel
-	Quote QuoteModel
-	Tokens TokenModel
-	Users UserModel
+	Changes ChangeStore
+	Permissions PermissionStore
+	Quote QuoteStore
+	Tokens TokenStore
+	Users UserStore
+	Webhooks WebhookStore
+
+	// Set by the constructors, see WithTx()
+	withTx func(ctx context.Context, fn func(Models) error) error
 }
 
-// NewModels() allows us to create a new MOdels 
+// NewModels() allows us to create a new MOdels
+
+func NewModels(db *sql.DB, opts Options) Models {
+	var reader Querier = db
+	if opts.Replicas != nil {
+		reader = opts.Replicas
+	}
+	models := postgresModels(db, reader, &opts)
+	// Serializable so that a WithTx() caller never acts on a stale read,
+	// the losers of a race get a serialization failure and are retried.
+	// Everything in a transaction reads from the primary
+	models.withTx = sqlWithTx(db, &sql.TxOptions{Isolation: sql.LevelSerializable}, func(tx Querier) Models {
+		return postgresModels(tx, tx, &opts)
+	})
+	return models
+}
 
-func NewModels(db *sql.DB) Models {
+func postgresModels(db, reader Querier, opts *Options) Models {
 	return Models{
-		Permissions: PermissionModel{DB: db},
-		Quote: QuoteModel{DB: db},
-		Tokens: TokenModel{DB: db},
-		Users:     UserModel{DB: db},
+		Changes: ChangeModel{DB: db, opts: opts},
+		Permissions: PermissionModel{DB: db, reader: reader, opts: opts},
+		Quote: QuoteModel{DB: db, reader: reader, opts: opts},
+		Tokens: TokenModel{DB: db, opts: opts},
+		Users:     UserModel{DB: db, reader: reader, opts: opts},
+		Webhooks: WebhookModel{DB: db, reader: reader, opts: opts},
+	}
+}
+
+// The database/sql driver names of the supported databases
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// ParseDSN() picks the driver from the scheme of the DSN. "sqlite:" followed
+// by a file name, as in sqlite:///var/lib/quotes.db or sqlite:quotes.db,
+// opens SQLite with foreign keys, WAL, a busy timeout and write locking
+// transactions unless the query string says otherwise. Anything else is
+// handed to Postgres as it is
+func ParseDSN(dsn string) (driver, source string) {
+	if !strings.HasPrefix(dsn, "sqlite:") {
+		return DriverPostgres, dsn
 	}
-} 
\ No newline at end of file
+	path, rawQuery, _ := strings.Cut(strings.TrimPrefix(dsn, "sqlite:"), "?")
+	path = strings.TrimPrefix(path, "//")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		query = url.Values{}
+	}
+	for _, pragma := range []string{"foreign_keys(1)", "journal_mode(WAL)", "busy_timeout(5000)"} {
+		name, _, _ := strings.Cut(pragma, "(")
+		set := false
+		for _, p := range query["_pragma"] {
+			set = set || strings.HasPrefix(p, name+"(")
+		}
+		if !set {
+			query.Add("_pragma", pragma)
+		}
+	}
+	if query.Get("_txlock") == "" {
+		query.Set("_txlock", "immediate")
+	}
+	return DriverSQLite, "file:" + path + "?" + query.Encode()
+}
+
+// NewModelsFor() returns the models for a database that was opened with the
+// given driver
+func NewModelsFor(driver string, db *sql.DB, opts Options) Models {
+	if driver == DriverSQLite {
+		return NewSQLiteModels(db, opts)
+	}
+	return NewModels(db, opts)
+}
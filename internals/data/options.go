@@ -0,0 +1,125 @@
+// Filename: internals/data/options.go
+
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long a model method may run when nothing else has
+// been configured for it
+const DefaultTimeout = 3 * time.Second
+
+// The outcomes that Options.Observe is called with. An operation that
+// failed with an ordinary error still completed
+const (
+	OutcomeCompleted = "completed"
+	OutcomeTimedOut  = "timed_out"
+	OutcomeCancelled = "cancelled"
+)
+
+// Options changes how the SQL models run their statements. The zero value
+// gives every operation DefaultTimeout
+type Options struct {
+	// Timeout bounds every operation that isn't listed in Timeouts
+	Timeout time.Duration
+	// Timeouts bounds single operations, which are named after the store
+	// and the method, as in "quotes.GetAll"
+	Timeouts map[string]time.Duration
+	// Observe, if set, is called as every operation finishes
+	Observe func(op, outcome string, duration time.Duration)
+	// Replicas, if set, serves the reads that can stand to be slightly
+	// stale: quote and webhook lookups and the user and permission
+	// listings. Authentication and authorization always read from the
+	// primary, so that a revoked token or permission stops working at
+	// once. Only the Postgres models use it
+	Replicas *ReplicaSet
+}
+
+// The stores that the operation names start with
+var stores = map[string]reflect.Type{
+	"changes":     reflect.TypeOf((*ChangeStore)(nil)).Elem(),
+	"permissions": reflect.TypeOf((*PermissionStore)(nil)).Elem(),
+	"quotes":      reflect.TypeOf((*QuoteStore)(nil)).Elem(),
+	"tokens":      reflect.TypeOf((*TokenStore)(nil)).Elem(),
+	"users":       reflect.TypeOf((*UserStore)(nil)).Elem(),
+	"webhooks":    reflect.TypeOf((*WebhookStore)(nil)).Elem(),
+}
+
+// Operations() returns the name of every operation that can be given a
+// timeout, in order
+func Operations() []string {
+	var ops []string
+	for name, store := range stores {
+		for i := 0; i < store.NumMethod(); i++ {
+			ops = append(ops, name+"."+store.Method(i).Name)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// ParseTimeouts() reads per-operation timeouts written as space separated
+// op=duration pairs, such as "quotes.GetAll=10s users.GetAll=5s"
+func ParseTimeouts(s string) (map[string]time.Duration, error) {
+	known := make(map[string]bool)
+	for _, op := range Operations() {
+		known[op] = true
+	}
+	timeouts := make(map[string]time.Duration)
+	for _, field := range strings.Fields(s) {
+		op, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("timeout %q is not of the form op=duration", field)
+		}
+		if !known[op] {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout for %s: %q", op, value)
+		}
+		timeouts[op] = timeout
+	}
+	return timeouts, nil
+}
+
+func (o *Options) timeout(op string) time.Duration {
+	if o == nil {
+		return DefaultTimeout
+	}
+	if timeout, ok := o.Timeouts[op]; ok {
+		return timeout
+	}
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return DefaultTimeout
+}
+
+// start() bounds ctx by the timeout for op. The cancel func it returns
+// reports the outcome to Observe, so the caller should defer it straight away
+func (o *Options) start(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, o.timeout(op))
+	if o == nil || o.Observe == nil {
+		return ctx, cancel
+	}
+	started := time.Now()
+	return ctx, func() {
+		outcome := OutcomeCompleted
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			outcome = OutcomeTimedOut
+		case errors.Is(ctx.Err(), context.Canceled):
+			outcome = OutcomeCancelled
+		}
+		cancel()
+		o.Observe(op, outcome, time.Since(started))
+	}
+}
@@ -3,8 +3,7 @@ package data
 
 import (
 	"context"
-	"database/sql"
-	"time"
+	"strings"
 
 	"github.com/lib/pq"
 )
@@ -12,21 +11,50 @@ import (
 // Define a slice to hold the permission codes
 type Permissions []string
 
-// Checks the slice for a specific permission code
+// Checks the slice for a specific permission code. A code ending in * in
+// the slice grants every code that starts with what comes before it, so
+// quotes:* grants quotes:read and * grants everything
 func (p Permissions) Include(code string) bool {
 	for i := range p {
 		if code == p[i] {
 			return true
 		}
+		if prefix, ok := strings.CutSuffix(p[i], "*"); ok && strings.HasPrefix(code, prefix) {
+			return true
+		}
 	}
 	return false
 }
 
+// Contains() reports whether code itself is in the slice, without resolving
+// wildcards. It is for checking that codes exist, access checks should use
+// Include()
+func (p Permissions) Contains(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// A Role bundles permission codes. Users in a role get all of them on top
+// of the ones granted to them directly
+type Role struct {
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
 type PermissionModel struct {
-	DB *sql.DB
+	DB Querier
+	// The read-only methods run on reader, which may be a ReplicaSet
+	reader Querier
+	opts *Options
 }
 
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// GetAllForUser() returns the permissions granted to the user directly and
+// through their roles
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 	     SELECT permissions.code
 		 FROM permissions
@@ -35,8 +63,16 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 		 INNER JOIN users
 		 ON users_permissions.user_id = users.id
 		 WHERE users.id = $1
+		 UNION
+		 SELECT permissions.code
+		 FROM permissions
+		 INNER JOIN roles_permissions
+		 ON roles_permissions.permission_id = permissions.id
+		 INNER JOIN users_roles
+		 ON users_roles.role_id = roles_permissions.role_id
+		 WHERE users_roles.user_id = $1
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAllForUser")
 	defer cancel()
 	rows, err := m.DB.QueryContext(ctx, query, userID)
 	if err != nil {
@@ -59,14 +95,204 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// GetAllForUsers() fetches the permissions of several users in one query.
+// Like GetAllForUser() it includes the permissions of their roles
+func (m PermissionModel) GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error) {
+	query := `
+	     SELECT users_permissions.user_id, permissions.code
+		 FROM permissions
+		 INNER JOIN users_permissions
+		 ON users_permissions.permission_id = permissions.id
+		 WHERE users_permissions.user_id = ANY($1)
+		 UNION
+		 SELECT users_roles.user_id, permissions.code
+		 FROM permissions
+		 INNER JOIN roles_permissions
+		 ON roles_permissions.permission_id = permissions.id
+		 INNER JOIN users_roles
+		 ON users_roles.role_id = roles_permissions.role_id
+		 WHERE users_roles.user_id = ANY($1)
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAllForUsers")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[int64]Permissions, len(userIDs))
+	for rows.Next() {
+		var userID int64
+		var permission string
+		err := rows.Scan(&userID, &permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions[userID] = append(permissions[userID], permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
 	      INSERT INTO users_permissions
-		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)	 
+		  SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		  ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.AddForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// RemoveForUser() takes permissions away from a user
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "permissions.RemoveForUser")
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
-}
\ No newline at end of file
+}
+
+// GetAll() returns every permission code that exists
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAll")
+	defer cancel()
+	rows, err := m.reader.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// GetRoles() returns every role with the codes that it grants
+func (m PermissionModel) GetRoles(ctx context.Context) ([]*Role, error) {
+	query := `
+		SELECT roles.name, COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions
+		ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions
+		ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.id
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetRoles")
+	defer cancel()
+	rows, err := m.reader.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		var codes []string
+		err := rows.Scan(&role.Name, pq.Array(&codes))
+		if err != nil {
+			return nil, err
+		}
+		role.Permissions = codes
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetRolesForUser() returns the names of the roles that a user is in
+func (m PermissionModel) GetRolesForUser(ctx context.Context, userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.id
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetRolesForUser")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// AddRolesForUser() puts a user in roles. Like AddForUser() it skips roles
+// that don't exist
+func (m PermissionModel) AddRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+		ON CONFLICT DO NOTHING
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.AddRolesForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(roles))
+	return err
+}
+
+// RemoveRolesForUser() takes a user out of roles
+func (m PermissionModel) RemoveRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = ANY($2)
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.RemoveRolesForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(roles))
+	return err
+}
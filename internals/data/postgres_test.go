@@ -0,0 +1,43 @@
+// Filename: internals/data/postgres_test.go
+
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/data/datatest"
+	"quotesapi.desireamagwula.net/internals/migrate"
+	"quotesapi.desireamagwula.net/migrations"
+)
+
+// TestPostgresModels runs against the database in QUOTES_TEST_DB_DSN, which
+// is migrated up first. The suite leaves its rows behind, so it has to be a
+// database that is only used for tests
+func TestPostgresModels(t *testing.T) {
+	dsn := os.Getenv("QUOTES_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("QUOTES_TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open(data.DriverPostgres, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := migrate.New(db, data.DriverPostgres, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewModels(db, data.Options{})
+	datatest.Run(t, func(t *testing.T) data.Models {
+		return models
+	})
+}
@@ -39,12 +39,15 @@ func ValidateQuote(v *validator.Validator, quote *Quote) {
 }
 
 type QuoteModel struct {
-	DB *sql.DB
+	DB Querier
+	// The read-only methods run on reader, which may be a ReplicaSet
+	reader Querier
+	opts *Options
 }
 
 // Insert() allows us to create a new quote
 
-func (m QuoteModel) Insert(quote *Quote) error {
+func (m QuoteModel) Insert(ctx context.Context, quote *Quote) error {
 	query := `
 		INSERT INTO quotes (author, quote_string, category)
 		VALUES ($1, $2, $3)
@@ -56,16 +59,22 @@ func (m QuoteModel) Insert(quote *Quote) error {
 		pq.Array(quote.Category),
 	}
 	// Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "quotes.Insert")
 	// Cleanup to prevent memory leaks
 	defer cancel()
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&quote.ID, &quote.CreatedAt, &quote.Version)
-	//return m.DB.QueryRow(query, args...).Scan(&quote.ID, &quote.CreatedAt, &quote.Version)
+	// The quote and its outbox event are written in the same transaction
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&quote.ID, &quote.CreatedAt, &quote.Version)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventQuoteCreated, quote)
+	})
 }
 
 // Get() allows us to retrieve
 
-func (m QuoteModel) Get(id int64) (*Quote, error) {
+func (m QuoteModel) Get(ctx context.Context, id int64) (*Quote, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -78,11 +87,11 @@ func (m QuoteModel) Get(id int64) (*Quote, error) {
 	// Declare a quote variable to hold the returned data
 	var quote Quote
 	// Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "quotes.Get")
 	// Cleanup to prevent memory leaks
 	defer cancel()
 	// Execute the query using QueryRow()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.reader.QueryRowContext(ctx, query, id).Scan(
 		&quote.ID,
 		&quote.CreatedAt,
 		&quote.Author,
@@ -106,7 +115,7 @@ func (m QuoteModel) Get(id int64) (*Quote, error) {
 
 // Update() allows us to edit/alter a specific quote
 
-func (m QuoteModel) Update(quote *Quote) error {
+func (m QuoteModel) Update(ctx context.Context, quote *Quote) error {
 	// Create a query
 	query := `
 		UPDATE quotes
@@ -125,57 +134,67 @@ func (m QuoteModel) Update(quote *Quote) error {
 	}
 
 	//Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "quotes.Update")
 	//Cleanup to prevent memory leaks
 	defer cancel()
-	// Check for edit conflicts
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&quote.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
-			return err
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		// Check for edit conflicts
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&quote.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
 		}
-	}
-	return nil
+		return insertOutboxEvent(ctx, tx, EventQuoteUpdated, quote)
+	})
 
 }
 
 // Delete removes a specific quote
-func (m QuoteModel) Delete(id int64) error {
+func (m QuoteModel) Delete(ctx context.Context, id int64) error {
 
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	// Create the delete query
+	// Create the delete query. The deleted row is returned so that it can
+	// be carried by the quote.deleted event
 	query := `
 		DELETE FROM quotes
 		WHERE id = $1
+		RETURNING id, created_at, author, quote_string, category, version
 	`
 	// Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "quotes.Delete")
 	// Cleanup to prevent memory leaks
 	defer cancel()
-	// Execute the query
-	result, err := m.DB.ExecContext(ctx, query, id)
-	if err != nil {
-		return err
-	}
-	// Check how many rows were affected by the delete operation. We
-	// call the RowsAffected() method on the result variable
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
-	// Check if no rows were affected
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
-	return nil
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		// Execute the query
+		var quote Quote
+		err := tx.QueryRowContext(ctx, query, id).Scan(
+			&quote.ID,
+			&quote.CreatedAt,
+			&quote.Author,
+			&quote.Quote_string,
+			pq.Array(&quote.Category),
+			&quote.Version,
+		)
+		// Check if no rows were affected
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		return insertOutboxEvent(ctx, tx, EventQuoteDeleted, &quote)
+	})
 
 }
-func (m QuoteModel) GetAll(author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error) {
+func (m QuoteModel) GetAll(ctx context.Context, author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error) {
 	// Construct the query
 	query := fmt.Sprintf(`
 		SELECT COUNT (*) OVER(), id, created_at, author, quote_string,
@@ -187,11 +206,11 @@ func (m QuoteModel) GetAll(author string, quote_string string, category []string
 		ORDER by %s %s, id ASC
 		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
 	// Create
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "quotes.GetAll")
 	defer cancel()
 	args := []interface{}{author, quote_string, pq.Array(category), filters.limit(), filters.offSet()}
 	// Execute the query
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.reader.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -227,3 +246,41 @@ func (m QuoteModel) GetAll(author string, quote_string string, category []string
 	// safely return the resultset
 	return quotes, metadata, nil
 }
+
+// GetMany() fetches several quotes in a single query. Quotes that don't
+// exist are left out of the map
+func (m QuoteModel) GetMany(ctx context.Context, ids []int64) (map[int64]*Quote, error) {
+	query := `
+		SELECT id, created_at, author, quote_string, category, version
+		FROM quotes
+		WHERE id = ANY($1)
+	`
+	ctx, cancel := m.opts.start(ctx, "quotes.GetMany")
+	defer cancel()
+	rows, err := m.reader.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotes := make(map[int64]*Quote, len(ids))
+	for rows.Next() {
+		var quote Quote
+		err := rows.Scan(
+			&quote.ID,
+			&quote.CreatedAt,
+			&quote.Author,
+			&quote.Quote_string,
+			pq.Array(&quote.Category),
+			&quote.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		quotes[quote.ID] = &quote
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return quotes, nil
+}
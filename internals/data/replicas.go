@@ -0,0 +1,158 @@
+// Filename: internals/data/replicas.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type primaryContextKey struct{}
+
+// WithPrimary() returns a context whose reads go to the primary even when
+// there are healthy replicas. It is used for requests that write, and for
+// clients that have written recently and must see their own writes
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// A ReplicaSet is the Querier that the read-only model methods run on when
+// there are read replicas. Reads are spread over the healthy replicas and
+// fall back to the primary when there aren't any. Writes always go to the
+// primary
+type ReplicaSet struct {
+	primary  *sql.DB
+	replicas []*replica
+	next     uint32
+
+	// MaxLag is how far behind the primary a replica may fall before it
+	// stops taking reads
+	MaxLag time.Duration
+	// OnChange, if set, is called when a replica becomes healthy or
+	// unhealthy. err is why it was taken out of rotation
+	OnChange func(name string, healthy bool, err error)
+}
+
+type replica struct {
+	name string
+	db   *sql.DB
+	// One of the replica states below
+	state atomic.Int32
+}
+
+const (
+	replicaUnchecked int32 = iota
+	replicaHealthy
+	replicaUnhealthy
+)
+
+// NewReplicaSet() returns a set that reads from the replicas in dbs, which
+// are keyed by a name used in logs. Every replica starts out unhealthy until
+// the first health check has passed
+func NewReplicaSet(primary *sql.DB, dbs map[string]*sql.DB) *ReplicaSet {
+	r := &ReplicaSet{primary: primary, MaxLag: 10 * time.Second}
+	for name, db := range dbs {
+		r.replicas = append(r.replicas, &replica{name: name, db: db})
+	}
+	return r
+}
+
+// pick() returns the database that a read with this context should use
+func (r *ReplicaSet) pick(ctx context.Context) Querier {
+	if usePrimary(ctx) {
+		return r.primary
+	}
+	// Round robin from where the last read left off
+	start := atomic.AddUint32(&r.next, 1)
+	for i := range r.replicas {
+		rp := r.replicas[(int(start)+i)%len(r.replicas)]
+		if rp.state.Load() == replicaHealthy {
+			return rp.db
+		}
+	}
+	return r.primary
+}
+
+func (r *ReplicaSet) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return r.primary.ExecContext(ctx, query, args...)
+}
+
+func (r *ReplicaSet) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return r.pick(ctx).QueryContext(ctx, query, args...)
+}
+
+func (r *ReplicaSet) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return r.pick(ctx).QueryRowContext(ctx, query, args...)
+}
+
+// Run() checks every replica straight away and then once every interval,
+// until the context is cancelled
+func (r *ReplicaSet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.check(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check() runs the health checks in parallel, so that one replica that
+// doesn't answer can't hold up the rest
+func (r *ReplicaSet) check(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, rp := range r.replicas {
+		wg.Add(1)
+		go func(rp *replica) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := r.checkReplica(ctx, rp.db)
+			if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+				// Shutting down, which says nothing about the replica
+				return
+			}
+			state := replicaHealthy
+			if err != nil {
+				state = replicaUnhealthy
+			}
+			if rp.state.Swap(state) != state && r.OnChange != nil {
+				r.OnChange(rp.name, err == nil, err)
+			}
+		}(rp)
+	}
+	wg.Wait()
+}
+
+// checkReplica() returns nil if the replica answers and has replayed
+// everything it has received, or isn't further behind than MaxLag
+func (r *ReplicaSet) checkReplica(ctx context.Context, db *sql.DB) error {
+	query := `
+		SELECT CASE
+			WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END
+	`
+	var lag float64
+	err := db.QueryRowContext(ctx, query).Scan(&lag)
+	if err != nil {
+		return err
+	}
+	if behind := time.Duration(lag * float64(time.Second)); behind > r.MaxLag {
+		return fmt.Errorf("replica is %s behind the primary", behind.Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+// Filename: internals/data/sqlite.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Timestamps are stored in SQLite as UTC text of a fixed width, which is
+// what strftime('%Y-%m-%d %H:%M:%f', 'now') returns, so that they compare
+// correctly as strings
+const sqliteTimeFormat = "2006-01-02 15:04:05.000"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// jsonArray stands in for pq.Array(). SQLite has no arrays, so the text[]
+// columns hold JSON arrays instead and lists of ids are passed as JSON to
+// json_each()
+type jsonArray struct {
+	v interface{}
+}
+
+func (a jsonArray) Value() (driver.Value, error) {
+	b, err := json.Marshal(a.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (a jsonArray) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), a.v)
+	case []byte:
+		return json.Unmarshal(src, a.v)
+	default:
+		return fmt.Errorf("cannot scan %T into a JSON array", src)
+	}
+}
+
+// ftsQuery() builds the FTS5 query for the author and quote_string
+// searches. Like plainto_tsquery('simple', ...) every word of a search has
+// to appear in its column. An empty string means that nothing was searched
+func ftsQuery(author, quoteString string) string {
+	var terms []string
+	for _, search := range []struct{ column, text string }{
+		{"author", author},
+		{"quote_string", quoteString},
+	} {
+		// searchTerms() only returns letters and digits, so the words
+		// don't need escaping
+		for _, term := range searchTerms(search.text) {
+			terms = append(terms, fmt.Sprintf(`%s : "%s"`, search.column, term))
+		}
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// NewSQLiteModels() returns models backed by SQLite, for single node
+// installs and local development. The database should be opened with a
+// DSN from ParseDSN(), which turns on foreign keys and makes every
+// transaction take the write lock up front
+func NewSQLiteModels(db *sql.DB, opts Options) Models {
+	newModels := func(db Querier) Models {
+		return sqliteModels(db, &opts)
+	}
+	models := newModels(db)
+	// SQLite transactions are always serializable
+	models.withTx = sqlWithTx(db, nil, newModels)
+	return models
+}
+
+func sqliteModels(db Querier, opts *Options) Models {
+	return Models{
+		Changes:     sqliteChangeModel{DB: db, opts: opts},
+		Permissions: sqlitePermissionModel{DB: db, opts: opts},
+		Quote:       sqliteQuoteModel{DB: db, opts: opts},
+		Tokens:      sqliteTokenModel{DB: db, opts: opts},
+		Users:       sqliteUserModel{DB: db, opts: opts},
+		Webhooks:    sqliteWebhookModel{DB: db, opts: opts},
+	}
+}
+
+type sqliteQuoteModel struct {
+	DB   Querier
+	opts *Options
+}
+
+func (m sqliteQuoteModel) Insert(ctx context.Context, quote *Quote) error {
+	query := `
+		INSERT INTO quotes (author, quote_string, category)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{quote.Author, quote.Quote_string, jsonArray{quote.Category}}
+	ctx, cancel := m.opts.start(ctx, "quotes.Insert")
+	defer cancel()
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&quote.ID, &quote.CreatedAt, &quote.Version)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventQuoteCreated, quote)
+	})
+}
+
+func (m sqliteQuoteModel) Get(ctx context.Context, id int64) (*Quote, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, author, quote_string, category, version
+		FROM quotes
+		WHERE id = $1
+	`
+	var quote Quote
+	ctx, cancel := m.opts.start(ctx, "quotes.Get")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&quote.ID,
+		&quote.CreatedAt,
+		&quote.Author,
+		&quote.Quote_string,
+		jsonArray{&quote.Category},
+		&quote.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &quote, nil
+}
+
+func (m sqliteQuoteModel) Update(ctx context.Context, quote *Quote) error {
+	query := `
+		UPDATE quotes
+		SET author = $1, quote_string = $2,
+		category = $3, version = version + 1
+		WHERE id = $4
+		AND version = $5
+		RETURNING version
+	`
+	args := []interface{}{
+		quote.Author,
+		quote.Quote_string,
+		jsonArray{quote.Category},
+		quote.ID,
+		quote.Version,
+	}
+	ctx, cancel := m.opts.start(ctx, "quotes.Update")
+	defer cancel()
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&quote.Version)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrEditConflict
+			default:
+				return err
+			}
+		}
+		return insertOutboxEvent(ctx, tx, EventQuoteUpdated, quote)
+	})
+}
+
+func (m sqliteQuoteModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM quotes
+		WHERE id = $1
+		RETURNING id, created_at, author, quote_string, category, version
+	`
+	ctx, cancel := m.opts.start(ctx, "quotes.Delete")
+	defer cancel()
+	return inTx(ctx, m.DB, func(tx Querier) error {
+		var quote Quote
+		err := tx.QueryRowContext(ctx, query, id).Scan(
+			&quote.ID,
+			&quote.CreatedAt,
+			&quote.Author,
+			&quote.Quote_string,
+			jsonArray{&quote.Category},
+			&quote.Version,
+		)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+		return insertOutboxEvent(ctx, tx, EventQuoteDeleted, &quote)
+	})
+}
+
+// GetAll() searches quotes_fts in place of the tsvector indexes and checks
+// the categories with json_each() in place of @>
+func (m sqliteQuoteModel) GetAll(ctx context.Context, author string, quote_string string, category []string, filters Filters) ([]*Quote, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, author, quote_string,
+			   category, version
+		FROM quotes
+		WHERE ($1 = '' OR id IN (SELECT rowid FROM quotes_fts WHERE quotes_fts MATCH $1))
+		AND NOT EXISTS (
+			SELECT 1 FROM json_each($2) AS wanted
+			WHERE wanted.value NOT IN (SELECT value FROM json_each(quotes.category))
+		)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortOrder())
+	ctx, cancel := m.opts.start(ctx, "quotes.GetAll")
+	defer cancel()
+	args := []interface{}{ftsQuery(author, quote_string), jsonArray{category}, filters.limit(), filters.offSet()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	quotes := []*Quote{}
+	for rows.Next() {
+		var quote Quote
+		err := rows.Scan(
+			&totalRecords,
+			&quote.ID,
+			&quote.CreatedAt,
+			&quote.Author,
+			&quote.Quote_string,
+			jsonArray{&quote.Category},
+			&quote.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		quotes = append(quotes, &quote)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return quotes, metadata, nil
+}
+
+func (m sqliteQuoteModel) GetMany(ctx context.Context, ids []int64) (map[int64]*Quote, error) {
+	query := `
+		SELECT id, created_at, author, quote_string, category, version
+		FROM quotes
+		WHERE id IN (SELECT value FROM json_each($1))
+	`
+	ctx, cancel := m.opts.start(ctx, "quotes.GetMany")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, jsonArray{ids})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotes := make(map[int64]*Quote, len(ids))
+	for rows.Next() {
+		var quote Quote
+		err := rows.Scan(
+			&quote.ID,
+			&quote.CreatedAt,
+			&quote.Author,
+			&quote.Quote_string,
+			jsonArray{&quote.Category},
+			&quote.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		quotes[quote.ID] = &quote
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return quotes, nil
+}
+
+type sqliteChangeModel struct {
+	DB   Querier
+	opts *Options
+}
+
+// GetSince() reads by id alone. SQLite has one writer at a time, so a
+// change can't become visible behind one with a higher id, and the XID part
+// of the tokens is always zero
+func (m sqliteChangeModel) GetSince(ctx context.Context, after SyncToken, limit int) ([]*QuoteChange, error) {
+	query := `
+		SELECT id, created_at, quote_id, event_type, version, payload
+		FROM quote_changes
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.GetSince")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*QuoteChange{}
+	for rows.Next() {
+		var change QuoteChange
+		var payload []byte
+		err := rows.Scan(
+			&change.ID,
+			&change.CreatedAt,
+			&change.QuoteID,
+			&change.EventType,
+			&change.Version,
+			&payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(payload, &change.Quote)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (m sqliteChangeModel) Latest(ctx context.Context) (SyncToken, error) {
+	query := `
+		SELECT COALESCE(MAX(id), 0)
+		FROM quote_changes
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.Latest")
+	defer cancel()
+	var token SyncToken
+	err := m.DB.QueryRowContext(ctx, query).Scan(&token.ID)
+	return token, err
+}
+
+func (m sqliteChangeModel) TokenFor(ctx context.Context, id int64) (SyncToken, error) {
+	query := `
+		SELECT id
+		FROM quote_changes
+		WHERE id = $1
+	`
+	ctx, cancel := m.opts.start(ctx, "changes.TokenFor")
+	defer cancel()
+	var token SyncToken
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&token.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return SyncToken{}, ErrRecordNotFound
+		default:
+			return SyncToken{}, err
+		}
+	}
+	return token, nil
+}
+
+// As with Postgres, an empty page hands back the token that it was asked
+// for
+func (m sqliteChangeModel) GetFeed(ctx context.Context, since SyncToken, limit int) ([]*QuoteChange, SyncToken, bool, error) {
+	changes, err := m.GetSince(ctx, since, limit+1)
+	if err != nil {
+		return nil, since, false, err
+	}
+	changes, next, more := feedPage(changes, since, limit)
+	return changes, next, more, nil
+}
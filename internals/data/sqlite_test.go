@@ -0,0 +1,41 @@
+// Filename: internals/data/sqlite_test.go
+
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/data/datatest"
+	"quotesapi.desireamagwula.net/internals/migrate"
+	"quotesapi.desireamagwula.net/migrations"
+)
+
+// newSQLiteModels returns models on a fresh, migrated in-memory database.
+// Every connection to :memory: opens a database of its own, so the pool
+// is kept to one connection
+func newSQLiteModels(t *testing.T) data.Models {
+	t.Helper()
+	_, source := data.ParseDSN("sqlite::memory:")
+	db, err := sql.Open(data.DriverSQLite, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	migrator, err := migrate.New(db, data.DriverSQLite, migrations.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrator.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.NewSQLiteModels(db, data.Options{})
+}
+
+func TestSQLiteModels(t *testing.T) {
+	datatest.Run(t, newSQLiteModels)
+}
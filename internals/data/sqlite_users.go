@@ -0,0 +1,790 @@
+// Filename: internals/data/sqlite_users.go
+
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// isDuplicateEmail() reports whether err came from the unique constraint on
+// users.email
+func isDuplicateEmail(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed: users.email")
+}
+
+type sqliteUserModel struct {
+	DB   Querier
+	opts *Options
+}
+
+func (m sqliteUserModel) Insert(ctx context.Context, user *User) error {
+	query := `
+		INSERT INTO users (name, email, password_hash, activated, activated_at)
+		VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN strftime('%Y-%m-%d %H:%M:%f', 'now') END)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{
+		user.Name,
+		user.Email,
+		user.Password.hash,
+		user.Activated,
+	}
+	ctx, cancel := m.opts.start(ctx, "users.Insert")
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m sqliteUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE email = $1
+	`
+	var user User
+	ctx, cancel := m.opts.start(ctx, "users.GetByEmail")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m sqliteUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+	ctx, cancel := m.opts.start(ctx, "users.Get")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (m sqliteUserModel) GetAll(ctx context.Context, name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE (instr(lower(name), lower($1)) > 0 OR $1 = '')
+		AND (instr(lower(email), lower($2)) > 0 OR $2 = '')
+		AND (activated = $3 OR $3 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
+	ctx, cancel := m.opts.start(ctx, "users.GetAll")
+	defer cancel()
+	args := []interface{}{name, email, activated, filters.limit(), filters.offSet()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m sqliteUserModel) Update(ctx context.Context, user *User) error {
+	query := `
+		UPDATE users
+		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1,
+		activated_at = CASE WHEN $4 THEN COALESCE(activated_at, strftime('%Y-%m-%d %H:%M:%f', 'now')) ELSE activated_at END
+		WHERE id = $5 AND version = $6
+		RETURNING version
+	`
+	args := []interface{}{
+		user.Name,
+		user.Email,
+		user.Password.hash,
+		user.Activated,
+		user.ID,
+		user.Version,
+	}
+	ctx, cancel := m.opts.start(ctx, "users.Update")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case isDuplicateEmail(err):
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m sqliteUserModel) DeleteUnactivated(ctx context.Context, createdBefore time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated_at IS NULL AND NOT activated AND created_at < $1
+	`
+	ctx, cancel := m.opts.start(ctx, "users.DeleteUnactivated")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, sqliteTime(createdBefore))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (m sqliteUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email,
+		users.password_hash, users.activated, users.version
+		FROM users
+		INNER JOIN tokens
+		ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+	`
+	args := []interface{}{tokenHash[:], tokenScope, sqliteTime(time.Now())}
+	var user User
+	ctx, cancel := m.opts.start(ctx, "users.GetForToken")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+type sqliteTokenModel struct {
+	DB   Querier
+	opts *Options
+}
+
+func (m sqliteTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m sqliteTokenModel) NewAuthentication(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m sqliteTokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m sqliteTokenModel) NewEmailChange(ctx context.Context, userID int64, email string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.Email = email
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m sqliteTokenModel) Insert(ctx context.Context, token *Token) error {
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, email, ip, user_agent, family)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	args := []interface{}{
+		token.Hash,
+		token.UserID,
+		sqliteTime(token.Expiry),
+		token.Scope,
+		token.Email,
+		token.IP,
+		token.UserAgent,
+		token.Family,
+	}
+	ctx, cancel := m.opts.start(ctx, "tokens.Insert")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (m sqliteTokenModel) Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		SELECT hash, user_id, expiry, scope, email, family, used_at IS NOT NULL
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3
+	`
+	var token Token
+	ctx, cancel := m.opts.start(ctx, "tokens.Get")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, sqliteTime(time.Now())).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Email,
+		&token.Family,
+		&token.Used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+func (m sqliteTokenModel) DeleteAllForUsers(ctx context.Context, scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForUsers")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+func (m sqliteTokenModel) DeleteAllForFamily(ctx context.Context, scope, family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND family = $2 AND family <> ''
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForFamily")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, family)
+	return err
+}
+
+func (m sqliteTokenModel) UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	token, err := m.Get(ctx, ScopeRefresh, tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	if token.Used {
+		return token, ErrTokenReused
+	}
+	query := `
+		UPDATE tokens
+		SET used_at = $1
+		WHERE hash = $2 AND used_at IS NULL
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.UseRefresh")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, sqliteTime(time.Now()), token.Hash)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return token, ErrTokenReused
+	}
+	token.Used = true
+	return token, nil
+}
+
+func (m sqliteTokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.Delete")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, HashToken(tokenPlaintext), scope)
+	return err
+}
+
+func (m sqliteTokenModel) GetSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expiry, ip, user_agent, hash
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.GetSessions")
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, sqliteTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (m sqliteTokenModel) DeleteSession(ctx context.Context, userID, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2 AND ((id = $1 AND scope = $3) OR family IN (
+			SELECT family FROM tokens
+			WHERE id = $1 AND user_id = $2 AND scope = $3 AND family <> ''
+		))
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteSession")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m sqliteTokenModel) RecordUses(ctx context.Context, uses []TokenUse) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = $1, ip = $2, user_agent = $3
+		WHERE hash = $4 AND (last_used_at IS NULL OR last_used_at <= $1)
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.RecordUses")
+	defer cancel()
+
+	for _, use := range uses {
+		_, err := m.DB.ExecContext(ctx, query, sqliteTime(use.At), use.IP, use.UserAgent, use.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m sqliteTokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash <> $3
+		AND (family = '' OR family <> COALESCE((SELECT family FROM tokens WHERE hash = $3), ''))
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForUserExcept")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID, tokenHash[:])
+	return err
+}
+
+func (m sqliteTokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < $1
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteExpired")
+	defer cancel()
+
+	now := sqliteTime(time.Now())
+	result, err := m.DB.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM token_denylist WHERE expiry < $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (m sqliteTokenModel) GetDenylist(ctx context.Context) ([][]byte, error) {
+	query := `
+		SELECT hash
+		FROM token_denylist
+		WHERE expiry > $1
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.GetDenylist")
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, sqliteTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := [][]byte{}
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+type sqlitePermissionModel struct {
+	DB   Querier
+	opts *Options
+}
+
+func (m sqlitePermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions
+		ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions
+		ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAllForUser")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (m sqlitePermissionModel) GetAllForUsers(ctx context.Context, userIDs []int64) (map[int64]Permissions, error) {
+	query := `
+		SELECT users_permissions.user_id, permissions.code
+		FROM permissions
+		INNER JOIN users_permissions
+		ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id IN (SELECT value FROM json_each($1))
+		UNION
+		SELECT users_roles.user_id, permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions
+		ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id IN (SELECT value FROM json_each($1))
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAllForUsers")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, jsonArray{userIDs})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[int64]Permissions, len(userIDs))
+	for rows.Next() {
+		var userID int64
+		var permission string
+		err := rows.Scan(&userID, &permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions[userID] = append(permissions[userID], permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (m sqlitePermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		INSERT OR IGNORE INTO users_permissions (user_id, permission_id)
+		SELECT $1, permissions.id FROM permissions
+		WHERE permissions.code IN (SELECT value FROM json_each($2))
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.AddForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, jsonArray{codes})
+	return err
+}
+
+func (m sqlitePermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		WHERE user_id = $1
+		AND permission_id IN (
+			SELECT id FROM permissions
+			WHERE code IN (SELECT value FROM json_each($2))
+		)
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.RemoveForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, jsonArray{codes})
+	return err
+}
+
+func (m sqlitePermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT code
+		FROM permissions
+		ORDER BY code
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetAll")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (m sqlitePermissionModel) GetRoles(ctx context.Context) ([]*Role, error) {
+	query := `
+		SELECT roles.name, (
+			SELECT json_group_array(code) FROM (
+				SELECT permissions.code
+				FROM permissions
+				INNER JOIN roles_permissions
+				ON roles_permissions.permission_id = permissions.id
+				WHERE roles_permissions.role_id = roles.id
+				ORDER BY permissions.code
+			)
+		)
+		FROM roles
+		ORDER BY roles.id
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetRoles")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		var codes []string
+		err := rows.Scan(&role.Name, jsonArray{&codes})
+		if err != nil {
+			return nil, err
+		}
+		role.Permissions = codes
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (m sqlitePermissionModel) GetRolesForUser(ctx context.Context, userID int64) ([]string, error) {
+	query := `
+		SELECT roles.name
+		FROM roles
+		INNER JOIN users_roles
+		ON users_roles.role_id = roles.id
+		WHERE users_roles.user_id = $1
+		ORDER BY roles.id
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.GetRolesForUser")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []string{}
+	for rows.Next() {
+		var role string
+		err := rows.Scan(&role)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (m sqlitePermissionModel) AddRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	query := `
+		INSERT OR IGNORE INTO users_roles (user_id, role_id)
+		SELECT $1, roles.id FROM roles
+		WHERE roles.name IN (SELECT value FROM json_each($2))
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.AddRolesForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, jsonArray{roles})
+	return err
+}
+
+func (m sqlitePermissionModel) RemoveRolesForUser(ctx context.Context, userID int64, roles ...string) error {
+	query := `
+		DELETE FROM users_roles
+		WHERE user_id = $1
+		AND role_id IN (
+			SELECT id FROM roles
+			WHERE name IN (SELECT value FROM json_each($2))
+		)
+	`
+	ctx, cancel := m.opts.start(ctx, "permissions.RemoveRolesForUser")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, jsonArray{roles})
+	return err
+}
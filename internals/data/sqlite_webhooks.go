@@ -0,0 +1,404 @@
+// Filename: internals/data/sqlite_webhooks.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The SQLite webhook model does in a transaction what the Postgres one
+// does with SKIP LOCKED. Transactions take the write lock when they begin,
+// so two workers can't claim the same rows
+type sqliteWebhookModel struct {
+	DB   Querier
+	opts *Options
+}
+
+func (m sqliteWebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return err
+	}
+	webhook.Secret = secret
+	query := `
+		INSERT INTO webhooks (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{webhook.URL, webhook.Secret, jsonArray{webhook.Events}, webhook.Active}
+	ctx, cancel := m.opts.start(ctx, "webhooks.Insert")
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+func (m sqliteWebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1
+	`
+	var webhook Webhook
+	ctx, cancel := m.opts.start(ctx, "webhooks.Get")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		jsonArray{&webhook.Events},
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+func (m sqliteWebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		ORDER BY id
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.GetAll")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			&webhook.Secret,
+			jsonArray{&webhook.Events},
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (m sqliteWebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, active = $3, version = version + 1
+		WHERE id = $4
+		AND version = $5
+		RETURNING version
+	`
+	args := []interface{}{
+		webhook.URL,
+		jsonArray{webhook.Events},
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+	ctx, cancel := m.opts.start(ctx, "webhooks.Update")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m sqliteWebhookModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.Delete")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m sqliteWebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), webhook_deliveries.id, webhook_deliveries.created_at,
+			   webhook_deliveries.webhook_id, webhook_deliveries.event_id, outbox_events.event_type,
+			   webhook_deliveries.status, webhook_deliveries.attempts, webhook_deliveries.next_attempt_at,
+			   webhook_deliveries.last_attempt_at, webhook_deliveries.response_status, webhook_deliveries.last_error
+		FROM webhook_deliveries
+		INNER JOIN outbox_events
+		ON outbox_events.id = webhook_deliveries.event_id
+		WHERE webhook_deliveries.webhook_id = $1
+		AND (webhook_deliveries.status = $2 OR $2 = '')
+		ORDER BY webhook_deliveries.id DESC
+		LIMIT $3 OFFSET $4
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.GetDeliveries")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, status, filters.limit(), filters.offSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return deliveries, metadata, nil
+}
+
+func (m sqliteWebhookModel) FanOut(ctx context.Context, limit int) (int64, error) {
+	batch := `
+		SELECT id
+		FROM outbox_events
+		WHERE dispatched_at IS NULL
+		ORDER BY id
+		LIMIT $1
+	`
+	fanout := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id)
+		SELECT webhooks.id, outbox_events.id
+		FROM outbox_events
+		INNER JOIN webhooks
+		ON webhooks.active AND outbox_events.event_type IN (SELECT value FROM json_each(webhooks.events))
+		WHERE outbox_events.id IN (` + batch + `)
+		ORDER BY outbox_events.id, webhooks.id
+	`
+	dispatch := `
+		UPDATE outbox_events
+		SET dispatched_at = $2
+		WHERE id IN (` + batch + `)
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.FanOut")
+	defer cancel()
+	var n int64
+	err := inTx(ctx, m.DB, func(tx Querier) error {
+		_, err := tx.ExecContext(ctx, fanout, limit)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, dispatch, limit, sqliteTime(time.Now()))
+		if err != nil {
+			return err
+		}
+		n, err = result.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+func (m sqliteWebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*PendingDelivery, error) {
+	query := `
+		SELECT webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event_id,
+			   outbox_events.event_type, outbox_events.created_at, webhook_deliveries.attempts + 1,
+			   webhooks.url, webhooks.secret, outbox_events.payload
+		FROM webhook_deliveries
+		INNER JOIN webhooks
+		ON webhooks.id = webhook_deliveries.webhook_id
+		INNER JOIN outbox_events
+		ON outbox_events.id = webhook_deliveries.event_id
+		WHERE webhook_deliveries.status = 'pending'
+		AND webhook_deliveries.next_attempt_at <= $1
+		ORDER BY webhook_deliveries.next_attempt_at
+		LIMIT $2
+	`
+	claim := `
+		UPDATE webhook_deliveries
+		SET attempts = attempts + 1, last_attempt_at = $1, next_attempt_at = $2
+		WHERE id IN (SELECT value FROM json_each($3))
+	`
+	now := time.Now()
+	ctx, cancel := m.opts.start(ctx, "webhooks.ClaimDeliveries")
+	defer cancel()
+	deliveries := []*PendingDelivery{}
+	err := inTx(ctx, m.DB, func(tx Querier) error {
+		rows, err := tx.QueryContext(ctx, query, sqliteTime(now), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		ids := []int64{}
+		for rows.Next() {
+			var delivery PendingDelivery
+			// The payload is text in SQLite, which can't be scanned into a
+			// json.RawMessage directly
+			var payload []byte
+			err := rows.Scan(
+				&delivery.ID,
+				&delivery.WebhookID,
+				&delivery.EventID,
+				&delivery.EventType,
+				&delivery.EventCreatedAt,
+				&delivery.Attempts,
+				&delivery.URL,
+				&delivery.Secret,
+				&payload,
+			)
+			if err != nil {
+				return err
+			}
+			delivery.Payload = payload
+			deliveries = append(deliveries, &delivery)
+			ids = append(ids, delivery.ID)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		_, err = tx.ExecContext(ctx, claim, sqliteTime(now), sqliteTime(now.Add(lease)), jsonArray{ids})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (m sqliteWebhookModel) MarkDelivered(ctx context.Context, id int64, responseStatus int) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'succeeded', response_status = $1, last_error = ''
+		WHERE id = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.MarkDelivered")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, id)
+	return err
+}
+
+func (m sqliteWebhookModel) MarkFailed(ctx context.Context, id int64, responseStatus int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := DeliveryPending
+	if dead {
+		status = DeliveryDead
+	}
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, response_status = $2, last_error = $3, next_attempt_at = $4
+		WHERE id = $5
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.MarkFailed")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, status, responseStatus, lastError, sqliteTime(nextAttemptAt), id)
+	return err
+}
+
+func (m sqliteWebhookModel) ReleaseDelivery(ctx context.Context, id int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET attempts = attempts - 1
+		WHERE id = $1
+		AND status = 'pending'
+		AND attempts > 0
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.ReleaseDelivery")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+func (m sqliteWebhookModel) DeleteFinishedEvents(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM outbox_events
+		WHERE dispatched_at IS NOT NULL
+		AND created_at < $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM webhook_deliveries
+			WHERE webhook_deliveries.event_id = outbox_events.id
+			AND webhook_deliveries.status = 'pending'
+		)
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.DeleteFinishedEvents")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, sqliteTime(before))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (m sqliteWebhookModel) Redeliver(ctx context.Context, webhookID, deliveryID int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = $1
+		WHERE id = $2
+		AND webhook_id = $3
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.Redeliver")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, sqliteTime(time.Now()), deliveryID, webhookID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"quotesapi.desireamagwula.net/internals/validator"
@@ -18,7 +20,18 @@ import (
 const (
 	ScopeActivation = "activation"
 	ScopeAuthentication = "authentication"
+	// An email change token carries the new address until it is confirmed
+	ScopeEmailChange = "email_change"
+	ScopePasswordReset = "password_reset"
+	// A refresh token is exchanged for a new authentication token and a new
+	// refresh token, it can only be used once
+	ScopeRefresh = "refresh"
 )
+
+// ErrTokenReused is returned by UseRefresh() for a refresh token that has
+// been exchanged before. Someone else has a copy of it
+var ErrTokenReused = errors.New("token reused")
+
 // Define the token type 
 type Token struct {
 	Plaintext string `json:"token"`
@@ -26,6 +39,53 @@ type Token struct {
 	UserID int64 `json:"-"`
 	Expiry time.Time `json:"expiry"`
 	Scope string `json:"-"`
+	Email string `json:"-"`
+	// The client that an authentication token was issued to
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
+	// The tokens that come from the same sign in share a family, see
+	// NewTokenFamily(). Used is set on refresh tokens that were exchanged
+	Family string `json:"-"`
+	Used   bool   `json:"-"`
+}
+
+// Session is how an authentication token is shown to its owner. The
+// IP address and user agent are from the last time that it was used, or
+// from when it was issued if it hasn't been used since
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
+	Hash       []byte     `json:"-"`
+}
+
+// TokenUse records that a token was used, see RecordUses()
+type TokenUse struct {
+	Hash      []byte
+	At        time.Time
+	IP        string
+	UserAgent string
+}
+
+// HashToken() returns the hash that a token is stored under
+func HashToken(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+// NewTokenFamily() returns the family of the tokens issued at a sign in.
+// Refreshing them keeps the family, so that all of them can be revoked
+// together
+func NewTokenFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
 }
 // The generate token function returns a token 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -58,22 +118,57 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the token model 
 type TokenModel struct {
-	DB *sql.DB
+	DB Querier
+	opts *Options
 }
 // Create and insert a Token into the tokens table 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
+	return token, err
+}
+// NewAuthentication() creates an authentication token of the family for a
+// client with the given IP address and user agent
+func (m TokenModel) NewAuthentication(ctx context.Context, userID int64, ttl time.Duration, family, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.IP = ip
+	token.UserAgent = userAgent
+	err = m.Insert(ctx, token)
+	return token, err
+}
+// NewRefresh() creates a refresh token of the family
+func (m TokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, family string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	err = m.Insert(ctx, token)
+	return token, err
+}
+// NewEmailChange() creates a token that confirms the change of the user's
+// email address to email
+func (m TokenModel) NewEmailChange(ctx context.Context, userID int64, email string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.Email = email
+	err = m.Insert(ctx, token)
 	return token, err
 }
 // Insert will insert an entry into the tokens table 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, email, ip, user_agent, family)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 
 	args := []interface{} {
@@ -81,22 +176,281 @@ func (m TokenModel) Insert(token *Token) error {
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.Email,
+		token.IP,
+		token.UserAgent,
+		token.Family,
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+		ctx, cancel := m.opts.start(ctx, "tokens.Insert")
 		defer cancel()
 
 		_, err := m.DB.ExecContext(ctx, query, args...)
 		return err
 }
-func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
+// Get() returns the token with the given plaintext and scope if it has
+// not expired. The plaintext isn't stored, so it is not filled in
+func (m TokenModel) Get(ctx context.Context, scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		SELECT hash, user_id, expiry, scope, email, family, used_at IS NOT NULL
+		FROM tokens
+		WHERE hash = $1
+		AND scope = $2
+		AND expiry > $3
+	`
+	var token Token
+
+	ctx, cancel := m.opts.start(ctx, "tokens.Get")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.Email,
+		&token.Family,
+		&token.Used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+func (m TokenModel) DeleteAllForUsers(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 and user_id = $2
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForUsers")
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 		return err
-}
\ No newline at end of file
+}
+
+// DeleteAllForFamily() removes the family's tokens of the given scope.
+// Tokens that were issued without a family are never removed by it
+func (m TokenModel) DeleteAllForFamily(ctx context.Context, scope, family string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND family = $2 AND family <> ''
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForFamily")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, family)
+	return err
+}
+
+// UseRefresh() marks the refresh token with the given plaintext as used
+// and returns it. A token that was used before is returned along with
+// ErrTokenReused, so that the caller can revoke its family
+func (m TokenModel) UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	token, err := m.Get(ctx, ScopeRefresh, tokenPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	if token.Used {
+		return token, ErrTokenReused
+	}
+	query := `
+		UPDATE tokens
+		SET used_at = $1
+		WHERE hash = $2 AND used_at IS NULL
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.UseRefresh")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now(), token.Hash)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	// Another request exchanged it in the meantime
+	if rowsAffected == 0 {
+		return token, ErrTokenReused
+	}
+	token.Used = true
+	return token, nil
+}
+
+// Delete() removes the token with the given plaintext and scope, such as
+// the authentication token of a client that signs out
+func (m TokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.Delete")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, HashToken(tokenPlaintext), scope)
+	return err
+}
+
+// GetSessions() returns the authentication tokens of the user that
+// haven't expired, the most recently used first
+func (m TokenModel) GetSessions(ctx context.Context, userID int64) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expiry, ip, user_agent, hash
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.GetSessions")
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession() revokes one of the user's authentication tokens by the
+// id that GetSessions() shows, along with the rest of its family so that
+// the session can't be refreshed
+func (m TokenModel) DeleteSession(ctx context.Context, userID, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2 AND ((id = $1 AND scope = $3) OR family IN (
+			SELECT family FROM tokens
+			WHERE id = $1 AND user_id = $2 AND scope = $3 AND family <> ''
+		))
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteSession")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// RecordUses() saves when, where from and by what the tokens were last
+// used. The uses are collected and saved in batches, so a use never moves
+// last_used_at backwards
+func (m TokenModel) RecordUses(ctx context.Context, uses []TokenUse) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = $1, ip = $2, user_agent = $3
+		WHERE hash = $4 AND (last_used_at IS NULL OR last_used_at <= $1)
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.RecordUses")
+	defer cancel()
+
+	for _, use := range uses {
+		_, err := m.DB.ExecContext(ctx, query, use.At, use.IP, use.UserAgent, use.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteAllForUserExcept() removes the user's tokens of the given scope
+// apart from the one with the given plaintext, which is usually the token
+// that the request was made with, and the tokens of its family
+func (m TokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND hash <> $3
+		AND (family = '' OR family <> COALESCE((SELECT family FROM tokens WHERE hash = $3), ''))
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteAllForUserExcept")
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID, tokenHash[:])
+	return err
+}
+
+// DeleteExpired() removes every token that has expired and returns how
+// many were removed. The denylist entries that have expired go with them
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < $1
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.DeleteExpired")
+	defer cancel()
+
+	now := time.Now()
+	result, err := m.DB.ExecContext(ctx, query, now)
+	if err != nil {
+		return 0, err
+	}
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM token_denylist WHERE expiry < $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetDenylist() returns the hashes of the authentication tokens that were
+// removed before they expired, and haven't expired since
+func (m TokenModel) GetDenylist(ctx context.Context) ([][]byte, error) {
+	query := `
+		SELECT hash
+		FROM token_denylist
+		WHERE expiry > $1
+	`
+	ctx, cancel := m.opts.start(ctx, "tokens.GetDenylist")
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := [][]byte{}
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
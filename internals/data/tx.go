@@ -0,0 +1,117 @@
+// Filename: internals/data/tx.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// How many times WithTx() runs a transaction that keeps hitting
+// serialization failures before it gives up
+const maxTxAttempts = 5
+
+// Querier is what the SQL models run their statements on, either the
+// connection pool or a transaction
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// WithTx() runs fn with models that share a single transaction, which is
+// committed if fn returns nil and rolled back otherwise. If the database
+// reports a serialization failure or a deadlock, fn is run again from the
+// start, so it shouldn't do anything that can't be repeated, such as
+// sending email. Calling WithTx() on the models that fn was given runs in
+// the same transaction
+func (m Models) WithTx(ctx context.Context, fn func(Models) error) error {
+	if m.withTx == nil {
+		return fn(m)
+	}
+	return m.withTx(ctx, fn)
+}
+
+// sqlWithTx() returns the WithTx() implementation for a connection pool.
+// newModels builds the models on top of the transaction
+func sqlWithTx(db *sql.DB, opts *sql.TxOptions, newModels func(Querier) Models) func(context.Context, func(Models) error) error {
+	return func(ctx context.Context, fn func(Models) error) error {
+		for attempt := 1; ; attempt++ {
+			err := runTx(ctx, db, opts, newModels, fn)
+			if err == nil || !isSerializationFailure(err) || attempt == maxTxAttempts {
+				return err
+			}
+			// Back off with some jitter so that the transactions that
+			// collided don't collide again
+			delay := time.Duration(attempt*attempt)*10*time.Millisecond + time.Duration(rand.Int63n(int64(10*time.Millisecond)))
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, newModels func(Querier) Models, fn func(Models) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	models := newModels(tx)
+	models.withTx = func(_ context.Context, fn func(Models) error) error {
+		return fn(models)
+	}
+	err = fn(models)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isSerializationFailure() reports whether err means that the transaction
+// lost a race with another one and can be retried
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure and deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// SQLITE_BUSY, including its extended codes. The busy timeout ran
+		// out while waiting for the write lock
+		return sqliteErr.Code()&0xff == 5
+	}
+	return false
+}
+
+// inTx() runs fn in a transaction on db, or straight on db if it already
+// is one, in which case the caller's transaction decides whether it commits
+func inTx(ctx context.Context, db Querier, fn func(tx Querier) error) error {
+	switch db := db.(type) {
+	case *sql.Tx:
+		return fn(db)
+	case *sql.DB:
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		err = fn(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	default:
+		return errors.New("data: cannot begin a transaction on this querier")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"quotesapi.desireamagwula.net/internals/validator"
@@ -96,15 +97,18 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // Create our user model
 type UserModel struct {
-	DB *sql.DB
+	DB Querier
+	// The read-only methods run on reader, which may be a ReplicaSet
+	reader Querier
+	opts *Options
 }
 
 // create a new User
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	//create our query
 	query := `
-		INSERT INTO users (name, email, password_hash, activated)
-		Values($1, $2, $3, $4)
+		INSERT INTO users (name, email, password_hash, activated, activated_at)
+		Values($1, $2, $3, $4, CASE WHEN $4 THEN NOW() END)
 		RETURNING id, created_at, version
 		`
 
@@ -114,7 +118,7 @@ func (m UserModel) Insert(user *User) error {
 		user.Password.hash,
 		user.Activated,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "users.Insert")
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
@@ -130,7 +134,7 @@ func (m UserModel) Insert(user *User) error {
 }
 
 // get user based on their email
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
@@ -138,7 +142,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	`
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "users.GetByEmail")
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
@@ -162,11 +166,91 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 
 }
 
+// Get() returns the user with the given id
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := m.opts.start(ctx, "users.Get")
+	defer cancel()
+	err := m.reader.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// GetAll() returns a page of users, used by the admin tooling. name and
+// email match anywhere in the field regardless of case, activated is
+// ignored when it is nil
+func (m UserModel) GetAll(ctx context.Context, name string, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE (strpos(lower(name), lower($1)) > 0 OR $1 = '')
+		AND (strpos(lower(email::text), lower($2)) > 0 OR $2 = '')
+		AND (activated = $3 OR $3 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
+	ctx, cancel := m.opts.start(ctx, "users.GetAll")
+	defer cancel()
+	args := []interface{}{name, email, activated, filters.limit(), filters.offSet()}
+	rows, err := m.reader.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
 // The client can udate their information
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
+		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1,
+		activated_at = CASE WHEN $4 THEN COALESCE(activated_at, NOW()) ELSE activated_at END
 		WHERE id = $5 and version = $6
 		RETURNING version
 		`
@@ -179,13 +263,15 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "users.Update")
 	defer cancel()
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
 		default:
 			return err
 		}
@@ -193,7 +279,26 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// DeleteUnactivated() removes the accounts created before createdBefore
+// that were never activated and returns how many were removed. Accounts
+// that an admin deactivated are kept, activated_at tells them apart. So are
+// all of the accounts from before migration 000014, which couldn't tell
+func (m UserModel) DeleteUnactivated(ctx context.Context, createdBefore time.Time) (int64, error) {
+	query := `
+		DELETE FROM users
+		WHERE activated_at IS NULL AND NOT activated AND created_at < $1
+	`
+	ctx, cancel := m.opts.start(ctx, "users.DeleteUnactivated")
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, createdBefore)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Setup query
 	query := `
@@ -209,7 +314,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := m.opts.start(ctx, "users.GetForToken")
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -0,0 +1,503 @@
+// Filename: internals/data/webhooks.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"quotesapi.desireamagwula.net/internals/validator"
+)
+
+// The quote lifecycle events that can be subscribed to
+const (
+	EventQuoteCreated = "quote.created"
+	EventQuoteUpdated = "quote.updated"
+	EventQuoteDeleted = "quote.deleted"
+)
+
+var WebhookEvents = []string{EventQuoteCreated, EventQuoteUpdated, EventQuoteDeleted}
+
+// Delivery states. A delivery that runs out of attempts is moved to the
+// dead-letter state and is not retried again
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// A single delivery of an event to a subscription
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	WebhookID      int64      `json:"webhook_id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// A delivery that has been claimed by the worker, along with everything
+// that is needed to send it
+type PendingDelivery struct {
+	ID             int64
+	WebhookID      int64
+	EventID        int64
+	EventType      string
+	EventCreatedAt time.Time
+	Attempts       int
+	URL            string
+	Secret         string
+	Payload        json.RawMessage
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	v.Check(validator.ValidWebsite(webhook.URL), "url", "must be a valid URL")
+	v.Check(strings.HasPrefix(webhook.URL, "http://") || strings.HasPrefix(webhook.URL, "https://"), "url", "must use http or https")
+
+	v.Check(webhook.Events != nil, "events", "must be provided")
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least one entry")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate entries")
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", "contains an unknown event")
+	}
+}
+
+// The generateWebhookSecret() function returns a random signing secret
+func generateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+// insertOutboxEvent() records an event inside of the caller's transaction
+// so that it is only published if the quote write commits. The payload is
+// sent as text, which Postgres and SQLite both take for a JSON column
+func insertOutboxEvent(ctx context.Context, tx Querier, eventType string, quote *Quote) error {
+	payload, err := json.Marshal(map[string]interface{}{"quote": quote})
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO outbox_events (event_type, payload)
+		VALUES ($1, $2)
+	`
+	_, err = tx.ExecContext(ctx, query, eventType, string(payload))
+	return err
+}
+
+type WebhookModel struct {
+	DB Querier
+	// The read-only methods run on reader, which may be a ReplicaSet
+	reader Querier
+	opts   *Options
+}
+
+// Insert() creates a new subscription and generates its signing secret
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return err
+	}
+	webhook.Secret = secret
+	query := `
+		INSERT INTO webhooks (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+	ctx, cancel := m.opts.start(ctx, "webhooks.Insert")
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+func (m WebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		WHERE id = $1
+	`
+	var webhook Webhook
+	ctx, cancel := m.opts.start(ctx, "webhooks.Get")
+	defer cancel()
+	err := m.reader.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+func (m WebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhooks
+		ORDER BY id
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.GetAll")
+	defer cancel()
+	rows, err := m.reader.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			&webhook.Secret,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, active = $3, version = version + 1
+		WHERE id = $4
+		AND version = $5
+		RETURNING version
+	`
+	args := []interface{}{
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+	ctx, cancel := m.opts.start(ctx, "webhooks.Update")
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.Delete")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetDeliveries() returns the delivery log for a subscription, newest first
+func (m WebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), webhook_deliveries.id, webhook_deliveries.created_at,
+			   webhook_deliveries.webhook_id, webhook_deliveries.event_id, outbox_events.event_type,
+			   webhook_deliveries.status, webhook_deliveries.attempts, webhook_deliveries.next_attempt_at,
+			   webhook_deliveries.last_attempt_at, webhook_deliveries.response_status, webhook_deliveries.last_error
+		FROM webhook_deliveries
+		INNER JOIN outbox_events
+		ON outbox_events.id = webhook_deliveries.event_id
+		WHERE webhook_deliveries.webhook_id = $1
+		AND (webhook_deliveries.status = $2 OR $2 = '')
+		ORDER BY webhook_deliveries.id DESC
+		LIMIT $3 OFFSET $4
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.GetDeliveries")
+	defer cancel()
+	rows, err := m.reader.QueryContext(ctx, query, webhookID, status, filters.limit(), filters.offSet())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return deliveries, metadata, nil
+}
+
+// FanOut() moves a batch of events out of the outbox by creating a
+// delivery for every active subscription to the event type. SKIP LOCKED
+// lets several API replicas run the worker at the same time
+func (m WebhookModel) FanOut(ctx context.Context, limit int) (int64, error) {
+	query := `
+		WITH batch AS (
+			SELECT id, event_type
+			FROM outbox_events
+			WHERE dispatched_at IS NULL
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		), fanout AS (
+			INSERT INTO webhook_deliveries (webhook_id, event_id)
+			SELECT webhooks.id, batch.id
+			FROM batch
+			INNER JOIN webhooks
+			ON webhooks.active AND batch.event_type = ANY(webhooks.events)
+		)
+		UPDATE outbox_events
+		SET dispatched_at = NOW()
+		FROM batch
+		WHERE outbox_events.id = batch.id
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.FanOut")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ClaimDeliveries() picks up deliveries that are due and leases them to the
+// caller. If the worker dies mid-send the lease runs out and the delivery
+// is picked up again
+func (m WebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*PendingDelivery, error) {
+	query := `
+		WITH due AS (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending'
+			AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries
+		SET attempts = webhook_deliveries.attempts + 1,
+			last_attempt_at = NOW(),
+			next_attempt_at = NOW() + make_interval(secs => $2)
+		FROM due, webhooks, outbox_events
+		WHERE webhook_deliveries.id = due.id
+		AND webhooks.id = webhook_deliveries.webhook_id
+		AND outbox_events.id = webhook_deliveries.event_id
+		RETURNING webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event_id,
+				  outbox_events.event_type, outbox_events.created_at, webhook_deliveries.attempts,
+				  webhooks.url, webhooks.secret, outbox_events.payload
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.ClaimDeliveries")
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*PendingDelivery{}
+	for rows.Next() {
+		var delivery PendingDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.EventID,
+			&delivery.EventType,
+			&delivery.EventCreatedAt,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret,
+			&delivery.Payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// MarkDelivered() records a successful attempt
+func (m WebhookModel) MarkDelivered(ctx context.Context, id int64, responseStatus int) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'succeeded', response_status = $1, last_error = ''
+		WHERE id = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.MarkDelivered")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, id)
+	return err
+}
+
+// MarkFailed() records a failed attempt and either schedules the next one
+// or, when dead is true, moves the delivery to the dead-letter state
+func (m WebhookModel) MarkFailed(ctx context.Context, id int64, responseStatus int, lastError string, nextAttemptAt time.Time, dead bool) error {
+	status := DeliveryPending
+	if dead {
+		status = DeliveryDead
+	}
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, response_status = $2, last_error = $3, next_attempt_at = $4
+		WHERE id = $5
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.MarkFailed")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, status, responseStatus, lastError, nextAttemptAt, id)
+	return err
+}
+
+// ReleaseDelivery() takes back the attempt that ClaimDeliveries() counted,
+// for a delivery whose send was cut short by the worker stopping. The
+// lease is left to run out, and then the delivery is picked up again
+func (m WebhookModel) ReleaseDelivery(ctx context.Context, id int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET attempts = attempts - 1
+		WHERE id = $1
+		AND status = 'pending'
+		AND attempts > 0
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.ReleaseDelivery")
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// DeleteFinishedEvents() prunes the outbox of the events created before
+// the given time that have been fanned out and have no pending delivery
+// left. Their deliveries go with them, so they leave the delivery log and
+// can no longer be redelivered
+func (m WebhookModel) DeleteFinishedEvents(ctx context.Context, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM outbox_events
+		WHERE dispatched_at IS NOT NULL
+		AND created_at < $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM webhook_deliveries
+			WHERE webhook_deliveries.event_id = outbox_events.id
+			AND webhook_deliveries.status = 'pending'
+		)
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.DeleteFinishedEvents")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Redeliver() puts a delivery back into the pending state so that the
+// worker picks it up on its next pass. This is how dead letters are replayed
+func (m WebhookModel) Redeliver(ctx context.Context, webhookID, deliveryID int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1
+		AND webhook_id = $2
+	`
+	ctx, cancel := m.opts.start(ctx, "webhooks.Redeliver")
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, deliveryID, webhookID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
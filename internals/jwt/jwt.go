@@ -0,0 +1,226 @@
+// Filename: internals/jwt/jwt.go
+
+// Package jwt signs and verifies the JSON Web Tokens that the API issues
+// when it runs with -token-format=jwt. Only the two algorithms that the API
+// uses are supported: EdDSA with Ed25519 keys, whose public halves are
+// published as a JWKS, and HS256 with a shared secret
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The supported values of the "alg" header
+const (
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+var (
+	// ErrInvalid is returned for a token that is malformed, is signed with
+	// an unknown key or algorithm, or whose signature doesn't match
+	ErrInvalid = errors.New("invalid token")
+	// ErrExpired is returned for a well signed token that has expired
+	ErrExpired = errors.New("token expired")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a signing key and the id that tokens name it by in their "kid"
+// header
+type Key struct {
+	ID        string
+	Algorithm string
+
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	secret  []byte
+}
+
+// ParseKey() reads a key written as "kid:alg:base64". For EdDSA the base64
+// part is a 32 byte Ed25519 seed, for HS256 it is a secret of at least 32
+// bytes. Either can be made with "openssl rand -base64 32"
+func ParseKey(s string) (*Key, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, errors.New(`jwt key must look like "kid:alg:base64"`)
+	}
+	raw, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt key %q: %w", parts[0], err)
+	}
+	key := &Key{ID: parts[0], Algorithm: parts[1]}
+	switch key.Algorithm {
+	case EdDSA:
+		if len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt key %q: an EdDSA seed is %d bytes, not %d", key.ID, ed25519.SeedSize, len(raw))
+		}
+		key.private = ed25519.NewKeyFromSeed(raw)
+		key.public = key.private.Public().(ed25519.PublicKey)
+	case HS256:
+		if len(raw) < 32 {
+			return nil, fmt.Errorf("jwt key %q: an HS256 secret needs at least 32 bytes", key.ID)
+		}
+		key.secret = raw
+	default:
+		return nil, fmt.Errorf("jwt key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+	return key, nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == EdDSA {
+		return ed25519.Sign(k.private, input)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == EdDSA {
+		return ed25519.Verify(k.public, input, signature)
+	}
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// KeySet signs with one key and verifies with any of them. Keys are
+// rotated by putting the new one first and keeping the old ones until
+// the tokens that they signed have expired
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+	ordered []*Key
+}
+
+// NewKeySet() returns a set that signs with the first of keys
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: no keys")
+	}
+	set := &KeySet{signing: keys[0], keys: make(map[string]*Key, len(keys)), ordered: keys}
+	for _, key := range keys {
+		if _, ok := set.keys[key.ID]; ok {
+			return nil, fmt.Errorf("jwt: key id %q is used twice", key.ID)
+		}
+		set.keys[key.ID] = key
+	}
+	return set, nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Claims are the registered claims that every token carries. Types that
+// embed it can be passed to Sign() and Verify()
+type Claims struct {
+	Subject   string `json:"sub"`
+	ID        string `json:"jti,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (c *Claims) expiry() int64 {
+	return c.ExpiresAt
+}
+
+type expirer interface {
+	expiry() int64
+}
+
+// Sign() returns claims as a token signed with the first key of the set
+func (s *KeySet) Sign(claims interface{}) (string, error) {
+	h, err := json.Marshal(header{Algorithm: s.signing.Algorithm, Type: "JWT", KeyID: s.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	return input + "." + encoding.EncodeToString(s.signing.sign([]byte(input))), nil
+}
+
+// Verify() checks the signature of token and decodes its payload into
+// claims, which has to embed Claims. A token that has expired is refused
+// with ErrExpired
+func (s *KeySet) Verify(token string, claims expirer) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalid
+	}
+	raw, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalid
+	}
+	var h header
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return ErrInvalid
+	}
+	// The algorithm has to be the key's own, so that a token can't pick a
+	// weaker one, such as HS256 with an EdDSA public key as the secret
+	key, ok := s.keys[h.KeyID]
+	if !ok || key.Algorithm != h.Algorithm {
+		return ErrInvalid
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalid
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalid
+	}
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalid
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalid
+	}
+	if time.Now().Unix() >= claims.expiry() {
+		return ErrExpired
+	}
+	return nil
+}
+
+// JWK is the public half of an EdDSA key, as RFC 8037 writes it
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWKS() returns the public keys of the set, the signing key first, for
+// others to verify tokens with. HS256 secrets are never included
+func (s *KeySet) JWKS() []JWK {
+	keys := []JWK{}
+	for _, key := range s.ordered {
+		if key.Algorithm != EdDSA {
+			continue
+		}
+		keys = append(keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(key.public),
+			KeyID:     key.ID,
+			Algorithm: EdDSA,
+			Use:       "sig",
+		})
+	}
+	return keys
+}
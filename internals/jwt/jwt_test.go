@@ -0,0 +1,274 @@
+// Filename: internals/jwt/jwt_test.go
+
+package jwt_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/jwt"
+)
+
+var encoding = base64.RawURLEncoding
+
+// The raw bytes of the test keys, the EdDSA seed and HS256 secret are both
+// 32 bytes
+func keyBytes(id string) []byte {
+	return bytes.Repeat([]byte(id), 32)[:32]
+}
+
+func newKey(t *testing.T, id, alg string) *jwt.Key {
+	t.Helper()
+	key, err := jwt.ParseKey(id + ":" + alg + ":" + base64.StdEncoding.EncodeToString(keyBytes(id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newKeySet(t *testing.T, keys ...*jwt.Key) *jwt.KeySet {
+	t.Helper()
+	set, err := jwt.NewKeySet(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+type testClaims struct {
+	jwt.Claims
+	Name string `json:"name"`
+}
+
+func claimsFor(subject string, ttl time.Duration) testClaims {
+	now := time.Now()
+	return testClaims{
+		Claims: jwt.Claims{Subject: subject, IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()},
+		Name:   "Alice",
+	}
+}
+
+// headerOf() decodes the header of token
+func headerOf(t *testing.T, token string) map[string]string {
+	t.Helper()
+	raw, err := encoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h map[string]string
+	err = json.Unmarshal(raw, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{jwt.EdDSA, jwt.HS256} {
+		t.Run(alg, func(t *testing.T) {
+			set := newKeySet(t, newKey(t, "k1", alg))
+			token, err := set.Sign(claimsFor("42", time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := headerOf(t, token); h["alg"] != alg || h["kid"] != "k1" || h["typ"] != "JWT" {
+				t.Errorf("got header %v", h)
+			}
+			var claims testClaims
+			err = set.Verify(token, &claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "42" || claims.Name != "Alice" {
+				t.Errorf("got claims %+v", claims)
+			}
+
+			// Any change to the payload breaks the signature
+			parts := strings.Split(token, ".")
+			forged, _ := json.Marshal(claimsFor("1", time.Minute))
+			parts[1] = encoding.EncodeToString(forged)
+			err = set.Verify(strings.Join(parts, "."), &claims)
+			if !errors.Is(err, jwt.ErrInvalid) {
+				t.Errorf("forged payload: got %v; want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := newKey(t, "old", jwt.EdDSA)
+	oldToken, err := newKeySet(t, old).Sign(claimsFor("42", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key goes first and the old one stays for its tokens
+	rotated := newKeySet(t, newKey(t, "new", jwt.HS256), old)
+	var claims testClaims
+	err = rotated.Verify(oldToken, &claims)
+	if err != nil {
+		t.Errorf("token of the old key: got %v; want no error", err)
+	}
+	newToken, err := rotated.Sign(claimsFor("42", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := headerOf(t, newToken); h["kid"] != "new" || h["alg"] != jwt.HS256 {
+		t.Errorf("got header %v; want the new key", h)
+	}
+
+	// Once the old key is gone so are its tokens
+	err = newKeySet(t, newKey(t, "new", jwt.HS256)).Verify(oldToken, &claims)
+	if !errors.Is(err, jwt.ErrInvalid) {
+		t.Errorf("token of a removed key: got %v; want ErrInvalid", err)
+	}
+
+	_, err = jwt.NewKeySet(old, newKey(t, "old", jwt.HS256))
+	if err == nil {
+		t.Error("a key id that is used twice was accepted")
+	}
+	_, err = jwt.NewKeySet()
+	if err == nil {
+		t.Error("an empty key set was accepted")
+	}
+}
+
+// forge() builds a token with the header and signature that it is given
+func forge(t *testing.T, h map[string]string, sign func(input []byte) []byte) string {
+	t.Helper()
+	rawHeader, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claimsFor("42", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := encoding.EncodeToString(rawHeader) + "." + encoding.EncodeToString(payload)
+	return input + "." + encoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestVerifyRefusesOtherAlgorithms(t *testing.T) {
+	set := newKeySet(t, newKey(t, "ed", jwt.EdDSA), newKey(t, "hs", jwt.HS256))
+	public := ed25519.NewKeyFromSeed(keyBytes("ed")).Public().(ed25519.PublicKey)
+	hs256 := func(secret []byte) func([]byte) []byte {
+		return func(input []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(input)
+			return mac.Sum(nil)
+		}
+	}
+	none := func([]byte) []byte { return nil }
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		sign   func([]byte) []byte
+	}{
+		// The public key is published, so it can't be an HMAC secret
+		{"HS256 with the EdDSA public key", map[string]string{"alg": jwt.HS256, "kid": "ed", "typ": "JWT"}, hs256(public)},
+		{"EdDSA header on an HS256 key", map[string]string{"alg": jwt.EdDSA, "kid": "hs", "typ": "JWT"}, hs256(keyBytes("hs"))},
+		{"none", map[string]string{"alg": "none", "kid": "ed", "typ": "JWT"}, none},
+		{"none without a kid", map[string]string{"alg": "none", "typ": "JWT"}, none},
+		{"unknown kid", map[string]string{"alg": jwt.HS256, "kid": "other", "typ": "JWT"}, hs256(keyBytes("hs"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims testClaims
+			err := set.Verify(forge(t, tt.header, tt.sign), &claims)
+			if !errors.Is(err, jwt.ErrInvalid) {
+				t.Errorf("got %v; want ErrInvalid", err)
+			}
+		})
+	}
+
+	// The forger gets the same token through when it uses the real secret
+	var claims testClaims
+	err := set.Verify(forge(t, map[string]string{"alg": jwt.HS256, "kid": "hs", "typ": "JWT"}, hs256(keyBytes("hs"))), &claims)
+	if err != nil {
+		t.Errorf("token signed with the secret: got %v; want no error", err)
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.!.!"} {
+		err := set.Verify(token, &claims)
+		if !errors.Is(err, jwt.ErrInvalid) {
+			t.Errorf("%q: got %v; want ErrInvalid", token, err)
+		}
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	set := newKeySet(t, newKey(t, "k1", jwt.EdDSA))
+	token, err := set.Sign(claimsFor("42", -time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims testClaims
+	err = set.Verify(token, &claims)
+	if !errors.Is(err, jwt.ErrExpired) {
+		t.Errorf("got %v; want ErrExpired", err)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	set := newKeySet(t, newKey(t, "ed2", jwt.EdDSA), newKey(t, "hs", jwt.HS256), newKey(t, "ed1", jwt.EdDSA))
+	keys := set.JWKS()
+	if len(keys) != 2 || keys[0].KeyID != "ed2" || keys[1].KeyID != "ed1" {
+		t.Fatalf("got %+v; want the two EdDSA keys, in order", keys)
+	}
+	for _, key := range keys {
+		if key.KeyType != "OKP" || key.Curve != "Ed25519" || key.Algorithm != jwt.EdDSA || key.Use != "sig" {
+			t.Errorf("got %+v", key)
+		}
+		x, err := encoding.DecodeString(key.X)
+		want := ed25519.NewKeyFromSeed(keyBytes(key.KeyID)).Public().(ed25519.PublicKey)
+		if err != nil || !bytes.Equal(x, want) {
+			t.Errorf("%s: got x %q; want the public key", key.KeyID, key.X)
+		}
+	}
+
+	// Neither the seeds nor the HS256 secret are published
+	js, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ed1", "ed2", "hs"} {
+		secret := encoding.EncodeToString(keyBytes(id))
+		if strings.Contains(string(js), secret) {
+			t.Errorf("the JWKS has the secret of %s: %s", id, js)
+		}
+	}
+	if strings.Contains(string(js), `"d"`) {
+		t.Errorf("the JWKS has a private key: %s", js)
+	}
+
+	if keys := newKeySet(t, newKey(t, "hs", jwt.HS256)).JWKS(); len(keys) != 0 {
+		t.Errorf("got %+v for an HS256 key; want none", keys)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(keyBytes("k"))
+	short := base64.StdEncoding.EncodeToString(keyBytes("k")[:16])
+	for _, s := range []string{
+		"k1:EdDSA:" + short,
+		"k1:HS256:" + short,
+		"k1:RS256:" + seed,
+		"k1:EdDSA:not base64",
+		":EdDSA:" + seed,
+		"k1:" + seed,
+	} {
+		_, err := jwt.ParseKey(s)
+		if err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Filename: internals/migrate/migrate.go
+
+// Package migrate applies numbered SQL migrations to Postgres or SQLite. The
+// version is kept in a schema_migrations table with the same layout as the
+// one written by the golang-migrate CLI, so databases that were migrated
+// with that tool carry on from where they are
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrDirty          = errors.New("a previous migration failed part way, fix the schema by hand and then set schema_migrations.dirty to false")
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// Every replica that starts at the same time takes this advisory lock
+// before touching the schema, so only one of them migrates
+const lockID = 7242116151
+
+var filenameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// The SQL that differs between the databases
+type dialect struct {
+	tableExists string
+	// SQLite only ever has one writer, so it doesn't need a lock
+	lock, unlock string
+}
+
+var dialects = map[string]dialect{
+	"postgres": {
+		tableExists: `SELECT to_regclass('schema_migrations') IS NOT NULL`,
+		lock:        `SELECT pg_advisory_lock($1)`,
+		unlock:      `SELECT pg_advisory_unlock($1)`,
+	},
+	"sqlite": {
+		tableExists: `SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`,
+	},
+}
+
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+}
+
+// The New() function reads the migrations from fsys. driver is the name
+// that db was opened with, postgres or sqlite. Every version needs both an
+// up and a down file
+func New(db *sql.DB, driver string, fsys fs.FS) (*Migrator, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("migrate: unsupported driver %q", driver)
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %s: %w", entry.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[uint(version)]
+		if m == nil {
+			m = &Migration{Version: uint(version), Name: matches[2]}
+			byVersion[uint(version)] = m
+		}
+		if matches[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrator := &Migrator{db: db, dialect: d}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrate: version %d (%s) needs a non-empty up and down file", m.Version, m.Name)
+		}
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+	return migrator, nil
+}
+
+// Latest() is the version that the binary expects the database to be at
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Version() returns the version of the database, zero when nothing has been
+// applied
+func (m *Migrator) Version(ctx context.Context) (uint, bool, error) {
+	var exists bool
+	err := m.db.QueryRowContext(ctx, m.dialect.tableExists).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+	return version(ctx, m.db)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func version(ctx context.Context, q querier) (uint, bool, error) {
+	var v int64
+	var dirty bool
+	err := q.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&v, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return uint(v), dirty, err
+}
+
+// Up() applies every migration that hasn't been applied yet
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down() rolls back the most recent migration
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, func(current uint) (uint, error) {
+		target := uint(0)
+		for _, migration := range m.migrations {
+			if migration.Version < current {
+				target = migration.Version
+			}
+		}
+		return target, nil
+	})
+}
+
+// To() moves the database up or down to the given version. Zero rolls back
+// every migration
+func (m *Migrator) To(ctx context.Context, target uint) error {
+	if target != 0 && m.index(target) < 0 {
+		return fmt.Errorf("%w %d", ErrUnknownVersion, target)
+	}
+	return m.migrate(ctx, func(uint) (uint, error) { return target, nil })
+}
+
+func (m *Migrator) index(version uint) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// migrate() holds the advisory lock, if the database has one, on a single
+// connection while it works out the target from the current version and
+// steps towards it. Each step runs in its own transaction together with the
+// version update
+func (m *Migrator) migrate(ctx context.Context, target func(current uint) (uint, error)) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.lock != "" {
+		_, err = conn.ExecContext(ctx, m.dialect.lock, lockID)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), m.dialect.unlock, lockID)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	current, dirty, err := version(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migrate: version %d: %w", current, ErrDirty)
+	}
+	if current != 0 && m.index(current) < 0 {
+		return fmt.Errorf("migrate: the database is at version %d, which this binary doesn't know about: %w", current, ErrUnknownVersion)
+	}
+	to, err := target(current)
+	if err != nil {
+		return err
+	}
+
+	for current != to {
+		var sqlText string
+		var next uint
+		if current < to {
+			migration := m.migrations[m.index(current)+1]
+			sqlText, next = migration.Up, migration.Version
+		} else {
+			i := m.index(current)
+			sqlText = m.migrations[i].Down
+			if i > 0 {
+				next = m.migrations[i-1].Version
+			}
+		}
+		err = step(ctx, conn, sqlText, next)
+		if err != nil {
+			return fmt.Errorf("migrate: from %d to %d: %w", current, next, err)
+		}
+		current = next
+	}
+	return nil
+}
+
+func step(ctx context.Context, conn *sql.Conn, sqlText string, next uint) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sqlText)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	if next != 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, int64(next))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,190 @@
+// Filename: internals/migrate/migrate_test.go
+
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"quotesapi.desireamagwula.net/internals/data"
+	"quotesapi.desireamagwula.net/internals/migrate"
+	"quotesapi.desireamagwula.net/migrations"
+)
+
+// openSQLite returns a fresh in-memory database on a single connection
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	_, source := data.ParseDSN("sqlite::memory:")
+	db, err := sql.Open(data.DriverSQLite, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// tables() lists the tables of db other than schema_migrations
+func tables(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence') ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func expectVersion(t *testing.T, m *migrate.Migrator, want uint) {
+	t.Helper()
+	version, dirty, err := m.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != want || dirty {
+		t.Fatalf("got version %d (dirty %t); want %d", version, dirty, want)
+	}
+}
+
+func TestSQLiteUpDownTo(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	m, err := migrate.New(db, data.DriverSQLite, migrations.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := m.Latest()
+	expectVersion(t, m, 0)
+
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, m, latest)
+	schema := tables(t, db)
+
+	// Up again has nothing to do
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, m, latest)
+
+	err = m.Down(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, m, latest-1)
+
+	// Every down migration has to undo its up migration, so going all the
+	// way down and up again gives the same schema
+	for _, target := range []uint{3, 0} {
+		err = m.To(ctx, target)
+		if err != nil {
+			t.Fatalf("to %d: %v", target, err)
+		}
+		expectVersion(t, m, target)
+	}
+	if left := tables(t, db); len(left) > 0 {
+		t.Errorf("got tables %v after rolling back every migration", left)
+	}
+	err = m.To(ctx, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, m, latest)
+	if got := tables(t, db); strings.Join(got, " ") != strings.Join(schema, " ") {
+		t.Errorf("got tables %v; want %v", got, schema)
+	}
+
+	err = m.To(ctx, latest+1)
+	if err == nil {
+		t.Error("migrating to an unknown version succeeded")
+	}
+}
+
+func TestNewNeedsUpAndDown(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000001_first.up.sql":   {Data: []byte("CREATE TABLE a (id integer);")},
+		"000001_first.down.sql": {Data: []byte("DROP TABLE a;")},
+		"000002_second.up.sql":  {Data: []byte("CREATE TABLE b (id integer);")},
+	}
+	_, err := migrate.New(openSQLite(t), data.DriverSQLite, fsys)
+	if err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("got %v; want an error about version 2", err)
+	}
+
+	_, err = migrate.New(openSQLite(t), "mysql", fsys)
+	if err == nil {
+		t.Error("an unknown driver was accepted")
+	}
+}
+
+// Migration 000014 can't tell which of the accounts that aren't activated
+// never were, so the cleanup of unactivated users has to leave every
+// account from before it alone
+func TestSQLiteActivatedAtBackfill(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	m, err := migrate.New(db, data.DriverSQLite, migrations.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.To(ctx, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, user := range []struct {
+		activated bool
+		version   int
+	}{{true, 2}, {false, 1}, {false, 2}, {false, 3}} {
+		_, err = db.Exec(`INSERT INTO users (name, email, password_hash, activated, version) VALUES ('Old User', $1, x'00', $2, $3)`,
+			"old"+strconv.Itoa(i)+"@example.com", user.activated, user.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := data.NewSQLiteModels(db, data.Options{})
+	user := &data.User{Name: "New User", Email: "new@example.com"}
+	err = user.Password.Set("pa55word1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := models.Users.DeleteUnactivated(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("removed %d users; want only the new one", n)
+	}
+	_, err = models.Users.GetByEmail(ctx, "new@example.com")
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("got %v looking up the new user; want ErrRecordNotFound", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Filename: internals/webhook/webhook.go
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The headers that are sent along with every delivery
+const (
+	HeaderEvent     = "X-Quotes-Event"
+	HeaderDelivery  = "X-Quotes-Delivery"
+	HeaderTimestamp = "X-Quotes-Timestamp"
+	HeaderSignature = "X-Quotes-Signature"
+)
+
+// Sender posts signed event payloads to subscriber URLs
+type Sender struct {
+	client    *http.Client
+	userAgent string
+}
+
+// The New() function creates a new Sender. Passing a nil client uses a
+// client with the given timeout
+func New(client *http.Client, timeout time.Duration, userAgent string) Sender {
+	if client == nil {
+		client = &http.Client{Timeout: timeout}
+	}
+	return Sender{
+		client:    client,
+		userAgent: userAgent,
+	}
+}
+
+// Sign() returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>". Including
+// the timestamp stops a captured payload from being replayed later on
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify() checks a signature header the way a receiver should
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	expected := Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Send() delivers the body to the url and returns the status code of the
+// response. Anything outside of the 2xx range is reported as an error
+func (s Sender) Send(ctx context.Context, url, secret, eventType string, deliveryID int64, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", s.userAgent)
+	req.Header.Set(HeaderEvent, eventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook receiver responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Backoff() returns how long to wait before the next attempt. The delay
+// doubles with every attempt, up to max, with up to 10% jitter added so
+// that failed deliveries don't all retry at the same moment
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/10 + 1))
+	return delay + jitter
+}
@@ -0,0 +1,83 @@
+// Filename: internals/webhook/webhook_test.go
+
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := Sign("whsec_test", 1700000000, body)
+	if !Verify("whsec_test", 1700000000, body, signature) {
+		t.Error("Verify() rejected its own signature")
+	}
+	if Verify("whsec_other", 1700000000, body, signature) {
+		t.Error("Verify() accepted the signature of another secret")
+	}
+	if Verify("whsec_test", 1700000001, body, signature) {
+		t.Error("Verify() accepted the signature of another timestamp")
+	}
+}
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	status := http.StatusNoContent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	sender := New(nil, time.Second, "test-agent")
+	body := []byte(`{"type":"quote.created"}`)
+	code, err := sender.Send(context.Background(), receiver.URL, "whsec_test", "quote.created", 42, body)
+	if err != nil || code != http.StatusNoContent {
+		t.Fatalf("Send() = %d, %v, want %d, nil", code, err, http.StatusNoContent)
+	}
+	if got.Header.Get(HeaderEvent) != "quote.created" || got.Header.Get(HeaderDelivery) != "42" || got.UserAgent() != "test-agent" {
+		t.Errorf("Send() sent headers %v", got.Header)
+	}
+	timestamp, err := strconv.ParseInt(got.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		t.Fatalf("%s header: %v", HeaderTimestamp, err)
+	}
+	if !Verify("whsec_test", timestamp, gotBody, got.Header.Get(HeaderSignature)) {
+		t.Error("the receiver can't verify the signature")
+	}
+
+	status = http.StatusBadGateway
+	code, err = sender.Send(context.Background(), receiver.URL, "whsec_test", "quote.created", 42, body)
+	if err == nil || code != http.StatusBadGateway {
+		t.Errorf("Send() to a failing receiver = %d, %v, want %d and an error", code, err, http.StatusBadGateway)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 10*time.Second, time.Minute
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{20, time.Minute},
+	}
+	for _, tt := range tests {
+		got := Backoff(tt.attempt, base, max)
+		if got < tt.want || got > tt.want+tt.want/10 {
+			t.Errorf("Backoff(%d) = %s, want %s plus up to 10%%", tt.attempt, got, tt.want)
+		}
+	}
+}
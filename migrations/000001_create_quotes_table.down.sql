@@ -1 +1,3 @@
-DROP TABLE IF EXISTS quotes;
\ No newline at end of file
+-- Filename: migrations/000001_create_quotes_table.down.sql
+
+DROP TABLE IF EXISTS quotes;
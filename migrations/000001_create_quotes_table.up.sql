@@ -1,5 +1,9 @@
 -- Filename: migrations/000001_create_quotes_table.up.sql
 
+-- The users table in 000004 needs citext. It is created here, ahead of
+-- everything else, so that a new database can be migrated from scratch
+CREATE EXTENSION IF NOT EXISTS citext;
+
 CREATE TABLE IF NOT EXISTS quotes (
     id bigserial PRIMARY KEY,
     created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
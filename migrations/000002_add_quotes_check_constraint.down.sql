@@ -1 +1,3 @@
-ALTER TABLE quotes DROP CONSTRAINT IF EXISTS category_length_check;
\ No newline at end of file
+-- Filename: migrations/000002_add_quotes_check_constraint.down.sql
+
+ALTER TABLE quotes DROP CONSTRAINT IF EXISTS category_length_check;
@@ -1,3 +1,5 @@
-DROP INDEX If EXISTS quotes_author_idx;
-DROP INDEX If EXISTS quotes_quotestring_idx;
-DROP INDEX If EXISTS quotes_category_idx;
\ No newline at end of file
+-- Filename: migrations/000003_add_quotes_indexes.down.sql
+
+DROP INDEX IF EXISTS quotes_author_idx;
+DROP INDEX IF EXISTS quotes_quotestring_idx;
+DROP INDEX IF EXISTS quotes_category_idx;
@@ -1,3 +1,3 @@
--- Filename: migrations/000001_create_schools_table.down.sql
+-- Filename: migrations/000004_create_users_table.down.sql
 
 DROP TABLE IF EXISTS users;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- Filename: migrations/000007_create_webhooks_tables.down.sql
+
+DELETE FROM permissions WHERE code = 'webhooks:manage';
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS outbox_events;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,5 @@
+-- Filename: migrations/000008_create_quote_changes.down.sql
+
+DROP TRIGGER IF EXISTS quotes_notify_change ON quotes;
+DROP FUNCTION IF EXISTS quotes_notify_change();
+DROP TABLE IF EXISTS quote_changes;
@@ -0,0 +1,62 @@
+-- Filename: migrations/000008_create_quote_changes.up.sql
+
+-- every change to a quote is recorded here so that streaming clients can
+-- resume from the last event id that they saw
+CREATE TABLE IF NOT EXISTS quote_changes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    quote_id bigint NOT NULL,
+    event_type text NOT NULL,
+    version integer NOT NULL,
+    payload jsonb NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION quotes_notify_change() RETURNS trigger AS $$
+DECLARE
+    changed quotes%ROWTYPE;
+    event text;
+    change_id bigint;
+    change_at timestamp with time zone;
+    payload jsonb;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+        event := 'quote.deleted';
+    ELSIF TG_OP = 'UPDATE' THEN
+        changed := NEW;
+        event := 'quote.updated';
+    ELSE
+        changed := NEW;
+        event := 'quote.created';
+    END IF;
+
+    payload := jsonb_build_object(
+        'id', changed.id,
+        'author', changed.author,
+        'quote_string', changed.quote_string,
+        'category', changed.category,
+        'version', changed.version
+    );
+
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (changed.id, event, changed.version, payload)
+    RETURNING id, created_at INTO change_id, change_at;
+
+    -- the notification is only delivered once the transaction commits
+    PERFORM pg_notify('quote_changes', jsonb_build_object(
+        'id', change_id,
+        'created_at', change_at,
+        'quote_id', changed.id,
+        'event_type', event,
+        'version', changed.version,
+        'quote', payload
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS quotes_notify_change ON quotes;
+CREATE TRIGGER quotes_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON quotes
+FOR EACH ROW EXECUTE FUNCTION quotes_notify_change();
@@ -0,0 +1,4 @@
+-- Filename: migrations/000009_add_quote_changes_xid.down.sql
+
+DROP INDEX IF EXISTS quote_changes_xid_idx;
+ALTER TABLE quote_changes DROP COLUMN IF EXISTS xid;
@@ -0,0 +1,25 @@
+-- Filename: migrations/000009_add_quote_changes_xid.up.sql
+
+-- ids are handed out before commit, so a change with a lower id can become
+-- visible after one with a higher id. The change feed pages by the id of
+-- the writing transaction instead and only reads transactions that are
+-- known to be finished
+ALTER TABLE quote_changes ADD COLUMN IF NOT EXISTS xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+CREATE INDEX IF NOT EXISTS quote_changes_xid_idx ON quote_changes (xid, id);
+
+-- backfill the quotes that existed before changes were being recorded so
+-- that a full sync can be done from the change log alone
+INSERT INTO quote_changes (quote_id, event_type, version, payload)
+SELECT id, 'quote.created', version, jsonb_build_object(
+    'id', id,
+    'author', author,
+    'quote_string', quote_string,
+    'category', category,
+    'version', version
+)
+FROM quotes
+WHERE NOT EXISTS (
+    SELECT 1 FROM quote_changes WHERE quote_changes.quote_id = quotes.id
+)
+ORDER BY id;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000010_add_permission_notify.down.sql
+
+DROP TRIGGER IF EXISTS users_permissions_notify_change ON users_permissions;
+DROP FUNCTION IF EXISTS users_permissions_notify_change();
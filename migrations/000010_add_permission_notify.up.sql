@@ -0,0 +1,22 @@
+-- Filename: migrations/000010_add_permission_notify.up.sql
+
+-- the API caches permissions for a short while. Every change to a user's
+-- permissions is announced so that the cached entry can be dropped at once
+CREATE OR REPLACE FUNCTION users_permissions_notify_change() RETURNS trigger AS $$
+BEGIN
+    -- notifications with the same payload in one transaction are folded
+    -- into one, and are only delivered once it commits
+    IF TG_OP IN ('DELETE', 'UPDATE') THEN
+        PERFORM pg_notify('permission_changes', OLD.user_id::text);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('permission_changes', NEW.user_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_permissions_notify_change ON users_permissions;
+CREATE TRIGGER users_permissions_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION users_permissions_notify_change();
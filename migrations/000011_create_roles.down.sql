@@ -0,0 +1,10 @@
+-- Filename: migrations/000011_create_roles.down.sql
+
+DROP TRIGGER IF EXISTS roles_permissions_notify_change ON roles_permissions;
+DROP FUNCTION IF EXISTS roles_permissions_notify_change();
+DROP TRIGGER IF EXISTS users_roles_notify_change ON users_roles;
+DROP FUNCTION IF EXISTS users_roles_notify_change();
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+DELETE FROM permissions WHERE code IN ('*', 'quotes:*', 'webhooks:*');
@@ -0,0 +1,76 @@
+-- Filename: migrations/000011_create_roles.up.sql
+
+-- wildcard codes grant every permission that starts with what comes
+-- before the *, and * on its own grants everything
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('*'), ('quotes:*'), ('webhooks:*')) AS wildcards (code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = wildcards.code);
+
+-- a role bundles permissions, and users get every permission of the roles
+-- that they are in on top of the ones granted to them directly
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO roles (name)
+VALUES
+('viewer'), ('contributor'), ('moderator'), ('admin')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM (VALUES
+    ('viewer', 'quotes:read'),
+    ('contributor', 'quotes:read'),
+    ('contributor', 'quotes:write'),
+    ('moderator', 'quotes:*'),
+    ('admin', '*')
+) AS grants (role, code)
+INNER JOIN roles ON roles.name = grants.role
+INNER JOIN permissions ON permissions.code = grants.code
+ON CONFLICT DO NOTHING;
+
+-- changing the roles of a user is announced like a change to their
+-- permissions. Changing what a role grants affects everyone in it, which
+-- is announced with an empty payload
+CREATE OR REPLACE FUNCTION users_roles_notify_change() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('DELETE', 'UPDATE') THEN
+        PERFORM pg_notify('permission_changes', OLD.user_id::text);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('permission_changes', NEW.user_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_roles_notify_change ON users_roles;
+CREATE TRIGGER users_roles_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION users_roles_notify_change();
+
+CREATE OR REPLACE FUNCTION roles_permissions_notify_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('permission_changes', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS roles_permissions_notify_change ON roles_permissions;
+CREATE TRIGGER roles_permissions_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON roles_permissions
+FOR EACH STATEMENT EXECUTE FUNCTION roles_permissions_notify_change();
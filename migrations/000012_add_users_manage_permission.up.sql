@@ -0,0 +1,6 @@
+-- Filename: migrations/000012_add_users_manage_permission.up.sql
+
+-- guards the admin API for users, the admin role gets it through *
+INSERT INTO permissions (code)
+SELECT 'users:manage'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:manage');
@@ -0,0 +1,4 @@
+-- Filename: migrations/000013_add_tokens_email.down.sql
+
+DELETE FROM tokens WHERE scope = 'email_change';
+ALTER TABLE tokens DROP COLUMN IF EXISTS email;
@@ -0,0 +1,5 @@
+-- Filename: migrations/000017_create_token_denylist.down.sql
+
+DROP TRIGGER IF EXISTS tokens_deny_deleted ON tokens;
+DROP FUNCTION IF EXISTS tokens_deny_deleted();
+DROP TABLE IF EXISTS token_denylist;
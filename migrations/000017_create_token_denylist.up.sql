@@ -0,0 +1,25 @@
+-- Filename: migrations/000017_create_token_denylist.up.sql
+
+-- Signed authentication tokens are checked without reading the tokens
+-- table. When one is removed before it expires its hash is put on a
+-- denylist, which the API keeps in memory and reloads when the trigger
+-- announces an addition
+CREATE TABLE IF NOT EXISTS token_denylist (
+    hash bytea PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION tokens_deny_deleted() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO token_denylist (hash, expiry) VALUES (OLD.hash, OLD.expiry)
+    ON CONFLICT (hash) DO NOTHING;
+    PERFORM pg_notify('token_denylist', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tokens_deny_deleted ON tokens;
+CREATE TRIGGER tokens_deny_deleted
+AFTER DELETE ON tokens
+FOR EACH ROW WHEN (OLD.scope = 'authentication' AND OLD.expiry > NOW())
+EXECUTE FUNCTION tokens_deny_deleted();
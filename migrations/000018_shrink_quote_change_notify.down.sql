@@ -0,0 +1,47 @@
+-- Filename: migrations/000018_shrink_quote_change_notify.down.sql
+
+-- puts back the function from 000008, which sends the whole change
+CREATE OR REPLACE FUNCTION quotes_notify_change() RETURNS trigger AS $$
+DECLARE
+    changed quotes%ROWTYPE;
+    event text;
+    change_id bigint;
+    change_at timestamp with time zone;
+    payload jsonb;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+        event := 'quote.deleted';
+    ELSIF TG_OP = 'UPDATE' THEN
+        changed := NEW;
+        event := 'quote.updated';
+    ELSE
+        changed := NEW;
+        event := 'quote.created';
+    END IF;
+
+    payload := jsonb_build_object(
+        'id', changed.id,
+        'author', changed.author,
+        'quote_string', changed.quote_string,
+        'category', changed.category,
+        'version', changed.version
+    );
+
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (changed.id, event, changed.version, payload)
+    RETURNING id, created_at INTO change_id, change_at;
+
+    -- the notification is only delivered once the transaction commits
+    PERFORM pg_notify('quote_changes', jsonb_build_object(
+        'id', change_id,
+        'created_at', change_at,
+        'quote_id', changed.id,
+        'event_type', event,
+        'version', changed.version,
+        'quote', payload
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
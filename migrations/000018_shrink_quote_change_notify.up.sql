@@ -0,0 +1,41 @@
+-- Filename: migrations/000018_shrink_quote_change_notify.up.sql
+
+-- NOTIFY payloads are capped at 8000 bytes, which a long quote could go
+-- over. The notification now only carries the id of the change and the
+-- listeners read the row from quote_changes
+CREATE OR REPLACE FUNCTION quotes_notify_change() RETURNS trigger AS $$
+DECLARE
+    changed quotes%ROWTYPE;
+    event text;
+    change_id bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed := OLD;
+        event := 'quote.deleted';
+    ELSIF TG_OP = 'UPDATE' THEN
+        changed := NEW;
+        event := 'quote.updated';
+    ELSE
+        changed := NEW;
+        event := 'quote.created';
+    END IF;
+
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (changed.id, event, changed.version, jsonb_build_object(
+        'id', changed.id,
+        'author', changed.author,
+        'quote_string', changed.quote_string,
+        'category', changed.category,
+        'version', changed.version
+    ))
+    RETURNING id INTO change_id;
+
+    -- the notification is only delivered once the transaction commits
+    PERFORM pg_notify('quote_changes', jsonb_build_object(
+        'id', change_id,
+        'quote_id', changed.id
+    )::text);
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,31 @@
+// Filename: migrations/migrations.go
+
+// Package migrations embeds the SQL migrations so that the api binary can
+// apply them itself
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// FS holds the Postgres migrations
+//
+//go:embed *.sql
+var FS embed.FS
+
+//go:embed sqlite/*.sql
+var sqliteFS embed.FS
+
+// SQLite holds the migrations for the SQLite backend. They are numbered the
+// same as the Postgres ones, so both databases report the same version
+var SQLite, _ = fs.Sub(sqliteFS, "sqlite")
+
+// For() returns the migrations for a database opened with the given
+// driver name
+func For(driver string) fs.FS {
+	if driver == "sqlite" {
+		return SQLite
+	}
+	return FS
+}
@@ -0,0 +1,79 @@
+// Filename: migrations/migrations_test.go
+
+package migrations_test
+
+import (
+	"io/fs"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"quotesapi.desireamagwula.net/migrations"
+)
+
+var filenameRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// versions() returns the name of every version in fsys, and fails the test
+// for files that aren't named like a migration or have no partner
+func versions(t *testing.T, fsys fs.FS) map[int]string {
+	t.Helper()
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[int]string)
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			t.Errorf("%s isn't named like a migration", entry.Name())
+			continue
+		}
+		version, _ := strconv.Atoi(matches[1])
+		if name, ok := names[version]; ok && name != matches[2] {
+			t.Errorf("version %d is named both %q and %q", version, name, matches[2])
+		}
+		names[version] = matches[2]
+		files[entry.Name()] = true
+	}
+	for version, name := range names {
+		for _, direction := range []string{"up", "down"} {
+			file := migrationFile(version, name, direction)
+			if !files[file] {
+				t.Errorf("%s is missing", file)
+			}
+		}
+	}
+	for version := 1; version <= len(names); version++ {
+		if _, ok := names[version]; !ok {
+			t.Errorf("version %d is missing", version)
+		}
+	}
+	return names
+}
+
+func migrationFile(version int, name, direction string) string {
+	return strconv.Itoa(version + 1000000)[1:] + "_" + name + "." + direction + ".sql"
+}
+
+func TestMigrations(t *testing.T) {
+	postgres := versions(t, migrations.FS)
+	sqlite := versions(t, migrations.SQLite)
+	if len(postgres) == 0 {
+		t.Fatal("there are no migrations")
+	}
+	// Both databases have to report the same version for the same schema
+	for version, name := range postgres {
+		if sqlite[version] != name {
+			t.Errorf("version %d is %q for Postgres but %q for SQLite", version, name, sqlite[version])
+		}
+	}
+	for version, name := range sqlite {
+		if _, ok := postgres[version]; !ok {
+			t.Errorf("version %d (%s) is only in the SQLite migrations", version, name)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+-- Filename: migrations/sqlite/000001_create_quotes_table.down.sql
+
+DROP TABLE IF EXISTS quotes;
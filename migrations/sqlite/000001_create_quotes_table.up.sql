@@ -0,0 +1,12 @@
+-- Filename: migrations/sqlite/000001_create_quotes_table.up.sql
+
+-- timestamps are kept as UTC text in a fixed format so that they sort and
+-- compare as strings, and category holds a JSON array in place of text[]
+CREATE TABLE IF NOT EXISTS quotes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    author text NOT NULL,
+    quote_string text NOT NULL,
+    category text NOT NULL CHECK (json_valid(category)),
+    version integer NOT NULL DEFAULT 1
+);
@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000002_add_quotes_check_constraint.down.sql
+
+DROP TRIGGER IF EXISTS category_length_check_insert;
+DROP TRIGGER IF EXISTS category_length_check_update;
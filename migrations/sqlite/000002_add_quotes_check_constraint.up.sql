@@ -0,0 +1,17 @@
+-- Filename: migrations/sqlite/000002_add_quotes_check_constraint.up.sql
+
+-- SQLite can't add a constraint to an existing table, so the check is done
+-- by triggers instead
+CREATE TRIGGER IF NOT EXISTS category_length_check_insert
+BEFORE INSERT ON quotes
+WHEN json_array_length(NEW.category) NOT BETWEEN 1 AND 10
+BEGIN
+    SELECT RAISE(ABORT, 'category_length_check');
+END;
+
+CREATE TRIGGER IF NOT EXISTS category_length_check_update
+BEFORE UPDATE OF category ON quotes
+WHEN json_array_length(NEW.category) NOT BETWEEN 1 AND 10
+BEGIN
+    SELECT RAISE(ABORT, 'category_length_check');
+END;
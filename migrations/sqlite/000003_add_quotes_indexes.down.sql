@@ -0,0 +1,6 @@
+-- Filename: migrations/sqlite/000003_add_quotes_indexes.down.sql
+
+DROP TRIGGER IF EXISTS quotes_fts_insert;
+DROP TRIGGER IF EXISTS quotes_fts_update;
+DROP TRIGGER IF EXISTS quotes_fts_delete;
+DROP TABLE IF EXISTS quotes_fts;
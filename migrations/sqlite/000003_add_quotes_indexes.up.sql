@@ -0,0 +1,38 @@
+-- Filename: migrations/sqlite/000003_add_quotes_indexes.up.sql
+
+-- the full text index for the author and quote_string searches. It reads
+-- its content from the quotes table and the triggers keep it up to date.
+-- Diacritics are kept, the same as the 'simple' configuration in Postgres
+CREATE VIRTUAL TABLE IF NOT EXISTS quotes_fts USING fts5(
+    author,
+    quote_string,
+    content = 'quotes',
+    content_rowid = 'id',
+    tokenize = 'unicode61 remove_diacritics 0'
+);
+
+CREATE TRIGGER IF NOT EXISTS quotes_fts_insert
+AFTER INSERT ON quotes
+BEGIN
+    INSERT INTO quotes_fts (rowid, author, quote_string)
+    VALUES (NEW.id, NEW.author, NEW.quote_string);
+END;
+
+CREATE TRIGGER IF NOT EXISTS quotes_fts_update
+AFTER UPDATE OF author, quote_string ON quotes
+BEGIN
+    INSERT INTO quotes_fts (quotes_fts, rowid, author, quote_string)
+    VALUES ('delete', OLD.id, OLD.author, OLD.quote_string);
+    INSERT INTO quotes_fts (rowid, author, quote_string)
+    VALUES (NEW.id, NEW.author, NEW.quote_string);
+END;
+
+CREATE TRIGGER IF NOT EXISTS quotes_fts_delete
+AFTER DELETE ON quotes
+BEGIN
+    INSERT INTO quotes_fts (quotes_fts, rowid, author, quote_string)
+    VALUES ('delete', OLD.id, OLD.author, OLD.quote_string);
+END;
+
+-- index the quotes that are already there
+INSERT INTO quotes_fts (quotes_fts) VALUES ('rebuild');
@@ -0,0 +1,3 @@
+-- Filename: migrations/sqlite/000004_create_users_table.down.sql
+
+DROP TABLE IF EXISTS users;
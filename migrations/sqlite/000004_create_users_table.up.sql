@@ -0,0 +1,12 @@
+-- Filename: migrations/sqlite/000004_create_users_table.up.sql
+
+-- NOCASE stands in for citext. It only folds ASCII letters
+CREATE TABLE IF NOT EXISTS users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    name text NOT NULL,
+    email text NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash blob NOT NULL,
+    activated boolean NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
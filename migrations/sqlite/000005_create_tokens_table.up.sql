@@ -0,0 +1,8 @@
+-- Filename: migrations/sqlite/000005_create_tokens_table.up.sql
+
+CREATE TABLE IF NOT EXISTS tokens (
+    hash blob PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL
+);
@@ -0,0 +1,16 @@
+-- Filename: migrations/sqlite/000006_add_permissions.up.sql
+
+CREATE TABLE IF NOT EXISTS permissions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    code text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+    user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO permissions (code)
+VALUES
+('quotes:read'), ('quotes:write');
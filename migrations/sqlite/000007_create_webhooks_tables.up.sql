@@ -0,0 +1,43 @@
+-- Filename: migrations/sqlite/000007_create_webhooks_tables.up.sql
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text NOT NULL CHECK (json_valid(events)),
+    active boolean NOT NULL DEFAULT true,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- the transactional outbox, written in the same transaction as the quote
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    event_type text NOT NULL,
+    payload text NOT NULL CHECK (json_valid(payload)),
+    dispatched_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (id) WHERE dispatched_at IS NULL;
+
+-- one row per (subscription, event), this is also the delivery log
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    webhook_id integer NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id integer NOT NULL REFERENCES outbox_events ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    last_attempt_at timestamp,
+    response_status integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_idx ON webhook_deliveries (webhook_id, id);
+
+INSERT INTO permissions (code)
+SELECT 'webhooks:manage'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'webhooks:manage');
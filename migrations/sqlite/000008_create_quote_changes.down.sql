@@ -0,0 +1,6 @@
+-- Filename: migrations/sqlite/000008_create_quote_changes.down.sql
+
+DROP TRIGGER IF EXISTS quotes_change_insert;
+DROP TRIGGER IF EXISTS quotes_change_update;
+DROP TRIGGER IF EXISTS quotes_change_delete;
+DROP TABLE IF EXISTS quote_changes;
@@ -0,0 +1,52 @@
+-- Filename: migrations/sqlite/000008_create_quote_changes.up.sql
+
+-- every change to a quote is recorded here so that streaming clients can
+-- resume from the last event id that they saw. There is no NOTIFY, the
+-- API polls this table instead
+CREATE TABLE IF NOT EXISTS quote_changes (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    quote_id integer NOT NULL,
+    event_type text NOT NULL,
+    version integer NOT NULL,
+    payload text NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS quotes_change_insert
+AFTER INSERT ON quotes
+BEGIN
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (NEW.id, 'quote.created', NEW.version, json_object(
+        'id', NEW.id,
+        'author', NEW.author,
+        'quote_string', NEW.quote_string,
+        'category', json(NEW.category),
+        'version', NEW.version
+    ));
+END;
+
+CREATE TRIGGER IF NOT EXISTS quotes_change_update
+AFTER UPDATE ON quotes
+BEGIN
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (NEW.id, 'quote.updated', NEW.version, json_object(
+        'id', NEW.id,
+        'author', NEW.author,
+        'quote_string', NEW.quote_string,
+        'category', json(NEW.category),
+        'version', NEW.version
+    ));
+END;
+
+CREATE TRIGGER IF NOT EXISTS quotes_change_delete
+AFTER DELETE ON quotes
+BEGIN
+    INSERT INTO quote_changes (quote_id, event_type, version, payload)
+    VALUES (OLD.id, 'quote.deleted', OLD.version, json_object(
+        'id', OLD.id,
+        'author', OLD.author,
+        'quote_string', OLD.quote_string,
+        'category', json(OLD.category),
+        'version', OLD.version
+    ));
+END;
@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000009_add_quote_changes_xid.down.sql
+
+-- the backfilled changes are kept, the same as in Postgres
+SELECT 1;
@@ -0,0 +1,18 @@
+-- Filename: migrations/sqlite/000009_add_quote_changes_xid.up.sql
+
+-- SQLite has a single writer, so change ids are handed out in commit order
+-- and the change feed can page by id alone. There is no xid column, only
+-- the backfill of the quotes that existed before changes were recorded
+INSERT INTO quote_changes (quote_id, event_type, version, payload)
+SELECT id, 'quote.created', version, json_object(
+    'id', id,
+    'author', author,
+    'quote_string', quote_string,
+    'category', json(category),
+    'version', version
+)
+FROM quotes
+WHERE NOT EXISTS (
+    SELECT 1 FROM quote_changes WHERE quote_changes.quote_id = quotes.id
+)
+ORDER BY id;
@@ -0,0 +1,3 @@
+-- Filename: migrations/sqlite/000010_add_permission_notify.down.sql
+
+SELECT 1;
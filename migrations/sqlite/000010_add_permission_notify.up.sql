@@ -0,0 +1,5 @@
+-- Filename: migrations/sqlite/000010_add_permission_notify.up.sql
+
+-- SQLite has no notifications, so a permission change made by another
+-- process is only seen once the API's cached entry expires
+SELECT 1;
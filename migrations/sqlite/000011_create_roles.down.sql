@@ -0,0 +1,6 @@
+-- Filename: migrations/sqlite/000011_create_roles.down.sql
+
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+DELETE FROM permissions WHERE code IN ('*', 'quotes:*', 'webhooks:*');
@@ -0,0 +1,38 @@
+-- Filename: migrations/sqlite/000011_create_roles.up.sql
+
+INSERT INTO permissions (code)
+SELECT column1 FROM (VALUES ('*'), ('quotes:*'), ('webhooks:*')) AS wildcards
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = wildcards.column1);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES permissions (id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT OR IGNORE INTO roles (name)
+VALUES
+('viewer'), ('contributor'), ('moderator'), ('admin');
+
+INSERT OR IGNORE INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM (VALUES
+    ('viewer', 'quotes:read'),
+    ('contributor', 'quotes:read'),
+    ('contributor', 'quotes:write'),
+    ('moderator', 'quotes:*'),
+    ('admin', '*')
+) AS grants
+INNER JOIN roles ON roles.name = grants.column1
+INNER JOIN permissions ON permissions.code = grants.column2;
@@ -0,0 +1,3 @@
+-- Filename: migrations/sqlite/000012_add_users_manage_permission.down.sql
+
+DELETE FROM permissions WHERE code = 'users:manage';
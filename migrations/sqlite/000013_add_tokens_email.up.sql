@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000013_add_tokens_email.up.sql
+
+-- email change tokens carry the address that is waiting to be confirmed
+ALTER TABLE tokens ADD COLUMN email text NOT NULL DEFAULT '' COLLATE NOCASE;
@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000014_add_users_activated_at.down.sql
+
+DROP INDEX IF EXISTS users_unactivated_idx;
+ALTER TABLE users DROP COLUMN activated_at;
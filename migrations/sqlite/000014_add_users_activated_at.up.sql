@@ -0,0 +1,17 @@
+-- Filename: migrations/sqlite/000014_add_users_activated_at.up.sql
+
+-- activated_at is set the first time that a user is activated and kept when
+-- an admin deactivates them, so that accounts that were never activated
+-- can be told apart and removed
+ALTER TABLE users ADD COLUMN activated_at timestamp;
+
+-- Whether a user was ever activated wasn't recorded before. Every update
+-- bumps the version, so it doesn't tell, and activation tokens may have
+-- been pruned or re-sent to a deactivated user. So every account that
+-- exists now is kept out of the unactivated user cleanup, and only the
+-- accounts created from here on can be removed by it. For the ones that
+-- aren't activated, created_at only stands in for the missing date
+UPDATE users SET activated_at = created_at
+WHERE activated_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS users_unactivated_idx ON users (created_at) WHERE activated_at IS NULL;
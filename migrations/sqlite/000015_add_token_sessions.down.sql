@@ -0,0 +1,15 @@
+-- Filename: migrations/sqlite/000015_add_token_sessions.down.sql
+
+CREATE TABLE tokens_old (
+    hash blob PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL,
+    email text NOT NULL DEFAULT '' COLLATE NOCASE
+);
+
+INSERT INTO tokens_old (hash, user_id, expiry, scope, email)
+SELECT hash, user_id, expiry, scope, email FROM tokens;
+
+DROP TABLE tokens;
+ALTER TABLE tokens_old RENAME TO tokens;
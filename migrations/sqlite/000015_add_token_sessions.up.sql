@@ -0,0 +1,26 @@
+-- Filename: migrations/sqlite/000015_add_token_sessions.up.sql
+
+-- Authentication tokens are listed to their owners as sessions. The hash
+-- can't be shown, so they get an id to be revoked by, and a record of the
+-- client that last used them. SQLite can't add an AUTOINCREMENT column, so
+-- the table is rebuilt with the id as its key
+CREATE TABLE tokens_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    hash blob NOT NULL UNIQUE,
+    user_id integer NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry timestamp NOT NULL,
+    scope text NOT NULL,
+    email text NOT NULL DEFAULT '' COLLATE NOCASE,
+    created_at timestamp NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    last_used_at timestamp,
+    ip text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT ''
+);
+
+INSERT INTO tokens_new (hash, user_id, expiry, scope, email)
+SELECT hash, user_id, expiry, scope, email FROM tokens;
+
+DROP TABLE tokens;
+ALTER TABLE tokens_new RENAME TO tokens;
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
@@ -0,0 +1,6 @@
+-- Filename: migrations/sqlite/000016_add_token_families.down.sql
+
+DELETE FROM tokens WHERE scope = 'refresh';
+DROP INDEX IF EXISTS tokens_family_idx;
+ALTER TABLE tokens DROP COLUMN used_at;
+ALTER TABLE tokens DROP COLUMN family;
@@ -0,0 +1,9 @@
+-- Filename: migrations/sqlite/000016_add_token_families.up.sql
+
+-- The authentication and refresh tokens of a sign in share a family, which
+-- is revoked as a whole when a refresh token is used twice. Used refresh
+-- tokens are kept until they expire so that a second use can be spotted
+ALTER TABLE tokens ADD COLUMN family text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN used_at timestamp;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family <> '';
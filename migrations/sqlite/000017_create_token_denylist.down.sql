@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000017_create_token_denylist.down.sql
+
+DROP TRIGGER IF EXISTS tokens_deny_deleted;
+DROP TABLE IF EXISTS token_denylist;
@@ -0,0 +1,17 @@
+-- Filename: migrations/sqlite/000017_create_token_denylist.up.sql
+
+-- Signed authentication tokens are checked without reading the tokens
+-- table. When one is removed before it expires its hash is put on a
+-- denylist, which the API keeps in memory. SQLite has no notifications, so
+-- other processes see the additions when they next reload it
+CREATE TABLE IF NOT EXISTS token_denylist (
+    hash blob PRIMARY KEY,
+    expiry timestamp NOT NULL
+);
+
+CREATE TRIGGER IF NOT EXISTS tokens_deny_deleted
+AFTER DELETE ON tokens
+WHEN OLD.scope = 'authentication' AND OLD.expiry > strftime('%Y-%m-%d %H:%M:%f', 'now')
+BEGIN
+    INSERT OR IGNORE INTO token_denylist (hash, expiry) VALUES (OLD.hash, OLD.expiry);
+END;
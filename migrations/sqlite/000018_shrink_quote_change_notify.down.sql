@@ -0,0 +1,3 @@
+-- Filename: migrations/sqlite/000018_shrink_quote_change_notify.down.sql
+
+SELECT 1;
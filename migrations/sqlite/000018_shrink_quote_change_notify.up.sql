@@ -0,0 +1,4 @@
+-- Filename: migrations/sqlite/000018_shrink_quote_change_notify.up.sql
+
+-- SQLite has no notifications, the API polls quote_changes already
+SELECT 1;